@@ -0,0 +1,109 @@
+package chacha20poly1305guard
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrDuplicateLabel is returned by AADBuilder.Bytes when the same label
+// was added more than once.
+var ErrDuplicateLabel = errors.New("duplicate associated data label")
+
+// aadVersion is the first byte of the encoding produced by AADBuilder.
+const aadVersion = 1
+
+// Field types in the AADBuilder encoding. A string and a []byte with the
+// same contents encode differently.
+const (
+	aadString byte = iota + 1
+	aadUint64
+	aadBytes
+)
+
+// AADBuilder builds associated data out of labelled fields with an
+// unambiguous encoding, so that no two different sets of fields produce
+// the same bytes: ("user", "1"+"23") and ("user", "12"+"3") never
+// collide, and neither do a string and a []byte with the same contents.
+//
+// Fields are sorted by label, so the order they are added in does not
+// matter and the same fields give the same bytes at seal and open time.
+// Each field is encoded as
+//
+//	uint32 LE len(label) | label | type | uint32 LE len(value) | value
+//
+// after a version byte. The result can be passed as the data argument of
+// Seal and Open, or of SealEnvelope and OpenEnvelope, which bind the
+// envelope header in front of it.
+//
+// The Add methods return the builder so calls can be chained; a
+// duplicate label is reported by Bytes.
+type AADBuilder struct {
+	fields []aadField
+}
+
+type aadField struct {
+	label string
+	typ   byte
+	value []byte
+}
+
+// NewAADBuilder returns an empty AADBuilder.
+func NewAADBuilder() *AADBuilder {
+	return &AADBuilder{}
+}
+
+// AddString adds a string field.
+func (b *AADBuilder) AddString(label, value string) *AADBuilder {
+	return b.add(label, aadString, []byte(value))
+}
+
+// AddUint64 adds an integer field.
+func (b *AADBuilder) AddUint64(label string, v uint64) *AADBuilder {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return b.add(label, aadUint64, buf[:])
+}
+
+// AddBytes adds a byte field. value is copied.
+func (b *AADBuilder) AddBytes(label string, value []byte) *AADBuilder {
+	return b.add(label, aadBytes, append([]byte(nil), value...))
+}
+
+func (b *AADBuilder) add(label string, typ byte, value []byte) *AADBuilder {
+	b.fields = append(b.fields, aadField{label: label, typ: typ, value: value})
+	return b
+}
+
+// Bytes returns the canonical encoding of the fields added so far, or
+// ErrDuplicateLabel if a label was added twice.
+func (b *AADBuilder) Bytes() ([]byte, error) {
+	fields := append([]aadField(nil), b.fields...)
+	sort.Slice(fields, func(i, j int) bool { return fields[i].label < fields[j].label })
+
+	n := 1
+	for i, f := range fields {
+		if i > 0 && fields[i-1].label == f.label {
+			return nil, fmt.Errorf("%w: %q", ErrDuplicateLabel, f.label)
+		}
+		n += 4 + len(f.label) + 1 + 4 + len(f.value)
+	}
+
+	out := make([]byte, 0, n)
+	out = append(out, aadVersion)
+	for _, f := range fields {
+		out = appendUint32(out, uint32(len(f.label)))
+		out = append(out, f.label...)
+		out = append(out, f.typ)
+		out = appendUint32(out, uint32(len(f.value)))
+		out = append(out, f.value...)
+	}
+	return out, nil
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
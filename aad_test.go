@@ -0,0 +1,119 @@
+package chacha20poly1305guard
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+)
+
+// splits returns every way of cutting s into n parts, empty ones
+// included.
+func splits(s string, n int) [][]string {
+	if n == 1 {
+		return [][]string{{s}}
+	}
+	var out [][]string
+	for i := 0; i <= len(s); i++ {
+		for _, rest := range splits(s[i:], n-1) {
+			out = append(out, append([]string{s[:i]}, rest...))
+		}
+	}
+	return out
+}
+
+func TestAADBuilderNoCollisions(t *testing.T) {
+	// Cut the same bytes into every possible sequence of labels and
+	// values, of every type, and check that no two different sets of
+	// fields encode the same.
+	seen := make(map[string]string)
+	for fields := 1; fields <= 3; fields++ {
+		for _, parts := range splits("abcaab", 2*fields) {
+			for types := 0; types < 1<<fields; types++ {
+				b := NewAADBuilder()
+				desc := make([]string, fields)
+				for i := 0; i < fields; i++ {
+					label, value := parts[2*i], parts[2*i+1]
+					if types&(1<<i) != 0 {
+						b.AddBytes(label, []byte(value))
+						desc[i] = fmt.Sprintf("%q=[]byte(%q)", label, value)
+					} else {
+						b.AddString(label, value)
+						desc[i] = fmt.Sprintf("%q=%q", label, value)
+					}
+				}
+				sort.Strings(desc)
+				key := fmt.Sprint(desc)
+
+				enc, err := b.Bytes()
+				if errors.Is(err, ErrDuplicateLabel) {
+					continue
+				}
+				if err != nil {
+					t.Fatalf("%s: %v", key, err)
+				}
+				if other, ok := seen[string(enc)]; ok && other != key {
+					t.Fatalf("%s and %s encode the same", other, key)
+				}
+				seen[string(enc)] = key
+			}
+		}
+	}
+}
+
+func TestAADBuilder(t *testing.T) {
+	a, err := NewAADBuilder().AddString("user", "alice").AddUint64("version", 3).AddBytes("id", []byte{1, 2}).Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewAADBuilder().AddBytes("id", []byte{1, 2}).AddString("user", "alice").AddUint64("version", 3).Bytes()
+	if err != nil || !bytes.Equal(a, b) {
+		t.Fatalf("order of the fields changes the encoding: %v", err)
+	}
+	if a[0] != aadVersion {
+		t.Fatalf("version byte %d, want %d", a[0], aadVersion)
+	}
+
+	// An integer differs from its bytes and from its decimal string.
+	u, _ := NewAADBuilder().AddUint64("n", 1).Bytes()
+	raw, _ := NewAADBuilder().AddBytes("n", []byte{1, 0, 0, 0, 0, 0, 0, 0}).Bytes()
+	str, _ := NewAADBuilder().AddString("n", "1").Bytes()
+	if bytes.Equal(u, raw) || bytes.Equal(u, str) {
+		t.Fatal("integer field collides with another type")
+	}
+
+	// AddBytes copies its value.
+	v := []byte("value")
+	builder := NewAADBuilder().AddBytes("v", v)
+	before, _ := builder.Bytes()
+	v[0] = 'V'
+	if after, _ := builder.Bytes(); !bytes.Equal(before, after) {
+		t.Fatal("AddBytes did not copy its value")
+	}
+
+	// A different field fails to open.
+	aead := testAEAD(t, ChaCha20)
+	nonce := make([]byte, NonceSize)
+	ct := aead.Seal(nil, nonce, []byte("plaintext"), a)
+	other, _ := NewAADBuilder().AddString("user", "alice").AddUint64("version", 4).AddBytes("id", []byte{1, 2}).Bytes()
+	if _, err := aead.Open(nil, nonce, ct, other); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("other fields: got %v, want ErrAuthFailed", err)
+	}
+	if p, err := aead.Open(nil, nonce, ct, b); err != nil || string(p) != "plaintext" {
+		t.Fatalf("same fields: %q, %v", p, err)
+	}
+}
+
+func TestAADBuilderDuplicateLabel(t *testing.T) {
+	for name, b := range map[string]*AADBuilder{
+		"same type":      NewAADBuilder().AddString("user", "alice").AddString("user", "bob"),
+		"same value":     NewAADBuilder().AddString("user", "alice").AddString("user", "alice"),
+		"different type": NewAADBuilder().AddString("n", "1").AddUint64("n", 1),
+		"empty label":    NewAADBuilder().AddBytes("", nil).AddString("", ""),
+	} {
+		if enc, err := b.Bytes(); !errors.Is(err, ErrDuplicateLabel) || enc != nil {
+			t.Errorf("%s: got %x, %v, want ErrDuplicateLabel", name, enc, err)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package chacha20poly1305guard
+
+import (
+	"runtime"
+	"sync/atomic"
+
+	"github.com/awnumar/memguard"
+)
+
+// LockedUsage describes the locked memory held for one purpose. Bytes
+// are counted in whole pages, as they count against RLIMIT_MEMLOCK.
+type LockedUsage struct {
+	Buffers     int64
+	Bytes       int64
+	PeakBuffers int64
+	PeakBytes   int64
+}
+
+// LockedStats reports the LockedBuffers this package has allocated for
+// its own use and not yet destroyed. Buffers handed to the caller, such
+// as the result of OpenToLockedBuffer, are not included.
+type LockedStats struct {
+	// Keys are key buffers created by the package, such as the copy
+	// made by NewFromArray and the reference kept to detect corruption.
+	Keys LockedUsage
+
+	// Scratch are the buffers of GuardedPools, including the one used
+	// for internal scratch memory, and short-lived decryption buffers.
+	Scratch LockedUsage
+
+	// Streams are the chunk buffers of streaming encryption.
+	Streams LockedUsage
+
+	// Degraded counts the times ordinary memory was used because locked
+	// memory was unavailable. See DegradeWithWarning.
+	Degraded int64
+}
+
+// Stats returns the current locked memory usage of the package. It only
+// reads a few atomic counters and is cheap enough to sample frequently.
+func Stats() LockedStats {
+	return LockedStats{
+		Keys:     keyUsage.load(),
+		Scratch:  scratchUsage.load(),
+		Streams:  streamUsage.load(),
+		Degraded: atomic.LoadInt64(&degraded),
+	}
+}
+
+var keyUsage, scratchUsage, streamUsage usage
+
+// usage holds the counters behind a LockedUsage.
+type usage struct {
+	buffers, bytes, peakBuffers, peakBytes int64
+}
+
+func (u *usage) load() LockedUsage {
+	return LockedUsage{
+		Buffers:     atomic.LoadInt64(&u.buffers),
+		Bytes:       atomic.LoadInt64(&u.bytes),
+		PeakBuffers: atomic.LoadInt64(&u.peakBuffers),
+		PeakBytes:   atomic.LoadInt64(&u.peakBytes),
+	}
+}
+
+// add records the allocation of a buffer of n bytes.
+func (u *usage) add(n int) {
+	raisePeak(&u.peakBuffers, atomic.AddInt64(&u.buffers, 1))
+	raisePeak(&u.peakBytes, atomic.AddInt64(&u.bytes, int64(lockedSize(n))))
+}
+
+// remove records the destruction of a buffer of n bytes.
+func (u *usage) remove(n int) {
+	atomic.AddInt64(&u.buffers, -1)
+	atomic.AddInt64(&u.bytes, -int64(lockedSize(n)))
+}
+
+func raisePeak(peak *int64, v int64) {
+	for {
+		p := atomic.LoadInt64(peak)
+		if v <= p || atomic.CompareAndSwapInt64(peak, p, v) {
+			return
+		}
+	}
+}
+
+// track records b, which may be nil after a failed allocation, against
+// u. It returns its arguments so it can wrap a constructor call. If b is
+// dropped without going through destroy, memguard destroys it once it
+// is unreachable, and a finalizer releases it from u at the same time.
+func (u *usage) track(b *memguard.LockedBuffer, err error) (*memguard.LockedBuffer, error) {
+	if err != nil {
+		return b, err
+	}
+
+	n := b.Size()
+	u.add(n)
+	runtime.SetFinalizer(b, func(*memguard.LockedBuffer) { u.remove(n) })
+
+	return b, nil
+}
+
+// destroy destroys a buffer returned by track and releases it from u.
+// If b was already destroyed elsewhere, for example by
+// memguard.DestroyAll, it is released by its finalizer instead.
+func (u *usage) destroy(b *memguard.LockedBuffer) {
+	if b.IsDestroyed() {
+		return
+	}
+
+	runtime.SetFinalizer(b, nil)
+	n := b.Size()
+	b.Destroy()
+	u.remove(n)
+}
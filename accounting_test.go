@@ -0,0 +1,75 @@
+package chacha20poly1305guard
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+// TestStatsBaseline checks that the counters go back to where they were
+// once the AEADs are closed and the buffers handed out are returned.
+func TestStatsBaseline(t *testing.T) {
+	// Seal and Open keep their scratch buffers in scratchPool, which
+	// is emptied on both sides of the comparison.
+	scratchPool.Purge()
+	before := settledStats()
+
+	var key [32]byte
+	aead, err := NewFromArray(key, XChaCha20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The copy of the key and the reference kept to detect corruption.
+	if got := Stats().Keys; got.Buffers != before.Keys.Buffers+2 || got.PeakBuffers < got.Buffers {
+		t.Fatalf("keys with an AEAD open: %+v, before %+v", got, before.Keys)
+	}
+
+	nonce := make([]byte, XNonceSize)
+	sealed := aead.Seal(nil, nonce, []byte("plaintext"), nil)
+	if err := aead.(AEAD).OpenWith(nonce, sealed, nil, func([]byte) error {
+		if got := Stats().Scratch.Buffers; got <= before.Scratch.Buffers {
+			t.Errorf("scratch buffers while OpenWith runs = %d, want more than %d", got, before.Scratch.Buffers)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewGuardedPool(DefaultPoolRetained)
+	b, err := p.Get(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Put(b)
+	p.Purge()
+	aead.(AEAD).Close()
+	scratchPool.Purge()
+
+	after := settledStats()
+	if after.Keys.Buffers != before.Keys.Buffers || after.Keys.Bytes != before.Keys.Bytes {
+		t.Fatalf("keys: %+v after Close, %+v before", after.Keys, before.Keys)
+	}
+	if after.Scratch.Buffers != before.Scratch.Buffers || after.Scratch.Bytes != before.Scratch.Bytes {
+		t.Fatalf("scratch: %+v after, %+v before", after.Scratch, before.Scratch)
+	}
+	if after.Keys.PeakBuffers < before.Keys.Buffers+2 {
+		t.Fatalf("peak key buffers %d, want at least %d", after.Keys.PeakBuffers, before.Keys.Buffers+2)
+	}
+}
+
+// settledStats returns Stats once the finalizers of buffers dropped by
+// earlier tests have run, so that they do not move the counters while a
+// test compares them.
+func settledStats() LockedStats {
+	prev := Stats()
+	for i := 0; i < 10; i++ {
+		runtime.GC()
+		time.Sleep(time.Millisecond)
+		s := Stats()
+		if s == prev {
+			return s
+		}
+		prev = s
+	}
+	return prev
+}
@@ -0,0 +1,73 @@
+package chacha20poly1305guard
+
+import (
+	"crypto/cipher"
+	"sync"
+
+	"github.com/awnumar/memguard"
+)
+
+// AEADPool hands out AEADs for one key, recycling them instead of
+// building one per request. Building an AEAD allocates the struct and a
+// locked reference copy of the key to detect corruption; the instances
+// of a pool share the reference copy of the pool, so Get only costs a
+// struct when the pool is empty.
+//
+// Note that an AEAD of this package is itself safe for concurrent use,
+// so sharing one across requests is cheaper still; AEADPool suits code
+// that expects an AEAD per request. An AEADPool is safe for concurrent
+// use.
+type AEADPool struct {
+	template *chacha20poly1305
+	pool     sync.Pool
+}
+
+// NewPool returns an AEADPool of variant v keyed with key, which must
+// stay valid until the pool is closed.
+func NewPool(key *memguard.LockedBuffer, v Variant) (*AEADPool, error) {
+	k, err := newAEAD(key, v, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &AEADPool{template: k}
+	p.pool.New = func() interface{} {
+		return p.instance(new(chacha20poly1305))
+	}
+	return p, nil
+}
+
+// instance resets k to a fresh copy of the template.
+func (p *AEADPool) instance(k *chacha20poly1305) *chacha20poly1305 {
+	*k = chacha20poly1305{}
+	k.ek = p.template.ek
+	k.variant = p.template.variant
+	k.nonceSize = p.template.nonceSize
+	k.newStream = p.template.newStream
+	k.tagSize = p.template.tagSize
+	k.keyCheck = p.template.keyCheck
+	k.pool = p
+	return k
+}
+
+// Get returns an AEAD of the pool. Closing it has no effect beyond
+// making it unusable until it is returned with Put.
+func (p *AEADPool) Get() cipher.AEAD {
+	return p.pool.Get().(*chacha20poly1305)
+}
+
+// Put returns an AEAD obtained from Get, which must not be used
+// afterwards. AEADs from elsewhere are ignored.
+func (p *AEADPool) Put(aead cipher.AEAD) {
+	k, ok := aead.(*chacha20poly1305)
+	if !ok || k.pool != p {
+		return
+	}
+	p.pool.Put(p.instance(k))
+}
+
+// Close destroys the reference copy of the key held by the pool. The
+// AEADs of the pool must not be used afterwards.
+func (p *AEADPool) Close() error {
+	return p.template.Close()
+}
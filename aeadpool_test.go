@@ -0,0 +1,92 @@
+package chacha20poly1305guard
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+)
+
+// TestAEADPoolConcurrent seals from AEADs of one pool on many goroutines,
+// closing some before they are returned. Run it with -race.
+func TestAEADPoolConcurrent(t *testing.T) {
+	const goroutines, perGoroutine = 16, 200
+
+	key := testKey(t)
+	ref := testAEAD(t, XChaCha20)
+	before := Stats().Keys.Buffers
+	p, err := NewPool(key, XChaCha20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			nonce := make([]byte, XNonceSize)
+			nonce[0] = byte(g)
+			plaintext := []byte("request")
+			for i := 0; i < perGoroutine; i++ {
+				aead := p.Get()
+				nonce[1] = byte(i)
+				sealed := aead.Seal(nil, nonce, plaintext, nil)
+				if out, err := ref.Open(nil, nonce, sealed, nil); err != nil || !bytes.Equal(out, plaintext) {
+					t.Errorf("pooled AEAD sealed a ciphertext that does not open: %v", err)
+					return
+				}
+				if i%7 == 0 {
+					aead.(AEAD).Close()
+				}
+				p.Put(aead)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	// The instances share the reference copy of the key of the pool.
+	if got := Stats().Keys.Buffers; got != before+1 {
+		t.Fatalf("key buffers = %d, want %d", got, before+1)
+	}
+	p.Put(ref)
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := Stats().Keys.Buffers; got != before {
+		t.Fatalf("key buffers after Close = %d, want %d", got, before)
+	}
+}
+
+// BenchmarkAEADPerRequest compares building an AEAD for every request
+// with taking one from an AEADPool.
+func BenchmarkAEADPerRequest(b *testing.B) {
+	key := testKey(b)
+	nonce := make([]byte, XNonceSize)
+	dst := make([]byte, 0, 64+TagSize)
+	msg := bytes.Repeat([]byte{1}, 64)
+
+	b.Run("new", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			aead, err := NewX(key)
+			if err != nil {
+				b.Fatal(err)
+			}
+			aead.Seal(dst[:0], nonce, msg, nil)
+			aead.(AEAD).Close()
+		}
+	})
+	b.Run("pool", func(b *testing.B) {
+		p, err := NewPool(key, XChaCha20)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer p.Close()
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			aead := p.Get()
+			aead.Seal(dst[:0], nonce, msg, nil)
+			p.Put(aead)
+		}
+	})
+}
@@ -0,0 +1,139 @@
+package chacha20poly1305guard
+
+import (
+	"crypto/cipher"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/awnumar/memguard"
+)
+
+// AlgorithmInfo describes a construction registered with
+// RegisterAlgorithm.
+type AlgorithmInfo struct {
+	ID        Algorithm
+	Name      string
+	NonceSize int
+	TagSize   int
+
+	factory func(key *memguard.LockedBuffer) (cipher.AEAD, error)
+}
+
+var algorithms = struct {
+	sync.RWMutex
+	byID   map[Algorithm]*AlgorithmInfo
+	byName map[string]*AlgorithmInfo
+}{
+	byID:   make(map[Algorithm]*AlgorithmInfo),
+	byName: make(map[string]*AlgorithmInfo),
+}
+
+// The built-in constructions are registered under the IDs of their
+// Algorithm constants and the names returned by Variant.String. Both
+// are frozen: they are written into envelopes and will never change.
+func init() {
+	for _, v := range []Variant{ChaCha20, XChaCha20} {
+		v := v
+		nonceSize, _, _ := v.params()
+		RegisterAlgorithm(variantAlgorithms[v], v.String(), func(key *memguard.LockedBuffer) (cipher.AEAD, error) {
+			return NewAEAD(key, v)
+		}, nonceSize, TagSize)
+	}
+}
+
+// variantAlgorithms maps the variants to the IDs of their algorithms.
+var variantAlgorithms = map[Variant]Algorithm{
+	ChaCha20:  AlgorithmChaCha20Poly1305,
+	XChaCha20: AlgorithmXChaCha20Poly1305,
+}
+
+// RegisterAlgorithm makes a construction available to envelopes under
+// id and name, so that adding one does not need changes throughout the
+// package. factory returns an AEAD for a key, which must have the given
+// nonce and tag sizes. Names are matched ignoring case.
+//
+// RegisterAlgorithm is meant to be called from init functions. It
+// panics if id is zero, name is empty, factory is nil, or id or name is
+// already registered.
+func RegisterAlgorithm(id Algorithm, name string, factory func(key *memguard.LockedBuffer) (cipher.AEAD, error), nonceSize, tagSize int) {
+	if id == 0 || name == "" || factory == nil {
+		panic("chacha20poly1305guard: invalid algorithm registration")
+	}
+
+	algorithms.Lock()
+	defer algorithms.Unlock()
+
+	key := strings.ToLower(name)
+	if _, dup := algorithms.byID[id]; dup {
+		panic(fmt.Sprintf("chacha20poly1305guard: algorithm %d registered twice", id))
+	}
+	if _, dup := algorithms.byName[key]; dup {
+		panic(fmt.Sprintf("chacha20poly1305guard: algorithm %q registered twice", name))
+	}
+
+	info := &AlgorithmInfo{ID: id, Name: name, NonceSize: nonceSize, TagSize: tagSize, factory: factory}
+	algorithms.byID[id] = info
+	algorithms.byName[key] = info
+}
+
+// LookupAlgorithm returns the construction registered under id. An
+// unregistered id fails with an error matching ErrUnknownAlgorithm.
+func LookupAlgorithm(id Algorithm) (AlgorithmInfo, error) {
+	algorithms.RLock()
+	info, ok := algorithms.byID[id]
+	algorithms.RUnlock()
+	if !ok {
+		return AlgorithmInfo{}, fmt.Errorf("%w: %d", ErrUnknownAlgorithm, id)
+	}
+	return *info, nil
+}
+
+// LookupAlgorithmByName returns the construction registered under name,
+// ignoring case. An unregistered name fails with an error matching
+// ErrUnknownAlgorithm.
+func LookupAlgorithmByName(name string) (AlgorithmInfo, error) {
+	algorithms.RLock()
+	info, ok := algorithms.byName[strings.ToLower(name)]
+	algorithms.RUnlock()
+	if !ok {
+		return AlgorithmInfo{}, fmt.Errorf("%w: %q", ErrUnknownAlgorithm, name)
+	}
+	return *info, nil
+}
+
+// New returns an AEAD of the construction for key. It fails with
+// ErrUnknownAlgorithm if the factory returns an AEAD whose sizes differ
+// from those it was registered with. AEADs of constructions registered
+// outside this package are wrapped so that SealEnvelope can tell which
+// algorithm they implement.
+func (info AlgorithmInfo) New(key *memguard.LockedBuffer) (cipher.AEAD, error) {
+	aead, err := info.factory(key)
+	if err != nil {
+		return nil, err
+	}
+	if aead.NonceSize() != info.NonceSize || aead.Overhead() != info.TagSize {
+		return nil, fmt.Errorf("%w: %d: factory returned an AEAD of the wrong size", ErrUnknownAlgorithm, info.ID)
+	}
+
+	if _, ok := aead.(*chacha20poly1305); ok {
+		return aead, nil
+	}
+	return registeredAEAD{aead, info.ID}, nil
+}
+
+// registeredAEAD is an AEAD of a construction registered from outside
+// this package, tagged with its algorithm.
+type registeredAEAD struct {
+	cipher.AEAD
+	id Algorithm
+}
+
+// Close closes the wrapped AEAD if it has a Close method, so that
+// AEADs built through the registry can release their keys.
+func (r registeredAEAD) Close() error {
+	if c, ok := r.AEAD.(interface{ Close() error }); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package chacha20poly1305guard
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/awnumar/memguard"
+)
+
+// testAlgorithm is AES-256-GCM, registered for the tests under an ID
+// the package does not use.
+const testAlgorithm Algorithm = 0x7e00
+
+// closingAEAD records whether it was closed.
+type closingAEAD struct {
+	cipher.AEAD
+	closed bool
+}
+
+func (c *closingAEAD) Close() error {
+	c.closed = true
+	return nil
+}
+
+func init() {
+	RegisterAlgorithm(testAlgorithm, "AES-256-GCM-test", func(key *memguard.LockedBuffer) (cipher.AEAD, error) {
+		block, err := aes.NewCipher(key.Buffer())
+		if err != nil {
+			return nil, err
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		return &closingAEAD{AEAD: gcm}, nil
+	}, 12, 16)
+
+	// Registered with the wrong nonce size.
+	RegisterAlgorithm(testAlgorithm+1, "wrong-size-test", func(key *memguard.LockedBuffer) (cipher.AEAD, error) {
+		return NewAEAD(key, XChaCha20)
+	}, NonceSize, TagSize)
+}
+
+// panics reports whether fn panics.
+func panics(fn func()) (panicked bool) {
+	defer func() {
+		panicked = recover() != nil
+	}()
+	fn()
+	return false
+}
+
+func TestLookupAlgorithm(t *testing.T) {
+	for _, v := range variants {
+		id := variantAlgorithms[v]
+		info, err := LookupAlgorithm(id)
+		if err != nil || info.ID != id || info.Name != v.String() || info.TagSize != TagSize {
+			t.Fatalf("%v: %+v, %v", v, info, err)
+		}
+		byName, err := LookupAlgorithmByName(v.String())
+		if err != nil || byName.ID != id {
+			t.Fatalf("%v by name: %+v, %v", v, byName, err)
+		}
+		if _, err := LookupAlgorithmByName(strings.ToUpper(v.String())); err != nil {
+			t.Fatalf("%v by upper case name: %v", v, err)
+		}
+	}
+
+	if _, err := LookupAlgorithm(0x7eff); !errors.Is(err, ErrUnknownAlgorithm) {
+		t.Fatalf("unknown ID: got %v, want ErrUnknownAlgorithm", err)
+	}
+	if _, err := LookupAlgorithmByName("ROT13"); !errors.Is(err, ErrUnknownAlgorithm) {
+		t.Fatalf("unknown name: got %v, want ErrUnknownAlgorithm", err)
+	}
+}
+
+func TestRegisterAlgorithmInvalid(t *testing.T) {
+	factory := func(key *memguard.LockedBuffer) (cipher.AEAD, error) { return NewAEAD(key, ChaCha20) }
+	for name, register := range map[string]func(){
+		"duplicate ID":   func() { RegisterAlgorithm(AlgorithmChaCha20Poly1305, "other", factory, NonceSize, TagSize) },
+		"duplicate name": func() { RegisterAlgorithm(0x7e10, "chacha20poly1305", factory, NonceSize, TagSize) },
+		"zero ID":        func() { RegisterAlgorithm(0, "zero", factory, NonceSize, TagSize) },
+		"empty name":     func() { RegisterAlgorithm(0x7e11, "", factory, NonceSize, TagSize) },
+		"nil factory":    func() { RegisterAlgorithm(0x7e12, "nil", nil, NonceSize, TagSize) },
+	} {
+		if !panics(register) {
+			t.Errorf("%s: RegisterAlgorithm did not panic", name)
+		}
+	}
+	// The failed registrations left nothing behind.
+	for _, id := range []Algorithm{0x7e10, 0x7e11, 0x7e12} {
+		if _, err := LookupAlgorithm(id); !errors.Is(err, ErrUnknownAlgorithm) {
+			t.Errorf("ID %#x registered by a failed call", id)
+		}
+	}
+}
+
+func TestRegisteredAEAD(t *testing.T) {
+	info, err := LookupAlgorithmByName("aes-256-gcm-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := info.New(testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nonce := make([]byte, info.NonceSize)
+	env, err := SealEnvelope(aead, nonce, []byte("plaintext"), []byte("data"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := DecodeEnvelope(env)
+	if err != nil || m.Algorithm != testAlgorithm {
+		t.Fatalf("envelope algorithm %#x, %v", m.Algorithm, err)
+	}
+	if p, err := OpenEnvelope(aead, env, []byte("data")); err != nil || string(p) != "plaintext" {
+		t.Fatalf("OpenEnvelope: %q, %v", p, err)
+	}
+	if _, err := OpenEnvelope(testAEAD(t, ChaCha20), env, []byte("data")); !errors.Is(err, ErrAlgorithmMismatch) {
+		t.Fatalf("other algorithm: got %v, want ErrAlgorithmMismatch", err)
+	}
+
+	// Built-in constructions come back unwrapped.
+	builtin, err := LookupAlgorithm(AlgorithmXChaCha20Poly1305)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, err := builtin.New(testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x.(AEAD).Close()
+	if _, ok := x.(*chacha20poly1305); !ok {
+		t.Fatalf("built-in algorithm returned a %T", x)
+	}
+
+	wrong, err := LookupAlgorithm(testAlgorithm + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wrong.New(testKey(t)); !errors.Is(err, ErrUnknownAlgorithm) {
+		t.Fatalf("factory of the wrong size: got %v, want ErrUnknownAlgorithm", err)
+	}
+}
+
+func TestRegisteredAEADClose(t *testing.T) {
+	info, err := LookupAlgorithm(testAlgorithm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := info.New(testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, ok := aead.(interface{ Close() error })
+	if !ok {
+		t.Fatal("registered AEAD has no Close method")
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !aead.(registeredAEAD).AEAD.(*closingAEAD).closed {
+		t.Fatal("Close was not forwarded to the registered AEAD")
+	}
+}
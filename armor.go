@@ -0,0 +1,122 @@
+package chacha20poly1305guard
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strings"
+)
+
+var (
+	// ErrInvalidArmor is returned by DecodeArmor when the text is not a
+	// complete armored message.
+	ErrInvalidArmor = errors.New("invalid armor")
+
+	// ErrArmorChecksum is returned by DecodeArmor when the body does not
+	// match its checksum line, meaning it was damaged in transit.
+	ErrArmorChecksum = errors.New("armor checksum mismatch")
+)
+
+const (
+	armorBegin     = "-----BEGIN C20PGUARD MESSAGE-----"
+	armorEnd       = "-----END C20PGUARD MESSAGE-----"
+	armorLineWidth = 64
+)
+
+// EncodeArmor returns the envelope of msg as ASCII armor, suitable for
+// configuration files and tickets:
+//
+//	-----BEGIN C20PGUARD MESSAGE-----
+//	Version: 1
+//	Key-ID: a2lk
+//
+//	<base64 envelope, wrapped at 64 columns>
+//	=<base64 CRC-32 of the envelope>
+//	-----END C20PGUARD MESSAGE-----
+//
+// The headers are informational; the envelope itself is authoritative.
+// Key-ID is base64url and only present if msg has a key ID.
+func EncodeArmor(msg *SealedMessage) (string, error) {
+	env, err := EncodeEnvelope(msg)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	b.WriteString(armorBegin + "\n")
+	fmt.Fprintf(&b, "Version: %d\n", msg.Version)
+	if len(msg.KeyID) > 0 {
+		fmt.Fprintf(&b, "Key-ID: %s\n", base64.RawURLEncoding.EncodeToString(msg.KeyID))
+	}
+	b.WriteString("\n")
+
+	body := base64.StdEncoding.EncodeToString(env)
+	for len(body) > armorLineWidth {
+		b.WriteString(body[:armorLineWidth] + "\n")
+		body = body[armorLineWidth:]
+	}
+	b.WriteString(body + "\n")
+
+	b.WriteString("=" + armorChecksum(env) + "\n")
+	b.WriteString(armorEnd + "\n")
+
+	return b.String(), nil
+}
+
+// DecodeArmor parses armor written by EncodeArmor and decodes the
+// envelope it contains. Surrounding text and whitespace are ignored and
+// the body may have been wrapped differently. A missing begin or end
+// line, or anything but blank lines between the checksum and the end
+// line, fails with ErrInvalidArmor and a damaged body with
+// ErrArmorChecksum, before the envelope is looked at.
+func DecodeArmor(s string) (*SealedMessage, error) {
+	start := strings.Index(s, armorBegin)
+	if start < 0 {
+		return nil, fmt.Errorf("%w: missing begin line", ErrInvalidArmor)
+	}
+	s = s[start+len(armorBegin):]
+	end := strings.Index(s, armorEnd)
+	if end < 0 {
+		return nil, fmt.Errorf("%w: missing end line", ErrInvalidArmor)
+	}
+
+	var body strings.Builder
+	var sum string
+	for _, line := range strings.Split(s[:end], "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+		case strings.Contains(line, ":"):
+			// A header. Base64 never contains a colon.
+		case sum != "":
+			return nil, fmt.Errorf("%w: data after the checksum line", ErrInvalidArmor)
+		case strings.HasPrefix(line, "=") && len(line) == 1+8:
+			// The checksum. Padding wrapped onto a line of its own is
+			// shorter.
+			sum = line[1:]
+		default:
+			body.WriteString(line)
+		}
+	}
+	if sum == "" {
+		return nil, fmt.Errorf("%w: missing checksum line", ErrInvalidArmor)
+	}
+
+	env, err := base64.StdEncoding.DecodeString(body.String())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidArmor, err)
+	}
+	if armorChecksum(env) != sum {
+		return nil, ErrArmorChecksum
+	}
+
+	return DecodeEnvelope(env)
+}
+
+func armorChecksum(b []byte) string {
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(b))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
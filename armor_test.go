@@ -0,0 +1,87 @@
+package chacha20poly1305guard
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestArmor(t *testing.T) {
+	aead, env := sealTestEnvelope(t)
+	m, err := DecodeEnvelope(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	armored, err := EncodeArmor(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(armored, armorBegin+"\n") || !strings.HasSuffix(armored, armorEnd+"\n") {
+		t.Fatalf("armor is not delimited:\n%s", armored)
+	}
+
+	// Surrounding text, indentation and rewrapped lines are accepted.
+	rewrapped := strings.Replace(armored, "\n", "\r\n  ", -1)
+	body := strings.Index(rewrapped, "\r\n  \r\n") + 6
+	rewrapped = rewrapped[:body+10] + "\n" + rewrapped[body+10:]
+	for _, s := range []string{armored, "config: |\n  " + rewrapped + "\nmore: text"} {
+		got, err := DecodeArmor(s)
+		if err != nil {
+			t.Fatalf("%v:\n%s", err, s)
+		}
+		if plaintext, err := OpenSealedMessage(aead, got, []byte("data")); err != nil || string(plaintext) != "plaintext" {
+			t.Fatalf("armored envelope opens to %q, %v", plaintext, err)
+		}
+	}
+}
+
+func TestArmorRejected(t *testing.T) {
+	_, env := sealTestEnvelope(t)
+	m, err := DecodeEnvelope(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	armored, err := EncodeArmor(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(armored, "\n")
+	bodyLine := 4 // after the begin line, two headers and a blank line
+
+	replaceLine := func(i int, s string) string {
+		l := append([]string(nil), lines...)
+		l[i] = s
+		return strings.Join(l, "\n")
+	}
+	damaged := []byte(lines[bodyLine])
+	damaged[3] ^= 1
+
+	for _, tc := range []struct {
+		name  string
+		armor string
+		want  error
+	}{
+		{"empty", "", ErrInvalidArmor},
+		{"missing begin line", strings.Replace(armored, armorBegin, "", 1), ErrInvalidArmor},
+		{"missing end line", strings.Replace(armored, armorEnd, "", 1), ErrInvalidArmor},
+		{"wrong begin label", strings.Replace(armored, "BEGIN C20PGUARD MESSAGE", "BEGIN PGP MESSAGE", 1), ErrInvalidArmor},
+		{"wrong end label", strings.Replace(armored, "END C20PGUARD MESSAGE", "END PGP MESSAGE", 1), ErrInvalidArmor},
+		{"missing checksum", replaceLine(len(lines)-3, ""), ErrInvalidArmor},
+		{"bad base64", replaceLine(bodyLine, "!!!!"+lines[bodyLine][4:]), ErrInvalidArmor},
+		{"damaged body", replaceLine(bodyLine, string(damaged)), ErrArmorChecksum},
+		{"garbage after the body", replaceLine(len(lines)-3, lines[len(lines)-3]+"\nAAAA"), ErrInvalidArmor},
+	} {
+		_, err := DecodeArmor(tc.armor)
+		if !errors.Is(err, tc.want) {
+			t.Fatalf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+		if errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("%s: corrupted armor reported as an authentication failure", tc.name)
+		}
+	}
+
+	// Trailing text after the end line is ignored, like leading text.
+	if _, err := DecodeArmor(armored + "trailing text\n"); err != nil {
+		t.Fatalf("text after the end line: %v", err)
+	}
+}
@@ -0,0 +1,30 @@
+//go:build chacha_debug
+// +build chacha_debug
+
+package chacha20poly1305guard
+
+import (
+	"crypto/subtle"
+	"errors"
+
+	"golang.org/x/crypto/poly1305"
+)
+
+// authFailure is the chacha_debug version of the error for a tag
+// mismatch. It recomputes the tag without associated data and, if that
+// matches, hints that the message was sealed with different AAD than it
+// is being opened with. This leaks whether the AAD is to blame, so it
+// exists only in builds made with -tags chacha_debug and must never ship.
+// The hint is the cause of the *AuthError returned.
+func authFailure(key *[32]byte, ciphertext, data, digest []byte) error {
+	if len(data) == 0 {
+		return &AuthError{}
+	}
+
+	var t [poly1305.TagSize]byte
+	computeTag(&t, key, ciphertext, nil)
+	if subtle.ConstantTimeCompare(t[:len(digest)], digest) == 1 {
+		return &AuthError{Err: errors.New("chacha_debug: the tag matches empty associated data; the AAD passed to Open likely differs from the one used to seal")}
+	}
+	return &AuthError{}
+}
@@ -0,0 +1,26 @@
+//go:build chacha_debug
+// +build chacha_debug
+
+package chacha20poly1305guard
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAuthFailureAADHint(t *testing.T) {
+	err := authFailureCause(t, nil, []byte("aad"), false)
+	if err == nil || !strings.Contains(err.Error(), "AAD") {
+		t.Fatalf("AAD mismatch: got cause %v, want the AAD hint", err)
+	}
+
+	if err := authFailureCause(t, nil, nil, true); err != nil {
+		t.Fatalf("tampered ciphertext: got hint %v", err)
+	}
+	if err := authFailureCause(t, nil, []byte("aad"), true); err != nil {
+		t.Fatalf("tampered ciphertext and AAD mismatch: got hint %v", err)
+	}
+	if err := authFailureCause(t, []byte("sealed"), []byte("opened"), false); err != nil {
+		t.Fatalf("two non-empty AADs: got hint %v", err)
+	}
+}
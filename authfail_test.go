@@ -0,0 +1,15 @@
+//go:build !chacha_debug
+// +build !chacha_debug
+
+package chacha20poly1305guard
+
+import "testing"
+
+func TestAuthFailureNoHint(t *testing.T) {
+	if err := authFailureCause(t, nil, []byte("aad"), false); err != nil {
+		t.Fatalf("AAD mismatch: release build gave a hint: %v", err)
+	}
+	if err := authFailureCause(t, nil, nil, true); err != nil {
+		t.Fatalf("tampered ciphertext: release build gave a hint: %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package chacha20poly1305guard
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"sync"
+)
+
+// Domain separation for the entries of a transcript.
+const (
+	transcriptHandshake = 'h'
+	transcriptMessage   = 'm'
+)
+
+// BoundAEAD binds every message of a session to all those before it. It
+// keeps a running SHA-256 transcript hash, which is prepended to the
+// associated data of every Seal and Open, and to which every sealed or
+// successfully opened message is added. Two parties that process the
+// same messages in the same order keep the same transcript; a message
+// that was injected, dropped or reordered makes every later Open fail.
+//
+// The transcript only advances, so BoundAEAD must not be used for
+// messages that may legitimately be lost or arrive out of order. It is
+// safe for concurrent use, but concurrent messages are added to the
+// transcript in an unspecified order.
+type BoundAEAD struct {
+	aead cipher.AEAD
+
+	mu         sync.Mutex
+	transcript hash.Hash
+}
+
+// NewBoundAEAD returns a BoundAEAD around aead with an empty transcript.
+func NewBoundAEAD(aead cipher.AEAD) *BoundAEAD {
+	return &BoundAEAD{aead: aead, transcript: sha256.New()}
+}
+
+// UpdateTranscript mixes data, such as handshake messages, into the
+// transcript. Both parties must mix in the same data at the same point.
+func (b *BoundAEAD) UpdateTranscript(data []byte) {
+	b.mu.Lock()
+	b.update(transcriptHandshake, data)
+	b.mu.Unlock()
+}
+
+// Transcript returns the current transcript hash.
+func (b *BoundAEAD) Transcript() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.transcript.Sum(nil)
+}
+
+func (b *BoundAEAD) NonceSize() int {
+	return b.aead.NonceSize()
+}
+
+func (b *BoundAEAD) Overhead() int {
+	return b.aead.Overhead()
+}
+
+// Seal seals plaintext with the transcript hash prepended to data, then
+// adds the ciphertext to the transcript.
+func (b *BoundAEAD) Seal(dst, nonce, plaintext, data []byte) []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ret := b.aead.Seal(dst, nonce, plaintext, b.ad(data))
+	b.update(transcriptMessage, ret[len(dst):])
+	return ret
+}
+
+// Open opens ciphertext with the transcript hash prepended to data and,
+// if it is authentic, adds it to the transcript. A failed Open leaves
+// the transcript unchanged.
+func (b *BoundAEAD) Open(dst, nonce, ciphertext, data []byte) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ret, err := b.aead.Open(dst, nonce, ciphertext, b.ad(data))
+	if err != nil {
+		return nil, err
+	}
+	b.update(transcriptMessage, ciphertext)
+	return ret, nil
+}
+
+// ad returns the transcript hash followed by data. b.mu must be held.
+func (b *BoundAEAD) ad(data []byte) []byte {
+	ad := make([]byte, 0, sha256.Size+len(data))
+	ad = b.transcript.Sum(ad)
+	return append(ad, data...)
+}
+
+// update adds an entry to the transcript: its kind, its length as
+// uint64 LE and data. b.mu must be held.
+func (b *BoundAEAD) update(kind byte, data []byte) {
+	var head [9]byte
+	head[0] = kind
+	binary.LittleEndian.PutUint64(head[1:], uint64(len(data)))
+	b.transcript.Write(head[:])
+	b.transcript.Write(data)
+}
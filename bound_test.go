@@ -0,0 +1,129 @@
+package chacha20poly1305guard
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// boundMessage is a message sealed by a BoundAEAD, with its nonce.
+type boundMessage struct {
+	nonce, ciphertext []byte
+}
+
+// boundSession returns the receiving end of a session and n messages
+// sealed in order by the sending end.
+func boundSession(t *testing.T, n int) (*BoundAEAD, []boundMessage) {
+	t.Helper()
+	aead := testAEAD(t, XChaCha20)
+	sender, receiver := NewBoundAEAD(aead), NewBoundAEAD(aead)
+	sender.UpdateTranscript([]byte("hello"))
+	receiver.UpdateTranscript([]byte("hello"))
+
+	msgs := make([]boundMessage, n)
+	for i := range msgs {
+		nonce := make([]byte, XNonceSize)
+		nonce[0] = byte(i)
+		msgs[i] = boundMessage{nonce, sender.Seal(nil, nonce, []byte(fmt.Sprint("message ", i)), nil)}
+	}
+	return receiver, msgs
+}
+
+// openBound opens msg with b, checking that a failure leaves the
+// transcript unchanged.
+func openBound(t *testing.T, b *BoundAEAD, msg boundMessage) error {
+	t.Helper()
+	before := b.Transcript()
+	_, err := b.Open(nil, msg.nonce, msg.ciphertext, nil)
+	if err != nil && !bytes.Equal(b.Transcript(), before) {
+		t.Fatal("failed Open changed the transcript")
+	}
+	return err
+}
+
+func TestBoundAEAD(t *testing.T) {
+	receiver, msgs := boundSession(t, 3)
+	for i, msg := range msgs {
+		got, err := receiver.Open(nil, msg.nonce, msg.ciphertext, nil)
+		if err != nil || string(got) != fmt.Sprint("message ", i) {
+			t.Fatalf("message %d: %q, %v", i, got, err)
+		}
+	}
+	if receiver.NonceSize() != XNonceSize || receiver.Overhead() != TagSize {
+		t.Fatalf("nonce size %d and overhead %d", receiver.NonceSize(), receiver.Overhead())
+	}
+
+	// The transcript is part of the associated data: the plain AEAD
+	// cannot open the messages.
+	if _, err := testAEAD(t, XChaCha20).Open(nil, msgs[0].nonce, msgs[0].ciphertext, nil); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("message opened without the transcript: %v", err)
+	}
+
+	// A different handshake breaks the session from the start.
+	other := NewBoundAEAD(testAEAD(t, XChaCha20))
+	other.UpdateTranscript([]byte("goodbye"))
+	if err := openBound(t, other, msgs[0]); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("other handshake: got %v, want ErrAuthFailed", err)
+	}
+}
+
+func TestBoundAEADDropped(t *testing.T) {
+	receiver, msgs := boundSession(t, 4)
+	if err := openBound(t, receiver, msgs[0]); err != nil {
+		t.Fatal(err)
+	}
+	// With message 1 dropped, none of the later ones open.
+	for i := 2; i < len(msgs); i++ {
+		if err := openBound(t, receiver, msgs[i]); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("message %d after a dropped message: got %v, want ErrAuthFailed", i, err)
+		}
+	}
+	// Since the failures left the transcript alone, the session
+	// resumes once the missing message arrives.
+	for i := 1; i < len(msgs); i++ {
+		if err := openBound(t, receiver, msgs[i]); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+}
+
+func TestBoundAEADReplayed(t *testing.T) {
+	receiver, msgs := boundSession(t, 2)
+	if err := openBound(t, receiver, msgs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := openBound(t, receiver, msgs[0]); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("replayed message: got %v, want ErrAuthFailed", err)
+	}
+	if err := openBound(t, receiver, msgs[1]); err != nil {
+		t.Fatalf("message after a rejected replay: %v", err)
+	}
+}
+
+func TestBoundAEADReordered(t *testing.T) {
+	receiver, msgs := boundSession(t, 3)
+	for _, i := range []int{1, 2} {
+		if err := openBound(t, receiver, msgs[i]); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("message %d before message 0: got %v, want ErrAuthFailed", i, err)
+		}
+	}
+	if err := openBound(t, receiver, msgs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := openBound(t, receiver, msgs[2]); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("message 2 before message 1: got %v, want ErrAuthFailed", err)
+	}
+
+	// A tampered message is rejected without disturbing the session.
+	tampered := boundMessage{msgs[1].nonce, append([]byte(nil), msgs[1].ciphertext...)}
+	tampered.ciphertext[0] ^= 1
+	if err := openBound(t, receiver, tampered); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("tampered message: got %v, want ErrAuthFailed", err)
+	}
+	for _, i := range []int{1, 2} {
+		if err := openBound(t, receiver, msgs[i]); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+}
@@ -14,6 +14,10 @@ import (
 	"crypto/subtle"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"unsafe"
 
 	"github.com/alexzava/chacha20guard"
 	"golang.org/x/crypto/poly1305"
@@ -31,151 +35,1035 @@ var (
 	// ErrInvalidNonce is returned when the provided nonce is the wrong size.
 	ErrInvalidNonce = errors.New("invalid nonce size")
 
+	// ErrCiphertextTooShort is returned when a ciphertext is too short to
+	// hold an authentication tag.
+	ErrCiphertextTooShort = errors.New("ciphertext shorter than the authentication tag")
+
+	// ErrKeyDestroyed is returned when the key of an AEAD has been
+	// destroyed, by the caller or by Close. It matches
+	// memguard.ErrDestroyed with errors.Is.
+	ErrKeyDestroyed = fmt.Errorf("key has been destroyed: %w", memguard.ErrDestroyed)
+
+	// ErrShortBuffer is returned when a caller-provided output buffer is
+	// too small for the result.
+	ErrShortBuffer = errors.New("output buffer too small")
+
+	// ErrUnexpectedLength is returned when a ciphertext does not hold a
+	// plaintext of the length set with WithExpectedLength.
+	ErrUnexpectedLength = errors.New("unexpected plaintext length")
+
+	// ErrMessageTooLong is returned when a ciphertext holds more
+	// plaintext than the limit set with WithMaxPlaintext.
+	ErrMessageTooLong = errors.New("message too long")
+
+	// ErrWeakMACKey is returned when the derived Poly1305 key is all
+	// zeros, which would make forgeries trivial. With a working ChaCha20
+	// this has a negligible probability; seeing it means the keystream
+	// is broken.
+	ErrWeakMACKey = errors.New("derived Poly1305 key is all zeros")
+
 	// KeySize is the required size of ChaCha20 keys.
 	KeySize = chacha20guard.KeySize
 )
 
+const (
+	// TagSize is the size of the Poly1305 tag appended to every
+	// ciphertext, except by NewTelemetry.
+	TagSize = poly1305.TagSize
+
+	// NonceSize is the size of ChaCha20Poly1305 nonces.
+	NonceSize = 8
+
+	// XNonceSize is the size of XChaCha20Poly1305 nonces.
+	XNonceSize = 24
+)
+
+// AEAD is implemented by the ciphers returned from this package. It
+// extends cipher.AEAD with the methods below; the cipher.AEAD returned
+// by New and NewX can be asserted to it.
+type AEAD interface {
+	cipher.AEAD
+
+	// SealXSplit seals plaintext under the XChaCha20 nonce made of the
+	// 16 byte streamID followed by counter in little endian.
+	SealXSplit(dst []byte, streamID [16]byte, counter uint64, plaintext, data []byte) []byte
+
+	// OpenXSplit opens a ciphertext sealed with SealXSplit.
+	OpenXSplit(dst []byte, streamID [16]byte, counter uint64, ciphertext, data []byte) ([]byte, error)
+
+	// OpenToLockedBuffer is like Open but decrypts into a LockedBuffer.
+	OpenToLockedBuffer(nonce, ciphertext, data []byte) (*memguard.LockedBuffer, error)
+
+	// OpenWith decrypts into locked memory and passes the plaintext to fn,
+	// destroying it once fn returns.
+	OpenWith(nonce, ciphertext, data []byte, fn func(plaintext []byte) error) error
+
+	// SealFromLockedBuffer is like Seal but reads the plaintext from a
+	// LockedBuffer.
+	SealFromLockedBuffer(dst, nonce []byte, plaintext *memguard.LockedBuffer, data []byte) ([]byte, error)
+
+	// SealWithLockedAAD is like Seal but reads the associated data from a
+	// LockedBuffer.
+	SealWithLockedAAD(dst, nonce, plaintext []byte, data *memguard.LockedBuffer) ([]byte, error)
+
+	// OpenWithLockedAAD is like Open but reads the associated data from a
+	// LockedBuffer.
+	OpenWithLockedAAD(dst, nonce, ciphertext []byte, data *memguard.LockedBuffer) ([]byte, error)
+
+	// SealTo is like Seal but writes into a caller-provided buffer
+	// instead of appending.
+	SealTo(out, nonce, plaintext, data []byte) (n int, err error)
+
+	// SealInPlace seals a plaintext that follows its nonce in buf.
+	SealInPlace(buf []byte, nonceLen, plaintextLen int, data []byte) (int, error)
+
+	// OpenTo is like Open but writes into a caller-provided buffer
+	// instead of appending.
+	OpenTo(out, nonce, ciphertext, data []byte) (n int, err error)
+
+	// SealDetached is like Seal but returns the tag separately.
+	SealDetached(dst, nonce, plaintext, data []byte) (ciphertext, tag []byte)
+
+	// OpenDetached opens a ciphertext and tag returned by SealDetached.
+	OpenDetached(dst, nonce, ciphertext, tag, data []byte) ([]byte, error)
+
+	// SealFramed is like Seal but also returns where the tag starts.
+	SealFramed(dst, nonce, plaintext, data []byte) (out []byte, tagOffset int)
+
+	// SealAndWipe is like Seal but zeroes plaintext afterwards.
+	SealAndWipe(dst, nonce, plaintext, data []byte) ([]byte, error)
+
+	// PlaintextLen returns the length of the plaintext in ciphertext.
+	PlaintextLen(ciphertext []byte) (int, error)
+
+	// IsAuthentic reports whether Open would succeed.
+	IsAuthentic(nonce, ciphertext, data []byte) bool
+
+	// Verify returns the error Open would return, without decrypting.
+	Verify(nonce, ciphertext, data []byte) error
+
+	// OpenValidateOnly is Verify returning the plaintext length.
+	OpenValidateOnly(nonce, ciphertext, data []byte) (plaintextLen int, err error)
+
+	// Authenticate verifies ciphertext and returns a token that
+	// decrypts it later.
+	Authenticate(nonce, ciphertext, data []byte) (*Authenticated, error)
+
+	// MAC returns the tag of data alone, with nothing encrypted.
+	MAC(nonce, data []byte) ([]byte, error)
+
+	// VerifyMAC checks a tag returned by MAC.
+	VerifyMAC(nonce, data, tag []byte) error
+
+	// Variant returns the construction the AEAD implements.
+	Variant() Variant
+
+	// KeyIsFrozen reports whether the key buffer is immutable.
+	KeyIsFrozen() bool
+
+	// Close destroys the key buffers owned by the AEAD.
+	Close() error
+}
+
+// Option configures an AEAD created by this package.
+type Option func(*chacha20poly1305)
+
+// DestroyAfterSeal makes SealFromLockedBuffer destroy its plaintext
+// buffer once it has been sealed.
+func DestroyAfterSeal() Option {
+	return func(k *chacha20poly1305) {
+		k.destroyAfterSeal = true
+	}
+}
+
+// WithFrozenKey makes the constructor freeze the key buffer with
+// MakeImmutable, so that it cannot be modified while the AEAD uses it.
+// It only applies to keys held in a LockedBuffer.
+func WithFrozenKey() Option {
+	return func(k *chacha20poly1305) {
+		k.freezeKey = true
+	}
+}
+
+// NonceObserver is called with a copy of the nonce of every sealed
+// message, for example to feed an audit log or a nonce reuse checker.
+type NonceObserver func(nonce []byte)
+
+// WithNonceObserver registers fn to be called on every Seal. A nil fn
+// disables observation, which is the default.
+func WithNonceObserver(fn NonceObserver) Option {
+	return func(k *chacha20poly1305) {
+		k.nonceObserver = fn
+	}
+}
+
+// WithLockedScratch makes Open decrypt into locked scratch memory and
+// only then copy the plaintext to dst, wiping the scratch afterwards.
+// The keystream is never combined with the ciphertext in memory that
+// can be swapped out, at the cost of one extra copy per message. It
+// applies to every method that decrypts into a caller's slice, OpenTo,
+// OpenDetached, OpenXSplit and OpenWithLockedAAD included, and so to the
+// helpers that open through the AEAD, such as OpenEnvelope.
+// OpenToLockedBuffer, OpenWith and DecryptStream always decrypt into
+// locked memory and need no option.
+func WithLockedScratch(enabled bool) Option {
+	return func(k *chacha20poly1305) {
+		k.lockedScratch = enabled
+	}
+}
+
+// WithNoncePrefix fixes the first len(prefix) bytes of every nonce, for
+// instance to give each process sharing a key its own nonce space. Seal
+// and Open then take only the rest of the nonce, which NonceSize
+// reports, and prepend the prefix themselves. ChaCha20Poly1305 nonces
+// are only 8 bytes here, so a 4 byte prefix leaves a 4 byte counter;
+// XChaCha20Poly1305 leaves much more room. The constructor fails with
+// ErrInvalidNonce if the prefix is as long as the nonce.
+func WithNoncePrefix(prefix []byte) Option {
+	prefix = append([]byte(nil), prefix...)
+	return func(k *chacha20poly1305) {
+		k.noncePrefix = prefix
+	}
+}
+
+// WithExpectedLength makes Open, and every other method that verifies a
+// ciphertext, reject ciphertexts whose plaintext is not exactly n bytes
+// long, for stores of fixed-size records. The length is checked before
+// the tag, and a mismatch fails with a *SizeError matching
+// ErrUnexpectedLength, so a record of the wrong size is reported as
+// such rather than as an authentication failure. Seal and VerifyMAC are
+// unaffected.
+func WithExpectedLength(n int) Option {
+	return func(k *chacha20poly1305) {
+		k.expectLength = true
+		k.expectedLength = n
+	}
+}
+
+// WithMaxPlaintext makes Open, and every other method that verifies a
+// ciphertext, reject ciphertexts holding more than n bytes of
+// plaintext with a *SizeError matching ErrMessageTooLong, before the tag
+// is checked or anything is allocated. Services opening blobs from
+// untrusted sources can use it to bound their memory use. Zero means no
+// limit, the default. VerifyMAC is unaffected.
+func WithMaxPlaintext(n int) Option {
+	return func(k *chacha20poly1305) {
+		k.maxPlaintext = n
+	}
+}
+
+// streamFunc creates the ChaCha20 keystream of a variant for a key held
+// in a LockedBuffer.
+type streamFunc func(key *memguard.LockedBuffer, nonce []byte) (cipher.Stream, error)
+
 type chacha20poly1305 struct {
-	ek *memguard.LockedBuffer
-	isXChaCha bool
+	ek keyAccess
+
+	// nonceSize and newStream are the parameters of variant. Seal and
+	// Open only go through them, so adding a variant only needs a new
+	// case in Variant.params.
+	variant   Variant
+	nonceSize int
+	newStream streamFunc
+
+	// tagSize is the length of the tag appended to ciphertexts. It is
+	// poly1305.TagSize except for NewTelemetry, which truncates it.
+	tagSize int
+
+	// owned is a key buffer created by the constructor, which Close
+	// destroys. closed is set by Close.
+	owned  *memguard.LockedBuffer
+	closed int32
+
+	// pool is set on the instances handed out by an AEADPool, which
+	// share the key check of the pool and own nothing.
+	pool *AEADPool
+
+	// unlocked is set by NewUnlockedForTesting. Scratch buffers are then
+	// taken from ordinary memory as well.
+	unlocked bool
+
+	// keyCheck guards keys held in a LockedBuffer against corruption.
+	keyCheck *keyCheck
+
+	freezeKey        bool
+	destroyAfterSeal bool
+	nonceObserver    NonceObserver
+	lockedScratch    bool
+	noncePrefix      []byte
+	metrics          Metrics
+
+	expectLength   bool
+	expectedLength int
+	maxPlaintext   int
 }
 
 // NewX returns a XChaCha20Poly1305 AEAD.
 // The key must be 256 bits long, 
 // and the nonce must be 192 bits long. 
-func NewX(key *memguard.LockedBuffer) (cipher.AEAD, error) {
-	if len(key.Buffer()) != KeySize {
-		return nil, ErrInvalidKey
-	}
-
-	k := new(chacha20poly1305)
-	k.ek = key
-	k.isXChaCha = true
-
-	return k, nil
+func NewX(key *memguard.LockedBuffer, opts ...Option) (cipher.AEAD, error) {
+	return NewAEAD(key, XChaCha20, opts...)
 }
 
 // New returns a ChaCha20Poly1305 AEAD.
 // The key must be 256 bits long, 
 // and the nonce must be 64 bits long. 
 // The nonce must be randomly generated or used only once. 
-func New(key *memguard.LockedBuffer) (cipher.AEAD, error) {
+func New(key *memguard.LockedBuffer, opts ...Option) (cipher.AEAD, error) {
+	return NewAEAD(key, ChaCha20, opts...)
+}
+
+func newAEAD(key *memguard.LockedBuffer, v Variant, opts []Option) (*chacha20poly1305, error) {
 	if len(key.Buffer()) != KeySize {
-		return nil, ErrInvalidKey
+		return nil, &SizeError{Field: "key", Want: KeySize, Got: len(key.Buffer()), Err: ErrInvalidKey}
+	}
+
+	k, err := build(lockedKey{key}, v, opts)
+	if err != nil {
+		return nil, err
+	}
+	if k.freezeKey {
+		if err := key.MakeImmutable(); err != nil {
+			return nil, err
+		}
+	}
+
+	k.keyCheck, err = newKeyCheck(key)
+	if err != nil && !degrade(err) {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+func build(ek keyAccess, v Variant, opts []Option) (*chacha20poly1305, error) {
+	nonceSize, newStream, err := v.params()
+	if err != nil {
+		return nil, err
 	}
 
 	k := new(chacha20poly1305)
-	k.ek = key
-	k.isXChaCha = false
+	k.ek = ek
+	k.variant = v
+	k.nonceSize = nonceSize
+	k.newStream = newStream
+	k.tagSize = poly1305.TagSize
+
+	for _, opt := range opts {
+		opt(k)
+	}
+
+	if len(k.noncePrefix) >= nonceSize {
+		return nil, fmt.Errorf("nonce prefix of %d bytes leaves no room in a %d byte nonce: %w",
+			len(k.noncePrefix), nonceSize, ErrInvalidNonce)
+	}
+	if k.expectLength && k.expectedLength < 0 {
+		return nil, fmt.Errorf("invalid expected length %d", k.expectedLength)
+	}
+	if k.maxPlaintext < 0 {
+		return nil, fmt.Errorf("invalid plaintext limit %d", k.maxPlaintext)
+	}
 
 	return k, nil
 }
 
+// NonceSize returns the size of the nonces passed to Seal and Open. With
+// WithNoncePrefix this is the variant's nonce size less the prefix.
 func (k *chacha20poly1305) NonceSize() int {
-	if k.isXChaCha {
-		return chacha20guard.XNonceSize
-	} else {
-		return chacha20guard.NonceSize
+	return k.nonceSize - len(k.noncePrefix)
+}
+
+// fullNonce prepends the nonce prefix, if any, to a nonce that has been
+// checked with checkNonce.
+func (k *chacha20poly1305) fullNonce(nonce []byte) []byte {
+	if len(k.noncePrefix) == 0 {
+		return nonce
 	}
-	
+
+	full := make([]byte, 0, k.nonceSize)
+	full = append(full, k.noncePrefix...)
+	return append(full, nonce...)
 }
 
-func (*chacha20poly1305) Overhead() int {
-	return poly1305.TagSize
+// Variant returns the construction the AEAD implements.
+func (k *chacha20poly1305) Variant() Variant {
+	return k.variant
 }
 
-func (k *chacha20poly1305) Seal(dst, nonce, plaintext, data []byte) []byte {
+// KeyIsFrozen reports whether the key is held in a LockedBuffer that is
+// immutable and not destroyed. A key that is later made mutable again
+// and modified would silently change the output of Seal and Open, so
+// callers can use this to assert that it cannot be. Keys that are not
+// held in a LockedBuffer are never reported as frozen.
+func (k *chacha20poly1305) KeyIsFrozen() bool {
+	lk, ok := k.ek.(lockedKey)
+	return ok && !lk.b.IsDestroyed() && !lk.b.IsMutable()
+}
+
+func (k *chacha20poly1305) Overhead() int {
+	return k.tagSize
+}
+
+// PlaintextLen returns the length of the plaintext sealed in ciphertext,
+// which is useful to size a destination buffer before calling Open. It
+// does not authenticate anything; the length is not secret.
+func (k *chacha20poly1305) PlaintextLen(ciphertext []byte) (int, error) {
+	if len(ciphertext) < k.Overhead() {
+		return 0, &SizeError{Field: "ciphertext", Want: k.Overhead(), Got: len(ciphertext), Err: ErrCiphertextTooShort}
+	}
+	return len(ciphertext) - k.Overhead(), nil
+}
+
+// checkNonce reports whether nonce has the size expected by the AEAD.
+// A missing nonce gets its own message since forgetting to set it is
+// far more common than passing one of the wrong size. Both cases are a
+// *NonceError, which matches ErrInvalidNonce with errors.Is.
+func (k *chacha20poly1305) checkNonce(nonce []byte) error {
 	if len(nonce) != k.NonceSize() {
-		panic(ErrInvalidNonce)
+		return &NonceError{Want: k.NonceSize(), Got: len(nonce)}
 	}
+	return nil
+}
 
-	var c cipher.Stream
-	var err error
-	if k.isXChaCha {
-		c, err = chacha20guard.NewX(k.ek, nonce)
-		if err != nil {
-			panic(err)
-		}
-	} else {
-		c, err = chacha20guard.New(k.ek, nonce)
-		if err != nil {
-			panic(err)
+// Seal never writes through plaintext, so a shared or read-only buffer
+// can be passed safely. The only exception is when the caller makes dst
+// overlap plaintext for in-place encryption, as cipher.AEAD allows.
+// Methods that modify plaintext, such as SealAndWipe, are separate and
+// say so.
+func (k *chacha20poly1305) Seal(dst, nonce, plaintext, data []byte) []byte {
+	out, err := k.seal(dst, nonce, plaintext, data)
+	if err != nil {
+		panic(err)
+	}
+
+	return out
+}
+
+// SealFromLockedBuffer seals the contents of a LockedBuffer. The
+// plaintext is read in place during encryption and never copied into
+// ordinary memory. If the AEAD was created with DestroyAfterSeal the
+// buffer is destroyed before returning, whether sealing succeeded or not.
+func (k *chacha20poly1305) SealFromLockedBuffer(dst, nonce []byte, plaintext *memguard.LockedBuffer, data []byte) ([]byte, error) {
+	if k.destroyAfterSeal {
+		defer plaintext.Destroy()
+	}
+	if plaintext.IsDestroyed() {
+		return nil, memguard.ErrDestroyed
+	}
+
+	return k.seal(dst, nonce, plaintext.Buffer(), data)
+}
+
+// SealWithLockedAAD seals plaintext with associated data held in a
+// LockedBuffer. The associated data is only read while the tag is
+// computed and is never copied out of locked memory. The result is the
+// same as sealing with data.Buffer() as a plain slice, so it can be
+// opened with either Open or OpenWithLockedAAD.
+func (k *chacha20poly1305) SealWithLockedAAD(dst, nonce, plaintext []byte, data *memguard.LockedBuffer) ([]byte, error) {
+	if data.IsDestroyed() {
+		return nil, memguard.ErrDestroyed
+	}
+
+	return k.seal(dst, nonce, plaintext, data.Buffer())
+}
+
+// SealAndWipe is like Seal but zeroes plaintext before returning, on
+// success and on every error path. When dst aliases plaintext for in
+// place encryption, only the bytes of plaintext that were not
+// overwritten by the output are wiped.
+func (k *chacha20poly1305) SealAndWipe(dst, nonce, plaintext, data []byte) ([]byte, error) {
+	out, err := k.seal(dst, nonce, plaintext, data)
+	if err != nil {
+		wipe(plaintext)
+		return nil, err
+	}
+
+	wipeOutside(plaintext, out)
+
+	return out, nil
+}
+
+// wipeOutside zeroes the bytes of b that do not share memory with keep.
+func wipeOutside(b, keep []byte) {
+	if len(b) == 0 {
+		return
+	}
+	if len(keep) == 0 {
+		wipe(b)
+		return
+	}
+
+	bStart := uintptr(unsafe.Pointer(&b[0]))
+	kStart := uintptr(unsafe.Pointer(&keep[0]))
+	kEnd := kStart + uintptr(len(keep))
+
+	for i := range b {
+		if p := bStart + uintptr(i); p < kStart || p >= kEnd {
+			b[i] = 0
 		}
 	}
+	runtime.KeepAlive(b)
+}
 
-	// Converts the given key and nonce into 64 bytes of ChaCha20 key stream, the
-	// first 32 of which are used as the Poly1305 key.
-	subkey := make([]byte, 64)
-	c.XORKeyStream(subkey, subkey)
+func (k *chacha20poly1305) seal(dst, nonce, plaintext, data []byte) ([]byte, error) {
+	if err := k.checkNonce(nonce); err != nil {
+		return nil, err
+	}
+	nonce = k.fullNonce(nonce)
+	if k.nonceObserver != nil {
+		k.nonceObserver(append([]byte(nil), nonce...))
+	}
+
+	c, err := k.stream(nonce)
+	if err != nil {
+		return nil, err
+	}
 
-	var poly1305Key [32]byte
-	for i := 0; i < 32; i++ {
-		poly1305Key[i] = subkey[i]
+	poly1305Key, release, err := k.macKey(c)
+	if err != nil {
+		return nil, err
 	}
+	defer release()
 
-	ciphertext := make([]byte, len(plaintext))
+	// The ciphertext and the tag are written straight into dst, so
+	// apart from the keystream the only allocation is growing dst.
+	ret, out := sliceForAppend(dst, len(plaintext)+k.Overhead())
+	ciphertext, digest := out[:len(plaintext)], out[len(plaintext):]
 	c.XORKeyStream(ciphertext, plaintext)
 
-	tag := tag(poly1305Key, ciphertext, data)
+	var t [poly1305.TagSize]byte
+	computeTag(&t, poly1305Key, ciphertext, data)
+	copy(digest, t[:])
+	k.countSeal(len(plaintext))
 
-	return append(dst, append(ciphertext, tag...)...)
+	return ret, nil
 }
 
 func (k *chacha20poly1305) Open(dst, nonce, ciphertext, data []byte) ([]byte, error) {
-	if len(nonce) != k.NonceSize() {
-		panic(ErrInvalidNonce)
+	if err := k.checkNonce(nonce); err != nil {
+		panic(err)
+	}
+
+	c, ciphertext, err := k.verify(nonce, ciphertext, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return k.decrypt(dst, c, ciphertext)
+}
+
+// decrypt appends the plaintext of an authenticated ciphertext to dst.
+func (k *chacha20poly1305) decrypt(dst []byte, c cipher.Stream, ciphertext []byte) ([]byte, error) {
+	if k.lockedScratch && len(ciphertext) > 0 {
+		return k.openViaScratch(dst, c, ciphertext)
+	}
+
+	// Decrypt straight into dst rather than through an intermediate
+	// slice that would be left behind unwiped.
+	ret, out := sliceForAppend(dst, len(ciphertext))
+	defer wipeOnPanic(out)
+	c.XORKeyStream(out, ciphertext)
+
+	return ret, nil
+}
+
+// SealTo seals plaintext into out, which must have a capacity of at
+// least len(plaintext)+Overhead(), and returns the length of the
+// ciphertext written to out[:n]. Unlike Seal it never allocates a
+// destination: a smaller buffer fails with a *SizeError matching
+// ErrShortBuffer, and an invalid nonce is returned as an error. out may
+// be plaintext[:0] for in-place encryption, but must not overlap it
+// otherwise.
+func (k *chacha20poly1305) SealTo(out, nonce, plaintext, data []byte) (n int, err error) {
+	need := len(plaintext) + k.Overhead()
+	if cap(out) < need {
+		return 0, &SizeError{Field: "output", Want: need, Got: cap(out), Err: ErrShortBuffer}
+	}
+
+	ret, err := k.seal(out[:0], nonce, plaintext, data)
+	if err != nil {
+		return 0, err
+	}
+	return len(ret), nil
+}
+
+// SealInPlace seals, in place, a message laid out in buf as its nonce
+// followed by its plaintext, for serializers that preallocate
+// [nonce][ciphertext+tag]. buf[:nonceLen] must hold the nonce and
+// buf[nonceLen:nonceLen+plaintextLen] the plaintext; the plaintext is
+// replaced by the ciphertext, the tag written after it, and the total
+// length nonceLen+plaintextLen+Overhead() returned. A buf too short for
+// the tag fails with a *SizeError matching ErrShortBuffer.
+func (k *chacha20poly1305) SealInPlace(buf []byte, nonceLen, plaintextLen int, data []byte) (int, error) {
+	if nonceLen < 0 || plaintextLen < 0 {
+		return 0, fmt.Errorf("invalid lengths %d and %d", nonceLen, plaintextLen)
+	}
+	need := nonceLen + plaintextLen + k.Overhead()
+	if need > len(buf) {
+		return 0, &SizeError{Field: "buffer", Want: need, Got: len(buf), Err: ErrShortBuffer}
+	}
+
+	plaintext := buf[nonceLen : nonceLen+plaintextLen]
+	if _, err := k.seal(plaintext[:0], buf[:nonceLen], plaintext, data); err != nil {
+		return 0, err
+	}
+	return need, nil
+}
+
+// OpenTo is the counterpart of SealTo: it opens ciphertext into out,
+// which must have a capacity of at least len(ciphertext)-Overhead(), and
+// returns the length of the plaintext written to out[:n]. The tag is
+// checked before out is touched.
+func (k *chacha20poly1305) OpenTo(out, nonce, ciphertext, data []byte) (n int, err error) {
+	if need := len(ciphertext) - k.Overhead(); need > cap(out) {
+		return 0, &SizeError{Field: "output", Want: need, Got: cap(out), Err: ErrShortBuffer}
+	}
+
+	c, ciphertext, err := k.verify(nonce, ciphertext, data)
+	if err != nil {
+		return 0, err
+	}
+	ret, err := k.decrypt(out[:0], c, ciphertext)
+	if err != nil {
+		return 0, err
+	}
+	return len(ret), nil
+}
+
+// SealDetached is like Seal but returns the tag apart from the
+// ciphertext, as libsodium's detached functions do. The ciphertext is
+// appended to dst and the tag is a new slice of Overhead() bytes.
+// Appending the tag to the ciphertext gives exactly the output of Seal.
+func (k *chacha20poly1305) SealDetached(dst, nonce, plaintext, data []byte) (ciphertext, tag []byte) {
+	out := k.Seal(dst, nonce, plaintext, data)
+	n := len(out) - k.Overhead()
+
+	tag = append([]byte(nil), out[n:]...)
+	return out[:n:n], tag
+}
+
+// SealFramed is Seal for protocols that frame the ciphertext and the tag
+// separately. It returns the output of Seal together with the index in
+// out at which the tag starts, so that out[len(dst):tagOffset] is the
+// ciphertext and out[tagOffset:] the tag.
+func (k *chacha20poly1305) SealFramed(dst, nonce, plaintext, data []byte) (out []byte, tagOffset int) {
+	out = k.Seal(dst, nonce, plaintext, data)
+	return out, len(out) - k.Overhead()
+}
+
+// OpenDetached opens a ciphertext and tag returned by SealDetached, with
+// the same checks as Open on the ciphertext with the tag appended. A tag
+// of the wrong length fails with an *AuthError. Unlike Open it returns
+// an invalid nonce as an error.
+func (k *chacha20poly1305) OpenDetached(dst, nonce, ciphertext, tag, data []byte) ([]byte, error) {
+	if err := k.checkNonce(nonce); err != nil {
+		return nil, err
+	}
+	if len(tag) != k.tagSize {
+		k.countOpen(len(ciphertext)+len(tag), nil, false)
+		return nil, &AuthError{Err: &SizeError{Field: "tag", Want: k.tagSize, Got: len(tag)}}
+	}
+
+	c, ciphertext, err := k.verifyDetached(nonce, ciphertext, tag, data, nil)
+	if err != nil {
+		return nil, err
+	}
+	return k.decrypt(dst, c, ciphertext)
+}
+
+// openViaScratch decrypts ciphertext into a scratch buffer and appends
+// the result to dst. It is used by Open when WithLockedScratch is set.
+func (k *chacha20poly1305) openViaScratch(dst []byte, c cipher.Stream, ciphertext []byte) ([]byte, error) {
+	buf, release, err := k.scratch(len(ciphertext))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	c.XORKeyStream(buf, ciphertext)
+
+	ret, out := sliceForAppend(dst, len(ciphertext))
+	copy(out, buf)
+
+	return ret, nil
+}
+
+// OpenToLockedBuffer authenticates ciphertext and decrypts it straight
+// into a new mutable LockedBuffer, which the caller must destroy. The
+// buffer is only allocated once the tag has been verified, so no
+// unauthenticated plaintext is ever produced. memguard cannot allocate
+// empty buffers, so an empty plaintext results in
+// memguard.ErrInvalidLength.
+func (k *chacha20poly1305) OpenToLockedBuffer(nonce, ciphertext, data []byte) (*memguard.LockedBuffer, error) {
+	c, ciphertext, err := k.verify(nonce, ciphertext, data)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := newMutable(len(ciphertext))
+	if err != nil {
+		return nil, err
+	}
+	defer destroyOnPanic(b)
+	c.XORKeyStream(b.Buffer(), ciphertext)
+
+	return b, nil
+}
+
+// OpenWith authenticates and decrypts ciphertext into a locked buffer,
+// calls fn with its contents and destroys the buffer when fn returns,
+// including when fn panics. The plaintext slice is only valid during
+// the call: fn must not retain it or anything sliced from it. It
+// returns the error from fn, or the error that prevented fn from being
+// called. An empty plaintext is passed to fn as nil.
+func (k *chacha20poly1305) OpenWith(nonce, ciphertext, data []byte, fn func(plaintext []byte) error) error {
+	c, ciphertext, err := k.verify(nonce, ciphertext, data)
+	if err != nil {
+		return err
+	}
+	if len(ciphertext) == 0 {
+		return fn(nil)
+	}
+
+	b, err := scratchUsage.track(newMutable(len(ciphertext)))
+	if err != nil {
+		return err
+	}
+	defer scratchUsage.destroy(b)
+	c.XORKeyStream(b.Buffer(), ciphertext)
+
+	return fn(b.Buffer())
+}
+
+// OpenWithLockedAAD opens ciphertext with associated data held in a
+// LockedBuffer, reading it in place like SealWithLockedAAD. Unlike Open
+// it returns an invalid nonce as an error.
+func (k *chacha20poly1305) OpenWithLockedAAD(dst, nonce, ciphertext []byte, data *memguard.LockedBuffer) ([]byte, error) {
+	if data.IsDestroyed() {
+		return nil, memguard.ErrDestroyed
+	}
+
+	c, ciphertext, err := k.verify(nonce, ciphertext, data.Buffer())
+	if err != nil {
+		return nil, err
+	}
+
+	return k.decrypt(dst, c, ciphertext)
+}
+
+// verify checks the tag of ciphertext. On success it returns the
+// keystream positioned at the start of the message and the ciphertext
+// without its tag.
+func (k *chacha20poly1305) verify(nonce, ciphertext, data []byte) (cipher.Stream, []byte, error) {
+	return k.verifyKeyID(nonce, ciphertext, data, nil)
+}
+
+// verifyKeyID is verify for a message known to be sealed under keyID,
+// which is passed on to the auth failure handler.
+func (k *chacha20poly1305) verifyKeyID(nonce, ciphertext, data, keyID []byte) (cipher.Stream, []byte, error) {
+	if err := k.checkNonce(nonce); err != nil {
+		return nil, nil, err
+	}
+	if len(ciphertext) < k.Overhead() {
+		k.countOpen(len(ciphertext), keyID, false)
+		return nil, nil, &AuthError{Err: &SizeError{Field: "ciphertext", Want: k.Overhead(), Got: len(ciphertext), Err: ErrCiphertextTooShort}}
 	}
 
 	digest := ciphertext[len(ciphertext)-k.Overhead():]
 	ciphertext = ciphertext[0 : len(ciphertext)-k.Overhead()]
 
-	var c cipher.Stream
-	var err error
-	if k.isXChaCha {
-		c, err = chacha20guard.NewX(k.ek, nonce)
-		if err != nil {
-			panic(err)
-		}
-	} else {
-		c, err = chacha20guard.New(k.ek, nonce)
-		if err != nil {
-			panic(err)
+	return k.verifyDetached(nonce, ciphertext, digest, data, keyID)
+}
+
+// verifyDetached is verifyKeyID for a ciphertext whose tag, digest, is
+// held separately. The caller has checked the nonce and the length of
+// digest.
+func (k *chacha20poly1305) verifyDetached(nonce, ciphertext, digest, data, keyID []byte) (cipher.Stream, []byte, error) {
+	if k.expectLength && len(ciphertext) != k.expectedLength {
+		k.countOpen(len(ciphertext)+len(digest), keyID, false)
+		return nil, nil, &SizeError{Field: "plaintext", Want: k.expectedLength, Got: len(ciphertext), Err: ErrUnexpectedLength}
+	}
+	if k.maxPlaintext > 0 && len(ciphertext) > k.maxPlaintext {
+		k.countOpen(len(ciphertext)+len(digest), keyID, false)
+		return nil, nil, &SizeError{Field: "plaintext", Want: k.maxPlaintext, Got: len(ciphertext), Err: ErrMessageTooLong}
+	}
+	return k.verifyTag(nonce, ciphertext, digest, data, keyID)
+}
+
+// verifyTag is verifyDetached without the plaintext length checks of
+// WithExpectedLength and WithMaxPlaintext, which do not apply to MAC
+// tags.
+func (k *chacha20poly1305) verifyTag(nonce, ciphertext, digest, data, keyID []byte) (cipher.Stream, []byte, error) {
+	nonce = k.fullNonce(nonce)
+
+	c, err := k.stream(nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	poly1305Key, release, err := k.macKey(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+
+	var t [poly1305.TagSize]byte
+	computeTag(&t, poly1305Key, ciphertext, data)
+
+	if subtle.ConstantTimeCompare(t[:k.tagSize], digest) != 1 {
+		k.countOpen(len(ciphertext)+len(digest), keyID, false)
+		return nil, nil, authFailure(poly1305Key, ciphertext, data, digest)
+	}
+	k.countOpen(len(ciphertext)+len(digest), keyID, true)
+
+	return c, ciphertext, nil
+}
+
+// IsAuthentic reports whether ciphertext and data carry a valid tag for
+// nonce, that is whether Open would succeed. Nothing is decrypted, and
+// any error, including an invalid nonce, is reported as false.
+func (k *chacha20poly1305) IsAuthentic(nonce, ciphertext, data []byte) bool {
+	return k.Verify(nonce, ciphertext, data) == nil
+}
+
+// Verify checks the tag of ciphertext and data in constant time and
+// returns the error Open would return, without decrypting anything, so
+// it is cheaper than Open for callers that never need the plaintext.
+// Unlike Open it returns an invalid nonce as an error.
+func (k *chacha20poly1305) Verify(nonce, ciphertext, data []byte) error {
+	_, _, err := k.verify(nonce, ciphertext, data)
+	return err
+}
+
+// OpenValidateOnly is Verify for validation pipelines that need to know
+// how long the plaintext is but never what it is: on success it returns
+// the plaintext length, and no keystream is applied to the ciphertext.
+func (k *chacha20poly1305) OpenValidateOnly(nonce, ciphertext, data []byte) (plaintextLen int, err error) {
+	_, ciphertext, err = k.verify(nonce, ciphertext, data)
+	if err != nil {
+		return 0, err
+	}
+	return len(ciphertext), nil
+}
+
+// Authenticated is a ciphertext whose tag has been verified by
+// Authenticate, together with the keystream to decrypt it.
+type Authenticated struct {
+	c          cipher.Stream
+	ciphertext []byte
+}
+
+// Authenticate is the first half of Open: it verifies ciphertext and
+// data and, if they are authentic, returns a token whose Decrypt method
+// is the second half. The token keeps the keystream positioned at the
+// start of the message, so decrypting does not derive the Poly1305 key
+// again. This suits callers that authenticate many ciphertexts and only
+// decrypt some of them.
+//
+// The token refers to ciphertext rather than copying it, so ciphertext
+// must not be modified until Decrypt has been called; otherwise Decrypt
+// returns plaintext that was never authenticated. Unlike Open it
+// returns an invalid nonce as an error.
+func (k *chacha20poly1305) Authenticate(nonce, ciphertext, data []byte) (*Authenticated, error) {
+	c, ciphertext, err := k.verify(nonce, ciphertext, data)
+	if err != nil {
+		return nil, err
+	}
+	return &Authenticated{c: c, ciphertext: ciphertext}, nil
+}
+
+// Decrypt appends the plaintext to dst and returns the updated slice,
+// like Open. The keystream is consumed, so Decrypt panics if called a
+// second time.
+func (a *Authenticated) Decrypt(dst []byte) []byte {
+	if a.c == nil {
+		panic("chacha20poly1305guard: Authenticated.Decrypt called twice")
+	}
+	c := a.c
+	a.c = nil
+
+	ret, out := sliceForAppend(dst, len(a.ciphertext))
+	defer wipeOnPanic(out)
+	c.XORKeyStream(out, a.ciphertext)
+	a.ciphertext = nil
+
+	return ret
+}
+
+// MAC authenticates data without encrypting anything. The result is the
+// tag Seal would append to an empty plaintext, so the same nonce rules
+// apply: never reuse a nonce between MAC and Seal calls under one key.
+func (k *chacha20poly1305) MAC(nonce, data []byte) ([]byte, error) {
+	return k.seal(nil, nonce, nil, data)
+}
+
+// VerifyMAC checks in constant time that tag was returned by MAC for
+// nonce and data, and returns ErrAuthFailed if it was not.
+func (k *chacha20poly1305) VerifyMAC(nonce, data, tag []byte) error {
+	if len(tag) != k.tagSize {
+		return &AuthError{Err: &SizeError{Field: "tag", Want: k.tagSize, Got: len(tag)}}
+	}
+	if err := k.checkNonce(nonce); err != nil {
+		return err
+	}
+	_, _, err := k.verifyTag(nonce, nil, tag, data, nil)
+	return err
+}
+
+// stream returns the keystream for nonce, after making sure the key has
+// not been corrupted. A destroyed key, or a closed AEAD, results in
+// ErrKeyDestroyed.
+func (k *chacha20poly1305) stream(nonce []byte) (cipher.Stream, error) {
+	c, err := k.keyStream(nonce)
+	if errors.Is(err, memguard.ErrDestroyed) {
+		atomic.AddInt64(&opCounters.keyDestroyed, 1)
+		return nil, ErrKeyDestroyed
+	}
+	return c, err
+}
+
+func (k *chacha20poly1305) keyStream(nonce []byte) (cipher.Stream, error) {
+	if atomic.LoadInt32(&k.closed) != 0 {
+		return nil, memguard.ErrDestroyed
+	}
+	if k.keyCheck != nil {
+		if err := k.keyCheck.verify(); err != nil {
+			return nil, err
 		}
 	}
+	return k.ek.stream(k.newStream, nonce)
+}
+
+// Close destroys the key buffers the AEAD owns: the derived key of
+// NewWithContext, the copy made by NewFromArray, and the reference copy
+// kept to detect corruption. A key passed in by the caller is left for
+// the caller to destroy. Afterwards every operation fails with
+// ErrKeyDestroyed, which Seal raises as a panic. Close must not be
+// called while other methods are running; calling it twice is harmless.
+func (k *chacha20poly1305) Close() error {
+	if !atomic.CompareAndSwapInt32(&k.closed, 0, 1) || k.pool != nil {
+		return nil
+	}
+	if k.owned != nil {
+		keyUsage.destroy(k.owned)
+	}
+	if k.keyCheck != nil {
+		keyUsage.destroy(k.keyCheck.ref)
+	}
+	return nil
+}
 
-	// Converts the given key and nonce into 64 bytes of ChaCha20 key stream, the
-	// first 32 of which are used as the Poly1305 key.
-	subkey := make([]byte, 64)
+// macKey converts the given key and nonce into 64 bytes of ChaCha20 key
+// stream, the first 32 of which are used as the Poly1305 key. The block
+// is kept in locked scratch memory, so the one-time key never sits in
+// ordinary memory; release wipes it and must be called once the tag has
+// been computed. An all-zero key is rejected with ErrWeakMACKey.
+func (k *chacha20poly1305) macKey(c cipher.Stream) (key *[32]byte, release func(), err error) {
+	subkey, release, err := k.scratch(64)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer releaseOnPanic(release)
 	c.XORKeyStream(subkey, subkey)
 
-	var poly1305Key [32]byte
-	for i := 0; i < 32; i++ {
-		poly1305Key[i] = subkey[i]
+	var acc byte
+	for _, b := range subkey[:32] {
+		acc |= b
+	}
+	if acc == 0 {
+		release()
+		return nil, nil, ErrWeakMACKey
 	}
 
-	tag := tag(poly1305Key, ciphertext, data)
+	return (*[32]byte)(subkey[:32]), release, nil
+}
+
+// computeTag computes the Poly1305 tag of data || len(data) || ciphertext ||
+// len(ciphertext). The input is fed to the MAC incrementally rather than
+// assembled in one buffer, so neither the associated data nor the
+// ciphertext is ever copied. The MAC buffers at most one partial block;
+// its state, which also holds the one-time key, is zeroed afterwards,
+// even if the caller recovers from a panic in between.
+func computeTag(out *[poly1305.TagSize]byte, key *[32]byte, ciphertext, data []byte) {
+	var n [8]byte
+	h := poly1305.New(key)
+	defer clearMAC(h)
+
+	h.Write(data)
+	binary.LittleEndian.PutUint64(n[:], uint64(len(data)))
+	h.Write(n[:])
 
-	if subtle.ConstantTimeCompare(tag, digest) != 1 {
-		return nil, ErrAuthFailed
+	h.Write(ciphertext)
+	binary.LittleEndian.PutUint64(n[:], uint64(len(ciphertext)))
+	h.Write(n[:])
+
+	h.Sum(out[:0])
+}
+
+// clearMAC zeroes the state of a Poly1305 MAC.
+func clearMAC(h *poly1305.MAC) {
+	*h = poly1305.MAC{}
+	runtime.KeepAlive(h)
+}
+
+// VerifyWithKey checks tag against ciphertext and aad using a Poly1305
+// key derived elsewhere, for instance by a ChaCha20 implementation
+// outside this package. The MAC input has the same layout as Seal uses.
+// It returns ErrAuthFailed if the tag does not match.
+func VerifyWithKey(poly1305Key *memguard.LockedBuffer, ciphertext, aad, tag []byte) error {
+	key, err := oneTimeKey(poly1305Key)
+	if err != nil {
+		return err
+	}
+	if len(tag) != poly1305.TagSize {
+		return &AuthError{Err: &SizeError{Field: "tag", Want: poly1305.TagSize, Got: len(tag)}}
 	}
 
-	plaintext := make([]byte, len(ciphertext))
-	c.XORKeyStream(plaintext, ciphertext)
+	var t [poly1305.TagSize]byte
+	computeTag(&t, key, ciphertext, aad)
 
-	return append(dst, plaintext...), nil
+	if subtle.ConstantTimeCompare(t[:], tag) != 1 {
+		return &AuthError{}
+	}
+	return nil
+}
+
+// sliceForAppend extends in by n bytes, reallocating only if its
+// capacity is too small. It returns the whole slice and the new tail.
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return
 }
 
-func tag(key [32]byte, ciphertext, data []byte) []byte {
-	m := make([]byte, len(ciphertext)+len(data)+8+8)
-	copy(m[0:], data)
-	binary.LittleEndian.PutUint64(m[len(data):], uint64(len(data)))
+// splitNonce assembles the XChaCha20 nonce used by SealXSplit and
+// OpenXSplit. The first 16 bytes go through HChaCha20 and the counter
+// makes up the remaining 8.
+func splitNonce(streamID [16]byte, counter uint64) []byte {
+	nonce := make([]byte, XNonceSize)
+	copy(nonce, streamID[:])
+	setSplitCounter(nonce, counter)
+	return nonce
+}
 
-	copy(m[len(data)+8:], ciphertext)
-	binary.LittleEndian.PutUint64(m[len(data)+8+len(ciphertext):],
-		uint64(len(ciphertext)))
+// setSplitCounter replaces the counter of a nonce from splitNonce, so
+// that sequential messages can reuse one nonce buffer.
+func setSplitCounter(nonce []byte, counter uint64) {
+	binary.LittleEndian.PutUint64(nonce[16:], counter)
+}
 
-	var out [poly1305.TagSize]byte
-	poly1305.Sum(&out, m, &key)
+// SealXSplit seals plaintext under the nonce streamID || counter, which
+// suits sequenced messages sharing a fixed stream identifier. Like Seal
+// it panics with ErrInvalidNonce if the AEAD is not XChaCha20Poly1305.
+func (k *chacha20poly1305) SealXSplit(dst []byte, streamID [16]byte, counter uint64, plaintext, data []byte) []byte {
+	return k.Seal(dst, splitNonce(streamID, counter), plaintext, data)
+}
 
-	return out[0:]
+// OpenXSplit opens a ciphertext sealed with SealXSplit.
+func (k *chacha20poly1305) OpenXSplit(dst []byte, streamID [16]byte, counter uint64, ciphertext, data []byte) ([]byte, error) {
+	return k.Open(dst, splitNonce(streamID, counter), ciphertext, data)
 }
\ No newline at end of file
@@ -0,0 +1,1629 @@
+package chacha20poly1305guard
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/awnumar/memguard"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/poly1305"
+)
+
+// variants lists every construction of the package, for table tests.
+var variants = []Variant{ChaCha20, XChaCha20}
+
+// testKey returns an immutable key holding the bytes 0 to 31. It is
+// destroyed when the test ends.
+func testKey(tb testing.TB) *memguard.LockedBuffer {
+	tb.Helper()
+	b := make([]byte, KeySize)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	key, err := memguard.NewImmutableFromBytes(b)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(key.Destroy)
+	return key
+}
+
+// lockedBytes returns a mutable LockedBuffer holding a copy of b,
+// destroyed when the test ends.
+func lockedBytes(tb testing.TB, b []byte) *memguard.LockedBuffer {
+	tb.Helper()
+	buf, err := memguard.NewMutableFromBytes(append([]byte(nil), b...))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(buf.Destroy)
+	return buf
+}
+
+// testAEAD returns an AEAD of variant v under testKey, closed when the
+// test ends.
+func testAEAD(tb testing.TB, v Variant, opts ...Option) AEAD {
+	tb.Helper()
+	aead, err := NewAEAD(testKey(tb), v, opts...)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	k := aead.(AEAD)
+	tb.Cleanup(func() { k.Close() })
+	return k
+}
+
+func TestInvalidNonce(t *testing.T) {
+	for _, v := range variants {
+		aead := testAEAD(t, v)
+		want := aead.NonceSize()
+
+		tests := []struct {
+			name  string
+			nonce []byte
+			msg   string
+		}{
+			{"nil", nil, "nonce is empty"},
+			{"empty", []byte{}, "nonce is empty"},
+			{"short", make([]byte, want-1), "nonce is " + strconv.Itoa(want-1) + " bytes"},
+			{"long", make([]byte, want+1), "nonce is " + strconv.Itoa(want+1) + " bytes"},
+		}
+		for _, tt := range tests {
+			t.Run(v.String()+"/"+tt.name, func(t *testing.T) {
+				check := func(op string, err error) {
+					t.Helper()
+					if !errors.Is(err, ErrInvalidNonce) {
+						t.Fatalf("%s: got %v, want ErrInvalidNonce", op, err)
+					}
+					var ne *NonceError
+					if !errors.As(err, &ne) || ne.Want != want || ne.Got != len(tt.nonce) {
+						t.Fatalf("%s: got %#v", op, err)
+					}
+					if !strings.HasPrefix(err.Error(), tt.msg) {
+						t.Fatalf("%s: message %q does not start with %q", op, err, tt.msg)
+					}
+				}
+
+				_, err := aead.SealAndWipe(nil, tt.nonce, []byte("plaintext"), nil)
+				check("SealAndWipe", err)
+				check("Verify", aead.Verify(tt.nonce, make([]byte, TagSize), nil))
+
+				// Like cipher.AEAD, Seal and Open panic on a bad nonce.
+				check("Seal", panicErr(func() {
+					aead.Seal(nil, tt.nonce, []byte("plaintext"), nil)
+				}))
+				check("Open", panicErr(func() {
+					aead.Open(nil, tt.nonce, make([]byte, TagSize), nil)
+				}))
+			})
+		}
+	}
+}
+
+// panicErr calls fn and returns the error it panics with, if any.
+func panicErr(fn func()) (err error) {
+	defer func() {
+		err, _ = recover().(error)
+	}()
+	fn()
+	return nil
+}
+
+// referenceSeal seals plaintext under testKey the straightforward way,
+// as the package did before the variant refactoring and before Seal
+// wrote into dst directly: the whole keystream is generated from
+// x/crypto, the first 32 bytes key Poly1305, and the MAC input is
+// assembled in one buffer. The variant is picked by the nonce size;
+// ChaCha20 nonces are the last 8 bytes of an IETF nonce, which gives
+// the same keystream for messages under 256 GiB.
+func referenceSeal(tb testing.TB, nonce, plaintext, data []byte) []byte {
+	tb.Helper()
+	if len(nonce) == NonceSize {
+		nonce = append(make([]byte, 4), nonce...)
+	}
+	c, err := chacha20.NewUnauthenticatedCipher(testKey(tb).Buffer(), nonce)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	var block [64]byte
+	c.XORKeyStream(block[:], block[:])
+	var key [32]byte
+	copy(key[:], block[:])
+
+	ciphertext := make([]byte, len(plaintext))
+	c.XORKeyStream(ciphertext, plaintext)
+
+	m := make([]byte, len(data)+8+len(ciphertext)+8)
+	copy(m, data)
+	binary.LittleEndian.PutUint64(m[len(data):], uint64(len(data)))
+	copy(m[len(data)+8:], ciphertext)
+	binary.LittleEndian.PutUint64(m[len(m)-8:], uint64(len(ciphertext)))
+	var tag [poly1305.TagSize]byte
+	poly1305.Sum(&tag, m, &key)
+
+	return append(ciphertext, tag[:]...)
+}
+
+// TestVariants checks that New and NewX still produce the construction
+// of the original implementation now that the variant is described by
+// its nonce size and stream constructor.
+func TestVariants(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		newAEAD   func(*memguard.LockedBuffer, ...Option) (cipher.AEAD, error)
+		nonceSize int
+	}{
+		{"New", New, NonceSize},
+		{"NewX", NewX, XNonceSize},
+	} {
+		aead, err := tc.newAEAD(testKey(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if aead.NonceSize() != tc.nonceSize || aead.Overhead() != TagSize {
+			t.Fatalf("%s: NonceSize = %d, Overhead = %d", tc.name, aead.NonceSize(), aead.Overhead())
+		}
+
+		nonce := make([]byte, tc.nonceSize)
+		for _, n := range []int{0, 1, 63, 64, 65, 1000} {
+			nonce[0] = byte(n)
+			plaintext := bytes.Repeat([]byte{byte(n)}, n)
+			want := referenceSeal(t, nonce, plaintext, []byte("aad"))
+
+			if got := aead.Seal(nil, nonce, plaintext, []byte("aad")); !bytes.Equal(got, want) {
+				t.Fatalf("%s, %d bytes: Seal differs from the original construction", tc.name, n)
+			}
+			if got, err := aead.Open(nil, nonce, want, []byte("aad")); err != nil || !bytes.Equal(got, plaintext) {
+				t.Fatalf("%s, %d bytes: Open: %v", tc.name, n, err)
+			}
+		}
+
+		other := make([]byte, NonceSize+XNonceSize-tc.nonceSize)
+		if err := panicErr(func() { aead.Seal(nil, other, nil, nil) }); !errors.Is(err, ErrInvalidNonce) {
+			t.Fatalf("%s: nonce of the other variant: got %v, want ErrInvalidNonce", tc.name, err)
+		}
+	}
+}
+
+func TestSealXSplit(t *testing.T) {
+	aead, err := NewX(testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := aead.(AEAD)
+
+	var streamID [16]byte
+	copy(streamID[:], "stream identifier")
+	nonce := append(streamID[:], 0x2a, 0x01, 0, 0, 0, 0, 0, 0)
+	want := aead.Seal(nil, nonce, []byte("plaintext"), []byte("aad"))
+
+	sealed := k.SealXSplit(nil, streamID, 0x12a, []byte("plaintext"), []byte("aad"))
+	if !bytes.Equal(sealed, want) {
+		t.Fatal("SealXSplit differs from Seal with the 24 byte nonce built by hand")
+	}
+	if got, err := k.OpenXSplit(nil, streamID, 0x12a, sealed, []byte("aad")); err != nil || string(got) != "plaintext" {
+		t.Fatalf("OpenXSplit = %q, %v", got, err)
+	}
+	if _, err := k.OpenXSplit(nil, streamID, 0x12b, sealed, []byte("aad")); err == nil {
+		t.Fatal("OpenXSplit accepted the wrong counter")
+	}
+
+	seen := make(map[string]bool)
+	for counter := uint64(0); counter < 100; counter++ {
+		c := string(k.SealXSplit(nil, streamID, counter, []byte("plaintext"), nil))
+		if seen[c] {
+			t.Fatalf("counter %d repeats a ciphertext", counter)
+		}
+		seen[c] = true
+	}
+
+	short, err := New(testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := panicErr(func() { short.(AEAD).SealXSplit(nil, streamID, 0, nil, nil) }); !errors.Is(err, ErrInvalidNonce) {
+		t.Fatalf("SealXSplit on ChaCha20Poly1305: got %v, want ErrInvalidNonce", err)
+	}
+}
+
+func TestOpenToLockedBuffer(t *testing.T) {
+	aead, err := NewX(testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := aead.(AEAD)
+	nonce := make([]byte, XNonceSize)
+	plaintext := bytes.Repeat([]byte("secret"), 1<<16)
+	sealed := aead.Seal(nil, nonce, plaintext, nil)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	b, err := k.OpenToLockedBuffer(nonce, sealed, nil)
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Destroy()
+	if !bytes.Equal(b.Buffer(), plaintext) {
+		t.Fatal("LockedBuffer does not hold the plaintext")
+	}
+	// The plaintext is decrypted straight into locked memory, which is
+	// not on the Go heap.
+	if heap := after.TotalAlloc - before.TotalAlloc; heap >= uint64(len(plaintext)) {
+		t.Fatalf("OpenToLockedBuffer allocated %d bytes on the heap for %d bytes of plaintext", heap, len(plaintext))
+	}
+
+	sealed[0] ^= 1
+	if b, err := k.OpenToLockedBuffer(nonce, sealed, nil); b != nil || !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("tampered ciphertext: got %v, %v, want ErrAuthFailed", b, err)
+	}
+}
+
+func TestSealFromLockedBuffer(t *testing.T) {
+	nonce := make([]byte, XNonceSize)
+	for _, destroy := range []bool{false, true} {
+		var opts []Option
+		if destroy {
+			opts = append(opts, DestroyAfterSeal())
+		}
+		aead, err := NewX(testKey(t), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k := aead.(AEAD)
+
+		plaintext := lockedBytes(t, []byte("guarded plaintext"))
+		want := aead.Seal(nil, nonce, plaintext.Buffer(), []byte("aad"))
+
+		sealed, err := k.SealFromLockedBuffer(nil, nonce, plaintext, []byte("aad"))
+		if err != nil || !bytes.Equal(sealed, want) {
+			t.Fatalf("DestroyAfterSeal %v: SealFromLockedBuffer = %x, %v, want %x", destroy, sealed, err, want)
+		}
+		if plaintext.IsDestroyed() != destroy {
+			t.Fatalf("DestroyAfterSeal %v: plaintext destroyed = %v", destroy, plaintext.IsDestroyed())
+		}
+
+		opened, err := k.OpenToLockedBuffer(nonce, sealed, []byte("aad"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(opened.Buffer()) != "guarded plaintext" {
+			t.Fatalf("round trip through locked buffers gave %q", opened.Buffer())
+		}
+		opened.Destroy()
+
+		plaintext.Destroy()
+		if _, err := k.SealFromLockedBuffer(nil, nonce, plaintext, nil); !errors.Is(err, memguard.ErrDestroyed) {
+			t.Fatalf("destroyed plaintext: got %v, want memguard.ErrDestroyed", err)
+		}
+	}
+}
+
+func TestSealMatchesReference(t *testing.T) {
+	for _, v := range variants {
+		aead := testAEAD(t, v)
+		nonce := make([]byte, aead.NonceSize())
+		for n := 0; n <= 64; n++ {
+			nonce[len(nonce)-1] = byte(n)
+			plaintext := bytes.Repeat([]byte{byte(n)}, n)
+			data := bytes.Repeat([]byte{0xad}, 64-n)
+
+			want := referenceSeal(t, nonce, plaintext, data)
+			prefix := []byte("prefix")
+			got := aead.Seal(prefix, nonce, plaintext, data)
+			if !bytes.HasPrefix(got, prefix) || !bytes.Equal(got[len(prefix):], want) {
+				t.Fatalf("%v, %d bytes: Seal differs from the reference", v, n)
+			}
+			if out, err := aead.Open(nil, nonce, want, data); err != nil || !bytes.Equal(out, plaintext) {
+				t.Fatalf("%v, %d bytes: Open: %v", v, n, err)
+			}
+		}
+	}
+}
+
+// TestSealAllocs checks that sealing a short message into a dst with
+// room for it allocates nothing for the message itself. What remains is
+// the keystream, which chacha20guard returns as a cipher.Stream on the
+// heap, and the release of the locked MAC key buffer, so the count must
+// not depend on the size of the message.
+func TestSealAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocation counts are not meaningful under the race detector")
+	}
+	for _, v := range variants {
+		aead := testAEAD(t, v)
+		nonce := make([]byte, aead.NonceSize())
+		dst := make([]byte, 0, 64+TagSize)
+		msg := make([]byte, 64)
+
+		base := minAllocs(func() {
+			aead.Seal(dst[:0], nonce, nil, nil)
+		})
+		if base > 2 {
+			t.Errorf("%v: sealing an empty message allocates %v times, want at most 2", v, base)
+		}
+		for n := 1; n <= 64; n++ {
+			allocs := minAllocs(func() {
+				aead.Seal(dst[:0], nonce, msg[:n], msg[:n])
+			})
+			if allocs != base {
+				t.Fatalf("%v: sealing %d bytes allocates %v times, want %v", v, n, allocs, base)
+			}
+		}
+	}
+}
+
+// minAllocs returns the lowest of a few AllocsPerRun measurements of f.
+// AllocsPerRun counts the allocations of the whole process, so goroutines
+// left behind by other tests can inflate a single measurement.
+func minAllocs(f func()) float64 {
+	n := testing.AllocsPerRun(100, f)
+	for i := 0; i < 4; i++ {
+		n = math.Min(n, testing.AllocsPerRun(100, f))
+	}
+	return n
+}
+
+func BenchmarkSealSmall(b *testing.B) {
+	for _, n := range []int{16, 32, 64} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			aead := testAEAD(b, XChaCha20)
+			nonce := make([]byte, aead.NonceSize())
+			dst := make([]byte, 0, n+TagSize)
+			msg := make([]byte, n)
+
+			b.ReportAllocs()
+			b.SetBytes(int64(n))
+			for i := 0; i < b.N; i++ {
+				aead.Seal(dst[:0], nonce, msg, nil)
+			}
+		})
+	}
+}
+
+func TestSealAndWipe(t *testing.T) {
+	aead, err := NewX(testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := aead.(AEAD)
+	nonce := make([]byte, XNonceSize)
+	want := aead.Seal(nil, nonce, []byte("credential"), nil)
+
+	isZero := func(b []byte) bool {
+		for _, c := range b {
+			if c != 0 {
+				return false
+			}
+		}
+		return true
+	}
+
+	plaintext := []byte("credential")
+	sealed, err := k.SealAndWipe(nil, nonce, plaintext, nil)
+	if err != nil || !bytes.Equal(sealed, want) {
+		t.Fatalf("SealAndWipe = %x, %v, want %x", sealed, err, want)
+	}
+	if !isZero(plaintext) {
+		t.Fatal("plaintext was not wiped")
+	}
+
+	// In place, the output covers the plaintext, which must not be
+	// wiped from under it.
+	buf := make([]byte, 0, 64)
+	buf = append(buf, "credential"...)
+	sealed, err = k.SealAndWipe(buf[:0], nonce, buf, nil)
+	if err != nil || !bytes.Equal(sealed, want) || &sealed[0] != &buf[0] {
+		t.Fatalf("in place: SealAndWipe = %x, %v, want %x in place", sealed, err, want)
+	}
+
+	// dst aliases plaintext but is too small, so the output moves and
+	// the plaintext left behind is wiped.
+	buf = []byte("credential")
+	sealed, err = k.SealAndWipe(buf[:0], nonce, buf, nil)
+	if err != nil || !bytes.Equal(sealed, want) {
+		t.Fatalf("reallocated: SealAndWipe = %x, %v, want %x", sealed, err, want)
+	}
+	if !isZero(buf) {
+		t.Fatal("reallocated: plaintext was not wiped")
+	}
+
+	plaintext = []byte("credential")
+	if _, err := k.SealAndWipe(nil, nonce[1:], plaintext, nil); !errors.Is(err, ErrInvalidNonce) {
+		t.Fatalf("bad nonce: got %v, want ErrInvalidNonce", err)
+	}
+	if !isZero(plaintext) {
+		t.Fatal("bad nonce: plaintext was not wiped")
+	}
+}
+
+func TestPlaintextLen(t *testing.T) {
+	aead, err := New(testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := aead.(AEAD)
+
+	for _, n := range []int{0, 1, 100} {
+		sealed := aead.Seal(nil, make([]byte, NonceSize), make([]byte, n), nil)
+		if got, err := k.PlaintextLen(sealed); err != nil || got != n {
+			t.Fatalf("PlaintextLen of %d bytes of plaintext = %d, %v", n, got, err)
+		}
+	}
+	for _, n := range []int{0, TagSize - 1} {
+		if _, err := k.PlaintextLen(make([]byte, n)); !errors.Is(err, ErrCiphertextTooShort) {
+			t.Fatalf("PlaintextLen of %d bytes: got %v, want ErrCiphertextTooShort", n, err)
+		}
+	}
+}
+
+// TestMACKeyWiped checks that the locked scratch holding the Poly1305
+// one-time key is wiped once Seal and Open return.
+func TestMACKeyWiped(t *testing.T) {
+	aead, err := NewX(testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, XNonceSize)
+	sealed := aead.Seal(nil, nonce, []byte("plaintext"), nil)
+	if _, err := aead.Open(nil, nonce, sealed, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	scratchPool.mu.Lock()
+	defer scratchPool.mu.Unlock()
+	free := scratchPool.free[poolBucket(64)]
+	if len(free) == 0 {
+		t.Fatal("the one-time key was not kept in pooled locked memory")
+	}
+	for _, b := range free {
+		for _, c := range b.Buffer() {
+			if c != 0 {
+				t.Fatal("a released one-time key buffer was not wiped")
+			}
+		}
+	}
+}
+
+func TestNonceObserver(t *testing.T) {
+	var seen [][]byte
+	aead, err := NewX(testKey(t), WithNonceObserver(func(nonce []byte) {
+		seen = append(seen, nonce)
+		nonce[0] ^= 0xff
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nonce := make([]byte, XNonceSize)
+	for i := 0; i < 3; i++ {
+		nonce[1] = byte(i)
+		sealed := aead.Seal(nil, nonce, []byte("plaintext"), nil)
+		// The observer gets a copy: its change to the nonce must not
+		// have reached the message.
+		if _, err := aead.Open(nil, nonce, sealed, nil); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+	if len(seen) != 3 {
+		t.Fatalf("observer called %d times, want 3", len(seen))
+	}
+	for i, n := range seen {
+		want := make([]byte, XNonceSize)
+		want[0], want[1] = 0xff, byte(i)
+		if !bytes.Equal(n, want) {
+			t.Fatalf("nonce %d = %x", i, n)
+		}
+	}
+
+	if _, err := aead.Open(nil, nonce, aead.Seal(nil, nonce, nil, nil), nil); err != nil || len(seen) != 4 {
+		t.Fatalf("Open called the observer, or Seal did not: %d calls, %v", len(seen), err)
+	}
+
+	plain, err := NewX(testKey(t), WithNonceObserver(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain.Seal(nil, nonce, nil, nil)
+}
+
+func TestNewFromArray(t *testing.T) {
+	var key [32]byte
+	copy(key[:], testKey(t).Buffer())
+	keys := Stats().Keys.Buffers
+
+	for _, v := range []Variant{ChaCha20, XChaCha20} {
+		aead, err := NewFromArray(key, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonce := make([]byte, aead.NonceSize())
+		if got, want := aead.Seal(nil, nonce, []byte("plaintext"), nil), referenceSeal(t, nonce, []byte("plaintext"), nil); !bytes.Equal(got, want) {
+			t.Fatalf("%v: NewFromArray differs from a LockedBuffer of the same bytes", v)
+		}
+		aead.(AEAD).Close()
+	}
+	if got := Stats().Keys.Buffers; got != keys {
+		t.Fatalf("key buffers after Close = %d, want %d", got, keys)
+	}
+
+	if _, err := NewFromArray(key, Variant(-1)); !errors.Is(err, ErrUnknownVariant) {
+		t.Fatalf("unknown variant: got %v, want ErrUnknownVariant", err)
+	}
+}
+
+func TestNewAEAD(t *testing.T) {
+	for v, nonceSize := range map[Variant]int{ChaCha20: NonceSize, XChaCha20: XNonceSize} {
+		aead, err := NewAEAD(testKey(t), v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer aead.(AEAD).Close()
+		if aead.NonceSize() != nonceSize || aead.(AEAD).Variant() != v {
+			t.Fatalf("%v: NonceSize = %d, Variant = %v", v, aead.NonceSize(), aead.(AEAD).Variant())
+		}
+
+		nonce := make([]byte, nonceSize)
+		sealed := aead.Seal(nil, nonce, []byte("plaintext"), nil)
+		if !bytes.Equal(sealed, referenceSeal(t, nonce, []byte("plaintext"), nil)) {
+			t.Fatalf("%v: Seal differs from New and NewX", v)
+		}
+		if got, err := aead.Open(nil, nonce, sealed, nil); err != nil || string(got) != "plaintext" {
+			t.Fatalf("%v: Open = %q, %v", v, got, err)
+		}
+	}
+
+	for _, v := range []Variant{-1, XChaCha20 + 1} {
+		if _, err := NewAEAD(testKey(t), v); !errors.Is(err, ErrUnknownVariant) {
+			t.Fatalf("%v: got %v, want ErrUnknownVariant", v, err)
+		}
+	}
+}
+
+func TestLockedAAD(t *testing.T) {
+	for _, v := range variants {
+		aead := testAEAD(t, v)
+		nonce := make([]byte, aead.NonceSize())
+		data := lockedBytes(t, []byte("account 1234"))
+
+		sealed, err := aead.SealWithLockedAAD(nil, nonce, []byte("plaintext"), data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(sealed, aead.Seal(nil, nonce, []byte("plaintext"), data.Buffer())) {
+			t.Fatalf("%v: SealWithLockedAAD differs from Seal", v)
+		}
+		if got, err := aead.Open(nil, nonce, sealed, []byte("account 1234")); err != nil || string(got) != "plaintext" {
+			t.Fatalf("%v: Open with plain AAD: %q, %v", v, got, err)
+		}
+		plain := aead.Seal(nil, nonce, []byte("plaintext"), []byte("account 1234"))
+		if got, err := aead.OpenWithLockedAAD(nil, nonce, plain, data); err != nil || string(got) != "plaintext" {
+			t.Fatalf("%v: OpenWithLockedAAD of a Seal: %q, %v", v, got, err)
+		}
+
+		other := lockedBytes(t, []byte("account 1235"))
+		if _, err := aead.OpenWithLockedAAD(nil, nonce, sealed, other); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("%v: other AAD: got %v, want ErrAuthFailed", v, err)
+		}
+		other.Destroy()
+		if _, err := aead.SealWithLockedAAD(nil, nonce, nil, other); !errors.Is(err, memguard.ErrDestroyed) {
+			t.Fatalf("%v: SealWithLockedAAD with destroyed AAD: got %v", v, err)
+		}
+		if _, err := aead.OpenWithLockedAAD(nil, nonce, sealed, other); !errors.Is(err, memguard.ErrDestroyed) {
+			t.Fatalf("%v: OpenWithLockedAAD with destroyed AAD: got %v", v, err)
+		}
+	}
+}
+
+// TestSealDoesNotMutatePlaintext seals a plaintext surrounded by
+// sentinel bytes, with dst unrelated to it and with dst in the same
+// backing array but not overlapping it.
+func TestSealDoesNotMutatePlaintext(t *testing.T) {
+	for _, v := range variants {
+		aead := testAEAD(t, v)
+		nonce := make([]byte, aead.NonceSize())
+
+		var buf [512]byte
+		for i := range buf {
+			buf[i] = 0xa5
+		}
+		plaintext := buf[64:192]
+		want := aead.Seal(nil, nonce, bytes.Repeat([]byte{0xa5}, len(plaintext)), nil)
+
+		for name, dst := range map[string][]byte{
+			"nil":                    nil,
+			"before, too small":      buf[:0:64],
+			"after, large enough":    buf[256:256],
+			"after, sentinel prefix": buf[192:200],
+		} {
+			prefix := append([]byte(nil), dst...)
+			got := aead.Seal(dst, nonce, plaintext, nil)
+			if !bytes.Equal(got[len(prefix):], want) {
+				t.Fatalf("%v, dst %s: wrong ciphertext", v, name)
+			}
+			for i, c := range buf[:256] {
+				if c != 0xa5 && !(i >= 192 && name == "after, sentinel prefix") {
+					t.Fatalf("%v, dst %s: byte %d of the plaintext array changed", v, name, i)
+				}
+			}
+			for i := range buf {
+				buf[i] = 0xa5
+			}
+		}
+	}
+}
+
+func TestVerifyWithKey(t *testing.T) {
+	nonce := make([]byte, XNonceSize)
+	c, err := chacha20.NewUnauthenticatedCipher(testKey(t).Buffer(), nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var block [64]byte
+	c.XORKeyStream(block[:], block[:])
+	polyKey := lockedBytes(t, block[:32])
+
+	aead := testAEAD(t, XChaCha20)
+	sealed := aead.Seal(nil, nonce, []byte("plaintext"), []byte("aad"))
+	ciphertext, tag := sealed[:len(sealed)-TagSize], sealed[len(sealed)-TagSize:]
+
+	if err := VerifyWithKey(polyKey, ciphertext, []byte("aad"), tag); err != nil {
+		t.Fatalf("tag from Seal: %v", err)
+	}
+
+	// A Poly1305 tag computed over the layout by x/crypto.
+	m := append(append([]byte("aad"), 3, 0, 0, 0, 0, 0, 0, 0), ciphertext...)
+	m = append(m, byte(len(ciphertext)), 0, 0, 0, 0, 0, 0, 0)
+	var key [32]byte
+	var want [poly1305.TagSize]byte
+	copy(key[:], block[:32])
+	poly1305.Sum(&want, m, &key)
+	if !bytes.Equal(want[:], tag) {
+		t.Fatal("Seal tag differs from Poly1305 over the documented layout")
+	}
+
+	bad := append([]byte(nil), tag...)
+	bad[0] ^= 1
+	if err := VerifyWithKey(polyKey, ciphertext, []byte("aad"), bad); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("flipped tag: got %v, want ErrAuthFailed", err)
+	}
+	if err := VerifyWithKey(polyKey, ciphertext, []byte("other"), tag); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("other AAD: got %v, want ErrAuthFailed", err)
+	}
+	if err := VerifyWithKey(polyKey, ciphertext, []byte("aad"), tag[:8]); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("short tag: got %v, want ErrAuthFailed", err)
+	}
+
+	short := lockedBytes(t, block[:16])
+	if err := VerifyWithKey(short, ciphertext, []byte("aad"), tag); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("16 byte key: got %v, want ErrInvalidKey", err)
+	}
+}
+
+func TestOpenWith(t *testing.T) {
+	aead := testAEAD(t, XChaCha20)
+	nonce := make([]byte, aead.NonceSize())
+	sealed := aead.Seal(nil, nonce, []byte("plaintext"), nil)
+	before := Stats().Scratch.Buffers
+
+	errCallback := errors.New("callback failed")
+	for name, fn := range map[string]func([]byte) error{
+		"return": func(p []byte) error {
+			if string(p) != "plaintext" {
+				t.Errorf("fn got %q", p)
+			}
+			return nil
+		},
+		"error": func([]byte) error { return errCallback },
+		"panic": func([]byte) error { panic("callback panicked") },
+	} {
+		var err error
+		panicked := func() (panicked bool) {
+			defer func() { panicked = recover() != nil }()
+			err = aead.OpenWith(nonce, sealed, nil, fn)
+			return false
+		}()
+		if (name == "panic") != panicked || (name == "error") != (err == errCallback) {
+			t.Fatalf("%s: panicked %v, err %v", name, panicked, err)
+		}
+		if got := Stats().Scratch.Buffers; got != before {
+			t.Fatalf("%s: %d scratch buffers left, want %d", name, got, before)
+		}
+	}
+
+	called := false
+	sealed[0] ^= 1
+	if err := aead.OpenWith(nonce, sealed, nil, func([]byte) error { called = true; return nil }); !errors.Is(err, ErrAuthFailed) || called {
+		t.Fatalf("tampered: got %v, fn called %v", err, called)
+	}
+	empty := aead.Seal(nil, nonce, nil, nil)
+	if err := aead.OpenWith(nonce, empty, nil, func(p []byte) error { called = p == nil; return nil }); err != nil || !called {
+		t.Fatalf("empty plaintext: got %v, fn called with nil %v", err, called)
+	}
+}
+
+func TestWipe(t *testing.T) {
+	b := bytes.Repeat([]byte{0xff}, 100)
+	Wipe(b[10:90])
+	for i, c := range b {
+		if zero := i >= 10 && i < 90; (c == 0) != zero {
+			t.Fatalf("byte %d = %#x after Wipe", i, c)
+		}
+	}
+	Wipe(nil)
+}
+
+// BenchmarkOpenLockedScratch measures what WithLockedScratch costs Open:
+// a locked scratch buffer from the pool and one more copy.
+func BenchmarkOpenLockedScratch(b *testing.B) {
+	for _, n := range []int{64, 1 << 10, 64 << 10} {
+		for _, locked := range []bool{false, true} {
+			name := strconv.Itoa(n) + "/default"
+			if locked {
+				name = strconv.Itoa(n) + "/locked"
+			}
+			b.Run(name, func(b *testing.B) {
+				aead := testAEAD(b, XChaCha20, WithLockedScratch(locked))
+				nonce := make([]byte, aead.NonceSize())
+				sealed := aead.Seal(nil, nonce, make([]byte, n), nil)
+				dst := make([]byte, 0, n)
+
+				b.ReportAllocs()
+				b.SetBytes(int64(n))
+				for i := 0; i < b.N; i++ {
+					if _, err := aead.Open(dst[:0], nonce, sealed, nil); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// TestLockedScratch checks that with WithLockedScratch every method that
+// decrypts into a caller's slice goes through a locked scratch buffer,
+// which is left in the scratch pool afterwards, and gives the same
+// plaintext as without it.
+func TestLockedScratch(t *testing.T) {
+	const n = 1000
+	plain := testAEAD(t, XChaCha20)
+	locked := testAEAD(t, XChaCha20, WithLockedScratch(true))
+	nonce := make([]byte, XNonceSize)
+	plaintext := bytes.Repeat([]byte{7}, n)
+	sealed := plain.Seal(nil, nonce, plaintext, []byte("aad"))
+	data := lockedBytes(t, []byte("aad"))
+
+	opens := map[string]func(AEAD) ([]byte, error){
+		"Open": func(a AEAD) ([]byte, error) { return a.Open(nil, nonce, sealed, []byte("aad")) },
+		"OpenTo": func(a AEAD) ([]byte, error) {
+			out := make([]byte, n)
+			m, err := a.OpenTo(out, nonce, sealed, []byte("aad"))
+			return out[:m], err
+		},
+		"OpenDetached": func(a AEAD) ([]byte, error) {
+			return a.OpenDetached(nil, nonce, sealed[:n], sealed[n:], []byte("aad"))
+		},
+		"OpenWithLockedAAD": func(a AEAD) ([]byte, error) { return a.OpenWithLockedAAD(nil, nonce, sealed, data) },
+	}
+	for name, open := range opens {
+		for _, a := range []AEAD{plain, locked} {
+			scratchPool.Purge()
+			got, err := open(a)
+			if err != nil || !bytes.Equal(got, plaintext) {
+				t.Fatalf("%s: got %d bytes, %v", name, len(got), err)
+			}
+
+			scratchPool.mu.Lock()
+			used := len(scratchPool.free[poolBucket(n)]) > 0
+			scratchPool.mu.Unlock()
+			if used != (a == locked) {
+				t.Fatalf("%s: locked scratch used = %v with WithLockedScratch(%v)", name, used, a == locked)
+			}
+		}
+	}
+}
+
+// zeroFactory is a broken StreamFactory whose keystream is all zeros,
+// as a miscompiled ChaCha20 might produce.
+type zeroFactory struct{ nonceSize int }
+
+func (f zeroFactory) NewStream(*memguard.LockedBuffer, []byte) (cipher.Stream, error) {
+	return zeroStream{}, nil
+}
+
+func (f zeroFactory) NonceSize() int { return f.nonceSize }
+
+type zeroStream struct{}
+
+func (zeroStream) XORKeyStream(dst, src []byte) { copy(dst, src) }
+
+func TestWeakMACKey(t *testing.T) {
+	for _, v := range variants {
+		good := testAEAD(t, v)
+		nonce := make([]byte, good.NonceSize())
+		sealed := good.Seal(nil, nonce, []byte("plaintext"), nil)
+
+		aead, err := NewWithFactory(testKey(t), zeroFactory{good.NonceSize()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		k := aead.(AEAD)
+
+		if _, err := k.SealAndWipe(nil, nonce, []byte("plaintext"), nil); err != ErrWeakMACKey {
+			t.Errorf("%v: SealAndWipe: got %v, want ErrWeakMACKey", v, err)
+		}
+		if err := panicErr(func() { k.Seal(nil, nonce, nil, nil) }); err != ErrWeakMACKey {
+			t.Errorf("%v: Seal: got panic %v, want ErrWeakMACKey", v, err)
+		}
+		if _, err := k.Open(nil, nonce, sealed, nil); err != ErrWeakMACKey {
+			t.Errorf("%v: Open: got %v, want ErrWeakMACKey", v, err)
+		}
+		if _, err := k.MAC(nonce, []byte("data")); err != ErrWeakMACKey {
+			t.Errorf("%v: MAC: got %v, want ErrWeakMACKey", v, err)
+		}
+	}
+}
+
+// authFailureCause seals a message with sealAAD, flips a bit of its
+// ciphertext if tamper is set, and opens it with openAAD. Opening must
+// fail with an *AuthError, whose cause is returned.
+func authFailureCause(t *testing.T, sealAAD, openAAD []byte, tamper bool) error {
+	t.Helper()
+	aead := testAEAD(t, XChaCha20)
+	nonce := make([]byte, aead.NonceSize())
+	sealed := aead.Seal(nil, nonce, []byte("plaintext"), sealAAD)
+	if tamper {
+		sealed[0] ^= 1
+	}
+
+	_, err := aead.Open(nil, nonce, sealed, openAAD)
+	var ae *AuthError
+	if !errors.As(err, &ae) {
+		t.Fatalf("Open: got %v, want an *AuthError", err)
+	}
+	return ae.Err
+}
+
+// sealVectors are messages sealed under testKey, with nonces
+// holding 0x40, 0x41, ...
+var sealVectors = []struct {
+	variant        Variant
+	plaintext, aad string
+	sealed         string
+}{
+	{ChaCha20, "verify first, decrypt later", "header", "127597f1cedd24716980fe3d899a2d0e9356af0ab080cd4514ccddf7ed68a7797f8e480a0e4518005a563d"},
+	{XChaCha20, "verify first, decrypt later", "header", "a25c7719b6995970e686f4ca83bc01f7f1c8d4b467793ffb1e548fd43fce311590052d7f1b04936d69a565"},
+}
+
+func TestAuthenticate(t *testing.T) {
+	for _, tv := range sealVectors {
+		aead := testAEAD(t, tv.variant)
+		nonce := make([]byte, aead.NonceSize())
+		for i := range nonce {
+			nonce[i] = byte(0x40 + i)
+		}
+		sealed, _ := hex.DecodeString(tv.sealed)
+
+		a, err := aead.Authenticate(nonce, sealed, []byte(tv.aad))
+		if err != nil {
+			t.Fatalf("%v: %v", tv.variant, err)
+		}
+		if got := a.Decrypt([]byte("dst:")); string(got) != "dst:"+tv.plaintext {
+			t.Fatalf("%v: Decrypt = %q", tv.variant, got)
+		}
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%v: second Decrypt did not panic", tv.variant)
+				}
+			}()
+			a.Decrypt(nil)
+		}()
+
+		tampered := map[string]func() ([]byte, []byte){
+			"ciphertext": func() ([]byte, []byte) {
+				b := append([]byte(nil), sealed...)
+				b[0] ^= 1
+				return b, []byte(tv.aad)
+			},
+			"tag": func() ([]byte, []byte) {
+				b := append([]byte(nil), sealed...)
+				b[len(b)-1] ^= 1
+				return b, []byte(tv.aad)
+			},
+			"aad":       func() ([]byte, []byte) { return sealed, []byte("other header") },
+			"truncated": func() ([]byte, []byte) { return sealed[:TagSize-1], []byte(tv.aad) },
+		}
+		for name, tamper := range tampered {
+			b, aad := tamper()
+			if a, err := aead.Authenticate(nonce, b, aad); a != nil || !errors.Is(err, ErrAuthFailed) {
+				t.Errorf("%v: tampered %s: got %v, %v, want ErrAuthFailed", tv.variant, name, a, err)
+			}
+		}
+	}
+}
+
+func TestAuthenticateMatchesOpen(t *testing.T) {
+	for _, v := range variants {
+		aead := testAEAD(t, v)
+		nonce := make([]byte, aead.NonceSize())
+		for n := 0; n <= 300; n += 37 {
+			plaintext := bytes.Repeat([]byte{byte(n)}, n)
+			sealed := aead.Seal(nil, nonce, plaintext, []byte("aad"))
+
+			want, err := aead.Open(nil, nonce, sealed, []byte("aad"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			a, err := aead.Authenticate(nonce, sealed, []byte("aad"))
+			if err != nil {
+				t.Fatalf("%v, %d bytes: %v", v, n, err)
+			}
+			if got := a.Decrypt(nil); !bytes.Equal(got, want) {
+				t.Fatalf("%v, %d bytes: Decrypt differs from Open", v, n)
+			}
+		}
+	}
+}
+
+func TestSealToOpenTo(t *testing.T) {
+	for _, v := range variants {
+		aead := testAEAD(t, v)
+		nonce := make([]byte, aead.NonceSize())
+		plaintext := []byte("a small message")
+		want := aead.Seal(nil, nonce, plaintext, nil)
+
+		out := make([]byte, 64)
+		n, err := aead.SealTo(out, nonce, plaintext, nil)
+		if err != nil || !bytes.Equal(out[:n], want) {
+			t.Fatalf("%v: SealTo = %x, %v, want %x", v, out[:n], err, want)
+		}
+		if _, err := aead.SealTo(make([]byte, len(want)-1), nonce, plaintext, nil); !errors.Is(err, ErrShortBuffer) {
+			t.Fatalf("%v: SealTo into a short buffer: got %v, want ErrShortBuffer", v, err)
+		}
+
+		pt := make([]byte, 64)
+		n, err = aead.OpenTo(pt, nonce, want, nil)
+		if err != nil || !bytes.Equal(pt[:n], plaintext) {
+			t.Fatalf("%v: OpenTo = %q, %v", v, pt[:n], err)
+		}
+		if _, err := aead.OpenTo(pt[:0:len(plaintext)-1], nonce, want, nil); !errors.Is(err, ErrShortBuffer) {
+			t.Fatalf("%v: OpenTo into a short buffer: got %v, want ErrShortBuffer", v, err)
+		}
+	}
+}
+
+// TestSealToOpenToAllocs checks that SealTo and OpenTo never allocate
+// their output: sealing or opening a small message costs the same
+// allocations as an empty one, which are only the keystream and the
+// release of the locked MAC key buffer, as in TestSealAllocs.
+func TestSealToOpenToAllocs(t *testing.T) {
+	for _, v := range variants {
+		aead := testAEAD(t, v)
+		nonce := make([]byte, aead.NonceSize())
+		out := make([]byte, 64+TagSize)
+		pt := make([]byte, 64)
+		empty := aead.Seal(nil, nonce, nil, nil)
+
+		sealBase := testing.AllocsPerRun(100, func() { aead.SealTo(out, nonce, nil, nil) })
+		openBase := testing.AllocsPerRun(100, func() { aead.OpenTo(pt, nonce, empty, nil) })
+		if sealBase > 2 || openBase > 2 {
+			t.Fatalf("%v: empty messages allocate %v times to seal and %v to open, want at most 2", v, sealBase, openBase)
+		}
+
+		for _, n := range []int{1, 16, 32, 64} {
+			sealed := aead.Seal(nil, nonce, pt[:n], nil)
+			if allocs := testing.AllocsPerRun(100, func() { aead.SealTo(out, nonce, pt[:n], nil) }); allocs != sealBase {
+				t.Errorf("%v: SealTo of %d bytes allocates %v times, want %v", v, n, allocs, sealBase)
+			}
+			if allocs := testing.AllocsPerRun(100, func() { aead.OpenTo(pt, nonce, sealed, nil) }); allocs != openBase {
+				t.Errorf("%v: OpenTo of %d bytes allocates %v times, want %v", v, n, allocs, openBase)
+			}
+		}
+	}
+}
+
+func TestDetachedVectors(t *testing.T) {
+	for _, tv := range sealVectors {
+		aead := testAEAD(t, tv.variant)
+		nonce := make([]byte, aead.NonceSize())
+		for i := range nonce {
+			nonce[i] = byte(0x40 + i)
+		}
+		sealed, _ := hex.DecodeString(tv.sealed)
+		n := len(sealed) - TagSize
+
+		ciphertext, tag := aead.SealDetached([]byte("dst:"), nonce, []byte(tv.plaintext), []byte(tv.aad))
+		if string(ciphertext[:4]) != "dst:" || !bytes.Equal(ciphertext[4:], sealed[:n]) || !bytes.Equal(tag, sealed[n:]) {
+			t.Fatalf("%v: SealDetached = %x, %x, want %x, %x", tv.variant, ciphertext[4:], tag, sealed[:n], sealed[n:])
+		}
+		got, err := aead.OpenDetached(nil, nonce, sealed[:n], sealed[n:], []byte(tv.aad))
+		if err != nil || string(got) != tv.plaintext {
+			t.Fatalf("%v: OpenDetached = %q, %v", tv.variant, got, err)
+		}
+	}
+
+	// The published test vectors keep the ciphertext and the tag apart.
+	var buf bytes.Buffer
+	if err := GenerateTestVectors(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var vectors []TestVector
+	if err := json.Unmarshal(buf.Bytes(), &vectors); err != nil {
+		t.Fatal(err)
+	}
+	for i, tv := range vectors {
+		key, _ := hex.DecodeString(tv.Key)
+		nonce, _ := hex.DecodeString(tv.Nonce)
+		aad, _ := hex.DecodeString(tv.AAD)
+		plaintext, _ := hex.DecodeString(tv.Plaintext)
+		ciphertext, _ := hex.DecodeString(tv.Ciphertext)
+		tag, _ := hex.DecodeString(tv.Tag)
+
+		newAEAD := NewUnlockedForTesting
+		if tv.Variant == XChaCha20.String() {
+			newAEAD = NewXUnlockedForTesting
+		}
+		a, err := newAEAD(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aead := a.(AEAD)
+
+		gotCiphertext, gotTag := aead.SealDetached(nil, nonce, plaintext, aad)
+		if !bytes.Equal(gotCiphertext, ciphertext) || !bytes.Equal(gotTag, tag) {
+			t.Fatalf("vector %d (%s): SealDetached differs", i, tv.Variant)
+		}
+		if got, err := aead.OpenDetached(nil, nonce, ciphertext, tag, aad); err != nil || !bytes.Equal(got, plaintext) {
+			t.Fatalf("vector %d (%s): OpenDetached: %v", i, tv.Variant, err)
+		}
+		combined := append(append([]byte(nil), ciphertext...), tag...)
+		if got, err := aead.Open(nil, nonce, combined, aad); err != nil || !bytes.Equal(got, plaintext) {
+			t.Fatalf("vector %d (%s): Open of ciphertext || tag: %v", i, tv.Variant, err)
+		}
+	}
+}
+
+func TestOpenDetachedRejects(t *testing.T) {
+	for _, v := range variants {
+		aead := testAEAD(t, v)
+		nonce := make([]byte, aead.NonceSize())
+		ciphertext, tag := aead.SealDetached(nil, nonce, []byte("plaintext"), []byte("aad"))
+
+		bad := append([]byte(nil), tag...)
+		bad[0] ^= 1
+		tests := []struct {
+			name            string
+			ciphertext, tag []byte
+			aad             string
+		}{
+			{"tag", ciphertext, bad, "aad"},
+			{"short tag", ciphertext, tag[:TagSize-1], "aad"},
+			{"long tag", ciphertext, append(tag[:TagSize:TagSize], 0), "aad"},
+			{"no tag", ciphertext, nil, "aad"},
+			{"aad", ciphertext, tag, "other"},
+		}
+		for _, tt := range tests {
+			if _, err := aead.OpenDetached(nil, nonce, tt.ciphertext, tt.tag, []byte(tt.aad)); !errors.Is(err, ErrAuthFailed) {
+				t.Errorf("%v: %s: got %v, want ErrAuthFailed", v, tt.name, err)
+			}
+		}
+	}
+}
+
+func TestOpenValidateOnlyMatchesOpen(t *testing.T) {
+	for _, v := range variants {
+		aead := testAEAD(t, v)
+		nonce := make([]byte, aead.NonceSize())
+		for _, n := range []int{0, 1, 64, 1000} {
+			sealed := aead.Seal(nil, nonce, make([]byte, n), []byte("aad"))
+
+			cases := map[string][]byte{"valid": sealed, "truncated": sealed[:TagSize-1]}
+			for _, i := range []int{0, len(sealed) - 1} {
+				b := append([]byte(nil), sealed...)
+				b[i] ^= 1
+				cases["flipped byte "+strconv.Itoa(i)] = b
+			}
+			for name, c := range cases {
+				_, openErr := aead.Open(nil, nonce, c, []byte("aad"))
+				got, err := aead.OpenValidateOnly(nonce, c, []byte("aad"))
+				if (err == nil) != (openErr == nil) {
+					t.Fatalf("%v, %d bytes, %s: OpenValidateOnly returned %v, Open %v", v, n, name, err, openErr)
+				}
+				if err == nil && got != n {
+					t.Fatalf("%v, %d bytes: plaintext length %d", v, n, got)
+				}
+				if err != nil && !errors.Is(err, ErrAuthFailed) {
+					t.Fatalf("%v, %d bytes, %s: got %v, want ErrAuthFailed", v, n, name, err)
+				}
+			}
+		}
+	}
+}
+
+// BenchmarkOpenValidateOnly compares OpenValidateOnly with Open, which
+// also decrypts.
+func BenchmarkOpenValidateOnly(b *testing.B) {
+	for _, n := range []int{1 << 10, 1 << 20} {
+		aead := testAEAD(b, XChaCha20)
+		nonce := make([]byte, aead.NonceSize())
+		sealed := aead.Seal(nil, nonce, make([]byte, n), nil)
+		dst := make([]byte, 0, n)
+
+		b.Run("validate/"+strconv.Itoa(n), func(b *testing.B) {
+			b.SetBytes(int64(n))
+			for i := 0; i < b.N; i++ {
+				if _, err := aead.OpenValidateOnly(nonce, sealed, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run("open/"+strconv.Itoa(n), func(b *testing.B) {
+			b.SetBytes(int64(n))
+			for i := 0; i < b.N; i++ {
+				if _, err := aead.Open(dst[:0], nonce, sealed, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestMaxPlaintext(t *testing.T) {
+	const limit = 100
+	for _, v := range variants {
+		plain := testAEAD(t, v)
+		limited := testAEAD(t, v, WithMaxPlaintext(limit))
+		nonce := make([]byte, plain.NonceSize())
+		atLimit := plain.Seal(nil, nonce, make([]byte, limit), nil)
+		overLimit := plain.Seal(nil, nonce, make([]byte, limit+1), nil)
+
+		if _, err := limited.Open(nil, nonce, atLimit, nil); err != nil {
+			t.Fatalf("%v: Open of %d bytes: %v", v, limit, err)
+		}
+		if err := limited.Verify(nonce, atLimit, nil); err != nil {
+			t.Fatalf("%v: Verify of %d bytes: %v", v, limit, err)
+		}
+		if _, err := plain.Open(nil, nonce, overLimit, nil); err != nil {
+			t.Fatalf("%v: Open without a limit: %v", v, err)
+		}
+
+		_, err := limited.Open(nil, nonce, overLimit, nil)
+		var se *SizeError
+		if !errors.As(err, &se) || !errors.Is(err, ErrMessageTooLong) || se.Want != limit || se.Got != limit+1 {
+			t.Fatalf("%v: Open of %d bytes: got %v, want a SizeError matching ErrMessageTooLong", v, limit+1, err)
+		}
+		if err := limited.Verify(nonce, overLimit, nil); !errors.Is(err, ErrMessageTooLong) {
+			t.Fatalf("%v: Verify of %d bytes: got %v, want ErrMessageTooLong", v, limit+1, err)
+		}
+	}
+
+	if _, err := NewX(testKey(t), WithMaxPlaintext(-1)); err == nil {
+		t.Fatal("negative limit accepted")
+	}
+}
+
+// TestMaxPlaintextAllocs checks that a ciphertext over the limit is
+// rejected without a plaintext or keystream being allocated: the only
+// allocation left is the *SizeError returned.
+func TestMaxPlaintextAllocs(t *testing.T) {
+	aead := testAEAD(t, XChaCha20, WithMaxPlaintext(1024))
+	nonce := make([]byte, aead.NonceSize())
+	huge := make([]byte, 1<<20)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		aead.Open(nil, nonce, huge, nil)
+	})
+	if allocs > 1 {
+		t.Fatalf("rejecting %d bytes allocates %v times, want at most the error", len(huge), allocs)
+	}
+}
+
+func TestNoncePrefix(t *testing.T) {
+	for _, v := range variants {
+		plain := testAEAD(t, v)
+		a := testAEAD(t, v, WithNoncePrefix([]byte{0, 0, 0, 1}))
+		b := testAEAD(t, v, WithNoncePrefix([]byte{0, 0, 0, 2}))
+		if got, want := a.NonceSize(), plain.NonceSize()-4; got != want {
+			t.Fatalf("%v: NonceSize() = %d, want %d", v, got, want)
+		}
+
+		nonce := make([]byte, a.NonceSize())
+		nonce[0] = 7
+		sealedA := a.Seal(nil, nonce, []byte("message"), nil)
+		sealedB := b.Seal(nil, nonce, []byte("message"), nil)
+		if bytes.Equal(sealedA, sealedB) {
+			t.Fatalf("%v: two prefixes give the same ciphertext for one nonce", v)
+		}
+
+		// The prefix goes in front of the nonce passed to Seal.
+		full := append([]byte{0, 0, 0, 1}, nonce...)
+		if want := plain.Seal(nil, full, []byte("message"), nil); !bytes.Equal(sealedA, want) {
+			t.Fatalf("%v: prefixed Seal differs from Seal under the whole nonce", v)
+		}
+		if _, err := a.Open(nil, nonce, sealedA, nil); err != nil {
+			t.Fatalf("%v: %v", v, err)
+		}
+		if _, err := b.Open(nil, nonce, sealedA, nil); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("%v: opened under another prefix: %v", v, err)
+		}
+		if err := panicErr(func() { a.Seal(nil, full, nil, nil) }); !errors.Is(err, ErrInvalidNonce) {
+			t.Fatalf("%v: Seal with the whole nonce: got %v, want ErrInvalidNonce", v, err)
+		}
+
+		if _, err := NewAEAD(testKey(t), v, WithNoncePrefix(make([]byte, plain.NonceSize()))); !errors.Is(err, ErrInvalidNonce) {
+			t.Fatalf("%v: prefix as long as the nonce: got %v, want ErrInvalidNonce", v, err)
+		}
+	}
+}
+
+func TestIsAuthentic(t *testing.T) {
+	for _, v := range variants {
+		aead := testAEAD(t, v)
+		nonce := make([]byte, aead.NonceSize())
+		for _, plaintext := range [][]byte{nil, []byte("plaintext")} {
+			sealed := aead.Seal(nil, nonce, plaintext, []byte("data"))
+			if !aead.IsAuthentic(nonce, sealed, []byte("data")) {
+				t.Fatalf("%v, %d bytes: valid ciphertext not authentic", v, len(plaintext))
+			}
+			for i := range sealed {
+				tampered := append([]byte(nil), sealed...)
+				tampered[i] ^= 1
+				if aead.IsAuthentic(nonce, tampered, []byte("data")) {
+					t.Fatalf("%v, %d bytes: bit flip at %d authentic", v, len(plaintext), i)
+				}
+			}
+			if aead.IsAuthentic(nonce, sealed, []byte("other")) {
+				t.Fatalf("%v, %d bytes: authentic with other data", v, len(plaintext))
+			}
+			if aead.IsAuthentic(nonce[1:], sealed, []byte("data")) {
+				t.Fatalf("%v, %d bytes: authentic with a short nonce", v, len(plaintext))
+			}
+			if aead.IsAuthentic(nonce, sealed[:TagSize-1], []byte("data")) {
+				t.Fatalf("%v, %d bytes: truncated ciphertext authentic", v, len(plaintext))
+			}
+		}
+	}
+}
+
+func TestMAC(t *testing.T) {
+	for _, v := range variants {
+		aead := testAEAD(t, v)
+		nonce := make([]byte, aead.NonceSize())
+		data := []byte("authenticated, not encrypted")
+
+		tag, err := aead.MAC(nonce, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := aead.Seal(nil, nonce, nil, data); !bytes.Equal(tag, want) {
+			t.Fatalf("%v: MAC = %x, want the tag of Seal %x", v, tag, want)
+		}
+		if err := aead.VerifyMAC(nonce, data, tag); err != nil {
+			t.Fatalf("%v: %v", v, err)
+		}
+
+		for i := range tag {
+			bad := append([]byte(nil), tag...)
+			bad[i] ^= 1
+			if err := aead.VerifyMAC(nonce, data, bad); !errors.Is(err, ErrAuthFailed) {
+				t.Fatalf("%v: bit flip at %d of the tag: got %v, want ErrAuthFailed", v, i, err)
+			}
+		}
+		if err := aead.VerifyMAC(nonce, data[1:], tag); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("%v: other data: got %v, want ErrAuthFailed", v, err)
+		}
+		otherNonce := append([]byte{1}, nonce[1:]...)
+		if err := aead.VerifyMAC(otherNonce, data, tag); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("%v: other nonce: got %v, want ErrAuthFailed", v, err)
+		}
+		if err := aead.VerifyMAC(nonce, data, tag[:TagSize-1]); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("%v: short tag: got %v, want ErrAuthFailed", v, err)
+		}
+		if err := aead.VerifyMAC(nonce[1:], data, tag); !errors.Is(err, ErrInvalidNonce) {
+			t.Fatalf("%v: short nonce: got %v, want ErrInvalidNonce", v, err)
+		}
+	}
+}
+
+func TestStructuredErrors(t *testing.T) {
+	aead := testAEAD(t, XChaCha20)
+	nonce := make([]byte, XNonceSize)
+	plaintext := []byte("do not print me")
+	sealed := aead.Seal(nil, nonce, plaintext, nil)
+
+	_, err := aead.Open(nil, nonce, sealed[:TagSize-1], nil)
+	var ae *AuthError
+	var se *SizeError
+	if !errors.As(err, &ae) || !errors.As(err, &se) || se.Field != "ciphertext" || se.Want != TagSize || se.Got != TagSize-1 {
+		t.Fatalf("short ciphertext: got %#v", err)
+	}
+	if !errors.Is(err, ErrAuthFailed) || !errors.Is(err, ErrCiphertextTooShort) {
+		t.Fatalf("short ciphertext: %v does not match ErrAuthFailed and ErrCiphertextTooShort", err)
+	}
+
+	sealed[0] ^= 1
+	_, err = aead.Open(nil, nonce, sealed, nil)
+	if !errors.As(err, &ae) || !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("bad tag: got %#v, want an AuthError", err)
+	}
+
+	err = panicErr(func() { aead.Seal(nil, nonce[:5], nil, nil) })
+	var ne *NonceError
+	if !errors.As(err, &ne) || ne.Want != XNonceSize || ne.Got != 5 || !errors.Is(err, ErrInvalidNonce) {
+		t.Fatalf("short nonce: got %#v, want a NonceError matching ErrInvalidNonce", err)
+	}
+	if _, err := aead.(AEAD).OpenDetached(nil, nil, nil, make([]byte, TagSize), nil); !errors.As(err, &ne) || ne.Got != 0 {
+		t.Fatalf("empty nonce: got %#v, want a NonceError", err)
+	}
+
+	_, err = NewX(lockedBytes(t, make([]byte, 16)))
+	if !errors.As(err, &se) || se.Field != "key" || se.Want != KeySize || se.Got != 16 || !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("short key: got %#v, want a SizeError matching ErrInvalidKey", err)
+	}
+
+	// Envelopes record the key ID of a message that fails to open.
+	env, err := SealEnvelope(aead, nonce, plaintext, nil, []byte("key-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env[len(env)-1] ^= 1
+	_, err = OpenEnvelope(aead, env, nil)
+	if !errors.As(err, &ae) || ae.KeyID != "key-1" || !strings.Contains(err.Error(), "key-1") {
+		t.Fatalf("tampered envelope: got %#v, want an AuthError with the key ID", err)
+	}
+
+	// Error strings carry lengths and IDs, never key or plaintext bytes.
+	for _, err := range []error{err, &SizeError{Field: "key", Want: KeySize, Got: 16, Err: ErrInvalidKey}, &NonceError{Want: 24, Got: 5}} {
+		s := err.Error()
+		if strings.Contains(s, string(plaintext)) || strings.Contains(s, hex.EncodeToString(testKey(t).Buffer())) {
+			t.Fatalf("error string %q leaks a secret", s)
+		}
+	}
+}
+
+func TestParseVariant(t *testing.T) {
+	if TagSize != 16 || NonceSize != 8 || XNonceSize != 24 || KeySize != 32 {
+		t.Fatalf("sizes: tag %d, nonce %d, extended nonce %d, key %d", TagSize, NonceSize, XNonceSize, KeySize)
+	}
+	for v, nonceSize := range map[Variant]int{ChaCha20: NonceSize, XChaCha20: XNonceSize} {
+		if got := NonceSizeFor(v); got != nonceSize {
+			t.Fatalf("NonceSizeFor(%v) = %d, want %d", v, got, nonceSize)
+		}
+		for _, s := range []string{v.String(), strings.ToLower(v.String()), strings.ToUpper(v.String())} {
+			if got, err := ParseVariant(s); err != nil || got != v {
+				t.Fatalf("ParseVariant(%q) = %v, %v, want %v", s, got, err, v)
+			}
+		}
+		if got := testAEAD(t, v).Variant(); got != v {
+			t.Fatalf("Variant() = %v, want %v", got, v)
+		}
+	}
+
+	if ChaCha20.String() != "ChaCha20Poly1305" || XChaCha20.String() != "XChaCha20Poly1305" {
+		t.Fatalf("names: %q, %q", ChaCha20, XChaCha20)
+	}
+	if got := Variant(7).String(); got != "Variant(7)" {
+		t.Fatalf("unknown variant is named %q", got)
+	}
+	if NonceSizeFor(Variant(7)) != 0 {
+		t.Fatal("unknown variant has a nonce size")
+	}
+	for _, s := range []string{"", "ChaCha20", "XChaCha20Poly1305 ", "Variant(1)"} {
+		if _, err := ParseVariant(s); !errors.Is(err, ErrUnknownVariant) {
+			t.Fatalf("ParseVariant(%q): got %v, want ErrUnknownVariant", s, err)
+		}
+	}
+}
+
+func TestFrozenKey(t *testing.T) {
+	key := lockedBytes(t, testKey(t).Buffer())
+	// testKey is immutable, and so frozen already.
+	aead := testAEAD(t, XChaCha20)
+	if !aead.KeyIsFrozen() {
+		t.Fatal("KeyIsFrozen does not report an immutable key as frozen")
+	}
+
+	frozen, err := NewX(key, WithFrozenKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.IsMutable() || !frozen.(AEAD).KeyIsFrozen() {
+		t.Fatal("WithFrozenKey left the key mutable")
+	}
+	if err := key.Copy(make([]byte, KeySize)); err != memguard.ErrImmutable {
+		t.Fatalf("writing to a frozen key: got %v, want memguard.ErrImmutable", err)
+	}
+
+	nonce := make([]byte, XNonceSize)
+	sealed := frozen.Seal(nil, nonce, []byte("plaintext"), nil)
+	if _, err := aead.Open(nil, nonce, sealed, nil); err != nil {
+		t.Fatalf("frozen key seals differently: %v", err)
+	}
+
+	if err := key.MakeMutable(); err != nil {
+		t.Fatal(err)
+	}
+	if frozen.(AEAD).KeyIsFrozen() {
+		t.Fatal("KeyIsFrozen after the key was made mutable")
+	}
+
+	mutable, err := NewX(lockedBytes(t, testKey(t).Buffer()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mutable.(AEAD).KeyIsFrozen() {
+		t.Fatal("KeyIsFrozen without WithFrozenKey")
+	}
+	unlocked, err := NewXUnlockedForTesting(testKey(t).Buffer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unlocked.(AEAD).KeyIsFrozen() {
+		t.Fatal("KeyIsFrozen for a key outside a LockedBuffer")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	for _, v := range variants {
+		aead := testAEAD(t, v)
+		nonce := make([]byte, aead.NonceSize())
+		sealed := aead.Seal(nil, nonce, []byte("plaintext"), []byte("data"))
+
+		if err := aead.Verify(nonce, sealed, []byte("data")); err != nil {
+			t.Fatalf("%v: %v", v, err)
+		}
+		for _, tc := range []struct {
+			name            string
+			nonce, ct, data []byte
+			want            error
+		}{
+			{"tampered", nonce, append([]byte{sealed[0] ^ 1}, sealed[1:]...), []byte("data"), ErrAuthFailed},
+			{"other data", nonce, sealed, nil, ErrAuthFailed},
+			{"short ciphertext", nonce, sealed[:TagSize-1], []byte("data"), ErrCiphertextTooShort},
+			{"short nonce", nonce[1:], sealed, []byte("data"), ErrInvalidNonce},
+		} {
+			err := aead.Verify(tc.nonce, tc.ct, tc.data)
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("%v, %s: got %v, want %v", v, tc.name, err, tc.want)
+			}
+			// Verify fails where Open does, which panics on a bad nonce.
+			if tc.want != ErrInvalidNonce {
+				if _, err := aead.Open(nil, tc.nonce, tc.ct, tc.data); !errors.Is(err, tc.want) {
+					t.Fatalf("%v, %s: Open returned %v", v, tc.name, err)
+				}
+			}
+		}
+
+		env, err := SealEnvelope(aead, nonce, []byte("plaintext"), []byte("data"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyEnvelope(aead, env, []byte("data")); err != nil {
+			t.Fatalf("%v: VerifyEnvelope: %v", v, err)
+		}
+		env[len(env)-1] ^= 1
+		if err := VerifyEnvelope(aead, env, []byte("data")); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("%v: VerifyEnvelope of a tampered envelope: got %v, want ErrAuthFailed", v, err)
+		}
+		if err := VerifyEnvelope(aead, env[:5], nil); !errors.Is(err, ErrInvalidEnvelope) {
+			t.Fatalf("%v: VerifyEnvelope of a truncated envelope: got %v, want ErrInvalidEnvelope", v, err)
+		}
+	}
+}
+
+func TestSealFramed(t *testing.T) {
+	for _, v := range variants {
+		aead := testAEAD(t, v)
+		nonce := make([]byte, aead.NonceSize())
+		for _, n := range []int{0, 1, 100} {
+			plaintext := bytes.Repeat([]byte{'p'}, n)
+			prefix := []byte("frame header")
+
+			out, tagOffset := aead.SealFramed(append([]byte(nil), prefix...), nonce, plaintext, nil)
+			if tagOffset != len(prefix)+n || len(out) != tagOffset+TagSize {
+				t.Fatalf("%v, %d bytes: tag offset %d in %d bytes", v, n, tagOffset, len(out))
+			}
+			ciphertext, tag := aead.SealDetached(nil, nonce, plaintext, nil)
+			if !bytes.Equal(out[tagOffset:], tag) || !bytes.Equal(out[len(prefix):tagOffset], ciphertext) {
+				t.Fatalf("%v, %d bytes: framed output differs from SealDetached", v, n)
+			}
+			if !bytes.Equal(out[:len(prefix)], prefix) {
+				t.Fatalf("%v, %d bytes: dst was overwritten", v, n)
+			}
+		}
+	}
+}
+
+func TestSealInPlace(t *testing.T) {
+	for _, v := range variants {
+		aead := testAEAD(t, v)
+		nonceLen := aead.NonceSize()
+		plaintext := []byte("sealed where it lies")
+
+		buf := make([]byte, nonceLen+len(plaintext)+TagSize+10)
+		buf[0] = 42
+		copy(buf[nonceLen:], plaintext)
+		n, err := aead.SealInPlace(buf, nonceLen, len(plaintext), []byte("data"))
+		if err != nil {
+			t.Fatalf("%v: %v", v, err)
+		}
+		if n != nonceLen+len(plaintext)+TagSize {
+			t.Fatalf("%v: used %d bytes", v, n)
+		}
+		nonce := buf[:nonceLen]
+		if want := aead.Seal(nil, nonce, plaintext, []byte("data")); !bytes.Equal(buf[nonceLen:n], want) {
+			t.Fatalf("%v: in place output differs from Seal", v)
+		}
+		if nonce[0] != 42 {
+			t.Fatalf("%v: the nonce was overwritten", v)
+		}
+		if !bytes.Equal(buf[n:], make([]byte, 10)) {
+			t.Fatalf("%v: bytes past the tag were written", v)
+		}
+
+		for _, size := range []int{0, nonceLen, n - 1} {
+			short := make([]byte, size)
+			_, err := aead.SealInPlace(short, nonceLen, len(plaintext), nil)
+			var se *SizeError
+			if !errors.As(err, &se) || !errors.Is(err, ErrShortBuffer) || se.Want != n || se.Got != size {
+				t.Fatalf("%v: %d byte buffer: got %v, want a SizeError matching ErrShortBuffer", v, size, err)
+			}
+		}
+		if _, err := aead.SealInPlace(buf, nonceLen-1, 0, nil); !errors.Is(err, ErrInvalidNonce) {
+			t.Fatalf("%v: short nonce: got %v, want ErrInvalidNonce", v, err)
+		}
+		if _, err := aead.SealInPlace(buf, -1, 0, nil); err == nil {
+			t.Fatalf("%v: negative length accepted", v)
+		}
+	}
+}
+
+func TestExpectedLength(t *testing.T) {
+	for _, v := range variants {
+		plain := testAEAD(t, v)
+		fixed := testAEAD(t, v, WithExpectedLength(8))
+		nonce := make([]byte, plain.NonceSize())
+		record := plain.Seal(nil, nonce, []byte("8 bytes!"), nil)
+		longer := plain.Seal(nil, nonce, []byte("9 bytes!!"), nil)
+
+		// A record of the right length goes on to the tag check.
+		if got, err := fixed.Open(nil, nonce, record, nil); err != nil || string(got) != "8 bytes!" {
+			t.Fatalf("%v: Open = %q, %v", v, got, err)
+		}
+		forged := append([]byte(nil), record...)
+		forged[0] ^= 1
+		if _, err := fixed.Open(nil, nonce, forged, nil); !errors.Is(err, ErrAuthFailed) || errors.Is(err, ErrUnexpectedLength) {
+			t.Fatalf("%v: forged record of the right length: got %v, want ErrAuthFailed", v, err)
+		}
+
+		for _, ct := range [][]byte{longer, longer[:TagSize]} {
+			_, err := fixed.Open(nil, nonce, ct, nil)
+			var se *SizeError
+			if !errors.As(err, &se) || !errors.Is(err, ErrUnexpectedLength) || errors.Is(err, ErrAuthFailed) || se.Want != 8 || se.Got != len(ct)-TagSize {
+				t.Fatalf("%v: %d byte plaintext: got %v, want a SizeError matching ErrUnexpectedLength", v, len(ct)-TagSize, err)
+			}
+			if err := fixed.Verify(nonce, ct, nil); !errors.Is(err, ErrUnexpectedLength) {
+				t.Fatalf("%v: Verify: got %v, want ErrUnexpectedLength", v, err)
+			}
+		}
+
+		// Seal is not restricted.
+		if got := fixed.Seal(nil, nonce, []byte("any length"), nil); len(got) != 10+TagSize {
+			t.Fatalf("%v: Seal produced %d bytes", v, len(got))
+		}
+	}
+	if _, err := NewX(testKey(t), WithExpectedLength(-1)); err == nil {
+		t.Fatal("negative expected length accepted")
+	}
+}
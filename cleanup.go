@@ -0,0 +1,54 @@
+package chacha20poly1305guard
+
+import (
+	"github.com/awnumar/memguard"
+)
+
+// Wipe zeroes b. Unlike a plain loop it cannot be removed by the
+// compiler as a dead store, so it is safe to use on buffers that are
+// about to go out of scope.
+func Wipe(b []byte) {
+	wipe(b)
+}
+
+// wipe is used for every wipe of ordinary memory in this package.
+func wipe(b []byte) {
+	memguard.WipeBytes(b)
+}
+
+// wipeOnPanic zeroes b if the calling function is panicking and then
+// lets the panic continue. It must be deferred directly.
+func wipeOnPanic(b []byte) {
+	if r := recover(); r != nil {
+		wipe(b)
+		panic(r)
+	}
+}
+
+// destroyOnPanic is wipeOnPanic for a LockedBuffer. It must be deferred
+// directly.
+func destroyOnPanic(b *memguard.LockedBuffer) {
+	if r := recover(); r != nil {
+		b.Destroy()
+		panic(r)
+	}
+}
+
+// releaseOnPanic calls release if the calling function is panicking and
+// then lets the panic continue. It must be deferred directly.
+func releaseOnPanic(release func()) {
+	if r := recover(); r != nil {
+		release()
+		panic(r)
+	}
+}
+
+// InstallInterruptHandler makes SIGINT and SIGTERM purge the scratch
+// buffers kept by this package and destroy every LockedBuffer, keys
+// included, before the process exits. It uses memguard.CatchInterrupt,
+// so only the first handler installed through either takes effect.
+func InstallInterruptHandler() {
+	memguard.CatchInterrupt(func() {
+		scratchPool.Purge()
+	})
+}
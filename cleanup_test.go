@@ -0,0 +1,131 @@
+package chacha20poly1305guard
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/awnumar/memguard"
+)
+
+// panicKey is a keyAccess whose keystream works for the Poly1305 key
+// and then panics halfway through the message, after writing to it.
+type panicKey struct{ unlockedKey }
+
+func (k panicKey) stream(newStream streamFunc, nonce []byte) (cipher.Stream, error) {
+	c, err := k.unlockedKey.stream(newStream, nonce)
+	return &panicStream{c: c}, err
+}
+
+type panicStream struct {
+	c     cipher.Stream
+	calls int
+}
+
+func (s *panicStream) XORKeyStream(dst, src []byte) {
+	s.calls++
+	s.c.XORKeyStream(dst, src)
+	if s.calls > 1 {
+		panic("keystream failed")
+	}
+}
+
+func TestOpenWipesOnPanic(t *testing.T) {
+	good, err := NewXUnlockedForTesting(testKey(t).Buffer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, XNonceSize)
+	sealed := good.Seal(nil, nonce, []byte("plaintext"), nil)
+
+	k, err := build(panicKey{unlockedKey(testKey(t).Buffer())}, XChaCha20, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.unlocked = true
+
+	dst := make([]byte, 0, 64)
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("Open did not panic")
+			}
+		}()
+		k.Open(dst, nonce, sealed, nil)
+	}()
+	if !bytes.Equal(dst[:cap(dst)], make([]byte, cap(dst))) {
+		t.Fatal("plaintext written before the panic was not wiped")
+	}
+}
+
+func TestWipeOnPanic(t *testing.T) {
+	recovered := func(fn func()) (r interface{}) {
+		defer func() { r = recover() }()
+		fn()
+		return nil
+	}
+
+	b := []byte("plaintext")
+	if r := recovered(func() {
+		defer wipeOnPanic(b)
+		panic("boom")
+	}); r != "boom" || !bytes.Equal(b, make([]byte, len(b))) {
+		t.Fatalf("wipeOnPanic: recovered %v, buffer %q", r, b)
+	}
+
+	b = []byte("plaintext")
+	recovered(func() { defer wipeOnPanic(b) })
+	if string(b) != "plaintext" {
+		t.Fatal("wipeOnPanic wiped without a panic")
+	}
+
+	lb, err := memguard.NewMutable(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := recovered(func() {
+		defer destroyOnPanic(lb)
+		panic("boom")
+	}); r != "boom" || !lb.IsDestroyed() {
+		t.Fatalf("destroyOnPanic: recovered %v, destroyed %v", r, lb.IsDestroyed())
+	}
+
+	released := false
+	if r := recovered(func() {
+		defer releaseOnPanic(func() { released = true })
+		panic("boom")
+	}); r != "boom" || !released {
+		t.Fatalf("releaseOnPanic: recovered %v, released %v", r, released)
+	}
+}
+
+// TestInstallInterruptHandler interrupts a copy of the test binary that
+// installed the handler, which must then exit cleanly instead of being
+// killed by the signal.
+func TestInstallInterruptHandler(t *testing.T) {
+	if os.Getenv("C20PGUARD_INTERRUPT_CHILD") == "1" {
+		InstallInterruptHandler()
+		p, err := os.FindProcess(os.Getpid())
+		if err == nil {
+			err = p.Signal(os.Interrupt)
+		}
+		if err != nil {
+			os.Exit(2)
+		}
+		time.Sleep(10 * time.Second)
+		os.Exit(3)
+	}
+	if runtime.GOOS == "windows" {
+		t.Skip("cannot send an interrupt to a process on windows")
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestInstallInterruptHandler$")
+	cmd.Env = append(os.Environ(), "C20PGUARD_INTERRUPT_CHILD=1")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("interrupted process: %v\n%s", err, out)
+	}
+}
@@ -0,0 +1,284 @@
+// Command c20pguard encrypts and decrypts files with the streaming format
+// of chacha20poly1305guard.
+//
+//	c20pguard keygen -o key.guard
+//	c20pguard encrypt -k key.guard -in file -out file.enc
+//	c20pguard decrypt -k key.guard -in file.enc -out file
+//	c20pguard verify -k key.guard -in file.enc
+//	c20pguard encrypt -p passphrase.txt -in file -out file.enc
+//	c20pguard vectors -out vectors.json
+//	c20pguard field -k key.guard -name ssn -in app.log
+//
+// With -p instead of -k, the key is derived with Argon2id from the first
+// line of the given file, and the parameters and salt used are recorded
+// in a header before the stream so that decrypt and verify can derive it
+// again.
+//
+// A path of "-" means standard input or output. Output files are written
+// to a temporary file next to the destination and renamed into place
+// once complete, so a failed decryption never leaves partial plaintext
+// behind.
+//
+// The exit status is 0 on success, 1 for usage errors, 2 for I/O and
+// other errors, and 3 when authentication fails.
+package main
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/alexzava/chacha20poly1305guard"
+	"github.com/awnumar/memguard"
+)
+
+const (
+	exitOK = iota
+	exitUsage
+	exitError
+	exitAuth
+)
+
+func main() {
+	memguard.DisableUnixCoreDumps()
+
+	memguard.SafeExit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	if len(args) < 1 {
+		usage()
+		return exitUsage
+	}
+
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	keyPath := fs.String("k", "", "key file")
+	passPath := fs.String("p", "", "passphrase file, instead of -k")
+	in := fs.String("in", "-", "input file, or - for standard input")
+	out := fs.String("out", "-", "output file, or - for standard output")
+	keyOut := fs.String("o", "", "key file to create")
+	name := fs.String("name", "", "name of the log field")
+
+	var err error
+	switch args[0] {
+	case "keygen":
+		if fs.Parse(args[1:]) != nil || *keyOut == "" {
+			return exitUsage
+		}
+		err = keygen(*keyOut)
+
+	case "encrypt", "decrypt", "verify":
+		if fs.Parse(args[1:]) != nil || (*keyPath == "") == (*passPath == "") {
+			return exitUsage
+		}
+		err = crypt(args[0], *keyPath, *passPath, *in, *out)
+
+	case "field":
+		if fs.Parse(args[1:]) != nil || *keyPath == "" || *name == "" || fs.NArg() > 1 {
+			return exitUsage
+		}
+		err = field(*keyPath, *name, *in, fs.Arg(0))
+
+	case "vectors":
+		if fs.Parse(args[1:]) != nil {
+			return exitUsage
+		}
+		err = writeAtomic(*out, chacha20poly1305guard.GenerateTestVectors)
+
+	default:
+		usage()
+		return exitUsage
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "c20pguard %s: %v\n", args[0], err)
+		if errors.Is(err, chacha20poly1305guard.ErrAuthFailed) {
+			return exitAuth
+		}
+		return exitError
+	}
+	return exitOK
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage:
+  c20pguard keygen -o key
+  c20pguard encrypt -k key|-p passphrase [-in file] [-out file]
+  c20pguard decrypt -k key|-p passphrase [-in file] [-out file]
+  c20pguard verify -k key|-p passphrase [-in file]
+  c20pguard field -k key -name field [-in file] [token]
+  c20pguard vectors [-out file]`)
+}
+
+// keygen writes a new random key to path, which must not exist yet.
+func keygen(path string) error {
+	key, err := memguard.NewImmutableRandom(chacha20poly1305guard.KeySize)
+	if err != nil {
+		return err
+	}
+	defer key.Destroy()
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(key.Buffer()); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+func crypt(op, keyPath, passPath, inPath, outPath string) error {
+	in := io.Reader(os.Stdin)
+	if inPath != "-" {
+		f, err := os.Open(inPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var (
+		key    *memguard.LockedBuffer
+		header []byte
+		err    error
+	)
+	if passPath != "" {
+		key, header, err = passphraseKey(op, passPath, in)
+	} else {
+		key, err = chacha20poly1305guard.LoadKeyFromFile(keyPath)
+	}
+	if err != nil {
+		return err
+	}
+	defer key.Destroy()
+
+	switch op {
+	case "encrypt":
+		return writeAtomic(outPath, func(w io.Writer) error {
+			if _, err := w.Write(header); err != nil {
+				return err
+			}
+			return chacha20poly1305guard.EncryptStream(key, in, w)
+		})
+	case "decrypt":
+		return writeAtomic(outPath, func(w io.Writer) error {
+			return chacha20poly1305guard.DecryptStream(key, in, w)
+		})
+	default:
+		return chacha20poly1305guard.DecryptStream(key, in, ioutil.Discard)
+	}
+}
+
+// field decrypts a log field sealed with EncryptField. Given a token it
+// prints its value; otherwise it reads log lines, in JSON or logfmt, and
+// prints the value of the field in each line that has it.
+func field(keyPath, name, inPath, token string) error {
+	key, err := chacha20poly1305guard.LoadKeyFromFile(keyPath)
+	if err != nil {
+		return err
+	}
+	defer key.Destroy()
+
+	aead, err := chacha20poly1305guard.NewX(key)
+	if err != nil {
+		return err
+	}
+	defer aead.(chacha20poly1305guard.AEAD).Close()
+
+	if token != "" {
+		return printField(aead, name, token)
+	}
+
+	in := io.Reader(os.Stdin)
+	if inPath != "-" {
+		f, err := os.Open(inPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	s := bufio.NewScanner(in)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		if token, ok := fieldToken(s.Text(), name); ok {
+			if err := printField(aead, name, token); err != nil {
+				return err
+			}
+		}
+	}
+	return s.Err()
+}
+
+func printField(aead cipher.AEAD, name, token string) error {
+	value, err := chacha20poly1305guard.DecryptField(aead, name, token)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Printf("%s\n", value)
+	return err
+}
+
+// fieldToken returns the value of the field name in a JSON or logfmt
+// log line.
+func fieldToken(line, name string) (string, bool) {
+	if strings.HasPrefix(strings.TrimSpace(line), "{") {
+		var fields map[string]interface{}
+		if json.Unmarshal([]byte(line), &fields) != nil {
+			return "", false
+		}
+		token, ok := fields[name].(string)
+		return token, ok
+	}
+
+	for _, f := range strings.Fields(line) {
+		if strings.HasPrefix(f, name+"=") {
+			return strings.Trim(f[len(name)+1:], `"`), true
+		}
+	}
+	return "", false
+}
+
+// writeAtomic calls fn with a temporary file in the directory of path and
+// renames it to path if fn succeeds. For "-" it writes to standard
+// output directly, which cannot be undone.
+func writeAtomic(path string, fn func(w io.Writer) error) error {
+	if path == "-" {
+		return fn(os.Stdout)
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), ".c20pguard-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	if err := fn(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// runStdio calls run with os.Stdin reading stdin and returns the exit
+// status and what was written to os.Stdout.
+func runStdio(t *testing.T, stdin []byte, args ...string) (int, []byte) {
+	t.Helper()
+	dir := t.TempDir()
+	inPath, outPath := filepath.Join(dir, "stdin"), filepath.Join(dir, "stdout")
+	if err := ioutil.WriteFile(inPath, stdin, 0600); err != nil {
+		t.Fatal(err)
+	}
+	in, err := os.Open(inPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	out, err := os.Create(outPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	oldIn, oldOut := os.Stdin, os.Stdout
+	os.Stdin, os.Stdout = in, out
+	code := run(args)
+	os.Stdin, os.Stdout = oldIn, oldOut
+
+	b, err := ioutil.ReadFile(outPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code, b
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	key := filepath.Join(dir, "key.guard")
+	plain := filepath.Join(dir, "plain")
+	enc := filepath.Join(dir, "plain.enc")
+	dec := filepath.Join(dir, "plain.dec")
+	data := bytes.Repeat([]byte("plaintext "), 10000)
+	if err := ioutil.WriteFile(plain, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := run([]string{"keygen", "-o", key}); code != exitOK {
+		t.Fatalf("keygen: exit %d", code)
+	}
+	if code := run([]string{"keygen", "-o", key}); code != exitError {
+		t.Fatalf("keygen over an existing file: exit %d, want %d", code, exitError)
+	}
+	if code := run([]string{"encrypt", "-k", key, "-in", plain, "-out", enc}); code != exitOK {
+		t.Fatalf("encrypt: exit %d", code)
+	}
+	if code := run([]string{"verify", "-k", key, "-in", enc}); code != exitOK {
+		t.Fatalf("verify: exit %d", code)
+	}
+	if code := run([]string{"decrypt", "-k", key, "-in", enc, "-out", dec}); code != exitOK {
+		t.Fatalf("decrypt: exit %d", code)
+	}
+	if got, err := ioutil.ReadFile(dec); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("decrypted file differs: %v", err)
+	}
+
+	// A tampered file fails authentication and leaves no output behind.
+	b, err := ioutil.ReadFile(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)/2] ^= 1
+	if err := ioutil.WriteFile(enc, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if code := run([]string{"verify", "-k", key, "-in", enc}); code != exitAuth {
+		t.Fatalf("verify of a tampered file: exit %d, want %d", code, exitAuth)
+	}
+	out := filepath.Join(dir, "tampered.dec")
+	if code := run([]string{"decrypt", "-k", key, "-in", enc, "-out", out}); code != exitAuth {
+		t.Fatalf("decrypt of a tampered file: exit %d, want %d", code, exitAuth)
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Fatalf("decrypt of a tampered file left output behind: %v", err)
+	}
+	if left, _ := filepath.Glob(filepath.Join(dir, ".c20pguard-*")); len(left) != 0 {
+		t.Fatalf("temporary files left behind: %v", left)
+	}
+
+	for _, args := range [][]string{
+		{"decrypt", "-k", key, "-in", filepath.Join(dir, "missing")},
+		{"decrypt", "-k", filepath.Join(dir, "missing"), "-in", enc},
+		{"encrypt", "-k", key, "-in", plain, "-out", filepath.Join(dir, "missing", "out")},
+	} {
+		if code := run(args); code != exitError {
+			t.Errorf("%v: exit %d, want %d", args, code, exitError)
+		}
+	}
+	for _, args := range [][]string{
+		nil,
+		{"unknown"},
+		{"encrypt", "-in", plain},
+		{"encrypt", "-k", key, "-p", key},
+		{"keygen"},
+	} {
+		if code := run(args); code != exitUsage {
+			t.Errorf("%v: exit %d, want %d", args, code, exitUsage)
+		}
+	}
+}
+
+func TestRunStdio(t *testing.T) {
+	dir := t.TempDir()
+	key := filepath.Join(dir, "key.guard")
+	if code := run([]string{"keygen", "-o", key}); code != exitOK {
+		t.Fatalf("keygen: exit %d", code)
+	}
+	data := []byte("from standard input")
+
+	code, enc := runStdio(t, data, "encrypt", "-k", key, "-in", "-", "-out", "-")
+	if code != exitOK || len(enc) <= len(data) || bytes.Contains(enc, data) {
+		t.Fatalf("encrypt: exit %d, %d bytes", code, len(enc))
+	}
+	// -in and -out default to "-".
+	if code, dec := runStdio(t, enc, "decrypt", "-k", key); code != exitOK || !bytes.Equal(dec, data) {
+		t.Fatalf("decrypt: exit %d, %q", code, dec)
+	}
+	if code, _ := runStdio(t, enc[:len(enc)-1], "verify", "-k", key); code != exitAuth {
+		t.Fatalf("verify of a truncated stream: exit %d, want %d", code, exitAuth)
+	}
+}
+
+func TestRunPassphrase(t *testing.T) {
+	defer func(p argon2Params) { defaultArgon2 = p }(defaultArgon2)
+	defaultArgon2 = argon2Params{time: 1, memory: 64, threads: 1}
+
+	dir := t.TempDir()
+	pass := filepath.Join(dir, "pass")
+	wrong := filepath.Join(dir, "wrong")
+	if err := ioutil.WriteFile(pass, []byte("correct horse\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(wrong, []byte("battery staple\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("sealed with a passphrase")
+
+	code, enc := runStdio(t, data, "encrypt", "-p", pass)
+	if code != exitOK {
+		t.Fatalf("encrypt: exit %d", code)
+	}
+	p, _, err := decodePassphraseHeader(enc[:passphraseHeaderSize])
+	if err != nil || p != defaultArgon2 {
+		t.Fatalf("header records %+v, %v, want %+v", p, err, defaultArgon2)
+	}
+
+	if code, dec := runStdio(t, enc, "decrypt", "-p", pass); code != exitOK || !bytes.Equal(dec, data) {
+		t.Fatalf("decrypt: exit %d, %q", code, dec)
+	}
+	if code, _ := runStdio(t, enc, "decrypt", "-p", wrong); code != exitAuth {
+		t.Fatalf("wrong passphrase: exit %d, want %d", code, exitAuth)
+	}
+
+	// Changed parameters derive another key.
+	tampered := append([]byte(nil), enc...)
+	tampered[len(passphraseMagic)+1]++
+	if code, _ := runStdio(t, tampered, "verify", "-p", pass); code != exitAuth {
+		t.Fatalf("changed parameters: exit %d, want %d", code, exitAuth)
+	}
+
+	// Parameters out of range are rejected before deriving anything.
+	huge := append([]byte(nil), enc...)
+	huge[len(passphraseMagic)+5+3] = 0xff
+	if code, _ := runStdio(t, huge, "verify", "-p", pass); code != exitError {
+		t.Fatalf("huge memory parameter: exit %d, want %d", code, exitError)
+	}
+	if code, _ := runStdio(t, []byte("C2P"), "verify", "-p", pass); code != exitError {
+		t.Fatalf("short header: exit %d, want %d", code, exitError)
+	}
+	if code, _ := runStdio(t, enc, "verify", "-p", filepath.Join(dir, "missing")); code != exitError {
+		t.Fatalf("missing passphrase file: exit %d, want %d", code, exitError)
+	}
+}
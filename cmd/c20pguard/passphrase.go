@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/alexzava/chacha20poly1305guard"
+	"github.com/awnumar/memguard"
+	"golang.org/x/crypto/argon2"
+)
+
+// A file encrypted with a passphrase starts with a header recording how
+// its key was derived, followed by the usual stream:
+//
+//	"C2PW" | version | time uint32 | memory uint32 | threads | salt
+//
+// The integers are little endian and memory is in KiB. The header is not
+// authenticated by itself; changing it derives another key, so the
+// stream then fails to authenticate.
+const (
+	passphraseMagic      = "C2PW"
+	passphraseVersion    = 1
+	passphraseSaltSize   = 16
+	passphraseHeaderSize = len(passphraseMagic) + 1 + 4 + 4 + 1 + passphraseSaltSize
+
+	// maxPassphraseSize bounds what readPassphrase reads.
+	maxPassphraseSize = 1024
+)
+
+// argon2Params are the Argon2id parameters of a passphrase file.
+type argon2Params struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+}
+
+// defaultArgon2 is the second recommended option of RFC 9106: 3 passes
+// over 64 MiB with 4 lanes.
+var defaultArgon2 = argon2Params{time: 3, memory: 64 * 1024, threads: 4}
+
+// maxArgon2 bounds the parameters read from a header, so that a crafted
+// file cannot make decrypt use unbounded time or memory.
+var maxArgon2 = argon2Params{time: 64, memory: 4 * 1024 * 1024, threads: 64}
+
+var errPassphraseHeader = errors.New("not a passphrase-encrypted file")
+
+// passphraseKey derives the key of a passphrase file from the passphrase
+// in passPath. When encrypting it picks a new salt and returns the header
+// to write before the stream; otherwise it reads the header from in.
+func passphraseKey(op, passPath string, in io.Reader) (key *memguard.LockedBuffer, header []byte, err error) {
+	pass, err := readPassphrase(passPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer pass.Destroy()
+
+	var (
+		p    argon2Params
+		salt []byte
+	)
+	if op == "encrypt" {
+		p = defaultArgon2
+		salt = make([]byte, passphraseSaltSize)
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			return nil, nil, err
+		}
+		header = encodePassphraseHeader(p, salt)
+	} else {
+		h := make([]byte, passphraseHeaderSize)
+		if _, err := io.ReadFull(in, h); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil, nil, errPassphraseHeader
+			}
+			return nil, nil, err
+		}
+		if p, salt, err = decodePassphraseHeader(h); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	k := argon2.IDKey(pass.Buffer(), salt, p.time, p.memory, p.threads, uint32(chacha20poly1305guard.KeySize))
+	key, err = memguard.NewImmutableFromBytes(k)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, header, nil
+}
+
+func encodePassphraseHeader(p argon2Params, salt []byte) []byte {
+	h := make([]byte, passphraseHeaderSize)
+	n := copy(h, passphraseMagic)
+	h[n] = passphraseVersion
+	binary.LittleEndian.PutUint32(h[n+1:], p.time)
+	binary.LittleEndian.PutUint32(h[n+5:], p.memory)
+	h[n+9] = p.threads
+	copy(h[n+10:], salt)
+	return h
+}
+
+func decodePassphraseHeader(h []byte) (p argon2Params, salt []byte, err error) {
+	if !bytes.HasPrefix(h, []byte(passphraseMagic)) {
+		return p, nil, errPassphraseHeader
+	}
+	h = h[len(passphraseMagic):]
+	if h[0] != passphraseVersion {
+		return p, nil, fmt.Errorf("unsupported passphrase header version %d", h[0])
+	}
+	p.time = binary.LittleEndian.Uint32(h[1:])
+	p.memory = binary.LittleEndian.Uint32(h[5:])
+	p.threads = h[9]
+	if p.time < 1 || p.time > maxArgon2.time ||
+		p.threads < 1 || p.threads > maxArgon2.threads ||
+		p.memory < 8*uint32(p.threads) || p.memory > maxArgon2.memory {
+		return p, nil, fmt.Errorf("Argon2id parameters t=%d m=%d p=%d out of range", p.time, p.memory, p.threads)
+	}
+	return p, h[10:], nil
+}
+
+// readPassphrase reads the first line of the file at path into locked
+// memory.
+func readPassphrase(path string) (*memguard.LockedBuffer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	buf, err := memguard.NewMutable(maxPassphraseSize)
+	if err != nil {
+		return nil, err
+	}
+	defer buf.Destroy()
+	n, err := io.ReadFull(f, buf.Buffer())
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	if n == maxPassphraseSize {
+		return nil, fmt.Errorf("passphrase file %s is too large", path)
+	}
+
+	b := buf.Buffer()[:n]
+	if i := bytes.IndexAny(b, "\r\n"); i >= 0 {
+		b = b[:i]
+	}
+	if len(b) == 0 {
+		return nil, fmt.Errorf("passphrase file %s is empty", path)
+	}
+	return memguard.NewImmutableFromBytes(b)
+}
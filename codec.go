@@ -0,0 +1,83 @@
+package chacha20poly1305guard
+
+import (
+	"crypto/cipher"
+	"encoding/json"
+)
+
+// Codec serializes values sealed with SealJSON and OpenJSON.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// jsonCodec is the default Codec, backed by encoding/json.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// CodecOption configures SealJSON and OpenJSON.
+type CodecOption func(*codecConfig)
+
+type codecConfig struct {
+	codec Codec
+}
+
+// WithCodec replaces encoding/json with c, for example a msgpack codec.
+func WithCodec(c Codec) CodecOption {
+	return func(cfg *codecConfig) {
+		cfg.codec = c
+	}
+}
+
+func newCodecConfig(opts []CodecOption) *codecConfig {
+	cfg := &codecConfig{codec: jsonCodec{}}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return cfg
+}
+
+// SealJSON marshals v and seals the result with aead. The serialized
+// value is wiped once it has been sealed, but encoders may leave partial
+// copies of it in their own buffers.
+func SealJSON(aead cipher.AEAD, nonce []byte, v interface{}, data []byte, opts ...CodecOption) ([]byte, error) {
+	if len(nonce) != aead.NonceSize() {
+		return nil, &NonceError{Want: aead.NonceSize(), Got: len(nonce)}
+	}
+
+	plaintext, err := newCodecConfig(opts).codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(plaintext)
+
+	return aead.Seal(nil, nonce, plaintext, data), nil
+}
+
+// OpenJSON opens a ciphertext sealed with SealJSON and unmarshals it into
+// v. When aead comes from this package the serialized value is decrypted
+// into locked memory, otherwise into ordinary memory that is wiped after
+// unmarshaling. Either way v itself holds the secret afterwards.
+func OpenJSON(aead cipher.AEAD, nonce, ciphertext, data []byte, v interface{}, opts ...CodecOption) error {
+	if len(nonce) != aead.NonceSize() {
+		return &NonceError{Want: aead.NonceSize(), Got: len(nonce)}
+	}
+	codec := newCodecConfig(opts).codec
+
+	if k, ok := aead.(AEAD); ok {
+		return k.OpenWith(nonce, ciphertext, data, func(plaintext []byte) error {
+			return codec.Unmarshal(plaintext, v)
+		})
+	}
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, data)
+	if err != nil {
+		return err
+	}
+	defer wipe(plaintext)
+
+	return codec.Unmarshal(plaintext, v)
+}
@@ -0,0 +1,86 @@
+package chacha20poly1305guard
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"testing"
+)
+
+type sealedConfig struct {
+	User     string
+	Password string
+	Ports    []int
+}
+
+func TestSealJSON(t *testing.T) {
+	for _, v := range variants {
+		aead := testAEAD(t, v)
+		nonce := make([]byte, aead.NonceSize())
+		in := sealedConfig{User: "admin", Password: "hunter2", Ports: []int{80, 443}}
+
+		sealed, err := SealJSON(aead, nonce, in, []byte("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(sealed, []byte("hunter2")) {
+			t.Fatalf("%v: the plaintext is visible", v)
+		}
+
+		var out sealedConfig
+		if err := OpenJSON(aead, nonce, sealed, []byte("data"), &out); err != nil {
+			t.Fatalf("%v: %v", v, err)
+		}
+		if out.User != in.User || out.Password != in.Password || len(out.Ports) != 2 || out.Ports[1] != 443 {
+			t.Fatalf("%v: round trip gave %+v", v, out)
+		}
+
+		sealed[0] ^= 1
+		var tampered sealedConfig
+		if err := OpenJSON(aead, nonce, sealed, []byte("data"), &tampered); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("%v: tampered: got %v, want ErrAuthFailed", v, err)
+		}
+		if tampered.Password != "" {
+			t.Fatalf("%v: tampered ciphertext was unmarshaled", v)
+		}
+
+		if _, err := SealJSON(aead, nonce[1:], in, nil); !errors.Is(err, ErrInvalidNonce) {
+			t.Fatalf("%v: short nonce: got %v, want ErrInvalidNonce", v, err)
+		}
+		if _, err := SealJSON(aead, nonce, func() {}, nil); err == nil {
+			t.Fatalf("%v: value JSON cannot encode was sealed", v)
+		}
+	}
+}
+
+// gobCodec is a Codec other than encoding/json.
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	err := gob.NewEncoder(&b).Encode(v)
+	return b.Bytes(), err
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func TestSealJSONWithCodec(t *testing.T) {
+	aead := testAEAD(t, XChaCha20)
+	nonce := make([]byte, XNonceSize)
+	in := sealedConfig{User: "admin", Password: "hunter2"}
+
+	sealed, err := SealJSON(aead, nonce, in, nil, WithCodec(gobCodec{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out sealedConfig
+	if err := OpenJSON(aead, nonce, sealed, nil, &out, WithCodec(gobCodec{})); err != nil || out.User != "admin" || out.Password != "hunter2" {
+		t.Fatalf("gob round trip: %+v, %v", out, err)
+	}
+	// The codec is part of the format: JSON cannot read gob.
+	if err := OpenJSON(aead, nonce, sealed, nil, &out); err == nil {
+		t.Fatal("gob value decoded as JSON")
+	}
+}
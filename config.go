@@ -0,0 +1,411 @@
+package chacha20poly1305guard
+
+import (
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrInvalidPath is returned by EncryptConfig for a path that does not
+	// parse.
+	ErrInvalidPath = errors.New("invalid config path")
+
+	// ErrUnknownPath is returned by EncryptConfig for a path that does not
+	// exist in the document.
+	ErrUnknownPath = errors.New("config path not found")
+)
+
+// ConfigFormat is the syntax of a document given to EncryptConfig.
+type ConfigFormat int
+
+const (
+	// ConfigJSON is a JSON document.
+	ConfigJSON ConfigFormat = iota
+
+	// ConfigYAML is a YAML document in the subset used by configuration
+	// files: block mappings and sequences, flow collections, and
+	// scalars, plain or quoted, on a single line. Anchors, aliases,
+	// tags, block and multi-line scalars and multiple documents are
+	// rejected with ErrUnsupportedYAML. Comments are kept.
+	ConfigYAML
+)
+
+// configAAD prefixes the associated data of every config value.
+const configAAD = "chacha20poly1305guard config\x00"
+
+// EncryptConfig encrypts the values at paths in doc and leaves the rest
+// of the document, including key order, formatting and YAML comments,
+// byte for byte as it was, so encrypted files still diff well.
+//
+// A path is a dot separated list of keys, with [n] for array elements
+// and [*] for all of them, such as "db.password" or
+// "servers[*].tls.key". A path missing from doc fails with
+// ErrUnknownPath; a wildcard over an empty array matches nothing.
+//
+// Each value, of any type, is sealed as its raw text under a random
+// nonce, so aead must be XChaCha20Poly1305, and replaced by a double
+// quoted string holding "c2pg:" and the envelope in base64url, as
+// EncryptStruct does. In YAML the raw text of a value starts right after
+// its ':' or '-', so that a mapping or sequence on the lines below its
+// key is restored with its layout and comments.
+// Its concrete path, with array indexes, is authenticated with it: a
+// value moved to another key or index no longer decrypts. Values that
+// are already encrypted are left alone.
+func EncryptConfig(doc []byte, format ConfigFormat, paths []string, aead cipher.AEAD) ([]byte, error) {
+	root, err := parseConfig(doc, format)
+	if err != nil {
+		return nil, err
+	}
+
+	var edits []configEdit
+	for _, p := range paths {
+		segs, err := parseConfigPath(p)
+		if err != nil {
+			return nil, err
+		}
+		err = root.resolve(segs, nil, func(n *configNode, path []configSeg) error {
+			if n.encrypted(doc) != nil {
+				return nil
+			}
+			env, err := sealField(aead, doc[n.start:n.end], configPathAAD(path))
+			if err != nil {
+				return err
+			}
+			s, err := json.Marshal(encryptedStringPrefix + base64.RawURLEncoding.EncodeToString(env))
+			if err != nil {
+				return err
+			}
+			if n.afterIndicator {
+				s = append([]byte(" "), s...)
+			}
+			edits = append(edits, configEdit{n.start, n.end, s})
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+	}
+
+	return applyConfigEdits(doc, edits)
+}
+
+// DecryptConfig decrypts every value encrypted by EncryptConfig in doc,
+// leaving the rest of it untouched.
+func DecryptConfig(doc []byte, format ConfigFormat, aead cipher.AEAD) ([]byte, error) {
+	root, err := parseConfig(doc, format)
+	if err != nil {
+		return nil, err
+	}
+
+	var edits []configEdit
+	err = root.walk(nil, func(n *configNode, path []configSeg) error {
+		env := n.encrypted(doc)
+		if env == nil {
+			return nil
+		}
+		p, err := OpenEnvelope(aead, env, configPathAAD(path))
+		if err != nil {
+			return fmt.Errorf("%s: %w", formatConfigPath(path), err)
+		}
+		edits = append(edits, configEdit{n.start, n.end, p})
+		return nil
+	})
+	defer func() {
+		for _, e := range edits {
+			wipe(e.text)
+		}
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	return applyConfigEdits(doc, edits)
+}
+
+// configNode is a value of a parsed document, located by its byte range
+// so that it can be replaced without re-encoding the rest.
+type configNode struct {
+	start, end int
+	value      int  // start of the value itself, after start in YAML
+	kind       byte // '{', '[', '"', '\'', or 0 for other scalars
+	keys       []string
+	children   []*configNode
+
+	// afterIndicator is set for YAML values following a ':' or '-',
+	// which need a space before anything put in their place.
+	afterIndicator bool
+}
+
+// configSeg is one step of a path: a key, an index, or with wildcard
+// set, every element of an array.
+type configSeg struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+type configEdit struct {
+	start, end int
+	text       []byte
+}
+
+func parseConfig(doc []byte, format ConfigFormat) (*configNode, error) {
+	switch format {
+	case ConfigJSON:
+	case ConfigYAML:
+		return parseYAMLConfig(doc)
+	default:
+		return nil, fmt.Errorf("%w: config format %d", ErrUnknownFormat, format)
+	}
+	var v interface{}
+	if err := json.Unmarshal(doc, &v); err != nil {
+		return nil, err
+	}
+	n, _ := parseConfigNode(doc, 0)
+	return n, nil
+}
+
+// parseConfigNode parses the value starting at or after doc[i] and
+// returns it with the index just past it. doc must be valid JSON.
+func parseConfigNode(doc []byte, i int) (*configNode, int) {
+	i = skipJSONSpace(doc, i)
+	n := &configNode{start: i, value: i}
+
+	switch doc[i] {
+	case '{', '[':
+		n.kind = doc[i]
+		i = skipJSONSpace(doc, i+1)
+		for doc[i] != '}' && doc[i] != ']' {
+			if n.kind == '{' {
+				end := scanJSONString(doc, i)
+				var key string
+				json.Unmarshal(doc[i:end], &key)
+				n.keys = append(n.keys, key)
+				i = skipJSONSpace(doc, end) + 1 // the colon
+			}
+			var child *configNode
+			child, i = parseConfigNode(doc, i)
+			n.children = append(n.children, child)
+			if i = skipJSONSpace(doc, i); doc[i] == ',' {
+				i = skipJSONSpace(doc, i+1)
+			}
+		}
+		i++
+	case '"':
+		n.kind = '"'
+		i = scanJSONString(doc, i)
+	default:
+		for i < len(doc) && !strings.ContainsRune(",]} \t\r\n", rune(doc[i])) {
+			i++
+		}
+	}
+
+	n.end = i
+	return n, i
+}
+
+func skipJSONSpace(doc []byte, i int) int {
+	for i < len(doc) && strings.ContainsRune(" \t\r\n", rune(doc[i])) {
+		i++
+	}
+	return i
+}
+
+// scanJSONString returns the index just past the string starting at
+// doc[i].
+func scanJSONString(doc []byte, i int) int {
+	for i++; doc[i] != '"'; i++ {
+		if doc[i] == '\\' {
+			i++
+		}
+	}
+	return i + 1
+}
+
+// encrypted returns the envelope held by n if it is a string written by
+// EncryptConfig, or nil.
+func (n *configNode) encrypted(doc []byte) []byte {
+	if n.kind != '"' {
+		return nil
+	}
+	var s string
+	if json.Unmarshal(doc[n.value:n.end], &s) != nil {
+		return nil
+	}
+	env, ok := decodeEncryptedString(s)
+	if !ok {
+		return nil
+	}
+	return env
+}
+
+// resolve calls fn for every node matching segs below n, with its
+// concrete path.
+func (n *configNode) resolve(segs, path []configSeg, fn func(*configNode, []configSeg) error) error {
+	if len(segs) == 0 {
+		return fn(n, path)
+	}
+	s := segs[0]
+	path = path[:len(path):len(path)]
+
+	switch {
+	case s.wildcard:
+		if n.kind != '[' {
+			return fmt.Errorf("%w: %s is not an array", ErrUnknownPath, formatConfigPath(path))
+		}
+		for i, c := range n.children {
+			if err := c.resolve(segs[1:], append(path, configSeg{index: i, isIndex: true}), fn); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case s.isIndex:
+		if n.kind != '[' || s.index >= len(n.children) {
+			return fmt.Errorf("%w: %s", ErrUnknownPath, formatConfigPath(append(path, s)))
+		}
+		return n.children[s.index].resolve(segs[1:], append(path, s), fn)
+
+	default:
+		if n.kind == '{' {
+			for i, k := range n.keys {
+				if k == s.key {
+					return n.children[i].resolve(segs[1:], append(path, s), fn)
+				}
+			}
+		}
+		return fmt.Errorf("%w: %s", ErrUnknownPath, formatConfigPath(append(path, s)))
+	}
+}
+
+// walk calls fn for n and every node below it, with its path.
+func (n *configNode) walk(path []configSeg, fn func(*configNode, []configSeg) error) error {
+	if err := fn(n, path); err != nil {
+		return err
+	}
+	path = path[:len(path):len(path)]
+	for i, c := range n.children {
+		s := configSeg{index: i, isIndex: true}
+		if n.kind == '{' {
+			s = configSeg{key: n.keys[i]}
+		}
+		if err := c.walk(append(path, s), fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseConfigPath parses a path such as "servers[*].tls.key".
+func parseConfigPath(p string) ([]configSeg, error) {
+	var segs []configSeg
+	rest := p
+	for rest != "" {
+		if len(segs) > 0 {
+			switch rest[0] {
+			case '.':
+				rest = rest[1:]
+			case '[':
+			default:
+				return nil, fmt.Errorf("%w: %q", ErrInvalidPath, p)
+			}
+		}
+
+		if rest != "" && rest[0] == '[' {
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("%w: %q", ErrInvalidPath, p)
+			}
+			if rest[1:end] == "*" {
+				segs = append(segs, configSeg{wildcard: true})
+			} else {
+				i, err := strconv.Atoi(rest[1:end])
+				if err != nil || i < 0 {
+					return nil, fmt.Errorf("%w: %q", ErrInvalidPath, p)
+				}
+				segs = append(segs, configSeg{index: i, isIndex: true})
+			}
+			rest = rest[end+1:]
+			continue
+		}
+
+		end := strings.IndexAny(rest, ".[")
+		if end < 0 {
+			end = len(rest)
+		}
+		if end == 0 {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidPath, p)
+		}
+		segs = append(segs, configSeg{key: rest[:end]})
+		rest = rest[end:]
+	}
+	if len(segs) == 0 {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidPath, p)
+	}
+	return segs, nil
+}
+
+func formatConfigPath(path []configSeg) string {
+	var b strings.Builder
+	for _, s := range path {
+		if s.isIndex {
+			fmt.Fprintf(&b, "[%d]", s.index)
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(s.key)
+	}
+	return b.String()
+}
+
+// configPathAAD encodes a concrete path unambiguously, with keys length
+// prefixed, so that "a.b" as one key and as two never collide.
+func configPathAAD(path []configSeg) []byte {
+	ad := []byte(configAAD)
+	var n [8]byte
+	for _, s := range path {
+		if s.isIndex {
+			binary.LittleEndian.PutUint64(n[:], uint64(s.index))
+			ad = append(ad, 'i')
+			ad = append(ad, n[:]...)
+			continue
+		}
+		binary.LittleEndian.PutUint64(n[:], uint64(len(s.key)))
+		ad = append(ad, 'k')
+		ad = append(ad, n[:]...)
+		ad = append(ad, s.key...)
+	}
+	return ad
+}
+
+// applyConfigEdits returns doc with the given ranges replaced. Paths
+// that match the same value twice are fine; a value inside another one
+// being replaced is not.
+func applyConfigEdits(doc []byte, edits []configEdit) ([]byte, error) {
+	sort.Slice(edits, func(i, j int) bool { return edits[i].start < edits[j].start })
+
+	out := make([]byte, 0, len(doc))
+	last := 0
+	for i, e := range edits {
+		if i > 0 && e.start == edits[i-1].start {
+			continue
+		}
+		if e.start < last {
+			return nil, fmt.Errorf("%w: overlapping paths", ErrInvalidPath)
+		}
+		out = append(out, doc[last:e.start]...)
+		out = append(out, e.text...)
+		last = e.end
+	}
+	return append(out, doc[last:]...), nil
+}
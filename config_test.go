@@ -0,0 +1,279 @@
+package chacha20poly1305guard
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+const testConfigJSON = `{
+  "user":   "alice",
+  "db": {"host": "db.internal", "password": "hunter2", "port": 5432},
+  "servers": [
+    {"name": "a", "tls": {"key": "key-a", "cert": "cert-a"}},
+    {"name": "b", "tls": {"key": "key-b", "cert": "cert-b"}}
+  ],
+  "tokens": ["tok.1", "tok.2"],
+  "empty": [],
+  "limits": {"max": 10, "on": true, "off": null}
+}
+`
+
+const testConfigYAML = `# Service configuration.
+user: alice   # the login
+db:
+  host: db.internal
+  password: "hunter2"
+  port: 5432
+servers:
+  - name: a
+    tls:
+      key: key-a
+      cert: 'cert-a'
+  # the second server
+  - name: b
+    tls: {key: key-b, cert: cert-b}
+tokens: [tok.1, "tok.2"]
+empty: []
+limits:
+  max: 10
+  on: true
+  off:
+"quoted key": value
+`
+
+// encryptedConfigString matches the strings EncryptConfig puts in place
+// of the values it encrypts.
+var encryptedConfigString = regexp.MustCompile(`"c2pg:[A-Za-z0-9_-]+"`)
+
+func TestConfigRoundTrip(t *testing.T) {
+	aead := testAEAD(t, XChaCha20)
+	for _, tc := range []struct {
+		name    string
+		format  ConfigFormat
+		doc     string
+		paths   []string
+		secrets []string
+		kept    []string
+	}{
+		{
+			name:    "JSON",
+			format:  ConfigJSON,
+			doc:     testConfigJSON,
+			paths:   []string{"db.password", "servers[*].tls.key", "tokens", "limits.off", "empty[*]"},
+			secrets: []string{"hunter2", "key-a", "key-b", "tok.1"},
+			kept:    []string{`"user":   "alice",`, `"host": "db.internal", "password": "c2pg:`, `"cert": "cert-b"`, `"empty": [],`},
+		},
+		{
+			name:    "YAML",
+			format:  ConfigYAML,
+			doc:     testConfigYAML,
+			paths:   []string{"db.password", "servers[*].tls.key", "tokens", "limits", "empty[*]", "quoted key"},
+			secrets: []string{"hunter2", "key-a", "key-b", "tok.1", "max: 10", ": value"},
+			kept:    []string{"# Service configuration.\nuser: alice   # the login\n", "cert: 'cert-a'\n  # the second server\n", "tls: {key: \"c2pg:", "empty: []\nlimits: \"c2pg:"},
+		},
+	} {
+		out, err := EncryptConfig([]byte(tc.doc), tc.format, tc.paths, aead)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		for _, s := range tc.secrets {
+			if bytes.Contains(out, []byte(s)) {
+				t.Errorf("%s: %q left in the clear:\n%s", tc.name, s, out)
+			}
+		}
+		for _, s := range tc.kept {
+			if !bytes.Contains(out, []byte(s)) {
+				t.Errorf("%s: %q not kept as it was:\n%s", tc.name, s, out)
+			}
+		}
+		// Everything but the encrypted values is unchanged, except for
+		// the space YAML needs after a ':' or '-'.
+		rest := encryptedConfigString.Split(string(out), -1)
+		for i := range rest {
+			rest[i] = strings.TrimSuffix(rest[i], " ")
+		}
+		if !inOrder(tc.doc, rest) {
+			t.Errorf("%s: the text around the encrypted values changed:\n%s", tc.name, out)
+		}
+
+		// Encrypting again leaves encrypted values alone.
+		again, err := EncryptConfig(out, tc.format, tc.paths, aead)
+		if err != nil || !bytes.Equal(again, out) {
+			t.Errorf("%s: encrypting twice changed the document: %v\n%s", tc.name, err, again)
+		}
+
+		got, err := DecryptConfig(out, tc.format, aead)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if string(got) != tc.doc {
+			t.Fatalf("%s: round trip changed the document:\n%s", tc.name, got)
+		}
+	}
+}
+
+// inOrder reports whether every part appears in s, in order.
+func inOrder(s string, parts []string) bool {
+	for _, p := range parts {
+		i := strings.Index(s, p)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(p):]
+	}
+	return true
+}
+
+func TestConfigPathErrors(t *testing.T) {
+	aead := testAEAD(t, XChaCha20)
+	for _, format := range []ConfigFormat{ConfigJSON, ConfigYAML} {
+		doc := []byte(testConfigJSON)
+		if format == ConfigYAML {
+			doc = []byte(testConfigYAML)
+		}
+		for _, tc := range []struct {
+			path string
+			err  error
+		}{
+			{"missing", ErrUnknownPath},
+			{"db.missing", ErrUnknownPath},
+			{"db.password.x", ErrUnknownPath},
+			{"servers[2]", ErrUnknownPath},
+			{"db[*]", ErrUnknownPath},
+			{"user[0]", ErrUnknownPath},
+			{"", ErrInvalidPath},
+			{"db.", ErrInvalidPath},
+			{"db..password", ErrInvalidPath},
+			{"servers[x]", ErrInvalidPath},
+			{"servers[-1]", ErrInvalidPath},
+			{"servers[0", ErrInvalidPath},
+		} {
+			if _, err := EncryptConfig(doc, format, []string{tc.path}, aead); !errors.Is(err, tc.err) {
+				t.Errorf("format %d, path %q: got %v, want %v", format, tc.path, err, tc.err)
+			}
+		}
+
+		// A wildcard over an empty array matches nothing.
+		if out, err := EncryptConfig(doc, format, []string{"empty[*].key"}, aead); err != nil || !bytes.Equal(out, doc) {
+			t.Errorf("format %d: wildcard over an empty array: %v", format, err)
+		}
+
+		// The same value named twice is encrypted once; a value inside
+		// another one being encrypted is refused.
+		out, err := EncryptConfig(doc, format, []string{"db.password", "db.password", "servers[0].tls.key", "servers[*].tls.key"}, aead)
+		if err != nil {
+			t.Fatalf("format %d: %v", format, err)
+		}
+		if n := len(encryptedConfigString.FindAll(out, -1)); n != 3 {
+			t.Errorf("format %d: %d values encrypted, want 3", format, n)
+		}
+		if _, err := EncryptConfig(doc, format, []string{"db", "db.password"}, aead); !errors.Is(err, ErrInvalidPath) {
+			t.Errorf("format %d: overlapping paths: got %v, want ErrInvalidPath", format, err)
+		}
+	}
+
+	if _, err := EncryptConfig([]byte(`{}`), ConfigFormat(7), nil, aead); !errors.Is(err, ErrUnknownFormat) {
+		t.Fatalf("unknown format: got %v, want ErrUnknownFormat", err)
+	}
+}
+
+// TestConfigMovedValue checks that an encrypted value moved to another
+// key or index, or to another document, does not decrypt.
+func TestConfigMovedValue(t *testing.T) {
+	aead := testAEAD(t, XChaCha20)
+	for _, tc := range []struct {
+		format ConfigFormat
+		doc    string
+		paths  []string
+	}{
+		{ConfigJSON, `{"a": {"x": "one"}, "b": {"x": "two"}, "list": ["p", "q"]}`, []string{"a.x", "b.x", "list[*]"}},
+		{ConfigYAML, "a:\n  x: one\nb:\n  x: two\nlist:\n  - p\n  - q\n", []string{"a.x", "b.x", "list[*]"}},
+	} {
+		out, err := EncryptConfig([]byte(tc.doc), tc.format, tc.paths, aead)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := encryptedConfigString.FindAllString(string(out), -1)
+		if len(values) != 4 {
+			t.Fatalf("format %d: %d encrypted values, want 4", tc.format, len(values))
+		}
+		for _, swap := range [][2]int{{0, 1}, {2, 3}, {0, 2}} {
+			i, j := swap[0], swap[1]
+			moved := strings.Replace(string(out), values[i], "SWAP", 1)
+			moved = strings.Replace(moved, values[j], values[i], 1)
+			moved = strings.Replace(moved, "SWAP", values[j], 1)
+			if _, err := DecryptConfig([]byte(moved), tc.format, aead); !errors.Is(err, ErrAuthFailed) {
+				t.Errorf("format %d: values %d and %d swapped: got %v, want ErrAuthFailed", tc.format, i, j, err)
+			}
+		}
+	}
+}
+
+func TestConfigYAML(t *testing.T) {
+	aead := testAEAD(t, XChaCha20)
+	for _, tc := range []struct {
+		name, doc, path, want string
+	}{
+		{"block mapping", "a:\n  b: 1 # one\n  c: [2, 3]\nd: 4\n", "a", "a: \"c2pg:X\"\nd: 4\n"},
+		{"same indentation sequence", "a:\n- 1\n- 2\nb: 3\n", "a", "a: \"c2pg:X\"\nb: 3\n"},
+		{"sequence item", "- x\n- y: 1\n  z: 2\n- - p\n  - q\n", "[1]", "- x\n- \"c2pg:X\"\n- - p\n  - q\n"},
+		{"nested sequence", "- x\n- - p\n  - q\n", "[1][0]", "- x\n- - \"c2pg:X\"\n  - q\n"},
+		{"null", "a:\nb: 2\n", "a", "a: \"c2pg:X\"\nb: 2\n"},
+		{"flow mapping", "a: {b: 1, c: {d: 2}}\n", "a.c.d", "a: {b: 1, c: {d: \"c2pg:X\"}}\n"},
+		{"document marker", "---\na: 1\n", "a", "---\na: \"c2pg:X\"\n"},
+		{"crlf", "a: 1\r\nb:\r\n  c: 2\r\n", "b", "a: 1\r\nb: \"c2pg:X\"\r\n"},
+		{"url", "a: http://example.com:80/x # c\n", "a", "a: \"c2pg:X\" # c\n"},
+		{"single quoted", "'it''s': 'a ''b'''\n", "it's", "'it''s': \"c2pg:X\"\n"},
+		{"no trailing newline", "a: 1", "a", "a: \"c2pg:X\""},
+	} {
+		out, err := EncryptConfig([]byte(tc.doc), ConfigYAML, []string{tc.path}, aead)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if got := encryptedConfigString.ReplaceAllString(string(out), `"c2pg:X"`); got != tc.want {
+			t.Errorf("%s: encrypted to %q, want %q", tc.name, got, tc.want)
+		}
+		if back, err := DecryptConfig(out, ConfigYAML, aead); err != nil || string(back) != tc.doc {
+			t.Errorf("%s: decrypted to %q, %v", tc.name, back, err)
+		}
+	}
+}
+
+func TestConfigYAMLUnsupported(t *testing.T) {
+	aead := testAEAD(t, XChaCha20)
+	for name, doc := range map[string]string{
+		"anchor":              "a: &x 1\nb: *x\n",
+		"tag":                 "a: !secret 1\n",
+		"block scalar":        "a: |\n  line\n",
+		"folded scalar":       "a: >\n  line\n",
+		"multi-line plain":    "a: one\n  two\n",
+		"multi-line quoted":   "a: \"one\n  two\"\n",
+		"tab indentation":     "a:\n\tb: 1\n",
+		"bad indentation":     "a:\n    b: 1\n  c: 2\n",
+		"two documents":       "a: 1\n---\nb: 2\n",
+		"directive":           "%YAML 1.2\n---\na: 1\n",
+		"unterminated flow":   "a: [1, 2\n",
+		"mapping on key line": "a: b: 1\n",
+		"complex key":         "? a\n: 1\n",
+		"yaml escape":         "\"\\x41\": 1\n",
+		"trailing text":       "a: \"one\" two\n",
+	} {
+		if _, err := EncryptConfig([]byte(doc), ConfigYAML, []string{"a"}, aead); !errors.Is(err, ErrUnsupportedYAML) {
+			t.Errorf("%s: got %v, want ErrUnsupportedYAML", name, err)
+		}
+	}
+
+	// Comments and blank lines are fine anywhere.
+	doc := "\n# top\n\na: 1 # one\n\n  # indented comment\nb:\n  # before\n  c: 2\n"
+	out, err := EncryptConfig([]byte(doc), ConfigYAML, []string{"a", "b.c"}, aead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back, err := DecryptConfig(out, ConfigYAML, aead); err != nil || string(back) != doc {
+		t.Fatalf("decrypted to %q, %v", back, err)
+	}
+}
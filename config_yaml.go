@@ -0,0 +1,486 @@
+package chacha20poly1305guard
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrUnsupportedYAML is returned for YAML documents that are malformed
+// or use features outside the subset described at ConfigYAML.
+var ErrUnsupportedYAML = errors.New("unsupported YAML")
+
+// yamlParser parses the subset of YAML described at ConfigYAML into
+// configNodes located by byte range, as parseConfigNode does for JSON.
+//
+// Values that follow a ':' or '-' indicator start just after it, so
+// that their range also covers the space or line break before them: a
+// mapping moved to the line of its key by EncryptConfig comes back on
+// its own lines, exactly as it was, once decrypted.
+type yamlParser struct {
+	doc []byte
+}
+
+func parseYAMLConfig(doc []byte) (*configNode, error) {
+	y := &yamlParser{doc: doc}
+
+	p, err := y.nextContent(0)
+	if err != nil {
+		return nil, err
+	}
+	if p < len(doc) && doc[p] == '%' {
+		return nil, y.errorf(p, "directives are not supported")
+	}
+	if y.marker(p, "---") {
+		if p, err = y.lineEnd(p + 3); err != nil {
+			return nil, err
+		}
+		if p, err = y.nextContent(p); err != nil {
+			return nil, err
+		}
+	}
+	if p == len(doc) {
+		return &configNode{start: p, value: p, end: p}, nil
+	}
+
+	root, next, err := y.parseBlock(p)
+	if err != nil {
+		return nil, err
+	}
+	if next < len(doc) {
+		if y.marker(next, "---") || y.marker(next, "...") {
+			return nil, y.errorf(next, "multiple documents are not supported")
+		}
+		return nil, y.errorf(next, "unexpected content")
+	}
+	return root, nil
+}
+
+func (y *yamlParser) errorf(i int, format string, a ...interface{}) error {
+	line := 1 + bytes.Count(y.doc[:i], []byte("\n"))
+	return fmt.Errorf("%w: line %d: %s", ErrUnsupportedYAML, line, fmt.Sprintf(format, a...))
+}
+
+// column returns the column of doc[i] within its line.
+func (y *yamlParser) column(i int) int {
+	return i - (bytes.LastIndexByte(y.doc[:i], '\n') + 1)
+}
+
+// marker reports whether a document marker such as "---" is at doc[i],
+// at the start of a line.
+func (y *yamlParser) marker(i int, m string) bool {
+	return i < len(y.doc) && y.column(i) == 0 && bytes.HasPrefix(y.doc[i:], []byte(m)) &&
+		(i+3 == len(y.doc) || isYAMLSpace(y.doc[i+3]))
+}
+
+func isYAMLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+// nextContent returns the index of the first character of the next
+// line, at or after the line starting at doc[i], that is neither blank
+// nor a comment, or len(doc).
+func (y *yamlParser) nextContent(i int) (int, error) {
+	for i < len(y.doc) {
+		j := i
+		for j < len(y.doc) && y.doc[j] == ' ' {
+			j++
+		}
+		if j < len(y.doc) && !isYAMLSpace(y.doc[j]) && y.doc[j] != '#' {
+			return j, nil
+		}
+		end, err := y.lineEnd(j)
+		if err != nil {
+			return 0, y.errorf(j, "tab in indentation")
+		}
+		i = end
+	}
+	return i, nil
+}
+
+// lineEnd checks that only spaces and a comment follow doc[i] on its
+// line and returns the start of the next line.
+func (y *yamlParser) lineEnd(i int) (int, error) {
+	j := i
+	for j < len(y.doc) && (y.doc[j] == ' ' || y.doc[j] == '\t') {
+		j++
+	}
+	if j < len(y.doc) && y.doc[j] == '#' && (j == 0 || isYAMLSpace(y.doc[j-1])) {
+		for j < len(y.doc) && y.doc[j] != '\n' {
+			j++
+		}
+	}
+	if j < len(y.doc) && y.doc[j] == '\r' {
+		j++
+	}
+	switch {
+	case j == len(y.doc):
+		return j, nil
+	case y.doc[j] == '\n':
+		return j + 1, nil
+	}
+	return 0, y.errorf(j, "unexpected %q", y.doc[j])
+}
+
+// isSeqEntry reports whether a block sequence entry starts at doc[i].
+func (y *yamlParser) isSeqEntry(i int) bool {
+	return y.doc[i] == '-' && (i+1 == len(y.doc) || isYAMLSpace(y.doc[i+1]))
+}
+
+// parseBlock parses the node whose first character is doc[p] and
+// returns it with the start of the content that follows it.
+func (y *yamlParser) parseBlock(p int) (*configNode, int, error) {
+	if y.isSeqEntry(p) {
+		return y.parseSeq(p)
+	}
+	if _, _, ok, err := y.mappingKey(p); err != nil {
+		return nil, 0, err
+	} else if ok {
+		return y.parseMap(p)
+	}
+	n, err := y.parseInline(p)
+	if err != nil {
+		return nil, 0, err
+	}
+	next, err := y.afterLine(n.end)
+	return n, next, err
+}
+
+// afterLine checks the rest of the line of doc[i] and returns the start
+// of the content that follows it.
+func (y *yamlParser) afterLine(i int) (int, error) {
+	end, err := y.lineEnd(i)
+	if err != nil {
+		return 0, err
+	}
+	return y.nextContent(end)
+}
+
+// parseMap parses the block mapping whose first key is at doc[p].
+func (y *yamlParser) parseMap(p int) (*configNode, int, error) {
+	indent := y.column(p)
+	n := &configNode{start: p, value: p, kind: '{'}
+	for {
+		key, colon, ok, err := y.mappingKey(p)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !ok {
+			return nil, 0, y.errorf(p, "expected a mapping key")
+		}
+		child, next, err := y.parseValue(colon, indent, false)
+		if err != nil {
+			return nil, 0, err
+		}
+		n.keys = append(n.keys, key)
+		n.children = append(n.children, child)
+		n.end = child.end
+
+		if p = next; p == len(y.doc) || y.column(p) < indent || y.marker(p, "---") || y.marker(p, "...") {
+			return n, p, nil
+		}
+		if y.column(p) > indent || y.isSeqEntry(p) {
+			return nil, 0, y.errorf(p, "bad indentation")
+		}
+	}
+}
+
+// parseSeq parses the block sequence whose first entry is at doc[p].
+func (y *yamlParser) parseSeq(p int) (*configNode, int, error) {
+	indent := y.column(p)
+	n := &configNode{start: p, value: p, kind: '['}
+	for {
+		child, next, err := y.parseValue(p+1, indent, true)
+		if err != nil {
+			return nil, 0, err
+		}
+		n.children = append(n.children, child)
+		n.end = child.end
+
+		if p = next; p == len(y.doc) || y.column(p) < indent {
+			return n, p, nil
+		}
+		if y.column(p) > indent {
+			return nil, 0, y.errorf(p, "bad indentation")
+		}
+		// A sequence may be the value of a key at its own indentation,
+		// in which case the next key ends it.
+		if !y.isSeqEntry(p) {
+			return n, p, nil
+		}
+	}
+}
+
+// parseValue parses the value following the indicator just before
+// doc[i], a ':' of a mapping or a '-' of a sequence whose entries are
+// at column indent.
+func (y *yamlParser) parseValue(i, indent int, inSeq bool) (*configNode, int, error) {
+	j := i
+	for j < len(y.doc) && (y.doc[j] == ' ' || y.doc[j] == '\t') {
+		j++
+	}
+
+	var n *configNode
+	var next int
+	var err error
+	switch {
+	case j == len(y.doc) || y.doc[j] == '\r' || y.doc[j] == '\n' || y.doc[j] == '#':
+		// The value is on the lines below, or there is none.
+		if next, err = y.afterLine(j); err != nil {
+			return nil, 0, err
+		}
+		if next < len(y.doc) && (y.column(next) > indent || !inSeq && y.column(next) == indent && y.isSeqEntry(next)) {
+			if n, next, err = y.parseBlock(next); err != nil {
+				return nil, 0, err
+			}
+		} else {
+			n = &configNode{value: i, end: i}
+		}
+
+	case inSeq && y.isSeqEntry(j):
+		n, next, err = y.parseSeq(j)
+
+	default:
+		var key bool
+		if _, _, key, err = y.mappingKey(j); err != nil {
+			return nil, 0, err
+		}
+		switch {
+		case key && inSeq:
+			n, next, err = y.parseMap(j)
+		case key || y.isSeqEntry(j):
+			return nil, 0, y.errorf(j, "a block collection must start on its own line")
+		default:
+			if n, err = y.parseInline(j); err != nil {
+				return nil, 0, err
+			}
+			if next, err = y.afterLine(n.end); err != nil {
+				return nil, 0, err
+			}
+			if next < len(y.doc) && y.column(next) > indent {
+				return nil, 0, y.errorf(next, "multi-line scalars are not supported")
+			}
+		}
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	n.start = i
+	n.afterIndicator = true
+	return n, next, nil
+}
+
+// mappingKey reports whether a block mapping key starts at doc[p], and
+// if so returns it with the index just past its colon.
+func (y *yamlParser) mappingKey(p int) (key string, colon int, ok bool, err error) {
+	var end int
+	switch y.doc[p] {
+	case '"', '\'':
+		n, err := y.parseQuoted(p)
+		if err != nil {
+			return "", 0, false, err
+		}
+		for end = n.end; end < len(y.doc) && (y.doc[end] == ' ' || y.doc[end] == '\t'); end++ {
+		}
+		if end == len(y.doc) || y.doc[end] != ':' {
+			return "", 0, false, nil
+		}
+		if key, err = y.quotedValue(n); err != nil {
+			return "", 0, false, err
+		}
+	case '[', ']', '{', '}', ',', '&', '*', '!', '|', '>', '%', '@', '`', '#', '?':
+		return "", 0, false, nil
+	default:
+		line := y.doc[p:]
+		if nl := bytes.IndexByte(line, '\n'); nl >= 0 {
+			line = line[:nl]
+		}
+		end = -1
+		for k := 0; k < len(line); k++ {
+			if line[k] == '#' && k > 0 && (line[k-1] == ' ' || line[k-1] == '\t') {
+				break
+			}
+			if line[k] == ':' && (k+1 == len(line) || isYAMLSpace(line[k+1])) {
+				end = p + k
+				break
+			}
+		}
+		if end < 0 {
+			return "", 0, false, nil
+		}
+		key = strings.TrimRight(string(y.doc[p:end]), " \t")
+	}
+	if end+1 < len(y.doc) && !isYAMLSpace(y.doc[end+1]) {
+		return "", 0, false, nil
+	}
+	return key, end + 1, true, nil
+}
+
+// parseInline parses the flow collection or single line scalar at
+// doc[j].
+func (y *yamlParser) parseInline(j int) (*configNode, error) {
+	switch c := y.doc[j]; c {
+	case '"', '\'':
+		return y.parseQuoted(j)
+	case '[', '{':
+		return y.parseFlow(j)
+	case '&', '*', '!':
+		return nil, y.errorf(j, "anchors, aliases and tags are not supported")
+	case '|', '>':
+		return nil, y.errorf(j, "block scalars are not supported")
+	case ']', '}', ',', '%', '@', '`', '?':
+		return nil, y.errorf(j, "unexpected %q", c)
+	}
+
+	end := j
+	for end < len(y.doc) && y.doc[end] != '\n' {
+		if y.doc[end] == '#' && (y.doc[end-1] == ' ' || y.doc[end-1] == '\t') {
+			break
+		}
+		end++
+	}
+	for isYAMLSpace(y.doc[end-1]) {
+		end--
+	}
+	return &configNode{start: j, value: j, end: end}, nil
+}
+
+// parseQuoted parses the single line quoted scalar at doc[j].
+func (y *yamlParser) parseQuoted(j int) (*configNode, error) {
+	q := y.doc[j]
+	for i := j + 1; i < len(y.doc) && y.doc[i] != '\n'; i++ {
+		switch {
+		case q == '"' && y.doc[i] == '\\':
+			i++
+		case y.doc[i] == q && q == '\'' && i+1 < len(y.doc) && y.doc[i+1] == '\'':
+			i++
+		case y.doc[i] == q:
+			return &configNode{start: j, value: j, end: i + 1, kind: q}, nil
+		}
+	}
+	return nil, y.errorf(j, "unterminated or multi-line quoted scalar")
+}
+
+// quotedValue returns the string held by the quoted scalar n. Double
+// quoted scalars may only use the escapes JSON has.
+func (y *yamlParser) quotedValue(n *configNode) (string, error) {
+	text := y.doc[n.value:n.end]
+	if n.kind == '\'' {
+		return strings.Replace(string(text[1:len(text)-1]), "''", "'", -1), nil
+	}
+	var s string
+	if err := json.Unmarshal(text, &s); err != nil {
+		return "", y.errorf(n.value, "unsupported escape in %s", text)
+	}
+	return s, nil
+}
+
+// skipFlowSpace skips the spaces, line breaks and comments inside a
+// flow collection.
+func (y *yamlParser) skipFlowSpace(i int) int {
+	for i < len(y.doc) {
+		switch c := y.doc[i]; {
+		case isYAMLSpace(c):
+			i++
+		case c == '#' && isYAMLSpace(y.doc[i-1]):
+			for i < len(y.doc) && y.doc[i] != '\n' {
+				i++
+			}
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// parseFlow parses the flow sequence or mapping at doc[j], such as
+// [a, b] or {a: 1, b: 2}.
+func (y *yamlParser) parseFlow(j int) (*configNode, error) {
+	n := &configNode{start: j, value: j, kind: y.doc[j]}
+	closer := byte(']')
+	if n.kind == '{' {
+		closer = '}'
+	}
+
+	i := y.skipFlowSpace(j + 1)
+	for {
+		if i == len(y.doc) {
+			return nil, y.errorf(j, "unterminated flow collection")
+		}
+		if y.doc[i] == closer {
+			n.end = i + 1
+			return n, nil
+		}
+
+		if n.kind == '{' {
+			k, err := y.parseFlowScalar(i, true)
+			if err != nil {
+				return nil, err
+			}
+			key := string(y.doc[k.value:k.end])
+			if k.kind != 0 {
+				if key, err = y.quotedValue(k); err != nil {
+					return nil, err
+				}
+			}
+			if i = y.skipFlowSpace(k.end); i == len(y.doc) || y.doc[i] != ':' {
+				return nil, y.errorf(k.start, "expected ':' after a flow mapping key")
+			}
+			i = y.skipFlowSpace(i + 1)
+			n.keys = append(n.keys, key)
+		}
+
+		var child *configNode
+		var err error
+		if i < len(y.doc) && (y.doc[i] == '[' || y.doc[i] == '{') {
+			child, err = y.parseFlow(i)
+		} else {
+			child, err = y.parseFlowScalar(i, false)
+		}
+		if err != nil {
+			return nil, err
+		}
+		n.children = append(n.children, child)
+
+		if i = y.skipFlowSpace(child.end); i < len(y.doc) && y.doc[i] == ',' {
+			i = y.skipFlowSpace(i + 1)
+		} else if i < len(y.doc) && y.doc[i] != closer {
+			return nil, y.errorf(i, "expected ',' or %q", closer)
+		}
+	}
+}
+
+// parseFlowScalar parses the scalar at doc[i] inside a flow collection.
+// A plain key ends at its colon.
+func (y *yamlParser) parseFlowScalar(i int, key bool) (*configNode, error) {
+	if i == len(y.doc) {
+		return nil, y.errorf(i, "unterminated flow collection")
+	}
+	switch c := y.doc[i]; c {
+	case '"', '\'':
+		return y.parseQuoted(i)
+	case '&', '*', '!', '|', '>', '%', '@', '`', '?', ',', ']', '}', '[', '{', '#':
+		return nil, y.errorf(i, "unexpected %q in a flow collection", c)
+	}
+
+	end := i
+	for end < len(y.doc) {
+		c := y.doc[end]
+		if c == '\n' || c == ',' || c == ']' || c == '}' || c == '[' || c == '{' ||
+			c == '#' && isYAMLSpace(y.doc[end-1]) ||
+			c == ':' && (key || end+1 == len(y.doc) || isYAMLSpace(y.doc[end+1]) || strings.IndexByte(",]}", y.doc[end+1]) >= 0) {
+			break
+		}
+		end++
+	}
+	for end > i && isYAMLSpace(y.doc[end-1]) {
+		end--
+	}
+	if end == i {
+		return nil, y.errorf(i, "empty flow entry")
+	}
+	return &configNode{start: i, value: i, end: end}, nil
+}
@@ -0,0 +1,102 @@
+package chacha20poly1305guard
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"github.com/awnumar/memguard"
+	"golang.org/x/crypto/hkdf"
+)
+
+// MaxContextLength is the longest context accepted by NewWithContext.
+const MaxContextLength = 255
+
+// ErrInvalidContext is returned for an empty context, or one longer than
+// MaxContextLength.
+var ErrInvalidContext = errors.New("invalid key derivation context")
+
+// contextInfo prefixes the HKDF info of every derived key, so that keys
+// derived by this package never coincide with keys derived from the same
+// master key by other software.
+const contextInfo = "chacha20poly1305guard context v1\x00"
+
+// NewWithContext returns a ChaCha20Poly1305 AEAD keyed with a subkey
+// derived from key with HKDF-SHA256, using context as the info. One
+// master key can then serve several features with cryptographic
+// separation: ciphertexts sealed under the context "sessions" do not
+// open under "backups". context must be between 1 and MaxContextLength
+// bytes.
+//
+// The subkey is written straight into a new LockedBuffer owned by the
+// AEAD, and destroyed by Close. The master key is only read, and may be
+// destroyed once NewWithContext returns; note that the HMAC state inside
+// HKDF briefly holds it in ordinary memory.
+func NewWithContext(key *memguard.LockedBuffer, context string, opts ...Option) (cipher.AEAD, error) {
+	return newWithContext(key, ChaCha20, context, opts)
+}
+
+// NewXWithContext is the XChaCha20Poly1305 counterpart of
+// NewWithContext.
+func NewXWithContext(key *memguard.LockedBuffer, context string, opts ...Option) (cipher.AEAD, error) {
+	return newWithContext(key, XChaCha20, context, opts)
+}
+
+// NewLabeled returns an AEAD of the given variant keyed with the subkey
+// of master for label, for apps that use one master key for several
+// purposes, such as "cookies" and "files". It is NewWithContext or
+// NewXWithContext with the variant as a parameter, and derives the same
+// keys: the same label always gives the same subkey, and different
+// labels independent ones.
+func NewLabeled(master *memguard.LockedBuffer, label string, variant Variant) (cipher.AEAD, error) {
+	return newWithContext(master, variant, label, nil)
+}
+
+func newWithContext(key *memguard.LockedBuffer, v Variant, context string, opts []Option) (cipher.AEAD, error) {
+	if len(context) == 0 || len(context) > MaxContextLength {
+		return nil, ErrInvalidContext
+	}
+
+	sub, err := deriveKey(key, context)
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := newAEAD(sub, v, opts)
+	if err != nil {
+		keyUsage.destroy(sub)
+		return nil, err
+	}
+	k.owned = sub
+
+	return k, nil
+}
+
+// deriveKey derives a KeySize subkey of key for info into a new
+// immutable LockedBuffer, tracked as a key buffer.
+func deriveKey(key *memguard.LockedBuffer, info string) (*memguard.LockedBuffer, error) {
+	if key.IsDestroyed() {
+		return nil, ErrKeyDestroyed
+	}
+	if key.Size() != KeySize {
+		return nil, &SizeError{Field: "key", Want: KeySize, Got: key.Size(), Err: ErrInvalidKey}
+	}
+
+	sub, err := keyUsage.track(newMutable(KeySize))
+	if err != nil {
+		return nil, err
+	}
+
+	r := hkdf.New(sha256.New, key.Buffer(), nil, []byte(contextInfo+info))
+	if _, err := io.ReadFull(r, sub.Buffer()); err != nil {
+		keyUsage.destroy(sub)
+		return nil, err
+	}
+	if err := sub.MakeImmutable(); err != nil {
+		keyUsage.destroy(sub)
+		return nil, err
+	}
+
+	return sub, nil
+}
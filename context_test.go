@@ -0,0 +1,157 @@
+package chacha20poly1305guard
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/awnumar/memguard"
+	"golang.org/x/crypto/hkdf"
+)
+
+func TestNewWithContext(t *testing.T) {
+	master := lockedBytes(t, bytes.Repeat([]byte{9}, KeySize))
+	sessions, err := NewWithContext(master, "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sessions.(AEAD).Close()
+	backups, err := NewWithContext(master, "backups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backups.(AEAD).Close()
+
+	// The subkey is HKDF-SHA256 of the master key with the prefixed
+	// context as info.
+	sub := make([]byte, KeySize)
+	io.ReadFull(hkdf.New(sha256.New, master.Buffer(), nil, []byte(contextInfo+"sessions")), sub)
+	direct, err := NewUnlockedForTesting(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The master key is not needed once the AEADs exist.
+	master.Destroy()
+
+	nonce := make([]byte, NonceSize)
+	sealed := sessions.Seal(nil, nonce, []byte("plaintext"), []byte("data"))
+	if want := direct.Seal(nil, nonce, []byte("plaintext"), []byte("data")); !bytes.Equal(sealed, want) {
+		t.Fatal("subkey does not match HKDF-SHA256 of the context")
+	}
+	if p, err := sessions.Open(nil, nonce, sealed, []byte("data")); err != nil || string(p) != "plaintext" {
+		t.Fatalf("open under the same context: %q, %v", p, err)
+	}
+	if _, err := backups.Open(nil, nonce, sealed, []byte("data")); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("open under another context: got %v, want ErrAuthFailed", err)
+	}
+
+	if _, err := NewWithContext(master, "sessions"); err != ErrKeyDestroyed {
+		t.Fatalf("destroyed master key: got %v, want ErrKeyDestroyed", err)
+	}
+}
+
+func TestNewWithContextInvalid(t *testing.T) {
+	master := testKey(t)
+	for _, newContext := range []func(*memguard.LockedBuffer, string, ...Option) (cipher.AEAD, error){NewWithContext, NewXWithContext} {
+		for _, context := range []string{"", strings.Repeat("x", MaxContextLength+1)} {
+			if _, err := newContext(master, context); err != ErrInvalidContext {
+				t.Fatalf("context of %d bytes: got %v, want ErrInvalidContext", len(context), err)
+			}
+		}
+		aead, err := newContext(master, strings.Repeat("x", MaxContextLength))
+		if err != nil {
+			t.Fatalf("context of MaxContextLength bytes: %v", err)
+		}
+		aead.(AEAD).Close()
+	}
+
+	short := lockedBytes(t, make([]byte, KeySize-1))
+	if _, err := NewXWithContext(short, "sessions"); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("short master key: got %v, want ErrInvalidKey", err)
+	}
+}
+
+func TestNewLabeled(t *testing.T) {
+	master := testKey(t)
+	for _, v := range variants {
+		t.Run(v.String(), func(t *testing.T) {
+			labeled := func(label string) AEAD {
+				t.Helper()
+				aead, err := NewLabeled(master, label, v)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { aead.(AEAD).Close() })
+				return aead.(AEAD)
+			}
+			cookies, cookies2, files := labeled("cookies"), labeled("cookies"), labeled("files")
+
+			nonce := make([]byte, cookies.NonceSize())
+			plaintext := []byte("plaintext")
+			sealed := cookies.Seal(nil, nonce, plaintext, nil)
+
+			if again := cookies2.Seal(nil, nonce, plaintext, nil); !bytes.Equal(again, sealed) {
+				t.Fatal("the same label derived a different key")
+			}
+			if out, err := cookies2.Open(nil, nonce, sealed, nil); err != nil || !bytes.Equal(out, plaintext) {
+				t.Fatalf("Open under the same label: %v", err)
+			}
+			if _, err := files.Open(nil, nonce, sealed, nil); err == nil {
+				t.Fatal("ciphertext opened under another label")
+			}
+			if bytes.Equal(files.Seal(nil, nonce, plaintext, nil), sealed) {
+				t.Fatal("different labels derived the same key")
+			}
+			if bytes.Equal(testAEAD(t, v).Seal(nil, nonce, plaintext, nil), sealed) {
+				t.Fatal("labeled key is the master key")
+			}
+		})
+	}
+}
+
+// TestNewLabeledMatchesContext checks that NewLabeled derives the keys of
+// NewWithContext and NewXWithContext, so data sealed with either opens
+// with the other.
+func TestNewLabeledMatchesContext(t *testing.T) {
+	master := testKey(t)
+	for _, v := range variants {
+		labeled, err := NewLabeled(master, "files", v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer labeled.(AEAD).Close()
+		newContext := NewWithContext
+		if v == XChaCha20 {
+			newContext = NewXWithContext
+		}
+		context, err := newContext(master, "files")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer context.(AEAD).Close()
+
+		nonce := make([]byte, labeled.NonceSize())
+		if !bytes.Equal(labeled.Seal(nil, nonce, nil, nil), context.Seal(nil, nonce, nil, nil)) {
+			t.Fatalf("%v: NewLabeled and the context constructor derive different keys", v)
+		}
+	}
+}
+
+func TestNewLabeledInvalidLabel(t *testing.T) {
+	master := testKey(t)
+	for _, label := range []string{"", strings.Repeat("x", MaxContextLength+1)} {
+		if _, err := NewLabeled(master, label, XChaCha20); err != ErrInvalidContext {
+			t.Fatalf("label of %d bytes: got %v, want ErrInvalidContext", len(label), err)
+		}
+	}
+	if aead, err := NewLabeled(master, strings.Repeat("x", MaxContextLength), XChaCha20); err != nil {
+		t.Fatalf("label of MaxContextLength bytes: %v", err)
+	} else {
+		aead.(AEAD).Close()
+	}
+}
@@ -0,0 +1,165 @@
+package chacha20poly1305guard
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"time"
+)
+
+var (
+	// ErrCookieExpired is returned by DecodeCookie for an authentic
+	// cookie whose maximum age has passed.
+	ErrCookieExpired = errors.New("cookie expired")
+
+	// ErrCookieName is the cause DecodeCookie gives for a cookie that
+	// fails to authenticate and whose name hash does not match the name
+	// it was given, most likely one encoded under a different name.
+	ErrCookieName = errors.New("cookie encoded for a different name")
+)
+
+// DefaultCookieClockSkew is the clock skew a new CookieCodec tolerates.
+const DefaultCookieClockSkew = time.Minute
+
+// cookieVersion is the first byte of every cookie.
+const cookieVersion = 1
+
+// cookieHeaderSize is the size of the authenticated header of a cookie:
+// version, issue time in Unix seconds as uint64 LE, maximum age in
+// seconds as uint32 LE, and the first 4 bytes of SHA-256 of the name.
+const cookieHeaderSize = 1 + 8 + 4 + 4
+
+// CookieCodec encodes values into compact, authenticated and encrypted
+// cookie or session tokens, like gorilla/securecookie but built on
+// XChaCha20Poly1305. A token is the unpadded base64url encoding of
+//
+//	header | nonce | ciphertext
+//
+// where the header holds the issue time, the maximum age and a short
+// hash of the cookie name. The header and the full name are
+// authenticated, so a token cannot be replayed under another name or
+// have its lifetime extended. The value itself is encrypted.
+//
+// New tokens are encoded with the current AEAD; tokens encoded with any
+// of the previous ones still decode, so keys can be rotated without
+// logging everybody out. A CookieCodec is safe for concurrent use.
+type CookieCodec struct {
+	aeads []cipher.AEAD
+
+	// MaxClockSkew is how far the clocks of the servers sharing the
+	// keys may disagree. Cookies are accepted up to MaxClockSkew after
+	// they expire, and from MaxClockSkew before they were issued. It
+	// must not be changed while the codec is in use.
+	MaxClockSkew time.Duration
+
+	now func() time.Time
+}
+
+// NewCookieCodec returns a CookieCodec encoding with current and
+// decoding with current and previous, which are tried in order. All of
+// them must be XChaCha20Poly1305 AEADs, since every cookie gets a random
+// nonce.
+func NewCookieCodec(current cipher.AEAD, previous ...cipher.AEAD) (*CookieCodec, error) {
+	aeads := append([]cipher.AEAD{current}, previous...)
+	for _, a := range aeads {
+		if a.NonceSize() != XNonceSize {
+			return nil, ErrNonceSourceRequired
+		}
+	}
+	return &CookieCodec{
+		aeads:        aeads,
+		MaxClockSkew: DefaultCookieClockSkew,
+		now:          time.Now,
+	}, nil
+}
+
+// EncodeCookie encrypts value for the cookie called name, valid for
+// maxAge from now, which is rounded down to whole seconds and must be at
+// least one second.
+func (c *CookieCodec) EncodeCookie(name string, value []byte, maxAge time.Duration) (string, error) {
+	if maxAge < time.Second || maxAge/time.Second > math.MaxUint32 {
+		return "", errors.New("invalid cookie max age")
+	}
+	if len(value) > MaxStringSize {
+		return "", ErrTooLarge
+	}
+	aead := c.aeads[0]
+
+	b := make([]byte, cookieHeaderSize+XNonceSize, cookieHeaderSize+XNonceSize+len(value)+aead.Overhead())
+	b[0] = cookieVersion
+	binary.LittleEndian.PutUint64(b[1:], uint64(c.now().Unix()))
+	binary.LittleEndian.PutUint32(b[9:], uint32(maxAge/time.Second))
+	nameHash := sha256.Sum256([]byte(name))
+	copy(b[13:], nameHash[:4])
+
+	nonce := b[cookieHeaderSize:]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	b = aead.Seal(b, nonce, value, cookieAD(b[:cookieHeaderSize], name))
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// DecodeCookie returns the value of a token written by EncodeCookie for
+// the cookie called name. A token that is not well formed fails with
+// ErrInvalidToken, one that does not authenticate under any of the keys
+// with an error matching ErrAuthFailed, and an authentic but expired one
+// with ErrCookieExpired.
+//
+// The name hash in the header is only looked at once authentication has
+// failed: if it does not match name, the error also matches
+// ErrCookieName. Since the hash is not secret, a token encoded for
+// another name and one with a tampered hash fail the same way.
+func (c *CookieCodec) DecodeCookie(name, token string) ([]byte, error) {
+	if base64.RawURLEncoding.DecodedLen(len(token)) > cookieHeaderSize+XNonceSize+MaxStringSize+TagSize {
+		return nil, ErrTooLarge
+	}
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(b) < cookieHeaderSize+XNonceSize+TagSize || b[0] != cookieVersion {
+		return nil, ErrInvalidToken
+	}
+
+	header := b[:cookieHeaderSize]
+	nonce := b[cookieHeaderSize : cookieHeaderSize+XNonceSize]
+	ciphertext := b[cookieHeaderSize+XNonceSize:]
+	ad := cookieAD(header, name)
+
+	var value []byte
+	err = &AuthError{}
+	for _, aead := range c.aeads {
+		if value, err = aead.Open(nil, nonce, ciphertext, ad); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		nameHash := sha256.Sum256([]byte(name))
+		if string(header[13:17]) != string(nameHash[:4]) {
+			return nil, &AuthError{Err: ErrCookieName}
+		}
+		return nil, err
+	}
+
+	// Only trust the timestamps once they have been authenticated.
+	issued := time.Unix(int64(binary.LittleEndian.Uint64(header[1:])), 0)
+	maxAge := time.Duration(binary.LittleEndian.Uint32(header[9:])) * time.Second
+	now := c.now()
+	if now.Add(c.MaxClockSkew).Before(issued) || now.Add(-c.MaxClockSkew).After(issued.Add(maxAge)) {
+		wipe(value)
+		return nil, ErrCookieExpired
+	}
+
+	return value, nil
+}
+
+// cookieAD returns the associated data of a cookie: its header and name.
+func cookieAD(header []byte, name string) []byte {
+	ad := make([]byte, 0, len(header)+len(name))
+	ad = append(ad, header...)
+	return append(ad, name...)
+}
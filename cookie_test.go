@@ -0,0 +1,154 @@
+package chacha20poly1305guard
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+)
+
+// testCookieCodec returns a CookieCodec whose clock is *now.
+func testCookieCodec(t *testing.T, now *time.Time, current cipher.AEAD, previous ...cipher.AEAD) *CookieCodec {
+	c, err := NewCookieCodec(current, previous...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.now = func() time.Time { return *now }
+	return c
+}
+
+func TestCookieCodec(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	c := testCookieCodec(t, &now, testAEAD(t, XChaCha20))
+
+	token, err := c.EncodeCookie("session", []byte("user=alice"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := c.DecodeCookie("session", token); err != nil || string(v) != "user=alice" {
+		t.Fatalf("DecodeCookie: %q, %v", v, err)
+	}
+	if other, _ := c.EncodeCookie("session", []byte("user=alice"), time.Hour); other == token {
+		t.Fatal("two cookies encoded with the same nonce")
+	}
+
+	// A cookie is refused under another name, with an error telling
+	// why.
+	if _, err := c.DecodeCookie("prefs", token); !errors.Is(err, ErrCookieName) || !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("other name: got %v, want ErrCookieName and ErrAuthFailed", err)
+	}
+
+	if _, err := c.EncodeCookie("session", nil, time.Second-1); err == nil {
+		t.Fatal("EncodeCookie accepted a max age under a second")
+	}
+	if _, err := NewCookieCodec(testAEAD(t, XChaCha20), testAEAD(t, ChaCha20)); err != ErrNonceSourceRequired {
+		t.Fatalf("ChaCha20Poly1305 key: got %v, want ErrNonceSourceRequired", err)
+	}
+}
+
+func TestCookieExpiry(t *testing.T) {
+	issued := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	now := issued
+	c := testCookieCodec(t, &now, testAEAD(t, XChaCha20))
+	token, err := c.EncodeCookie("session", []byte("value"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		at  time.Duration
+		err error
+	}{
+		{0, nil},
+		{time.Hour, nil},
+		{time.Hour + DefaultCookieClockSkew, nil},
+		{time.Hour + DefaultCookieClockSkew + time.Second, ErrCookieExpired},
+		{-DefaultCookieClockSkew, nil},
+		{-DefaultCookieClockSkew - time.Second, ErrCookieExpired},
+	} {
+		now = issued.Add(tc.at)
+		if _, err := c.DecodeCookie("session", token); err != tc.err {
+			t.Errorf("at %v: got %v, want %v", tc.at, err, tc.err)
+		}
+	}
+
+	c.MaxClockSkew = 0
+	now = issued.Add(time.Hour + time.Second)
+	if _, err := c.DecodeCookie("session", token); err != ErrCookieExpired {
+		t.Fatalf("no clock skew: got %v, want ErrCookieExpired", err)
+	}
+}
+
+func TestCookieRotation(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	old := testAEAD(t, XChaCha20)
+	current, err := NewAEAD(lockedBytes(t, bytes.Repeat([]byte{1}, KeySize)), XChaCha20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer current.(AEAD).Close()
+	before := testCookieCodec(t, &now, old)
+	token, err := before.EncodeCookie("session", []byte("value"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after := testCookieCodec(t, &now, current, old)
+	if v, err := after.DecodeCookie("session", token); err != nil || string(v) != "value" {
+		t.Fatalf("cookie under the previous key: %q, %v", v, err)
+	}
+	fresh, err := after.EncodeCookie("session", []byte("value"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := before.DecodeCookie("session", fresh); !errors.Is(err, ErrAuthFailed) || errors.Is(err, ErrCookieName) {
+		t.Fatalf("new cookie under the old key alone: got %v, want ErrAuthFailed only", err)
+	}
+
+	// Once the old key is dropped, its cookies stop decoding.
+	dropped := testCookieCodec(t, &now, current)
+	if _, err := dropped.DecodeCookie("session", token); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("old cookie after dropping its key: got %v, want ErrAuthFailed", err)
+	}
+}
+
+// TestCookieTampering flips every bit of a token after the version in
+// turn, including those of the issue time, the maximum age and the name
+// hash in the header.
+func TestCookieTampering(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	c := testCookieCodec(t, &now, testAEAD(t, XChaCha20))
+	token, err := c.EncodeCookie("session", []byte("value"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 8; i < len(b)*8; i++ {
+		b[i/8] ^= 1 << (i % 8)
+		_, err := c.DecodeCookie("session", base64.RawURLEncoding.EncodeToString(b))
+		b[i/8] ^= 1 << (i % 8)
+		if !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("bit %d flipped: got %v, want ErrAuthFailed", i, err)
+		}
+		if inHash := i/8 >= 13 && i/8 < cookieHeaderSize; errors.Is(err, ErrCookieName) != inHash {
+			t.Fatalf("bit %d flipped: got %v", i, err)
+		}
+	}
+
+	for name, bad := range map[string]string{
+		"version":    base64.RawURLEncoding.EncodeToString(append([]byte{cookieVersion + 1}, b[1:]...)),
+		"truncated":  base64.RawURLEncoding.EncodeToString(b[:cookieHeaderSize+XNonceSize+TagSize-1]),
+		"not base64": token[:len(token)-1] + "*",
+		"empty":      "",
+	} {
+		if _, err := c.DecodeCookie("session", bad); err != ErrInvalidToken {
+			t.Errorf("%s: got %v, want ErrInvalidToken", name, err)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package chacha20poly1305guard
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/awnumar/memguard"
+	"golang.org/x/crypto/poly1305"
+)
+
+var (
+	// ErrInvalidEnvelope is returned when an envelope is truncated or
+	// otherwise malformed.
+	ErrInvalidEnvelope = errors.New("invalid envelope")
+
+	// ErrUnsupportedVersion is returned for envelopes and tokens written
+	// by a newer version of their format.
+	ErrUnsupportedVersion = errors.New("unsupported envelope version")
+
+	// ErrUnknownAlgorithm is returned when an envelope names an algorithm
+	// that is not registered, or when an AEAD passed to SealEnvelope was
+	// neither created by this package nor by AlgorithmInfo.New.
+	ErrUnknownAlgorithm = errors.New("unknown algorithm")
+
+	// ErrAlgorithmMismatch is returned by OpenEnvelope when the envelope
+	// was sealed with a different algorithm than the AEAD implements.
+	ErrAlgorithmMismatch = errors.New("envelope algorithm does not match the AEAD")
+
+	// ErrAlgorithmNotAllowed is returned by OpenEnvelopeExpect when the
+	// envelope declares an algorithm outside the caller's allowlist.
+	ErrAlgorithmNotAllowed = errors.New("envelope algorithm not allowed")
+)
+
+// Algorithm identifies the construction that sealed an envelope.
+type Algorithm uint16
+
+// The algorithms of this package. Zero is left unassigned so that a
+// missing value is never mistaken for a valid one. These IDs are frozen;
+// other constructions can be added with RegisterAlgorithm.
+const (
+	AlgorithmChaCha20Poly1305  Algorithm = 1
+	AlgorithmXChaCha20Poly1305 Algorithm = 2
+)
+
+// EnvelopeVersion is the version of the envelope format written by
+// EncodeEnvelope.
+const EnvelopeVersion = 1
+
+// EnvelopeContextVersion is the version of envelopes that carry an
+// encryption context. It is only written when the context is not empty.
+const EnvelopeContextVersion = 2
+
+var envelopeMagic = []byte("C2PG")
+
+// envelopeHeaderSize is the size of an envelope header with an empty key
+// ID and nonce: magic, version, algorithm and the two length bytes.
+const envelopeHeaderSize = 4 + 1 + 2 + 1 + 1
+
+// SealedMessage is a sealed message together with what is needed to
+// open it. Its binary form, the envelope, is:
+//
+//	magic "C2PG" | version | algorithm (uint16 LE) |
+//	len(KeyID) | KeyID | len(Nonce) | Nonce | [Context] | Ciphertext
+//
+// Context is only present in version 2 and is described at
+// SealEnvelopeWithContext. Ciphertext includes the tag. Everything
+// before it is authenticated as part of the associated data, followed
+// by the caller's data, so the header cannot be altered.
+type SealedMessage struct {
+	Version    uint8
+	Algorithm  Algorithm
+	KeyID      []byte
+	Nonce      []byte
+	Context    map[string]string
+	Ciphertext []byte
+
+	// AAD optionally carries a copy of the caller's associated data in
+	// the JSON form, for transports that need it alongside the message.
+	// It is not part of the envelope and is never used implicitly: it
+	// must still be passed to OpenSealedMessage as data.
+	AAD []byte
+}
+
+// header returns the envelope of m up to and including the nonce.
+func (m *SealedMessage) header() ([]byte, error) {
+	if len(m.KeyID) > 255 || len(m.Nonce) > 255 {
+		return nil, ErrInvalidEnvelope
+	}
+
+	h := make([]byte, 0, envelopeHeaderSize+len(m.KeyID)+len(m.Nonce))
+	h = append(h, envelopeMagic...)
+	h = append(h, m.Version)
+	h = append(h, byte(m.Algorithm), byte(m.Algorithm>>8))
+	h = append(h, byte(len(m.KeyID)))
+	h = append(h, m.KeyID...)
+	h = append(h, byte(len(m.Nonce)))
+	h = append(h, m.Nonce...)
+
+	if m.Version == EnvelopeContextVersion {
+		return appendContext(h, m.Context)
+	}
+	if len(m.Context) > 0 {
+		return nil, ErrInvalidEncryptionContext
+	}
+	return h, nil
+}
+
+// EncodeEnvelope returns the envelope of m.
+func EncodeEnvelope(m *SealedMessage) ([]byte, error) {
+	h, err := m.header()
+	if err != nil {
+		return nil, err
+	}
+	return append(h, m.Ciphertext...), nil
+}
+
+// DecodeEnvelope parses an envelope. The fields of the result share
+// memory with b. Envelopes of a newer format version fail with
+// ErrUnsupportedVersion and malformed ones with ErrInvalidEnvelope.
+func DecodeEnvelope(b []byte) (*SealedMessage, error) {
+	if len(b) < envelopeHeaderSize || !bytes.Equal(b[:4], envelopeMagic) {
+		return nil, ErrInvalidEnvelope
+	}
+	if b[4] != EnvelopeVersion && b[4] != EnvelopeContextVersion {
+		return nil, ErrUnsupportedVersion
+	}
+
+	m := &SealedMessage{
+		Version:   b[4],
+		Algorithm: Algorithm(binary.LittleEndian.Uint16(b[5:])),
+	}
+	rest := b[7:]
+
+	var ok bool
+	if m.KeyID, rest, ok = readField(rest); !ok {
+		return nil, ErrInvalidEnvelope
+	}
+	if m.Nonce, rest, ok = readField(rest); !ok {
+		return nil, ErrInvalidEnvelope
+	}
+	if m.Version == EnvelopeContextVersion {
+		if m.Context, rest, ok = readContext(rest); !ok {
+			return nil, ErrInvalidEnvelope
+		}
+	}
+	if len(rest) < poly1305.TagSize {
+		return nil, ErrInvalidEnvelope
+	}
+	m.Ciphertext = rest
+
+	return m, nil
+}
+
+// readField splits a field prefixed by its one byte length off b.
+func readField(b []byte) (field, rest []byte, ok bool) {
+	if len(b) < 1 || len(b)-1 < int(b[0]) {
+		return nil, nil, false
+	}
+	n := int(b[0])
+	return b[1 : 1+n], b[1+n:], true
+}
+
+// algorithmOf returns the Algorithm implemented by aead, which must have
+// been created by this package with a full length tag, or by
+// AlgorithmInfo.New.
+func algorithmOf(aead cipher.AEAD) (Algorithm, error) {
+	switch k := aead.(type) {
+	case *chacha20poly1305:
+		if id, ok := variantAlgorithms[k.variant]; ok && k.tagSize == poly1305.TagSize {
+			return id, nil
+		}
+	case registeredAEAD:
+		return k.id, nil
+	}
+	return 0, ErrUnknownAlgorithm
+}
+
+// SealEnvelope seals plaintext with aead and returns it as an envelope
+// carrying the algorithm, keyID and nonce. keyID may be empty and is at
+// most 255 bytes. data is authenticated but not stored in the envelope.
+func SealEnvelope(aead cipher.AEAD, nonce, plaintext, data, keyID []byte) ([]byte, error) {
+	return sealEnvelope(aead, nonce, plaintext, data, keyID, nil)
+}
+
+func sealEnvelope(aead cipher.AEAD, nonce, plaintext, data, keyID []byte, context map[string]string) ([]byte, error) {
+	alg, err := algorithmOf(aead)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, &NonceError{Want: aead.NonceSize(), Got: len(nonce)}
+	}
+
+	m := &SealedMessage{
+		Version:   EnvelopeVersion,
+		Algorithm: alg,
+		KeyID:     keyID,
+		Nonce:     nonce,
+	}
+	if len(context) > 0 {
+		m.Version = EnvelopeContextVersion
+		m.Context = context
+	}
+	h, err := m.header()
+	if err != nil {
+		return nil, err
+	}
+	ad := append(h[:len(h):len(h)], data...)
+
+	return aead.Seal(h, nonce, plaintext, ad), nil
+}
+
+// OpenEnvelope decodes and opens an envelope written by SealEnvelope.
+// data must match the data it was sealed with.
+func OpenEnvelope(aead cipher.AEAD, envelope, data []byte) ([]byte, error) {
+	m, err := DecodeEnvelope(envelope)
+	if err != nil {
+		return nil, err
+	}
+	return OpenSealedMessage(aead, m, data)
+}
+
+// OpenSealedMessage opens a message that has already been decoded, for
+// instance from JSON.
+func OpenSealedMessage(aead cipher.AEAD, m *SealedMessage, data []byte) ([]byte, error) {
+	ad, err := messageAD(aead, m, data)
+	if err != nil {
+		return nil, err
+	}
+
+	k, ok := aead.(*chacha20poly1305)
+	if !ok {
+		plaintext, err := aead.Open(nil, m.Nonce, m.Ciphertext, ad)
+		return plaintext, withKeyID(err, m.KeyID)
+	}
+	c, ciphertext, err := k.verifyKeyID(m.Nonce, m.Ciphertext, ad, m.KeyID)
+	if err != nil {
+		return nil, withKeyID(err, m.KeyID)
+	}
+	return k.decrypt(nil, c, ciphertext)
+}
+
+// VerifyEnvelope checks that an envelope written by SealEnvelope is
+// authentic for data, with the same checks as OpenEnvelope, but without
+// decrypting it.
+func VerifyEnvelope(aead cipher.AEAD, envelope, data []byte) error {
+	m, err := DecodeEnvelope(envelope)
+	if err != nil {
+		return err
+	}
+	ad, err := messageAD(aead, m, data)
+	if err != nil {
+		return err
+	}
+
+	k, ok := aead.(*chacha20poly1305)
+	if !ok {
+		plaintext, err := aead.Open(nil, m.Nonce, m.Ciphertext, ad)
+		wipe(plaintext)
+		return withKeyID(err, m.KeyID)
+	}
+	_, _, err = k.verifyKeyID(m.Nonce, m.Ciphertext, ad, m.KeyID)
+	return withKeyID(err, m.KeyID)
+}
+
+// messageAD checks that m was sealed by the algorithm of aead and returns
+// the associated data it was sealed with: its header followed by data.
+func messageAD(aead cipher.AEAD, m *SealedMessage, data []byte) ([]byte, error) {
+	alg, err := algorithmOf(aead)
+	if err != nil {
+		return nil, err
+	}
+	if m.Algorithm != alg {
+		return nil, ErrAlgorithmMismatch
+	}
+	if len(m.Nonce) != aead.NonceSize() {
+		return nil, &NonceError{Want: aead.NonceSize(), Got: len(m.Nonce)}
+	}
+
+	h, err := m.header()
+	if err != nil {
+		return nil, err
+	}
+	return append(h, data...), nil
+}
+
+// OpenEnvelopeExpect opens an envelope with key, using the algorithm the
+// envelope declares, but only if it is one of allowed. Otherwise it
+// fails with ErrAlgorithmNotAllowed before anything is decrypted, so an
+// attacker who controls the envelope cannot downgrade it to a variant
+// the caller does not accept.
+func OpenEnvelopeExpect(key *memguard.LockedBuffer, envelope, aad []byte, allowed ...Variant) ([]byte, error) {
+	m, err := DecodeEnvelope(envelope)
+	if err != nil {
+		return nil, err
+	}
+	info, err := LookupAlgorithm(m.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	ok := false
+	for _, a := range allowed {
+		ok = ok || variantAlgorithms[a] == info.ID
+	}
+	if !ok {
+		return nil, ErrAlgorithmNotAllowed
+	}
+
+	aead, err := info.New(key)
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := aead.(io.Closer); ok {
+		defer c.Close()
+	}
+	return OpenSealedMessage(aead, m, aad)
+}
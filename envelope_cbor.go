@@ -0,0 +1,254 @@
+package chacha20poly1305guard
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/crypto/poly1305"
+)
+
+// CBOR major types used by the envelope encoding.
+const (
+	cborUint  = 0 << 5
+	cborBytes = 2 << 5
+	cborText  = 3 << 5
+	cborMap   = 5 << 5
+)
+
+// MarshalCBOR encodes m as a CBOR map with the same keys as MarshalJSON:
+// "v" and "alg" as unsigned integers, "kid", "nonce", "ct" and "aad" as
+// byte strings, with "kid" and "aad" left out when empty. The encoding
+// is deterministic in the sense of RFC 8949: keys are sorted and every
+// length uses its shortest form. Like MarshalJSON, it cannot encode
+// messages with an encryption context.
+func (m *SealedMessage) MarshalCBOR() ([]byte, error) {
+	if len(m.Context) > 0 {
+		return nil, errContextNotEncodable
+	}
+	if len(m.KeyID) > 255 || len(m.Nonce) > 255 {
+		return nil, ErrInvalidEnvelope
+	}
+
+	n := 4
+	if len(m.KeyID) > 0 {
+		n++
+	}
+	if len(m.AAD) > 0 {
+		n++
+	}
+
+	b := make([]byte, 0, 48+len(m.KeyID)+len(m.Nonce)+len(m.Ciphertext)+len(m.AAD))
+	b = appendCBORHead(b, cborMap, uint64(n))
+	b = appendCBORText(b, "v")
+	b = appendCBORHead(b, cborUint, uint64(m.Version))
+	b = appendCBORText(b, "ct")
+	b = appendCBORBytes(b, m.Ciphertext)
+	if len(m.AAD) > 0 {
+		b = appendCBORText(b, "aad")
+		b = appendCBORBytes(b, m.AAD)
+	}
+	b = appendCBORText(b, "alg")
+	b = appendCBORHead(b, cborUint, uint64(m.Algorithm))
+	if len(m.KeyID) > 0 {
+		b = appendCBORText(b, "kid")
+		b = appendCBORBytes(b, m.KeyID)
+	}
+	b = appendCBORText(b, "nonce")
+	b = appendCBORBytes(b, m.Nonce)
+	return b, nil
+}
+
+// UnmarshalCBOR decodes a SealedMessage written by MarshalCBOR. The byte
+// fields of m share memory with b. Only the deterministic encoding is
+// accepted: keys out of order, unknown or repeated keys, indefinite
+// lengths, trailing data and algorithms this package does not implement
+// are rejected, so that every message has a single encoding.
+func (m *SealedMessage) UnmarshalCBOR(b []byte) error {
+	d := cborDecoder{b: b}
+	n, ok := d.head(cborMap)
+	if !ok || n > 6 {
+		return ErrInvalidEnvelope
+	}
+
+	var out SealedMessage
+	var seen [6]bool
+	var prev []byte
+	for i := uint64(0); i < n; i++ {
+		key, ok := d.bytes(cborText)
+		if !ok {
+			return ErrInvalidEnvelope
+		}
+		if i > 0 && !cborKeyLess(prev, key) {
+			return fmt.Errorf("%w: key %q out of order", ErrInvalidEnvelope, key)
+		}
+		prev = key
+
+		var f int
+		switch string(key) {
+		case "v":
+			v, ok := d.head(cborUint)
+			if !ok || v > 255 {
+				return ErrInvalidEnvelope
+			}
+			out.Version = uint8(v)
+		case "alg":
+			v, ok := d.head(cborUint)
+			if !ok || v > 0xffff {
+				return ErrInvalidEnvelope
+			}
+			out.Algorithm = Algorithm(v)
+			f = 1
+		case "kid":
+			out.KeyID, ok = d.bytes(cborBytes)
+			f = 2
+		case "nonce":
+			out.Nonce, ok = d.bytes(cborBytes)
+			f = 3
+		case "ct":
+			out.Ciphertext, ok = d.bytes(cborBytes)
+			f = 4
+		case "aad":
+			out.AAD, ok = d.bytes(cborBytes)
+			f = 5
+		default:
+			return fmt.Errorf("%w: unknown key %q", ErrInvalidEnvelope, key)
+		}
+		if !ok || seen[f] {
+			return ErrInvalidEnvelope
+		}
+		seen[f] = true
+	}
+	if len(d.b) != 0 || !seen[0] || !seen[1] || !seen[3] || !seen[4] {
+		return ErrInvalidEnvelope
+	}
+
+	if out.Version != EnvelopeVersion {
+		return ErrUnsupportedVersion
+	}
+	if _, err := LookupAlgorithm(out.Algorithm); err != nil {
+		return err
+	}
+	if len(out.KeyID) > 255 || len(out.Nonce) > 255 || len(out.Ciphertext) < poly1305.TagSize {
+		return ErrInvalidEnvelope
+	}
+
+	*m = out
+	return nil
+}
+
+// cborKeyLess reports whether the text key a sorts before b in the
+// deterministic encoding, which compares encoded keys bytewise: shorter
+// keys first, as the length comes first, then by content.
+func cborKeyLess(a, b []byte) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return string(a) < string(b)
+}
+
+// SealEnvelopeCBOR is SealEnvelope with the envelope encoded by
+// MarshalCBOR. What is authenticated is exactly the same as for
+// SealEnvelope, including the binary envelope header, so the two
+// encodings can be converted into each other without re-sealing.
+func SealEnvelopeCBOR(aead cipher.AEAD, nonce, plaintext, data, keyID []byte) ([]byte, error) {
+	env, err := SealEnvelope(aead, nonce, plaintext, data, keyID)
+	if err != nil {
+		return nil, err
+	}
+	m, err := DecodeEnvelope(env)
+	if err != nil {
+		return nil, err
+	}
+	return m.MarshalCBOR()
+}
+
+// OpenEnvelopeCBOR decodes and opens an envelope written by
+// SealEnvelopeCBOR. data must match the data it was sealed with.
+func OpenEnvelopeCBOR(aead cipher.AEAD, envelope, data []byte) ([]byte, error) {
+	var m SealedMessage
+	if err := m.UnmarshalCBOR(envelope); err != nil {
+		return nil, err
+	}
+	return OpenSealedMessage(aead, &m, data)
+}
+
+// appendCBORHead appends the initial byte and argument of a data item,
+// using the shortest encoding of n.
+func appendCBORHead(b []byte, major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return append(b, major|byte(n))
+	case n <= 0xff:
+		return append(b, major|24, byte(n))
+	case n <= 0xffff:
+		return append(b, major|25, byte(n>>8), byte(n))
+	case n <= 0xffffffff:
+		return append(b, major|26, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	b = append(b, major|27)
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], n)
+	return append(b, buf[:]...)
+}
+
+func appendCBORBytes(b []byte, p []byte) []byte {
+	return append(appendCBORHead(b, cborBytes, uint64(len(p))), p...)
+}
+
+func appendCBORText(b []byte, s string) []byte {
+	return append(appendCBORHead(b, cborText, uint64(len(s))), s...)
+}
+
+// cborDecoder reads the small subset of CBOR that MarshalCBOR writes.
+type cborDecoder struct {
+	b []byte
+}
+
+// head reads the initial byte and argument of a data item of the given
+// major type. Indefinite lengths are not supported.
+func (d *cborDecoder) head(major byte) (uint64, bool) {
+	if len(d.b) < 1 || d.b[0]&0xe0 != major {
+		return 0, false
+	}
+	info := d.b[0] & 0x1f
+	d.b = d.b[1:]
+
+	var size int
+	switch {
+	case info < 24:
+		return uint64(info), true
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, false
+	}
+	if len(d.b) < size {
+		return 0, false
+	}
+
+	var n uint64
+	for _, c := range d.b[:size] {
+		n = n<<8 | uint64(c)
+	}
+	d.b = d.b[size:]
+	return n, true
+}
+
+// bytes reads a byte or text string, returning its contents without
+// copying.
+func (d *cborDecoder) bytes(major byte) ([]byte, bool) {
+	n, ok := d.head(major)
+	if !ok || n > uint64(len(d.b)) {
+		return nil, false
+	}
+	p := d.b[:n:n]
+	d.b = d.b[n:]
+	return p, true
+}
@@ -0,0 +1,88 @@
+package chacha20poly1305guard
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestEnvelopeCBOR(t *testing.T) {
+	aead := testAEAD(t, XChaCha20)
+	nonce := make([]byte, XNonceSize)
+	for _, keyID := range [][]byte{nil, []byte("key-1")} {
+		env, err := SealEnvelopeCBOR(aead, nonce, []byte("plaintext"), []byte("data"), keyID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := OpenEnvelopeCBOR(aead, env, []byte("data")); err != nil || string(got) != "plaintext" {
+			t.Fatalf("key ID %q: OpenEnvelopeCBOR = %q, %v", keyID, got, err)
+		}
+		if _, err := OpenEnvelopeCBOR(aead, env, nil); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("key ID %q: other data: got %v, want ErrAuthFailed", keyID, err)
+		}
+
+		// The CBOR and binary envelopes authenticate the same bytes.
+		var m SealedMessage
+		if err := m.UnmarshalCBOR(env); err != nil {
+			t.Fatal(err)
+		}
+		bin, err := EncodeEnvelope(&m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := OpenEnvelope(aead, bin, []byte("data")); err != nil || string(got) != "plaintext" {
+			t.Fatalf("key ID %q: converted to the binary envelope: %q, %v", keyID, got, err)
+		}
+		if again, err := m.MarshalCBOR(); err != nil || !bytes.Equal(again, env) {
+			t.Fatalf("key ID %q: MarshalCBOR(UnmarshalCBOR(env)) differs: %v", keyID, err)
+		}
+	}
+}
+
+// cborMessage encodes a map of the given keys and values in that order.
+func cborMessage(fields ...interface{}) []byte {
+	b := appendCBORHead(nil, cborMap, uint64(len(fields)/2))
+	for i := 0; i < len(fields); i += 2 {
+		b = appendCBORText(b, fields[i].(string))
+		switch v := fields[i+1].(type) {
+		case int:
+			b = appendCBORHead(b, cborUint, uint64(v))
+		case []byte:
+			b = appendCBORBytes(b, v)
+		}
+	}
+	return b
+}
+
+func TestEnvelopeCBORRejected(t *testing.T) {
+	nonce := make([]byte, XNonceSize)
+	ct := make([]byte, TagSize)
+	alg := int(AlgorithmXChaCha20Poly1305)
+
+	var m SealedMessage
+	if err := m.UnmarshalCBOR(cborMessage("v", 1, "ct", ct, "alg", alg, "nonce", nonce)); err != nil {
+		t.Fatalf("deterministic encoding rejected: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		cbor []byte
+		want error
+	}{
+		{"unknown algorithm", cborMessage("v", 1, "ct", ct, "alg", 0xfff0, "nonce", nonce), ErrUnknownAlgorithm},
+		{"algorithm zero", cborMessage("v", 1, "ct", ct, "alg", 0, "nonce", nonce), ErrUnknownAlgorithm},
+		{"keys sorted by content only", cborMessage("v", 1, "alg", alg, "ct", ct, "nonce", nonce), ErrInvalidEnvelope},
+		{"keys in JSON order", cborMessage("alg", alg, "nonce", nonce, "ct", ct, "v", 1), ErrInvalidEnvelope},
+		{"repeated key", cborMessage("v", 1, "v", 1, "ct", ct, "alg", alg, "nonce", nonce), ErrInvalidEnvelope},
+		{"unknown key", cborMessage("v", 1, "ct", ct, "alg", alg, "nonce", nonce, "extra", 1), ErrInvalidEnvelope},
+		{"missing nonce", cborMessage("v", 1, "ct", ct, "alg", alg), ErrInvalidEnvelope},
+		{"future version", cborMessage("v", 9, "ct", ct, "alg", alg, "nonce", nonce), ErrUnsupportedVersion},
+		{"short ciphertext", cborMessage("v", 1, "ct", ct[1:], "alg", alg, "nonce", nonce), ErrInvalidEnvelope},
+		{"trailing data", append(cborMessage("v", 1, "ct", ct, "alg", alg, "nonce", nonce), 0), ErrInvalidEnvelope},
+		{"empty", nil, ErrInvalidEnvelope},
+	} {
+		if err := m.UnmarshalCBOR(tc.cbor); !errors.Is(err, tc.want) {
+			t.Fatalf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package chacha20poly1305guard
+
+import (
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var (
+	// ErrInvalidEncryptionContext is returned by SealEnvelopeWithContext
+	// for a context outside the limits of the envelope format.
+	ErrInvalidEncryptionContext = errors.New("invalid encryption context")
+
+	// ErrContextMismatch is returned by OpenEnvelopeWithContext when the
+	// envelope does not carry the expected encryption context.
+	ErrContextMismatch = errors.New("encryption context does not match")
+)
+
+// errContextNotEncodable is returned when marshaling a SealedMessage
+// with an encryption context to JSON or CBOR.
+var errContextNotEncodable = fmt.Errorf("%w: the encryption context is only carried by the binary envelope", ErrUnsupportedVersion)
+
+const (
+	// MaxEncryptionContextEntries is the largest number of entries an
+	// encryption context may have.
+	MaxEncryptionContextEntries = 32
+
+	// MaxEncryptionContextField is the longest key or value, in bytes,
+	// of an encryption context entry.
+	MaxEncryptionContextField = 255
+)
+
+// SealEnvelopeWithContext is SealEnvelope with an encryption context: a
+// map stored in cleartext in the envelope header, for metadata such as a
+// tenant or purpose that must be readable without the key but must not
+// be forgeable. Like the rest of the header it is authenticated, so it
+// cannot be altered, added or removed without Open failing.
+//
+// The context is encoded canonically, as the number of entries followed
+// by each key and value prefixed by its one byte length, in ascending
+// order of keys. It may have at most MaxEncryptionContextEntries
+// entries, keys must not be empty, and keys and values are at most
+// MaxEncryptionContextField bytes; otherwise sealing fails with
+// ErrInvalidEncryptionContext. An empty context gives the same envelope
+// as SealEnvelope.
+func SealEnvelopeWithContext(aead cipher.AEAD, nonce, plaintext, data, keyID []byte, context map[string]string) ([]byte, error) {
+	return sealEnvelope(aead, nonce, plaintext, data, keyID, context)
+}
+
+// OpenEnvelopeWithContext opens an envelope written by
+// SealEnvelopeWithContext and returns its encryption context, which is
+// only returned once the envelope has been authenticated. If expected is
+// not nil, the context must be exactly equal to it, or opening fails
+// with ErrContextMismatch before anything is decrypted.
+//
+// OpenEnvelope also opens these envelopes, ignoring the context.
+func OpenEnvelopeWithContext(aead cipher.AEAD, envelope, data []byte, expected map[string]string) ([]byte, map[string]string, error) {
+	m, err := DecodeEnvelope(envelope)
+	if err != nil {
+		return nil, nil, err
+	}
+	if expected != nil && !equalContext(m.Context, expected) {
+		return nil, nil, ErrContextMismatch
+	}
+
+	plaintext, err := OpenSealedMessage(aead, m, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return plaintext, m.Context, nil
+}
+
+// appendContext appends the canonical encoding of context to b.
+func appendContext(b []byte, context map[string]string) ([]byte, error) {
+	if len(context) == 0 || len(context) > MaxEncryptionContextEntries {
+		return nil, ErrInvalidEncryptionContext
+	}
+
+	keys := make([]string, 0, len(context))
+	for k, v := range context {
+		if k == "" || len(k) > MaxEncryptionContextField || len(v) > MaxEncryptionContextField {
+			return nil, ErrInvalidEncryptionContext
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	b = append(b, byte(len(keys)))
+	for _, k := range keys {
+		b = append(b, byte(len(k)))
+		b = append(b, k...)
+		b = append(b, byte(len(context[k])))
+		b = append(b, context[k]...)
+	}
+	return b, nil
+}
+
+// readContext splits an encryption context off b. Only the canonical
+// encoding is accepted, so that every context has a single encoding.
+func readContext(b []byte) (context map[string]string, rest []byte, ok bool) {
+	if len(b) < 1 || b[0] == 0 || b[0] > MaxEncryptionContextEntries {
+		return nil, nil, false
+	}
+	n := int(b[0])
+	rest = b[1:]
+
+	context = make(map[string]string, n)
+	var prev string
+	for i := 0; i < n; i++ {
+		var k, v []byte
+		if k, rest, ok = readField(rest); !ok || len(k) == 0 {
+			return nil, nil, false
+		}
+		if v, rest, ok = readField(rest); !ok {
+			return nil, nil, false
+		}
+		if i > 0 && string(k) <= prev {
+			return nil, nil, false
+		}
+		prev = string(k)
+		context[prev] = string(v)
+	}
+	return context, rest, true
+}
+
+func equalContext(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,109 @@
+package chacha20poly1305guard
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestEnvelopeContext(t *testing.T) {
+	aead := testAEAD(t, XChaCha20)
+	nonce := make([]byte, XNonceSize)
+	context := map[string]string{"tenant": "acme", "purpose": "backup"}
+
+	env, err := SealEnvelopeWithContext(aead, nonce, []byte("plaintext"), nil, []byte("key-1"), context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env[4] != EnvelopeContextVersion {
+		t.Fatalf("envelope version %d, want %d", env[4], EnvelopeContextVersion)
+	}
+	// The context is readable without the key.
+	if !bytes.Contains(env, []byte("tenant")) || !bytes.Contains(env, []byte("acme")) {
+		t.Fatal("context not visible in the envelope")
+	}
+
+	for _, expected := range []map[string]string{nil, {"purpose": "backup", "tenant": "acme"}} {
+		got, ctx, err := OpenEnvelopeWithContext(aead, env, nil, expected)
+		if err != nil || string(got) != "plaintext" || !equalContext(ctx, context) {
+			t.Fatalf("expecting %v: %q, %v, %v", expected, got, ctx, err)
+		}
+	}
+	if got, err := OpenEnvelope(aead, env, nil); err != nil || string(got) != "plaintext" {
+		t.Fatalf("OpenEnvelope of a v2 envelope: %q, %v", got, err)
+	}
+
+	for _, expected := range []map[string]string{{}, {"tenant": "acme"}, {"tenant": "other", "purpose": "backup"}} {
+		if _, _, err := OpenEnvelopeWithContext(aead, env, nil, expected); !errors.Is(err, ErrContextMismatch) {
+			t.Fatalf("expecting %v: got %v, want ErrContextMismatch", expected, err)
+		}
+	}
+
+	// A tampered context still decodes but fails to authenticate.
+	i := bytes.Index(env, []byte("acme"))
+	tampered := append([]byte(nil), env...)
+	tampered[i] = 'A'
+	if _, _, err := OpenEnvelopeWithContext(aead, tampered, nil, nil); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("tampered context: got %v, want ErrAuthFailed", err)
+	}
+
+	// The encoding does not depend on the order the map was built in.
+	reordered := map[string]string{}
+	reordered["purpose"] = "backup"
+	reordered["tenant"] = "acme"
+	if again, err := SealEnvelopeWithContext(aead, nonce, []byte("plaintext"), nil, []byte("key-1"), reordered); err != nil || !bytes.Equal(again, env) {
+		t.Fatalf("same context sealed twice gives different envelopes: %v", err)
+	}
+}
+
+func TestEnvelopeContextVersion1(t *testing.T) {
+	aead := testAEAD(t, XChaCha20)
+	nonce := make([]byte, XNonceSize)
+	v1, err := SealEnvelope(aead, nonce, []byte("plaintext"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v1[4] != EnvelopeVersion {
+		t.Fatalf("envelope version %d, want %d", v1[4], EnvelopeVersion)
+	}
+	got, ctx, err := OpenEnvelopeWithContext(aead, v1, nil, nil)
+	if err != nil || string(got) != "plaintext" || ctx != nil {
+		t.Fatalf("v1 envelope: %q, %v, %v", got, ctx, err)
+	}
+	if _, _, err := OpenEnvelopeWithContext(aead, v1, nil, map[string]string{"tenant": "acme"}); !errors.Is(err, ErrContextMismatch) {
+		t.Fatalf("v1 envelope expecting a context: got %v, want ErrContextMismatch", err)
+	}
+
+	// An empty context gives a v1 envelope.
+	empty, err := SealEnvelopeWithContext(aead, nonce, []byte("plaintext"), nil, nil, map[string]string{})
+	if err != nil || !bytes.Equal(empty, v1) {
+		t.Fatalf("empty context: %v", err)
+	}
+}
+
+func TestEnvelopeContextLimits(t *testing.T) {
+	aead := testAEAD(t, XChaCha20)
+	nonce := make([]byte, XNonceSize)
+
+	tooMany := map[string]string{}
+	for i := 0; i <= MaxEncryptionContextEntries; i++ {
+		tooMany[strings.Repeat("k", i+1)] = "v"
+	}
+	long := strings.Repeat("x", MaxEncryptionContextField+1)
+	for name, context := range map[string]map[string]string{
+		"too many entries": tooMany,
+		"empty key":        {"": "v"},
+		"long key":         {long: "v"},
+		"long value":       {"k": long},
+	} {
+		if _, err := SealEnvelopeWithContext(aead, nonce, nil, nil, nil, context); !errors.Is(err, ErrInvalidEncryptionContext) {
+			t.Fatalf("%s: got %v, want ErrInvalidEncryptionContext", name, err)
+		}
+	}
+
+	max := strings.Repeat("x", MaxEncryptionContextField)
+	if _, err := SealEnvelopeWithContext(aead, nonce, nil, nil, nil, map[string]string{max: max}); err != nil {
+		t.Fatalf("fields of the maximum length: %v", err)
+	}
+}
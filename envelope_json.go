@@ -0,0 +1,125 @@
+package chacha20poly1305guard
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/poly1305"
+)
+
+// jsonEncoding encodes the binary fields of a SealedMessage. Decoding is
+// strict so that every accepted value encodes back to the same bytes.
+var jsonEncoding = base64.RawURLEncoding.Strict()
+
+// sealedMessageJSON is the JSON form of a SealedMessage. The field order
+// is fixed, so marshaling is deterministic.
+type sealedMessageJSON struct {
+	Version    uint8     `json:"v"`
+	Algorithm  Algorithm `json:"alg"`
+	KeyID      string    `json:"kid,omitempty"`
+	Nonce      string    `json:"nonce"`
+	Ciphertext string    `json:"ct"`
+	AAD        string    `json:"aad,omitempty"`
+}
+
+// MarshalJSON encodes m as a JSON object with the binary fields in
+// unpadded base64url. The output is stable: unmarshaling it and
+// marshaling again gives the same bytes. Messages with an encryption
+// context cannot be encoded, as only the binary envelope carries it.
+func (m *SealedMessage) MarshalJSON() ([]byte, error) {
+	if len(m.Context) > 0 {
+		return nil, errContextNotEncodable
+	}
+	return json.Marshal(sealedMessageJSON{
+		Version:    m.Version,
+		Algorithm:  m.Algorithm,
+		KeyID:      jsonEncoding.EncodeToString(m.KeyID),
+		Nonce:      jsonEncoding.EncodeToString(m.Nonce),
+		Ciphertext: jsonEncoding.EncodeToString(m.Ciphertext),
+		AAD:        jsonEncoding.EncodeToString(m.AAD),
+	})
+}
+
+// UnmarshalJSON decodes a SealedMessage written by MarshalJSON, ignoring
+// unknown fields. Use UnmarshalSealedMessageJSON to reject them. As with
+// UnmarshalCBOR, algorithms that are not registered fail with
+// ErrUnknownAlgorithm.
+func (m *SealedMessage) UnmarshalJSON(b []byte) error {
+	return m.unmarshalJSON(b, false)
+}
+
+// UnmarshalSealedMessageJSON decodes a SealedMessage from JSON. If strict
+// is set, fields other than those written by MarshalJSON are an error.
+func UnmarshalSealedMessageJSON(b []byte, strict bool) (*SealedMessage, error) {
+	m := new(SealedMessage)
+	if err := m.unmarshalJSON(b, strict); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *SealedMessage) unmarshalJSON(b []byte, strict bool) error {
+	var j sealedMessageJSON
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(&j); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidEnvelope, err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("%w: trailing data after JSON object", ErrInvalidEnvelope)
+	}
+	if j.Version != EnvelopeVersion {
+		return ErrUnsupportedVersion
+	}
+	if _, err := LookupAlgorithm(j.Algorithm); err != nil {
+		return err
+	}
+
+	// Check the encoded lengths before decoding anything, so oversized
+	// fields are rejected without allocating for them.
+	if jsonEncoding.DecodedLen(len(j.KeyID)) > 255 || jsonEncoding.DecodedLen(len(j.Nonce)) > 255 {
+		return ErrInvalidEnvelope
+	}
+
+	var out SealedMessage
+	out.Version = j.Version
+	out.Algorithm = j.Algorithm
+
+	var err error
+	if out.KeyID, err = decodeJSONField(j.KeyID); err != nil {
+		return err
+	}
+	if out.Nonce, err = decodeJSONField(j.Nonce); err != nil {
+		return err
+	}
+	if out.Ciphertext, err = decodeJSONField(j.Ciphertext); err != nil {
+		return err
+	}
+	if len(out.Ciphertext) < poly1305.TagSize {
+		return ErrInvalidEnvelope
+	}
+	if out.AAD, err = decodeJSONField(j.AAD); err != nil {
+		return err
+	}
+
+	*m = out
+	return nil
+}
+
+// decodeJSONField decodes a base64url field, returning nil for an empty
+// one so that omitted and empty fields are treated alike.
+func decodeJSONField(s string) ([]byte, error) {
+	if s == "" {
+		return nil, nil
+	}
+	b, err := jsonEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEnvelope, err)
+	}
+	return b, nil
+}
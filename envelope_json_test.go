@@ -0,0 +1,100 @@
+package chacha20poly1305guard
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSealedMessageJSON(t *testing.T) {
+	aead, env := sealTestEnvelope(t)
+	m, err := DecodeEnvelope(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.AAD = []byte("data")
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.ContainsAny(string(b), "+/=") {
+		t.Fatalf("%s is not unpadded base64url", b)
+	}
+
+	var back SealedMessage
+	if err := json.Unmarshal(b, &back); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := OpenSealedMessage(aead, &back, back.AAD); err != nil || string(got) != "plaintext" {
+		t.Fatalf("OpenSealedMessage = %q, %v", got, err)
+	}
+	// Unmarshaling and marshaling again gives the same bytes.
+	if again, err := json.Marshal(&back); err != nil || !bytes.Equal(again, b) {
+		t.Fatalf("round trip changed the JSON:\n%s\n%s", b, again)
+	}
+}
+
+func TestSealedMessageJSONRejected(t *testing.T) {
+	_, env := sealTestEnvelope(t)
+	m, err := DecodeEnvelope(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		t.Fatal(err)
+	}
+	with := func(key string, value interface{}) []byte {
+		f := map[string]interface{}{}
+		for k, v := range fields {
+			f[k] = v
+		}
+		if value == nil {
+			delete(f, key)
+		} else {
+			f[key] = value
+		}
+		b, err := json.Marshal(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	for _, tc := range []struct {
+		name string
+		json []byte
+		want error
+	}{
+		{"not JSON", []byte("{"), ErrInvalidEnvelope},
+		{"trailing data", append(append([]byte(nil), b...), "{}"...), ErrInvalidEnvelope},
+		{"future version", with("v", 9), ErrUnsupportedVersion},
+		{"unknown algorithm", with("alg", 0xfff0), ErrUnknownAlgorithm},
+		{"algorithm zero", with("alg", 0), ErrUnknownAlgorithm},
+		{"padded base64", with("nonce", jsonEncoding.EncodeToString(m.Nonce)+"="), ErrInvalidEnvelope},
+		{"standard base64", with("ct", "++++"+fields["ct"].(string)[4:]), ErrInvalidEnvelope},
+		{"oversized key ID", with("kid", strings.Repeat("A", 400)), ErrInvalidEnvelope},
+		{"ciphertext shorter than a tag", with("ct", jsonEncoding.EncodeToString(make([]byte, TagSize-1))), ErrInvalidEnvelope},
+		{"missing ciphertext", with("ct", nil), ErrInvalidEnvelope},
+	} {
+		var got SealedMessage
+		if err := got.UnmarshalJSON(tc.json); !errors.Is(err, tc.want) {
+			t.Fatalf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+
+	unknown := with("extra", "field")
+	if _, err := UnmarshalSealedMessageJSON(unknown, false); err != nil {
+		t.Fatalf("unknown field, not strict: %v", err)
+	}
+	if _, err := UnmarshalSealedMessageJSON(unknown, true); !errors.Is(err, ErrInvalidEnvelope) {
+		t.Fatalf("unknown field, strict: got %v, want ErrInvalidEnvelope", err)
+	}
+}
@@ -0,0 +1,154 @@
+package chacha20poly1305guard
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// sealTestEnvelope seals "plaintext" with data "data" under an XChaCha20
+// AEAD of testKey and key ID "key-1".
+func sealTestEnvelope(tb testing.TB) (AEAD, []byte) {
+	tb.Helper()
+	aead := testAEAD(tb, XChaCha20)
+	nonce := bytes.Repeat([]byte{9}, XNonceSize)
+	env, err := SealEnvelope(aead, nonce, []byte("plaintext"), []byte("data"), []byte("key-1"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return aead, env
+}
+
+func TestEnvelope(t *testing.T) {
+	aead, env := sealTestEnvelope(t)
+
+	m, err := DecodeEnvelope(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Version != EnvelopeVersion || m.Algorithm != AlgorithmXChaCha20Poly1305 || string(m.KeyID) != "key-1" || len(m.Nonce) != XNonceSize {
+		t.Fatalf("decoded %+v", m)
+	}
+	if len(m.Ciphertext) != len("plaintext")+TagSize {
+		t.Fatalf("ciphertext is %d bytes", len(m.Ciphertext))
+	}
+	if again, err := EncodeEnvelope(m); err != nil || !bytes.Equal(again, env) {
+		t.Fatalf("EncodeEnvelope(DecodeEnvelope(env)) differs: %v", err)
+	}
+
+	if got, err := OpenEnvelope(aead, env, []byte("data")); err != nil || string(got) != "plaintext" {
+		t.Fatalf("OpenEnvelope = %q, %v", got, err)
+	}
+	if _, err := OpenEnvelope(aead, env, nil); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("other data: got %v, want ErrAuthFailed", err)
+	}
+	if _, err := OpenEnvelope(testAEAD(t, ChaCha20), env, []byte("data")); !errors.Is(err, ErrAlgorithmMismatch) {
+		t.Fatalf("other variant: got %v, want ErrAlgorithmMismatch", err)
+	}
+}
+
+func TestDecodeEnvelopeTruncated(t *testing.T) {
+	_, env := sealTestEnvelope(t)
+	for n := 0; n < len(env); n++ {
+		m, err := DecodeEnvelope(env[:n])
+		if n >= len(env)-len("plaintext") && err == nil {
+			// Cut inside the plaintext, the ciphertext still holds a
+			// tag's worth of bytes; opening catches it.
+			continue
+		}
+		if !errors.Is(err, ErrInvalidEnvelope) || m != nil {
+			t.Fatalf("envelope truncated to %d bytes: got %v", n, err)
+		}
+	}
+}
+
+func TestDecodeEnvelopeMalformed(t *testing.T) {
+	_, env := sealTestEnvelope(t)
+	const keyIDLen = 7 // offset of the key ID length
+
+	for _, tc := range []struct {
+		name   string
+		modify func([]byte) []byte
+		want   error
+	}{
+		{"bad magic", func(b []byte) []byte { b[0] = 'X'; return b }, ErrInvalidEnvelope},
+		{"version 0", func(b []byte) []byte { b[4] = 0; return b }, ErrUnsupportedVersion},
+		{"future version", func(b []byte) []byte { b[4] = 0x7f; return b }, ErrUnsupportedVersion},
+		{"key ID length past the end", func(b []byte) []byte { b[keyIDLen] = 255; return b }, ErrInvalidEnvelope},
+		{"nonce length past the end", func(b []byte) []byte { b[keyIDLen+1+len("key-1")] = 255; return b }, ErrInvalidEnvelope},
+		{"key ID length eating the tag", func(b []byte) []byte {
+			b[keyIDLen] = byte(len(b) - keyIDLen - 2)
+			return b
+		}, ErrInvalidEnvelope},
+	} {
+		m, err := DecodeEnvelope(tc.modify(append([]byte(nil), env...)))
+		if !errors.Is(err, tc.want) || m != nil {
+			t.Fatalf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+
+	if _, err := EncodeEnvelope(&SealedMessage{Version: EnvelopeVersion, KeyID: make([]byte, 256)}); !errors.Is(err, ErrInvalidEnvelope) {
+		t.Fatalf("encoding a 256 byte key ID: got %v, want ErrInvalidEnvelope", err)
+	}
+}
+
+// TestEnvelopeHeaderAuthenticated flips every bit of the header of an
+// envelope and checks that none of them goes unnoticed.
+func TestEnvelopeHeaderAuthenticated(t *testing.T) {
+	aead, env := sealTestEnvelope(t)
+	header := len(env) - len("plaintext") - TagSize
+	for i := 0; i < header; i++ {
+		for bit := 0; bit < 8; bit++ {
+			tampered := append([]byte(nil), env...)
+			tampered[i] ^= 1 << bit
+			if _, err := OpenEnvelope(aead, tampered, []byte("data")); err == nil {
+				t.Fatalf("bit %d of header byte %d flipped: envelope opened", bit, i)
+			}
+		}
+	}
+
+	// Flips in the key ID and nonce, which decode fine, are caught by
+	// the authentication of the header.
+	for _, i := range []int{8, header - 1} {
+		tampered := append([]byte(nil), env...)
+		tampered[i] ^= 1
+		if _, err := OpenEnvelope(aead, tampered, []byte("data")); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("byte %d flipped: got %v, want ErrAuthFailed", i, err)
+		}
+	}
+}
+
+func TestOpenEnvelopeExpect(t *testing.T) {
+	_, env := sealTestEnvelope(t)
+	key := testKey(t)
+
+	for _, allowed := range [][]Variant{{XChaCha20}, {ChaCha20, XChaCha20}} {
+		if got, err := OpenEnvelopeExpect(key, env, []byte("data"), allowed...); err != nil || string(got) != "plaintext" {
+			t.Fatalf("allowed %v: %q, %v", allowed, got, err)
+		}
+	}
+	if _, err := OpenEnvelopeExpect(key, env, []byte("data"), ChaCha20); !errors.Is(err, ErrAlgorithmNotAllowed) {
+		t.Fatalf("XChaCha20 envelope, only ChaCha20 allowed: got %v, want ErrAlgorithmNotAllowed", err)
+	}
+	if _, err := OpenEnvelopeExpect(key, env, []byte("data")); !errors.Is(err, ErrAlgorithmNotAllowed) {
+		t.Fatalf("nothing allowed: got %v, want ErrAlgorithmNotAllowed", err)
+	}
+
+	// An algorithm ID rewritten to one the caller does not accept is
+	// rejected before any key is used: a nil key would fail otherwise.
+	downgraded := append([]byte(nil), env...)
+	binary.LittleEndian.PutUint16(downgraded[5:], uint16(AlgorithmChaCha20Poly1305))
+	if _, err := OpenEnvelopeExpect(nil, downgraded, []byte("data"), XChaCha20); !errors.Is(err, ErrAlgorithmNotAllowed) {
+		t.Fatalf("downgraded envelope: got %v, want ErrAlgorithmNotAllowed", err)
+	}
+	// Accepted, the rewritten ID still fails, as it is authenticated.
+	if _, err := OpenEnvelopeExpect(key, downgraded, []byte("data"), ChaCha20, XChaCha20); err == nil {
+		t.Fatal("downgraded envelope opened")
+	}
+
+	binary.LittleEndian.PutUint16(downgraded[5:], 0xfff0)
+	if _, err := OpenEnvelopeExpect(key, downgraded, []byte("data"), XChaCha20); !errors.Is(err, ErrUnknownAlgorithm) {
+		t.Fatalf("unknown algorithm: got %v, want ErrUnknownAlgorithm", err)
+	}
+}
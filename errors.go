@@ -0,0 +1,73 @@
+package chacha20poly1305guard
+
+import "fmt"
+
+// SizeError reports an input of the wrong length. Err is the sentinel it
+// stands for, such as ErrInvalidKey or ErrCiphertextTooShort, so
+// errors.Is keeps working on it. Only lengths are recorded, never the
+// contents of the input.
+type SizeError struct {
+	Field string // what had the wrong size: "key", "ciphertext", "tag"
+	Want  int    // expected size, or minimum size for a ciphertext
+	Got   int
+	Err   error
+}
+
+func (e *SizeError) Error() string {
+	s := fmt.Sprintf("%s is %d bytes, want %d", e.Field, e.Got, e.Want)
+	if e.Err != nil {
+		s = fmt.Sprintf("%v (%s)", e.Err, s)
+	}
+	return s
+}
+
+func (e *SizeError) Unwrap() error { return e.Err }
+
+// NonceError reports a nonce of the wrong length. It matches
+// ErrInvalidNonce with errors.Is.
+type NonceError struct {
+	Want, Got int
+}
+
+func (e *NonceError) Error() string {
+	if e.Got == 0 {
+		return fmt.Sprintf("nonce is empty; expected %d bytes: %v", e.Want, ErrInvalidNonce)
+	}
+	return fmt.Sprintf("nonce is %d bytes, want %d: %v", e.Got, e.Want, ErrInvalidNonce)
+}
+
+func (e *NonceError) Is(target error) bool { return target == ErrInvalidNonce }
+
+// AuthError reports a message that failed authentication. It matches
+// ErrAuthFailed with errors.Is. KeyID is the key ID of the envelope that
+// failed, if known. Err, if not nil, is a more specific cause such as a
+// *SizeError for a ciphertext too short to hold a tag; a bad tag on its
+// own has no further cause, since nothing can tell a wrong key from
+// tampered ciphertext or associated data.
+type AuthError struct {
+	KeyID string
+	Err   error
+}
+
+func (e *AuthError) Error() string {
+	s := ErrAuthFailed.Error()
+	if e.KeyID != "" {
+		s += fmt.Sprintf(" (key ID %q)", e.KeyID)
+	}
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+
+func (e *AuthError) Is(target error) bool { return target == ErrAuthFailed }
+
+func (e *AuthError) Unwrap() error { return e.Err }
+
+// withKeyID records keyID in err if it is an *AuthError.
+func withKeyID(err error, keyID []byte) error {
+	if e, ok := err.(*AuthError); ok && len(keyID) > 0 {
+		e.KeyID = string(keyID)
+	}
+	return err
+}
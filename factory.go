@@ -0,0 +1,140 @@
+package chacha20poly1305guard
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+
+	"github.com/awnumar/memguard"
+)
+
+// StreamFactory creates the ChaCha20 keystreams an AEAD encrypts with
+// and derives its Poly1305 keys from, for plugging in an alternative
+// implementation, such as one with hardware offload, under the rest of
+// the construction.
+//
+// NewStream must return the keystream of the variant whose nonce size
+// is NonceSize, starting at block 0, and reject nonces of any other
+// size. It must not keep a reference to the key buffer after returning:
+// the key may be destroyed or modified while the stream is still in use.
+// CheckStreamFactory verifies these properties.
+type StreamFactory interface {
+	NewStream(key *memguard.LockedBuffer, nonce []byte) (cipher.Stream, error)
+	NonceSize() int
+}
+
+// variantFactory is the built-in StreamFactory of a variant.
+type variantFactory struct {
+	nonceSize int
+	newStream streamFunc
+}
+
+func (f variantFactory) NewStream(key *memguard.LockedBuffer, nonce []byte) (cipher.Stream, error) {
+	return f.newStream(key, nonce)
+}
+
+func (f variantFactory) NonceSize() int {
+	return f.nonceSize
+}
+
+// DefaultStreamFactory returns the StreamFactory New and NewX use for
+// variant v, which is backed by chacha20guard.
+func DefaultStreamFactory(v Variant) (StreamFactory, error) {
+	nonceSize, newStream, err := v.params()
+	if err != nil {
+		return nil, err
+	}
+	return variantFactory{nonceSize, newStream}, nil
+}
+
+// NewWithFactory returns an AEAD that takes its keystreams from factory
+// and otherwise works like the one returned by New or NewX, which it
+// interoperates with. The variant is chosen by the nonce size of the
+// factory; a factory whose nonce size matches no variant fails with
+// ErrUnknownVariant.
+func NewWithFactory(key *memguard.LockedBuffer, factory StreamFactory, opts ...Option) (cipher.AEAD, error) {
+	v, err := variantForNonceSize(factory.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := newAEAD(key, v, opts)
+	if err != nil {
+		return nil, err
+	}
+	k.newStream = factory.NewStream
+
+	return k, nil
+}
+
+// variantForNonceSize returns the variant whose nonces are n bytes long.
+func variantForNonceSize(n int) (Variant, error) {
+	switch n {
+	case NonceSize:
+		return ChaCha20, nil
+	case XNonceSize:
+		return XChaCha20, nil
+	}
+	return 0, fmt.Errorf("%w: no variant has %d byte nonces", ErrUnknownVariant, n)
+}
+
+// ErrFactoryNonConformant is returned by CheckStreamFactory for a
+// StreamFactory that does not behave as StreamFactory requires.
+var ErrFactoryNonConformant = errors.New("stream factory does not conform")
+
+// CheckStreamFactory checks that factory produces the same keystream as
+// the built-in factory of its variant, including across block
+// boundaries and past the first 2^8 blocks, that it rejects nonces of
+// the wrong size, and that its streams do not depend on the key buffer
+// once created. It is meant for the test suites of third-party
+// factories. Failures match ErrFactoryNonConformant.
+func CheckStreamFactory(factory StreamFactory) error {
+	nonceSize := factory.NonceSize()
+	v, err := variantForNonceSize(nonceSize)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrFactoryNonConformant, err)
+	}
+	ref, _ := DefaultStreamFactory(v)
+
+	key, err := memguard.NewMutableRandom(KeySize)
+	if err != nil {
+		return err
+	}
+	defer key.Destroy()
+	nonce := make([]byte, nonceSize)
+	for i := range nonce {
+		nonce[i] = byte(i + 1)
+	}
+
+	for _, n := range []int{0, nonceSize - 1, nonceSize + 1} {
+		if _, err := factory.NewStream(key, make([]byte, n)); err == nil {
+			return fmt.Errorf("%w: accepted a %d byte nonce", ErrFactoryNonConformant, n)
+		}
+	}
+
+	want, err := ref.NewStream(key, nonce)
+	if err != nil {
+		return err
+	}
+	got, err := factory.NewStream(key, nonce)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrFactoryNonConformant, err)
+	}
+
+	// Change the key before using the stream, which must not notice.
+	if err := key.FillRandomBytes(); err != nil {
+		return err
+	}
+
+	// Odd sized reads, so that block boundaries fall inside them.
+	for _, n := range []int{1, 63, 64, 65, 300, 256 * 64} {
+		a, b := make([]byte, n), make([]byte, n)
+		want.XORKeyStream(a, a)
+		got.XORKeyStream(b, b)
+		if !bytes.Equal(a, b) {
+			return fmt.Errorf("%w: keystream differs from the built-in one", ErrFactoryNonConformant)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package chacha20poly1305guard
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"errors"
+	"testing"
+
+	"github.com/awnumar/memguard"
+)
+
+// offsetFactory starts its keystreams one block late.
+type offsetFactory struct{ StreamFactory }
+
+func (f offsetFactory) NewStream(key *memguard.LockedBuffer, nonce []byte) (cipher.Stream, error) {
+	s, err := f.StreamFactory.NewStream(key, nonce)
+	if err != nil {
+		return nil, err
+	}
+	skip := make([]byte, 64)
+	s.XORKeyStream(skip, skip)
+	return s, nil
+}
+
+// lenientFactory pads short nonces with zeros instead of rejecting them.
+type lenientFactory struct{ StreamFactory }
+
+func (f lenientFactory) NewStream(key *memguard.LockedBuffer, nonce []byte) (cipher.Stream, error) {
+	if len(nonce) < f.NonceSize() {
+		nonce = append(append([]byte(nil), nonce...), make([]byte, f.NonceSize()-len(nonce))...)
+	}
+	return f.StreamFactory.NewStream(key, nonce)
+}
+
+// lazyFactory reads the key only when its stream is first used.
+type lazyFactory struct{ StreamFactory }
+
+func (f lazyFactory) NewStream(key *memguard.LockedBuffer, nonce []byte) (cipher.Stream, error) {
+	if _, err := f.StreamFactory.NewStream(key, nonce); err != nil {
+		return nil, err
+	}
+	return &lazyStream{f: f.StreamFactory, key: key, nonce: nonce}, nil
+}
+
+type lazyStream struct {
+	f     StreamFactory
+	key   *memguard.LockedBuffer
+	nonce []byte
+	s     cipher.Stream
+}
+
+func (s *lazyStream) XORKeyStream(dst, src []byte) {
+	if s.s == nil {
+		s.s, _ = s.f.NewStream(s.key, s.nonce)
+	}
+	s.s.XORKeyStream(dst, src)
+}
+
+// sizeFactory claims a nonce size no variant has.
+type sizeFactory struct{ StreamFactory }
+
+func (sizeFactory) NonceSize() int { return 16 }
+
+func TestCheckStreamFactory(t *testing.T) {
+	for _, v := range variants {
+		f, err := DefaultStreamFactory(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := testAEAD(t, v).NonceSize(); f.NonceSize() != want {
+			t.Fatalf("%v: factory nonce size %d, want %d", v, f.NonceSize(), want)
+		}
+		if err := CheckStreamFactory(f); err != nil {
+			t.Fatalf("%v: default factory: %v", v, err)
+		}
+
+		for name, bad := range map[string]StreamFactory{
+			"wrong keystream offset": offsetFactory{f},
+			"accepts short nonces":   lenientFactory{f},
+			"keeps the key":          lazyFactory{f},
+			"unknown nonce size":     sizeFactory{f},
+		} {
+			if err := CheckStreamFactory(bad); !errors.Is(err, ErrFactoryNonConformant) {
+				t.Errorf("%v: %s: got %v, want ErrFactoryNonConformant", v, name, err)
+			}
+		}
+	}
+
+	if _, err := DefaultStreamFactory(Variant(99)); !errors.Is(err, ErrUnknownVariant) {
+		t.Fatalf("unknown variant: got %v, want ErrUnknownVariant", err)
+	}
+}
+
+func TestNewWithFactory(t *testing.T) {
+	for _, v := range variants {
+		f, err := DefaultStreamFactory(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aead, err := NewWithFactory(testKey(t), f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer aead.(AEAD).Close()
+
+		nonce := make([]byte, aead.NonceSize())
+		ct := aead.Seal(nil, nonce, []byte("plaintext"), []byte("data"))
+		if want := testAEAD(t, v).Seal(nil, nonce, []byte("plaintext"), []byte("data")); !bytes.Equal(ct, want) {
+			t.Fatalf("%v: output differs from NewAEAD", v)
+		}
+	}
+
+	f, _ := DefaultStreamFactory(ChaCha20)
+	if _, err := NewWithFactory(testKey(t), sizeFactory{f}); !errors.Is(err, ErrUnknownVariant) {
+		t.Fatalf("unknown nonce size: got %v, want ErrUnknownVariant", err)
+	}
+}
@@ -0,0 +1,148 @@
+package chacha20poly1305guard
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrUnknownFormat is returned by OpenAuto when a blob is neither an
+// envelope nor armor, and is not accepted as a legacy ciphertext.
+var ErrUnknownFormat = errors.New("unknown ciphertext format")
+
+// Format is a shape of sealed data written by this package.
+type Format int
+
+const (
+	// FormatUnknown is returned alongside ErrUnknownFormat.
+	FormatUnknown Format = iota
+
+	// FormatLegacy is the output of Seal, with the nonce kept elsewhere.
+	FormatLegacy
+
+	// FormatEnvelope is an envelope written by SealEnvelope.
+	FormatEnvelope
+
+	// FormatArmor is an envelope in ASCII armor, written by EncodeArmor.
+	FormatArmor
+
+	// FormatStream is a stream written by EncryptStream. OpenAuto
+	// recognizes streams but does not open them.
+	FormatStream
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatUnknown:
+		return "unknown"
+	case FormatLegacy:
+		return "legacy"
+	case FormatEnvelope:
+		return "envelope"
+	case FormatArmor:
+		return "armor"
+	case FormatStream:
+		return "stream"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// AutoOption configures OpenAuto.
+type AutoOption func(*autoConfig)
+
+type autoConfig struct {
+	legacyNonce []byte
+}
+
+// WithLegacyNonce makes OpenAuto accept blobs that are neither envelopes
+// nor armor as legacy ciphertexts sealed under nonce. Without it they
+// fail with ErrUnknownFormat.
+func WithLegacyNonce(nonce []byte) AutoOption {
+	return func(c *autoConfig) {
+		c.legacyNonce = nonce
+	}
+}
+
+// OpenAuto opens blob whatever its format and reports the format it
+// found, so that callers migrating between formats can count what is
+// left to convert. Envelopes are recognized by their magic bytes and
+// armor by its begin line, ignoring leading whitespace; anything else is
+// only opened as a legacy ciphertext if WithLegacyNonce is given, and
+// otherwise fails with ErrUnknownFormat rather than with a misleading
+// authentication failure. Sniffing only looks at the first bytes of
+// blob and does not depend on any length it claims.
+//
+// Streams are recognized by their header and fail with FormatStream and
+// ErrUnknownFormat, since they are opened with DecryptStream. The header
+// of a compact stream is a single marker byte, which a legacy ciphertext
+// may start with by chance, so with WithLegacyNonce anything that looks
+// like a stream is opened as a legacy ciphertext instead.
+//
+// Envelopes and armor are opened with OpenSealedMessage, so aead must
+// have been created by this package and match the algorithm they
+// declare. aad is the associated data in every format.
+func OpenAuto(aead cipher.AEAD, blob, aad []byte, opts ...AutoOption) ([]byte, Format, error) {
+	var cfg autoConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	switch f := sniffFormat(blob); f {
+	case FormatEnvelope:
+		pt, err := OpenEnvelope(aead, blob, aad)
+		return pt, f, err
+
+	case FormatArmor:
+		m, err := DecodeArmor(string(blob))
+		if err != nil {
+			return nil, f, err
+		}
+		pt, err := OpenSealedMessage(aead, m, aad)
+		return pt, f, err
+
+	case FormatStream:
+		if cfg.legacyNonce == nil {
+			return nil, f, fmt.Errorf("%w: streams are opened with DecryptStream", ErrUnknownFormat)
+		}
+	}
+
+	if len(cfg.legacyNonce) != aead.NonceSize() || len(blob) < aead.Overhead() {
+		return nil, FormatUnknown, ErrUnknownFormat
+	}
+	pt, err := aead.Open(nil, cfg.legacyNonce, blob, aad)
+	return pt, FormatLegacy, err
+}
+
+// sniffFormat returns the format blob declares, or FormatUnknown if it
+// declares none.
+func sniffFormat(blob []byte) Format {
+	if bytes.HasPrefix(blob, envelopeMagic) {
+		return FormatEnvelope
+	}
+	if bytes.HasPrefix(bytes.TrimLeft(blob, " \t\r\n"), []byte(armorBegin)) {
+		return FormatArmor
+	}
+	if isStream(blob) {
+		return FormatStream
+	}
+	return FormatUnknown
+}
+
+// isStream reports whether blob starts with a stream header followed by
+// room for at least the tag of the last chunk. Full headers must name
+// XChaCha20Poly1305 and a valid chunk size; compact ones are only their
+// marker.
+func isStream(blob []byte) bool {
+	if len(blob) >= compactStreamHeaderSize+TagSize && blob[0] == compactStreamMarker {
+		return true
+	}
+	if len(blob) < streamHeaderSize+TagSize || blob[0] != streamVersion {
+		return false
+	}
+	if Algorithm(blob[1]) != AlgorithmXChaCha20Poly1305 {
+		return false
+	}
+	return checkChunkSize(int(binary.LittleEndian.Uint32(blob[2:]))) == nil
+}
@@ -0,0 +1,98 @@
+package chacha20poly1305guard
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestOpenAuto(t *testing.T) {
+	aead, env := sealTestEnvelope(t)
+	m, err := DecodeEnvelope(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	armor, err := EncodeArmor(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := bytes.Repeat([]byte{5}, aead.NonceSize())
+	legacy := aead.Seal(nil, nonce, []byte("plaintext"), []byte("data"))
+
+	for _, tc := range []struct {
+		name string
+		blob []byte
+		want Format
+	}{
+		{"envelope", env, FormatEnvelope},
+		{"armor", []byte(armor), FormatArmor},
+		{"indented armor", []byte("\r\n  " + armor), FormatArmor},
+		{"legacy", legacy, FormatLegacy},
+	} {
+		got, f, err := OpenAuto(aead, tc.blob, []byte("data"), WithLegacyNonce(nonce))
+		if err != nil || f != tc.want || string(got) != "plaintext" {
+			t.Errorf("%s: %q, %v, %v, want %v", tc.name, got, f, err, tc.want)
+		}
+	}
+
+	// A blob that is neither envelope nor armor is not guessed to be
+	// legacy without a nonce.
+	if _, f, err := OpenAuto(aead, legacy, []byte("data")); f != FormatUnknown || !errors.Is(err, ErrUnknownFormat) {
+		t.Fatalf("legacy without a nonce: %v, %v, want ErrUnknownFormat", f, err)
+	}
+	if _, f, err := OpenAuto(aead, []byte("short"), nil, WithLegacyNonce(nonce)); f != FormatUnknown || !errors.Is(err, ErrUnknownFormat) {
+		t.Fatalf("blob shorter than a tag: %v, %v, want ErrUnknownFormat", f, err)
+	}
+	if _, f, err := OpenAuto(aead, legacy, []byte("data"), WithLegacyNonce(nonce[1:])); f != FormatUnknown || !errors.Is(err, ErrUnknownFormat) {
+		t.Fatalf("legacy nonce of the wrong size: %v, %v, want ErrUnknownFormat", f, err)
+	}
+
+	// A recognized format that fails to open reports the format and the
+	// authentication failure, not ErrUnknownFormat.
+	tampered := append([]byte(nil), env...)
+	tampered[len(tampered)-1] ^= 1
+	if _, f, err := OpenAuto(aead, tampered, []byte("data")); f != FormatEnvelope || !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("tampered envelope: %v, %v, want ErrAuthFailed", f, err)
+	}
+	if _, f, err := OpenAuto(aead, legacy, []byte("other"), WithLegacyNonce(nonce)); f != FormatLegacy || !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("legacy with other data: %v, %v, want ErrAuthFailed", f, err)
+	}
+
+	for f, want := range map[Format]string{FormatUnknown: "unknown", FormatLegacy: "legacy", FormatEnvelope: "envelope", FormatArmor: "armor", Format(42): "Format(42)"} {
+		if f.String() != want {
+			t.Errorf("Format(%d).String() = %q, want %q", int(f), f.String(), want)
+		}
+	}
+}
+
+func TestOpenAutoStream(t *testing.T) {
+	aead := testAEAD(t, XChaCha20)
+	for name, opts := range map[string][]StreamOption{"full header": nil, "compact header": {WithCompactHeader()}} {
+		stream := encryptStream(t, []byte("plaintext"), opts...)
+		if _, f, err := OpenAuto(aead, stream, nil); f != FormatStream || !errors.Is(err, ErrUnknownFormat) {
+			t.Fatalf("stream with a %s: %v, %v, want FormatStream and ErrUnknownFormat", name, f, err)
+		}
+	}
+	if FormatStream.String() != "stream" {
+		t.Fatalf("FormatStream.String() = %q", FormatStream.String())
+	}
+
+	// A legacy ciphertext starting with the compact stream marker is
+	// opened as legacy when a nonce is given.
+	for i := 0; ; i++ {
+		if i == 1<<16 {
+			t.Fatal("no legacy ciphertext starting with the compact stream marker")
+		}
+		nonce := make([]byte, aead.NonceSize())
+		nonce[0], nonce[1] = byte(i), byte(i>>8)
+		legacy := aead.Seal(nil, nonce, []byte("plaintext"), nil)
+		if legacy[0] != compactStreamMarker {
+			continue
+		}
+		got, f, err := OpenAuto(aead, legacy, nil, WithLegacyNonce(nonce))
+		if err != nil || f != FormatLegacy || string(got) != "plaintext" {
+			t.Fatalf("legacy ciphertext looking like a stream: %q, %v, %v", got, f, err)
+		}
+		break
+	}
+}
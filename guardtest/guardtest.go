@@ -0,0 +1,154 @@
+// Package guardtest helps test code that uses chacha20poly1305guard. It
+// makes sealed output reproducible, so it can be compared with golden
+// files, and checks that tests release the locked memory they use.
+//
+// Everything here is insecure by design and must never be used outside
+// of tests.
+package guardtest
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/alexzava/chacha20poly1305guard"
+	"golang.org/x/crypto/chacha20"
+)
+
+// Key is the fixed key of DeterministicAEAD: the bytes 0 to 31.
+var Key = func() []byte {
+	k := make([]byte, chacha20poly1305guard.KeySize)
+	for i := range k {
+		k[i] = byte(i)
+	}
+	return k
+}()
+
+// DeterministicAEAD is an AEAD of this package with the fixed Key, whose
+// NextNonce returns counter nonces, so that a test sealing the same
+// messages in the same order always gets the same output. Its key is
+// kept in ordinary memory, so it works where memory locking is not
+// permitted. It is safe for concurrent use, but the order of concurrent
+// NextNonce calls is not.
+//
+// The envelope helpers only accept AEADs created by the package itself,
+// so pass them the embedded AEAD rather than the DeterministicAEAD.
+type DeterministicAEAD struct {
+	cipher.AEAD
+
+	mu      sync.Mutex
+	counter uint64
+}
+
+// NewDeterministicAEAD returns a DeterministicAEAD of variant v.
+func NewDeterministicAEAD(v chacha20poly1305guard.Variant) (*DeterministicAEAD, error) {
+	var aead cipher.AEAD
+	var err error
+	switch v {
+	case chacha20poly1305guard.XChaCha20:
+		aead, err = chacha20poly1305guard.NewXUnlockedForTesting(Key)
+	default:
+		aead, err = chacha20poly1305guard.NewUnlockedForTesting(Key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &DeterministicAEAD{AEAD: aead}, nil
+}
+
+// NextNonce returns the next nonce: a counter starting at zero, as a
+// little endian integer in the first 8 bytes.
+func (d *DeterministicAEAD) NextNonce() []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	nonce := make([]byte, d.NonceSize())
+	binary.LittleEndian.PutUint64(nonce, d.counter)
+	d.counter++
+	return nonce
+}
+
+// SealNext seals plaintext under NextNonce and returns the nonce and
+// the appended output.
+func (d *DeterministicAEAD) SealNext(dst, plaintext, data []byte) (nonce, out []byte) {
+	nonce = d.NextNonce()
+	return nonce, d.Seal(dst, nonce, plaintext, data)
+}
+
+// FixedRand returns a reader producing an endless, reproducible stream
+// of bytes derived from seed, for use in place of crypto/rand.Reader,
+// for instance to fill nonces in a WithNonceSource function.
+func FixedRand(seed string) io.Reader {
+	key := sha256.Sum256([]byte(seed))
+	c, err := chacha20.NewUnauthenticatedCipher(key[:], make([]byte, chacha20.NonceSize))
+	if err != nil {
+		panic(err)
+	}
+	return &fixedRand{c: c}
+}
+
+type fixedRand struct {
+	mu sync.Mutex
+	c  *chacha20.Cipher
+}
+
+func (r *fixedRand) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := range p {
+		p[i] = 0
+	}
+	r.c.XORKeyStream(p, p)
+	return len(p), nil
+}
+
+// AssertOpens fails the test unless blob, sealed under nonce with data,
+// opens with aead to want.
+func AssertOpens(t testing.TB, aead cipher.AEAD, nonce, blob, data, want []byte) {
+	t.Helper()
+	got, err := aead.Open(nil, nonce, blob, data)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("Open returned %q, want %q", got, want)
+	}
+}
+
+// AssertEnvelopeOpens fails the test unless envelope opens with aead
+// and data to want.
+func AssertEnvelopeOpens(t testing.TB, aead cipher.AEAD, envelope, data, want []byte) {
+	t.Helper()
+	got, err := chacha20poly1305guard.OpenEnvelope(aead, envelope, data)
+	if err != nil {
+		t.Fatalf("OpenEnvelope: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("OpenEnvelope returned %q, want %q", got, want)
+	}
+}
+
+// CheckLockedBuffers fails the test if, when it ends, the package holds
+// more key or stream buffers than when CheckLockedBuffers was called,
+// meaning that an AEAD was not closed or a stream not finished. Scratch
+// buffers are not checked, as pools keep them on purpose. Since the
+// counts are global, tests using it must not run in parallel with other
+// tests using this package.
+func CheckLockedBuffers(t testing.TB) {
+	t.Helper()
+	before := chacha20poly1305guard.Stats()
+	t.Cleanup(func() {
+		after := chacha20poly1305guard.Stats()
+		if n := after.Keys.Buffers - before.Keys.Buffers; n > 0 {
+			t.Errorf("%d key buffers were not destroyed", n)
+		}
+		if n := after.Streams.Buffers - before.Streams.Buffers; n > 0 {
+			t.Errorf("%d stream buffers were not destroyed", n)
+		}
+	})
+}
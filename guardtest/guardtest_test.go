@@ -0,0 +1,170 @@
+package guardtest
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/alexzava/chacha20poly1305guard"
+	"github.com/awnumar/memguard"
+)
+
+// fakeTB records failures and cleanups instead of acting on them.
+type fakeTB struct {
+	testing.TB
+	failed   bool
+	cleanups []func()
+}
+
+func (f *fakeTB) Helper()                       {}
+func (f *fakeTB) Errorf(string, ...interface{}) { f.failed = true }
+func (f *fakeTB) Fatalf(string, ...interface{}) { f.failed = true }
+func (f *fakeTB) Cleanup(fn func())             { f.cleanups = append(f.cleanups, fn) }
+func (f *fakeTB) runCleanups() {
+	for _, fn := range f.cleanups {
+		fn()
+	}
+}
+func (f *fakeTB) Logf(format string, a ...interface{}) {}
+
+func TestDeterministicAEAD(t *testing.T) {
+	for _, v := range []chacha20poly1305guard.Variant{chacha20poly1305guard.ChaCha20, chacha20poly1305guard.XChaCha20} {
+		a, err := NewDeterministicAEAD(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := NewDeterministicAEAD(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			msg := []byte(fmt.Sprint("message ", i))
+			nonceA, outA := a.SealNext(nil, msg, nil)
+			nonceB, outB := b.SealNext(nil, msg, nil)
+			if !bytes.Equal(nonceA, nonceB) || !bytes.Equal(outA, outB) {
+				t.Fatalf("%v: message %d differs between two instances", v, i)
+			}
+			if nonceA[0] != byte(i) || !bytes.Equal(nonceA[1:], make([]byte, len(nonceA)-1)) {
+				t.Fatalf("%v: nonce %d is %x", v, i, nonceA)
+			}
+			AssertOpens(t, a, nonceA, outA, nil, msg)
+		}
+	}
+
+	// The output depends on nothing but the inputs.
+	for _, tc := range []struct {
+		v    chacha20poly1305guard.Variant
+		want string
+	}{
+		{chacha20poly1305guard.ChaCha20, "70dd2e5dc2e25845dbb5c8d6ed091bb50e04445442"},
+		{chacha20poly1305guard.XChaCha20, "fd63e0ab835085d920e1dca4527b4d2acb33206ece"},
+	} {
+		d, err := NewDeterministicAEAD(tc.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, out := d.SealNext(nil, []byte("hello"), nil); hex.EncodeToString(out) != tc.want {
+			t.Errorf("%v: output %x, want %s", tc.v, out, tc.want)
+		}
+	}
+}
+
+func TestFixedRand(t *testing.T) {
+	read := func(r io.Reader, n int) []byte {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	if got := read(FixedRand("seed"), 16); hex.EncodeToString(got) != "e9f5d902aebb39aa57fc233bacb995bf" {
+		t.Fatalf("FixedRand(\"seed\") starts with %x", got)
+	}
+	whole := read(FixedRand("seed"), 1000)
+	r := FixedRand("seed")
+	var pieces []byte
+	for _, n := range []int{1, 63, 64, 100, 772} {
+		pieces = append(pieces, read(r, n)...)
+	}
+	if !bytes.Equal(whole, pieces) {
+		t.Fatal("output depends on the size of the reads")
+	}
+	if bytes.Equal(read(FixedRand("other seed"), 1000), whole) {
+		t.Fatal("different seeds give the same output")
+	}
+}
+
+func TestAssertOpens(t *testing.T) {
+	d, err := NewDeterministicAEAD(chacha20poly1305guard.XChaCha20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce, out := d.SealNext(nil, []byte("plaintext"), []byte("data"))
+
+	ok := &fakeTB{TB: t}
+	AssertOpens(ok, d, nonce, out, []byte("data"), []byte("plaintext"))
+	if ok.failed {
+		t.Fatal("AssertOpens failed for a matching blob")
+	}
+	for name, assert := range map[string]func(tb testing.TB){
+		"other data":      func(tb testing.TB) { AssertOpens(tb, d, nonce, out, nil, []byte("plaintext")) },
+		"other plaintext": func(tb testing.TB) { AssertOpens(tb, d, nonce, out, []byte("data"), []byte("other")) },
+	} {
+		bad := &fakeTB{TB: t}
+		assert(bad)
+		if !bad.failed {
+			t.Fatalf("AssertOpens passed with %s", name)
+		}
+	}
+
+	env, err := chacha20poly1305guard.SealEnvelope(d.AEAD, d.NextNonce(), []byte("plaintext"), []byte("data"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok = &fakeTB{TB: t}
+	AssertEnvelopeOpens(ok, d.AEAD, env, []byte("data"), []byte("plaintext"))
+	if ok.failed {
+		t.Fatal("AssertEnvelopeOpens failed for a matching envelope")
+	}
+	bad := &fakeTB{TB: t}
+	AssertEnvelopeOpens(bad, d.AEAD, env, nil, []byte("plaintext"))
+	if !bad.failed {
+		t.Fatal("AssertEnvelopeOpens passed with other data")
+	}
+}
+
+func TestCheckLockedBuffers(t *testing.T) {
+	master, err := memguard.NewImmutableRandom(chacha20poly1305guard.KeySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer master.Destroy()
+
+	// NewXWithContext derives a key buffer, which Close destroys.
+	closed := &fakeTB{TB: t}
+	CheckLockedBuffers(closed)
+	aead, err := chacha20poly1305guard.NewXWithContext(master, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead.(chacha20poly1305guard.AEAD).Close()
+	closed.runCleanups()
+	if closed.failed {
+		t.Fatal("CheckLockedBuffers failed although the AEAD was closed")
+	}
+
+	leaked := &fakeTB{TB: t}
+	CheckLockedBuffers(leaked)
+	aead, err = chacha20poly1305guard.NewXWithContext(master, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaked.runCleanups()
+	aead.(chacha20poly1305guard.AEAD).Close()
+	if !leaked.failed {
+		t.Fatal("CheckLockedBuffers missed an AEAD left open")
+	}
+}
@@ -0,0 +1,46 @@
+package chacha20poly1305guard
+
+import (
+	"crypto/subtle"
+	"errors"
+
+	"github.com/awnumar/memguard"
+)
+
+// ErrKeyCorrupted is returned when the key buffer no longer matches its
+// contents at construction time, for example because something wrote
+// over it. Nothing is encrypted or decrypted with such a key.
+var ErrKeyCorrupted = errors.New("key buffer corrupted")
+
+// keyCheck detects changes to a key held in a LockedBuffer by comparing
+// it to a reference copy kept in a separate immutable LockedBuffer. A
+// hash of the key would be smaller, but it would pass the key through
+// the hash state in ordinary memory, which this package avoids.
+type keyCheck struct {
+	key, ref *memguard.LockedBuffer
+}
+
+func newKeyCheck(key *memguard.LockedBuffer) (*keyCheck, error) {
+	ref, err := keyUsage.track(duplicate(key))
+	if err != nil {
+		return nil, err
+	}
+	if err := ref.MakeImmutable(); err != nil {
+		keyUsage.destroy(ref)
+		return nil, err
+	}
+
+	return &keyCheck{key, ref}, nil
+}
+
+// verify returns memguard.ErrDestroyed if the key has been destroyed
+// and ErrKeyCorrupted if its contents changed since newKeyCheck.
+func (c *keyCheck) verify() error {
+	if c.key.IsDestroyed() || c.ref.IsDestroyed() {
+		return memguard.ErrDestroyed
+	}
+	if subtle.ConstantTimeCompare(c.key.Buffer(), c.ref.Buffer()) != 1 {
+		return ErrKeyCorrupted
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package chacha20poly1305guard
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/awnumar/memguard"
+)
+
+func TestKeyCorrupted(t *testing.T) {
+	key := lockedBytes(t, testKey(t).Buffer())
+	aead, err := NewX(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aead.(AEAD).Close()
+	nonce := make([]byte, XNonceSize)
+	sealed := aead.Seal(nil, nonce, []byte("plaintext"), nil)
+
+	// Something writes over the key behind the AEAD's back.
+	key.Buffer()[7] ^= 0x10
+
+	if _, err := aead.(AEAD).SealAndWipe(nil, nonce, []byte("plaintext"), nil); err != ErrKeyCorrupted {
+		t.Fatalf("SealAndWipe: got %v, want ErrKeyCorrupted", err)
+	}
+	if err := panicErr(func() { aead.Seal(nil, nonce, nil, nil) }); err != ErrKeyCorrupted {
+		t.Fatalf("Seal: got panic %v, want ErrKeyCorrupted", err)
+	}
+	if _, err := aead.Open(nil, nonce, sealed, nil); err != ErrKeyCorrupted {
+		t.Fatalf("Open: got %v, want ErrKeyCorrupted", err)
+	}
+
+	key.Buffer()[7] ^= 0x10
+	if _, err := aead.Open(nil, nonce, sealed, nil); err != nil {
+		t.Fatalf("Open once the key is restored: %v", err)
+	}
+
+	key.Destroy()
+	if _, err := aead.Open(nil, nonce, sealed, nil); !errors.Is(err, memguard.ErrDestroyed) {
+		t.Fatalf("Open with a destroyed key: got %v, want memguard.ErrDestroyed", err)
+	}
+}
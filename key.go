@@ -0,0 +1,168 @@
+package chacha20poly1305guard
+
+import (
+	"crypto/cipher"
+
+	"github.com/awnumar/memguard"
+	"golang.org/x/crypto/chacha20"
+)
+
+// KeyProvider gives access to a key on demand, so that it can live
+// somewhere other than this process, such as an HSM or a remote KMS.
+//
+// WithKey calls fn with the raw key bytes. The slice is only valid until
+// fn returns and implementations are free to wipe or release it then.
+type KeyProvider interface {
+	WithKey(fn func(key []byte)) error
+}
+
+// NewLockedBufferProvider returns a KeyProvider backed by a LockedBuffer.
+// This is what New and NewX use.
+func NewLockedBufferProvider(key *memguard.LockedBuffer) KeyProvider {
+	return lockedKey{key}
+}
+
+// keyAccess is how Seal and Open reach the key, so that the same code
+// runs on top of a LockedBuffer, a KeyProvider or, for testing only, a
+// plain slice.
+type keyAccess interface {
+	KeyProvider
+	stream(newStream streamFunc, nonce []byte) (cipher.Stream, error)
+}
+
+// lockedKey is a key held in a LockedBuffer.
+type lockedKey struct {
+	b *memguard.LockedBuffer
+}
+
+func (k lockedKey) WithKey(fn func(key []byte)) error {
+	if k.b.IsDestroyed() {
+		return memguard.ErrDestroyed
+	}
+	fn(k.b.Buffer())
+	return nil
+}
+
+func (k lockedKey) stream(newStream streamFunc, nonce []byte) (cipher.Stream, error) {
+	return newStream(k.b, nonce)
+}
+
+// providerKey is a key behind an arbitrary KeyProvider. The key is only
+// requested while the keystream for a message is set up.
+type providerKey struct {
+	p KeyProvider
+}
+
+func (k providerKey) WithKey(fn func(key []byte)) error {
+	return k.p.WithKey(fn)
+}
+
+func (k providerKey) stream(_ streamFunc, nonce []byte) (cipher.Stream, error) {
+	var c cipher.Stream
+	var err error
+	perr := k.p.WithKey(func(key []byte) {
+		if len(key) != KeySize {
+			err = &SizeError{Field: "key", Want: KeySize, Got: len(key), Err: ErrInvalidKey}
+			return
+		}
+		c, err = unlockedKey(key).stream(nil, nonce)
+	})
+	if perr != nil {
+		return nil, perr
+	}
+	return c, err
+}
+
+// unlockedKey is a key held in ordinary memory. chacha20guard only
+// accepts LockedBuffers, so the keystream comes from x/crypto instead;
+// the variant is picked by the nonce size.
+type unlockedKey []byte
+
+func (k unlockedKey) WithKey(fn func(key []byte)) error {
+	fn(k)
+	return nil
+}
+
+func (k unlockedKey) stream(_ streamFunc, nonce []byte) (cipher.Stream, error) {
+	if len(nonce) == NonceSize {
+		// The original ChaCha20 with a 64 bit nonce is the IETF one with
+		// the first 32 bits of the nonce set to zero, as long as the
+		// block counter stays below 2^32.
+		n := make([]byte, chacha20.NonceSize)
+		copy(n[4:], nonce)
+		nonce = n
+	}
+	return chacha20.NewUnauthenticatedCipher(k, nonce)
+}
+
+// NewUnlockedForTesting returns a ChaCha20Poly1305 AEAD whose key is
+// kept in ordinary memory instead of a LockedBuffer.
+//
+// THIS IS INSECURE. The key can be swapped to disk, end up in core dumps
+// and is never wiped. It only exists so that test suites can run in
+// environments where memory locking is not permitted, and produces the
+// same output as New for the same key bytes. keyBytes is copied.
+func NewUnlockedForTesting(keyBytes []byte, opts ...Option) (cipher.AEAD, error) {
+	return newUnlocked(keyBytes, ChaCha20, opts)
+}
+
+// NewXUnlockedForTesting is the XChaCha20Poly1305 counterpart of
+// NewUnlockedForTesting, with the same caveats.
+func NewXUnlockedForTesting(keyBytes []byte, opts ...Option) (cipher.AEAD, error) {
+	return newUnlocked(keyBytes, XChaCha20, opts)
+}
+
+func newUnlocked(keyBytes []byte, v Variant, opts []Option) (cipher.AEAD, error) {
+	if len(keyBytes) != KeySize {
+		return nil, &SizeError{Field: "key", Want: KeySize, Got: len(keyBytes), Err: ErrInvalidKey}
+	}
+
+	k, err := build(unlockedKey(append([]byte(nil), keyBytes...)), v, opts)
+	if err != nil {
+		return nil, err
+	}
+	k.unlocked = true
+
+	return k, nil
+}
+
+// NewWithProvider returns a ChaCha20Poly1305 AEAD whose key is obtained
+// from p for every Seal and Open. If p was returned by
+// NewLockedBufferProvider this is the same as New.
+//
+// For other providers the key bytes are only exposed while the keystream
+// is set up, but the keystream state derived from them is kept in
+// ordinary memory for the duration of the operation.
+func NewWithProvider(p KeyProvider, opts ...Option) (cipher.AEAD, error) {
+	return newWithProvider(p, ChaCha20, opts)
+}
+
+// NewXWithProvider is the XChaCha20Poly1305 counterpart of
+// NewWithProvider.
+func NewXWithProvider(p KeyProvider, opts ...Option) (cipher.AEAD, error) {
+	return newWithProvider(p, XChaCha20, opts)
+}
+
+func newWithProvider(p KeyProvider, v Variant, opts []Option) (cipher.AEAD, error) {
+	if lk, ok := p.(lockedKey); ok {
+		k, err := newAEAD(lk.b, v, opts)
+		if err != nil {
+			return nil, err
+		}
+		return k, nil
+	}
+
+	var size int
+	if err := p.WithKey(func(key []byte) { size = len(key) }); err != nil {
+		return nil, err
+	}
+	if size != KeySize {
+		return nil, &SizeError{Field: "key", Want: KeySize, Got: size, Err: ErrInvalidKey}
+	}
+
+	k, err := build(providerKey{p}, v, opts)
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
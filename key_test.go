@@ -0,0 +1,107 @@
+package chacha20poly1305guard
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"errors"
+	"testing"
+)
+
+func TestUnlockedForTesting(t *testing.T) {
+	constructors := map[Variant]func([]byte, ...Option) (cipher.AEAD, error){
+		ChaCha20:  NewUnlockedForTesting,
+		XChaCha20: NewXUnlockedForTesting,
+	}
+	for _, v := range variants {
+		t.Run(v.String(), func(t *testing.T) {
+			locked := testAEAD(t, v)
+			unlocked, err := constructors[v](testKey(t).Buffer())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			nonce := make([]byte, locked.NonceSize())
+			data := []byte("associated data")
+			for n := 0; n <= 300; n += 23 {
+				nonce[0] = byte(n)
+				pt := bytes.Repeat([]byte{0xa5}, n)
+
+				want := locked.Seal(nil, nonce, pt, data)
+				got := unlocked.Seal(nil, nonce, pt, data)
+				if !bytes.Equal(got, want) {
+					t.Fatalf("%d bytes: unlocked ciphertext differs from the LockedBuffer one", n)
+				}
+				if out, err := unlocked.Open(nil, nonce, want, data); err != nil || !bytes.Equal(out, pt) {
+					t.Fatalf("%d bytes: unlocked AEAD cannot open locked ciphertext: %v", n, err)
+				}
+			}
+		})
+	}
+}
+
+// mockProvider hands out a fresh copy of its key for every WithKey call
+// and wipes it as soon as fn returns, recording whether the key is
+// exposed at the moment.
+type mockProvider struct {
+	key     []byte
+	calls   int
+	exposed bool
+	err     error
+}
+
+func (p *mockProvider) WithKey(fn func(key []byte)) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.calls++
+	key := append([]byte(nil), p.key...)
+	p.exposed = true
+	fn(key)
+	p.exposed = false
+	Wipe(key)
+	return nil
+}
+
+func TestKeyProvider(t *testing.T) {
+	p := &mockProvider{key: testKey(t).Buffer()}
+	aead, err := NewXWithProvider(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked, err := NewX(testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nonce := make([]byte, XNonceSize)
+	p.calls = 0
+	sealed := aead.Seal(nil, nonce, []byte("plaintext"), nil)
+	if !bytes.Equal(sealed, locked.Seal(nil, nonce, []byte("plaintext"), nil)) {
+		t.Fatal("KeyProvider output differs from the LockedBuffer one")
+	}
+	if got, err := aead.Open(nil, nonce, sealed, nil); err != nil || string(got) != "plaintext" {
+		t.Fatalf("Open = %q, %v", got, err)
+	}
+	// The key is requested once per operation and never kept.
+	if p.calls != 2 || p.exposed {
+		t.Fatalf("key requested %d times, exposed afterwards: %v", p.calls, p.exposed)
+	}
+
+	p.err = errors.New("kms unavailable")
+	if _, err := aead.(AEAD).SealAndWipe(nil, nonce, []byte("plaintext"), nil); err != p.err {
+		t.Fatalf("provider error: got %v", err)
+	}
+
+	if _, err := NewWithProvider(&mockProvider{key: make([]byte, 16)}); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("16 byte key: got %v, want ErrInvalidKey", err)
+	}
+
+	// The default provider is the LockedBuffer path itself.
+	lp, err := NewWithProvider(NewLockedBufferProvider(testKey(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := lp.(*chacha20poly1305).ek.(lockedKey); !ok {
+		t.Fatal("NewLockedBufferProvider does not use the LockedBuffer directly")
+	}
+}
@@ -0,0 +1,162 @@
+package chacha20poly1305guard
+
+import (
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/awnumar/memguard"
+)
+
+// maxKeyFileSize bounds what LoadKeyFromFile reads; the longest encoding
+// it accepts is hex with some trailing whitespace.
+const maxKeyFileSize = 256
+
+// LoadKeyFromFile reads a key from the file at path straight into locked
+// memory and returns it as an immutable LockedBuffer. The file may hold
+// the KeySize raw bytes, or their hex or base64 (standard or URL, padded
+// or not) encoding; surrounding whitespace is ignored for the encoded
+// forms. Anything else fails with ErrInvalidKey. Intermediate buffers
+// are locked too and destroyed before returning.
+func LoadKeyFromFile(path string) (*memguard.LockedBuffer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+	if size < 1 || size > maxKeyFileSize {
+		return nil, ErrInvalidKey
+	}
+
+	raw, err := newMutable(int(size))
+	if err != nil {
+		return nil, err
+	}
+	defer raw.Destroy()
+	if _, err := io.ReadFull(f, raw.Buffer()); err != nil {
+		return nil, err
+	}
+
+	return parseKey(raw.Buffer())
+}
+
+// LoadKeyFromEnv is LoadKeyFromFile for the path held in the environment
+// variable name, so the key itself never appears in the environment or
+// on the command line.
+func LoadKeyFromEnv(name string) (*memguard.LockedBuffer, error) {
+	path := os.Getenv(name)
+	if path == "" {
+		return nil, fmt.Errorf("environment variable %s is not set", name)
+	}
+	return LoadKeyFromFile(path)
+}
+
+// NewFromReader reads a raw key of exactly KeySize bytes from r straight
+// into locked memory, as when it is provisioned through a pipe or a
+// TPM, and returns an AEAD of variant v together with the key. Nothing
+// past the key is read. A short read fails with a *SizeError matching
+// ErrInvalidKey. The key belongs to the caller, who must destroy it once
+// the AEAD is no longer used; it is counted in Stats as a key until it
+// is garbage collected.
+func NewFromReader(r io.Reader, v Variant) (cipher.AEAD, *memguard.LockedBuffer, error) {
+	key, err := keyUsage.track(newMutable(KeySize))
+	if err != nil {
+		return nil, nil, err
+	}
+	if n, err := io.ReadFull(r, key.Buffer()); err != nil {
+		keyUsage.destroy(key)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, nil, &SizeError{Field: "key", Want: KeySize, Got: n, Err: ErrInvalidKey}
+		}
+		return nil, nil, err
+	}
+	if err := key.MakeImmutable(); err != nil {
+		keyUsage.destroy(key)
+		return nil, nil, err
+	}
+
+	aead, err := newAEAD(key, v, nil)
+	if err != nil {
+		keyUsage.destroy(key)
+		return nil, nil, err
+	}
+	return aead, key, nil
+}
+
+// parseKey decodes a key in any of the forms LoadKeyFromFile accepts
+// into a new immutable LockedBuffer.
+func parseKey(b []byte) (*memguard.LockedBuffer, error) {
+	if len(b) == KeySize {
+		return newKeyBuffer(b, copyDecode)
+	}
+
+	b = trimSpace(b)
+	switch len(b) {
+	case hex.EncodedLen(KeySize):
+		return newKeyBuffer(b, hex.Decode)
+	case base64.StdEncoding.EncodedLen(KeySize):
+		if b[len(b)-1] == '=' {
+			if k, err := newKeyBuffer(b, base64.StdEncoding.Decode); err == nil {
+				return k, nil
+			}
+			return newKeyBuffer(b, base64.URLEncoding.Decode)
+		}
+	case base64.RawStdEncoding.EncodedLen(KeySize):
+		if k, err := newKeyBuffer(b, base64.RawStdEncoding.Decode); err == nil {
+			return k, nil
+		}
+		return newKeyBuffer(b, base64.RawURLEncoding.Decode)
+	}
+	return nil, ErrInvalidKey
+}
+
+// newKeyBuffer decodes src into a new immutable LockedBuffer, failing
+// with ErrInvalidKey unless it decodes to exactly KeySize bytes. Decoders
+// may write past the key, so the output goes through a locked buffer
+// with some room to spare.
+func newKeyBuffer(src []byte, decode func(dst, src []byte) (int, error)) (*memguard.LockedBuffer, error) {
+	tmp, err := newMutable(len(src))
+	if err != nil {
+		return nil, err
+	}
+	defer tmp.Destroy()
+
+	n, err := decode(tmp.Buffer(), src)
+	if err != nil || n != KeySize {
+		return nil, ErrInvalidKey
+	}
+
+	key, err := newMutable(KeySize)
+	if err != nil {
+		return nil, err
+	}
+	copy(key.Buffer(), tmp.Buffer()[:KeySize])
+	key.MakeImmutable()
+
+	return key, nil
+}
+
+func copyDecode(dst, src []byte) (int, error) {
+	return copy(dst, src), nil
+}
+
+// trimSpace is bytes.TrimSpace for ASCII whitespace; it never copies.
+func trimSpace(b []byte) []byte {
+	isSpace := func(c byte) bool { return c == ' ' || c == '\t' || c == '\r' || c == '\n' }
+	for len(b) > 0 && isSpace(b[0]) {
+		b = b[1:]
+	}
+	for len(b) > 0 && isSpace(b[len(b)-1]) {
+		b = b[:len(b)-1]
+	}
+	return b
+}
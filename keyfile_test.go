@@ -0,0 +1,149 @@
+package chacha20poly1305guard
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestNewFromReader(t *testing.T) {
+	want := testKey(t).Buffer()
+	ref := testAEAD(t, XChaCha20)
+	nonce := make([]byte, XNonceSize)
+	sealed := ref.Seal(nil, nonce, []byte("plaintext"), nil)
+
+	for _, tc := range []struct {
+		name  string
+		input []byte
+	}{
+		{"exact", want},
+		{"longer", append(append([]byte(nil), want...), "rest"...)},
+	} {
+		r := bytes.NewReader(tc.input)
+		aead, key, err := NewFromReader(iotest.OneByteReader(r), XChaCha20)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if r.Len() != len(tc.input)-KeySize {
+			t.Fatalf("%s: %d bytes left unread, want %d", tc.name, r.Len(), len(tc.input)-KeySize)
+		}
+		if !bytes.Equal(key.Buffer(), want) || key.IsMutable() {
+			t.Fatalf("%s: key does not hold the bytes read, or is mutable", tc.name)
+		}
+		if _, err := aead.Open(nil, nonce, sealed, nil); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		aead.(AEAD).Close()
+		key.Destroy()
+	}
+}
+
+func TestNewFromReaderShort(t *testing.T) {
+	want := testKey(t).Buffer()
+	before := Stats().Keys.Buffers
+
+	for _, n := range []int{0, 1, KeySize - 1} {
+		_, _, err := NewFromReader(bytes.NewReader(want[:n]), ChaCha20)
+		var se *SizeError
+		if !errors.As(err, &se) || !errors.Is(err, ErrInvalidKey) || se.Got != n {
+			t.Fatalf("%d bytes: got %v, want a SizeError matching ErrInvalidKey", n, err)
+		}
+	}
+
+	readErr := errors.New("read failed")
+	if _, _, err := NewFromReader(iotest.ErrReader(readErr), ChaCha20); err != readErr {
+		t.Fatalf("got %v, want the read error", err)
+	}
+
+	// The key buffers of failed reads are released at once.
+	if got := Stats().Keys.Buffers; got != before {
+		t.Fatalf("key buffers = %d, want %d", got, before)
+	}
+}
+
+func TestLoadKeyFromFile(t *testing.T) {
+	// A key whose base64 forms use every character that differs between
+	// the standard and URL alphabets.
+	key := bytes.Repeat([]byte{0xfb, 0xff, 0xbf}, 11)[:KeySize]
+	dir := t.TempDir()
+
+	for _, tc := range []struct {
+		name    string
+		content string
+		valid   bool
+	}{
+		{"raw", string(key), true},
+		{"hex", hex.EncodeToString(key), true},
+		{"upper case hex", strings.ToUpper(hex.EncodeToString(key)), true},
+		{"base64", base64.StdEncoding.EncodeToString(key), true},
+		{"unpadded base64", base64.RawStdEncoding.EncodeToString(key), true},
+		{"base64url", base64.URLEncoding.EncodeToString(key), true},
+		{"unpadded base64url", base64.RawURLEncoding.EncodeToString(key), true},
+		{"hex with a newline", hex.EncodeToString(key) + "\n", true},
+		{"base64 with surrounding whitespace", " \t" + base64.StdEncoding.EncodeToString(key) + "\r\n", true},
+		{"empty", "", false},
+		{"whitespace only", "   \n", false},
+		{"raw key with a newline", string(key) + "\n", false},
+		{"short raw key", string(key[:KeySize-1]), false},
+		{"long raw key", string(key) + "x", false},
+		{"short hex", hex.EncodeToString(key[:KeySize-1]), false},
+		{"long hex", hex.EncodeToString(append(key, 0)), false},
+		{"short base64", base64.StdEncoding.EncodeToString(key[:KeySize-1]), false},
+		{"invalid hex", strings.Repeat("zz", KeySize), false},
+		{"mixed alphabets", "+" + base64.RawURLEncoding.EncodeToString(key)[1:], false},
+		{"too large", strings.Repeat("0", maxKeyFileSize+1), false},
+	} {
+		path := filepath.Join(dir, strings.Replace(tc.name, " ", "-", -1))
+		if err := os.WriteFile(path, []byte(tc.content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := LoadKeyFromFile(path)
+		if !tc.valid {
+			if !errors.Is(err, ErrInvalidKey) || got != nil {
+				t.Fatalf("%s: got %v, want ErrInvalidKey", tc.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if !bytes.Equal(got.Buffer(), key) || got.IsMutable() {
+			t.Fatalf("%s: wrong key, or mutable", tc.name)
+		}
+		got.Destroy()
+	}
+
+	if _, err := LoadKeyFromFile(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Fatalf("missing file: got %v", err)
+	}
+}
+
+func TestLoadKeyFromEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(testKey(t).Buffer())), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	const name = "CHACHA20POLY1305GUARD_TEST_KEY_FILE"
+	os.Unsetenv(name)
+	if _, err := LoadKeyFromEnv(name); err == nil || !strings.Contains(err.Error(), name) {
+		t.Fatalf("unset variable: got %v, want an error naming it", err)
+	}
+
+	t.Setenv(name, path)
+	key, err := LoadKeyFromEnv(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer key.Destroy()
+	if !bytes.Equal(key.Buffer(), testKey(t).Buffer()) {
+		t.Fatal("wrong key")
+	}
+}
@@ -0,0 +1,163 @@
+package chacha20poly1305guard
+
+import (
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/awnumar/memguard"
+)
+
+// ErrUnknownKey is returned by Keyring when an envelope names a key that
+// is not on the keyring.
+var ErrUnknownKey = errors.New("unknown key")
+
+// Keyring holds several keys, identified by their KeyFingerprint, for
+// rotating keys without downtime. Envelopes sealed by a Keyring carry
+// the fingerprint of their key as key ID, so any keyring holding that
+// key can open them, whichever keys were added since.
+//
+// A Keyring is safe for concurrent use, including adding keys while
+// others are opening envelopes. The zero value is an empty keyring.
+type Keyring struct {
+	mu      sync.RWMutex
+	keys    map[string]*keyringEntry
+	current string
+}
+
+// keyringEntry is a key on a keyring together with the AEADs created for
+// it so far, one per algorithm.
+type keyringEntry struct {
+	key *memguard.LockedBuffer
+
+	mu    sync.Mutex
+	aeads map[Algorithm]cipher.AEAD
+}
+
+// Add puts key on the keyring and makes it the key SealEnvelope uses. It
+// returns the fingerprint of key. Adding a key that is already on the
+// keyring only makes it current again. The keyring does not copy key,
+// which must stay alive while it is on the keyring.
+func (r *Keyring) Add(key *memguard.LockedBuffer) (fingerprint string, err error) {
+	fp, err := KeyFingerprint(key)
+	if err != nil {
+		return "", err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.keys == nil {
+		r.keys = make(map[string]*keyringEntry)
+	}
+	if _, ok := r.keys[fp]; !ok {
+		r.keys[fp] = &keyringEntry{key: key, aeads: make(map[Algorithm]cipher.AEAD)}
+	}
+	r.current = fp
+	return fp, nil
+}
+
+// Remove takes the key with the given fingerprint off the keyring, so
+// that envelopes sealed with it no longer open, and releases the AEADs
+// created for it. If it was the current key, SealEnvelope fails with
+// ErrUnknownKey until another key is added. Removing a key that is not
+// on the keyring does nothing. The key itself is not destroyed.
+func (r *Keyring) Remove(fingerprint string) {
+	r.mu.Lock()
+	e, ok := r.keys[fingerprint]
+	delete(r.keys, fingerprint)
+	if r.current == fingerprint {
+		r.current = ""
+	}
+	r.mu.Unlock()
+
+	if ok {
+		e.close()
+	}
+}
+
+// SealEnvelope seals plaintext with the current key, using alg, and
+// returns an envelope whose key ID is the fingerprint of the key.
+func (r *Keyring) SealEnvelope(alg Algorithm, nonce, plaintext, data []byte) ([]byte, error) {
+	r.mu.RLock()
+	fp := r.current
+	r.mu.RUnlock()
+	if fp == "" {
+		return nil, ErrUnknownKey
+	}
+
+	aead, err := r.aead(fp, alg)
+	if err != nil {
+		return nil, err
+	}
+	return SealEnvelope(aead, nonce, plaintext, data, []byte(fp))
+}
+
+// OpenEnvelope opens an envelope with the key whose fingerprint is its
+// key ID. An envelope naming a key that is not on the keyring fails with
+// an error matching ErrUnknownKey, before anything is decrypted.
+func (r *Keyring) OpenEnvelope(envelope, data []byte) ([]byte, error) {
+	m, err := DecodeEnvelope(envelope)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := r.aead(string(m.KeyID), m.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return OpenSealedMessage(aead, m, data)
+}
+
+// aead returns the AEAD of algorithm alg for the key with fingerprint
+// fp, creating it on first use.
+func (r *Keyring) aead(fp string, alg Algorithm) (cipher.AEAD, error) {
+	r.mu.RLock()
+	e, ok := r.keys[fp]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, fp)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if aead, ok := e.aeads[alg]; ok {
+		return aead, nil
+	}
+
+	info, err := LookupAlgorithm(alg)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := info.New(e.key)
+	if err != nil {
+		return nil, err
+	}
+	e.aeads[alg] = aead
+	return aead, nil
+}
+
+// Close releases the AEADs the keyring created and empties it. The keys
+// themselves belong to the caller and are not destroyed.
+func (r *Keyring) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, e := range r.keys {
+		e.close()
+	}
+	r.keys = nil
+	r.current = ""
+	return nil
+}
+
+// close releases the AEADs created for the key.
+func (e *keyringEntry) close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for alg, aead := range e.aeads {
+		if c, ok := aead.(interface{ Close() error }); ok {
+			c.Close()
+		}
+		delete(e.aeads, alg)
+	}
+}
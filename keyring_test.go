@@ -0,0 +1,182 @@
+package chacha20poly1305guard
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/awnumar/memguard"
+)
+
+// sealKeyring seals plaintext with the current key of r.
+func sealKeyring(t *testing.T, r *Keyring, plaintext string) []byte {
+	t.Helper()
+	env, err := r.SealEnvelope(AlgorithmXChaCha20Poly1305, make([]byte, XNonceSize), []byte(plaintext), []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+func TestKeyring(t *testing.T) {
+	var r Keyring
+	defer r.Close()
+	if _, err := r.SealEnvelope(AlgorithmXChaCha20Poly1305, make([]byte, XNonceSize), nil, nil); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("empty keyring: got %v, want ErrUnknownKey", err)
+	}
+
+	k1, k2 := testKey(t), lockedBytes(t, bytes.Repeat([]byte{2}, KeySize))
+	fp1, err := r.Add(k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := KeyFingerprint(k1); fp1 != want {
+		t.Fatalf("Add returned %q, want the fingerprint %q", fp1, want)
+	}
+	e1 := sealKeyring(t, &r, "one")
+
+	// Rotating to k2 seals new envelopes under it; old ones still open.
+	fp2, err := r.Add(k2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e2 := sealKeyring(t, &r, "two")
+	for _, tc := range []struct {
+		env       []byte
+		fp, plain string
+	}{{e1, fp1, "one"}, {e2, fp2, "two"}} {
+		if m, err := DecodeEnvelope(tc.env); err != nil || string(m.KeyID) != tc.fp {
+			t.Fatalf("%s: envelope key ID %q, %v, want %q", tc.plain, m.KeyID, err, tc.fp)
+		}
+		if p, err := r.OpenEnvelope(tc.env, []byte("data")); err != nil || string(p) != tc.plain {
+			t.Fatalf("open %s: %q, %v", tc.plain, p, err)
+		}
+	}
+	// The envelopes open with the plain key too.
+	if p, err := OpenEnvelope(testAEAD(t, XChaCha20), e1, []byte("data")); err != nil || string(p) != "one" {
+		t.Fatalf("open with the key itself: %q, %v", p, err)
+	}
+
+	// Adding a key again makes it current.
+	if fp, err := r.Add(k1); err != nil || fp != fp1 {
+		t.Fatalf("Add again: %q, %v", fp, err)
+	}
+	if m, _ := DecodeEnvelope(sealKeyring(t, &r, "three")); string(m.KeyID) != fp1 {
+		t.Fatalf("sealed under %q after adding k1 again, want %q", m.KeyID, fp1)
+	}
+
+	// An envelope of a key that is not on the keyring fails before
+	// anything is decrypted.
+	var other Keyring
+	defer other.Close()
+	if _, err := other.Add(lockedBytes(t, bytes.Repeat([]byte{3}, KeySize))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.OpenEnvelope(sealKeyring(t, &other, "other"), []byte("data")); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("unknown fingerprint: got %v, want ErrUnknownKey", err)
+	}
+	if _, err := r.OpenEnvelope(e1, []byte("other data")); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("other data: got %v, want ErrAuthFailed", err)
+	}
+
+	r.Close()
+	if _, err := r.OpenEnvelope(e1, []byte("data")); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("after Close: got %v, want ErrUnknownKey", err)
+	}
+	if k1.IsDestroyed() || k2.IsDestroyed() {
+		t.Fatal("Close destroyed a key")
+	}
+}
+
+func TestKeyringRemove(t *testing.T) {
+	var r Keyring
+	defer r.Close()
+	k1, k2 := testKey(t), lockedBytes(t, bytes.Repeat([]byte{2}, KeySize))
+	fp1, _ := r.Add(k1)
+	e1 := sealKeyring(t, &r, "one")
+	fp2, _ := r.Add(k2)
+	e2 := sealKeyring(t, &r, "two")
+
+	r.Remove(fp1)
+	if _, err := r.OpenEnvelope(e1, []byte("data")); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("removed key: got %v, want ErrUnknownKey", err)
+	}
+	if p, err := r.OpenEnvelope(e2, []byte("data")); err != nil || string(p) != "two" {
+		t.Fatalf("remaining key: %q, %v", p, err)
+	}
+	r.Remove(fp1)
+	r.Remove("v1:0000000000000000")
+
+	// Removing the current key leaves no key to seal with.
+	r.Remove(fp2)
+	if _, err := r.SealEnvelope(AlgorithmXChaCha20Poly1305, make([]byte, XNonceSize), nil, nil); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("seal after removing the current key: got %v, want ErrUnknownKey", err)
+	}
+	if k1.IsDestroyed() || k2.IsDestroyed() {
+		t.Fatal("Remove destroyed a key")
+	}
+
+	// A removed key can be added back.
+	if _, err := r.Add(k1); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := r.OpenEnvelope(e1, []byte("data")); err != nil || string(p) != "one" {
+		t.Fatalf("key added back: %q, %v", p, err)
+	}
+}
+
+// TestKeyringConcurrent adds keys while other goroutines open and seal.
+// Run it with -race.
+func TestKeyringConcurrent(t *testing.T) {
+	var r Keyring
+	defer r.Close()
+	if _, err := r.Add(testKey(t)); err != nil {
+		t.Fatal(err)
+	}
+	env := sealKeyring(t, &r, "plaintext")
+
+	keys := make([]*memguard.LockedBuffer, 8)
+	for i := range keys {
+		keys[i] = lockedBytes(t, bytes.Repeat([]byte{byte(i + 10)}, KeySize))
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for _, k := range keys {
+			if _, err := r.Add(k); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				if p, err := r.OpenEnvelope(env, []byte("data")); err != nil || string(p) != "plaintext" {
+					errs <- err
+					return
+				}
+				sealed, err := r.SealEnvelope(AlgorithmChaCha20Poly1305, make([]byte, NonceSize), []byte("x"), nil)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if _, err := r.OpenEnvelope(sealed, nil); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,154 @@
+package chacha20poly1305guard
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/awnumar/memguard"
+)
+
+// ErrLockFailed is returned when locked memory cannot be allocated,
+// typically because RLIMIT_MEMLOCK has been reached. memguard itself
+// panics in that case; this package recovers and returns the error.
+var ErrLockFailed = errors.New("could not allocate locked memory")
+
+// LockPolicy decides what happens when locked memory is unavailable.
+type LockPolicy int32
+
+const (
+	// FailClosed makes the operation that needed locked memory fail with
+	// ErrLockFailed. It is the default.
+	FailClosed LockPolicy = iota
+
+	// DegradeWithWarning makes scratch buffers, such as the one holding
+	// the Poly1305 key, fall back to ordinary memory that is still wiped
+	// after use, and skips the reference copy used to detect key
+	// corruption. Every fallback is counted in Stats and reported to the
+	// handler set with SetDegradeHandler. Operations that must hand out a
+	// LockedBuffer, and the buffers of streams, still fail closed.
+	DegradeWithWarning
+)
+
+var (
+	lockPolicy int32 // LockPolicy
+
+	degradeMu      sync.Mutex
+	degradeHandler func(err error)
+	degraded       int64
+)
+
+// SetLockPolicy sets the LockPolicy of the package.
+func SetLockPolicy(p LockPolicy) {
+	atomic.StoreInt32(&lockPolicy, int32(p))
+}
+
+// SetDegradeHandler registers fn to be called, with the ErrLockFailed
+// that caused it, whenever DegradeWithWarning falls back to ordinary
+// memory. fn may be called concurrently and should not block. A nil fn
+// removes the handler.
+func SetDegradeHandler(fn func(err error)) {
+	degradeMu.Lock()
+	degradeHandler = fn
+	degradeMu.Unlock()
+}
+
+// ProtectionLevel describes how well secrets handled by the package are
+// currently protected.
+type ProtectionLevel int
+
+const (
+	// ProtectionFull means every buffer has been locked as intended.
+	ProtectionFull ProtectionLevel = iota
+
+	// ProtectionDegraded means DegradeWithWarning has fallen back to
+	// ordinary memory at least once, so some secrets may have been
+	// swappable.
+	ProtectionDegraded
+)
+
+func (l ProtectionLevel) String() string {
+	switch l {
+	case ProtectionFull:
+		return "full"
+	case ProtectionDegraded:
+		return "degraded"
+	}
+	return fmt.Sprintf("ProtectionLevel(%d)", int(l))
+}
+
+// CurrentProtectionLevel reports the ProtectionLevel of the process so
+// far, so applications can warn when full protection is not active.
+func CurrentProtectionLevel() ProtectionLevel {
+	if atomic.LoadInt64(&degraded) > 0 {
+		return ProtectionDegraded
+	}
+	return ProtectionFull
+}
+
+// TryLock checks that size bytes of locked memory can currently be
+// allocated, so that a service can fail at startup rather than in the
+// middle of a request. It returns ErrLockFailed if they cannot.
+func TryLock(size int) error {
+	b, err := newMutable(size)
+	if err != nil {
+		return err
+	}
+	b.Destroy()
+	return nil
+}
+
+// degrade reports whether err may be worked around by falling back to
+// ordinary memory, and if so records the fallback.
+func degrade(err error) bool {
+	if !errors.Is(err, ErrLockFailed) || LockPolicy(atomic.LoadInt32(&lockPolicy)) != DegradeWithWarning {
+		return false
+	}
+
+	atomic.AddInt64(&degraded, 1)
+
+	degradeMu.Lock()
+	fn := degradeHandler
+	degradeMu.Unlock()
+	if fn != nil {
+		fn(err)
+	}
+
+	return true
+}
+
+// allocate runs f and turns the panic memguard raises when memory cannot
+// be allocated or locked into ErrLockFailed. Other panics go through.
+func allocate(f func() (*memguard.LockedBuffer, error)) (b *memguard.LockedBuffer, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			msg, ok := r.(string)
+			if !ok || !strings.HasPrefix(msg, "memguard.memcall.") {
+				panic(r)
+			}
+			b, err = nil, fmt.Errorf("%w: %s", ErrLockFailed, msg)
+		}
+	}()
+
+	return f()
+}
+
+func newMutable(n int) (*memguard.LockedBuffer, error) {
+	return allocate(func() (*memguard.LockedBuffer, error) {
+		return memguard.NewMutable(n)
+	})
+}
+
+func newImmutableFromBytes(buf []byte) (*memguard.LockedBuffer, error) {
+	return allocate(func() (*memguard.LockedBuffer, error) {
+		return memguard.NewImmutableFromBytes(buf)
+	})
+}
+
+func duplicate(b *memguard.LockedBuffer) (*memguard.LockedBuffer, error) {
+	return allocate(func() (*memguard.LockedBuffer, error) {
+		return memguard.Duplicate(b)
+	})
+}
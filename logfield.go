@@ -0,0 +1,81 @@
+package chacha20poly1305guard
+
+import (
+	"crypto/cipher"
+	"encoding/json"
+)
+
+// logFieldAAD prefixes the name of a log field in the associated data of
+// its token, so that field tokens never open as plain string tokens.
+const logFieldAAD = "chacha20poly1305guard log field\x00"
+
+// EncryptField seals the value of the log field key into a token in the
+// format of EncryptString, under a random nonce, so aead must be
+// XChaCha20Poly1305. The field name is authenticated: a token copied
+// into another field no longer decrypts.
+func EncryptField(aead cipher.AEAD, key string, value []byte) (string, error) {
+	return encryptToken(aead, value, []byte(logFieldAAD+key), &stringConfig{})
+}
+
+// DecryptField opens a token written by EncryptField for the field key.
+func DecryptField(aead cipher.AEAD, key, token string) ([]byte, error) {
+	return decryptToken(aead, token, []byte(logFieldAAD+key))
+}
+
+// FieldEncoder is the part of zapcore.ObjectEncoder that LogField needs.
+type FieldEncoder interface {
+	AddString(key, value string)
+}
+
+// LogField is a log field whose value is sealed with EncryptField when
+// the entry is emitted, not when it is built, so entries dropped by the
+// log level cost nothing. It works with logrus as a field value, through
+// String and MarshalJSON, with zap as zap.Stringer(f.Key, f), and as a
+// zapcore.ObjectMarshaler through a small adapter:
+//
+//	type sealed struct{ guard.LogField }
+//
+//	func (s sealed) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+//		return s.MarshalLogFields(enc)
+//	}
+//
+// Value is kept in ordinary memory until the entry is written.
+type LogField struct {
+	AEAD  cipher.AEAD
+	Key   string
+	Value []byte
+}
+
+// NewLogField returns the LogField sealing value as the field key.
+func NewLogField(aead cipher.AEAD, key string, value []byte) LogField {
+	return LogField{AEAD: aead, Key: key, Value: value}
+}
+
+// String returns the token of f. Since fmt.Stringer cannot fail, an
+// error is returned as a placeholder that holds nothing of the value.
+func (f LogField) String() string {
+	token, err := EncryptField(f.AEAD, f.Key, f.Value)
+	if err != nil {
+		return "!ERROR(" + err.Error() + ")"
+	}
+	return token
+}
+
+// MarshalJSON returns the token of f as a JSON string.
+func (f LogField) MarshalJSON() ([]byte, error) {
+	token, err := EncryptField(f.AEAD, f.Key, f.Value)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(token)
+}
+
+// MarshalLogFields adds the token of f to enc under f.Key.
+func (f LogField) MarshalLogFields(enc FieldEncoder) error {
+	token, err := EncryptField(f.AEAD, f.Key, f.Value)
+	if err != nil {
+		return err
+	}
+	enc.AddString(f.Key, token)
+	return nil
+}
@@ -0,0 +1,143 @@
+package chacha20poly1305guard
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Metrics receives a call for every operation of an AEAD, for instance
+// to feed Prometheus counters. A spike in IncAuthFailure can mean that
+// someone is trying to forge messages. Implementations are called
+// synchronously from Seal and Open and must be cheap and safe for
+// concurrent use.
+type Metrics interface {
+	// IncSeal is called for every message sealed, including by MAC.
+	IncSeal()
+
+	// IncOpen is called for every message that authenticates, including
+	// checks by IsAuthentic and VerifyMAC.
+	IncOpen()
+
+	// IncAuthFailure is called for every message that fails to
+	// authenticate, including truncated ones.
+	IncAuthFailure()
+}
+
+// WithMetrics reports the operations of the AEAD to m. A nil m disables
+// reporting, which is the default. m is only called once the tag has
+// been compared, so it does not affect the timing of the comparison.
+func WithMetrics(m Metrics) Option {
+	return func(k *chacha20poly1305) {
+		k.metrics = m
+	}
+}
+
+// OperationStats counts the operations of every AEAD created by this
+// package since the program started.
+type OperationStats struct {
+	Seals       int64
+	BytesSealed int64 // plaintext bytes
+
+	// Opens counts messages that authenticated, including checks that
+	// did not decrypt, such as Verify. BytesOpened counts their
+	// plaintext bytes.
+	Opens       int64
+	BytesOpened int64
+
+	// AuthFailures counts messages that failed to authenticate.
+	AuthFailures int64
+
+	// KeyDestroyed counts operations that failed because the key's
+	// LockedBuffer had been destroyed.
+	KeyDestroyed int64
+}
+
+// OpStats returns the operation counters of the package. Like Stats it
+// only reads atomic counters. Keeping them costs two atomic additions
+// per operation.
+func OpStats() OperationStats {
+	return OperationStats{
+		Seals:        atomic.LoadInt64(&opCounters.seals),
+		BytesSealed:  atomic.LoadInt64(&opCounters.bytesSealed),
+		Opens:        atomic.LoadInt64(&opCounters.opens),
+		BytesOpened:  atomic.LoadInt64(&opCounters.bytesOpened),
+		AuthFailures: atomic.LoadInt64(&opCounters.authFailures),
+		KeyDestroyed: atomic.LoadInt64(&opCounters.keyDestroyed),
+	}
+}
+
+var opCounters struct {
+	seals, bytesSealed, opens, bytesOpened, authFailures, keyDestroyed int64
+}
+
+// AuthFailure describes a message that failed to authenticate. It never
+// holds key, plaintext or ciphertext bytes.
+type AuthFailure struct {
+	// KeyID is the key ID of the envelope, if the message was one.
+	KeyID string
+
+	// CiphertextLen is the length of the ciphertext, tag included.
+	CiphertextLen int
+
+	Variant Variant
+}
+
+var (
+	authFailureMu      sync.Mutex
+	authFailureHandler func(AuthFailure)
+)
+
+// SetAuthFailureHandler registers fn to be called for every message that
+// fails to authenticate, for instance to alert on a spike that may mean
+// corruption or an attack. fn is called synchronously after the error
+// has been decided, may be called concurrently and should not block. A
+// panic in fn is recovered and discarded, so it cannot turn a failed
+// Open into a crash. A nil fn removes the handler.
+func SetAuthFailureHandler(fn func(AuthFailure)) {
+	authFailureMu.Lock()
+	authFailureHandler = fn
+	authFailureMu.Unlock()
+}
+
+func (k *chacha20poly1305) countSeal(plaintextLen int) {
+	atomic.AddInt64(&opCounters.seals, 1)
+	atomic.AddInt64(&opCounters.bytesSealed, int64(plaintextLen))
+
+	if k.metrics != nil {
+		k.metrics.IncSeal()
+	}
+}
+
+// countOpen records the outcome of authenticating a ciphertext of
+// sealedLen bytes, tag included.
+func (k *chacha20poly1305) countOpen(sealedLen int, keyID []byte, authentic bool) {
+	if authentic {
+		atomic.AddInt64(&opCounters.opens, 1)
+		atomic.AddInt64(&opCounters.bytesOpened, int64(sealedLen-k.tagSize))
+		if k.metrics != nil {
+			k.metrics.IncOpen()
+		}
+		return
+	}
+
+	atomic.AddInt64(&opCounters.authFailures, 1)
+	if k.metrics != nil {
+		k.metrics.IncAuthFailure()
+	}
+
+	authFailureMu.Lock()
+	fn := authFailureHandler
+	authFailureMu.Unlock()
+	if fn != nil {
+		reportAuthFailure(fn, AuthFailure{
+			KeyID:         string(keyID),
+			CiphertextLen: sealedLen,
+			Variant:       k.variant,
+		})
+	}
+}
+
+func reportAuthFailure(fn func(AuthFailure), f AuthFailure) {
+	defer func() { recover() }()
+	fn(f)
+}
@@ -0,0 +1,145 @@
+package chacha20poly1305guard
+
+import (
+	"bytes"
+	"sync/atomic"
+	"testing"
+)
+
+type countingMetrics struct {
+	seals, opens, failures int64
+}
+
+func (m *countingMetrics) IncSeal()        { atomic.AddInt64(&m.seals, 1) }
+func (m *countingMetrics) IncOpen()        { atomic.AddInt64(&m.opens, 1) }
+func (m *countingMetrics) IncAuthFailure() { atomic.AddInt64(&m.failures, 1) }
+
+func TestMetrics(t *testing.T) {
+	m := &countingMetrics{}
+	aead := testAEAD(t, XChaCha20, WithMetrics(m))
+	nonce := make([]byte, aead.NonceSize())
+
+	sealed := aead.Seal(nil, nonce, []byte("one"), nil)
+	aead.Seal(nil, nonce, []byte("two"), nil)
+	aead.Open(nil, nonce, sealed, nil)
+	aead.Open(nil, nonce, sealed, []byte("other aad"))
+	aead.Open(nil, nonce, sealed[:TagSize-1], nil)
+
+	if m.seals != 2 || m.opens != 1 || m.failures != 2 {
+		t.Fatalf("got %d seals, %d opens and %d failures, want 2, 1 and 2", m.seals, m.opens, m.failures)
+	}
+}
+
+func TestOpStatsAndAuthFailureHandler(t *testing.T) {
+	var failures []AuthFailure
+	SetAuthFailureHandler(func(f AuthFailure) {
+		failures = append(failures, f)
+		panic("handler panics are recovered")
+	})
+	defer SetAuthFailureHandler(nil)
+
+	aead := testAEAD(t, XChaCha20)
+	nonce := make([]byte, aead.NonceSize())
+	plaintext := []byte("secret plaintext")
+
+	before := OpStats()
+	env, err := SealEnvelope(aead, nonce, plaintext, nil, []byte("key-7"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenEnvelope(aead, env, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenEnvelope(aead, env, []byte("other aad")); err == nil {
+		t.Fatal("OpenEnvelope accepted other AAD")
+	}
+	after := OpStats()
+
+	want := OperationStats{Seals: 1, BytesSealed: 16, Opens: 1, BytesOpened: 16, AuthFailures: 1}
+	got := OperationStats{
+		Seals:        after.Seals - before.Seals,
+		BytesSealed:  after.BytesSealed - before.BytesSealed,
+		Opens:        after.Opens - before.Opens,
+		BytesOpened:  after.BytesOpened - before.BytesOpened,
+		AuthFailures: after.AuthFailures - before.AuthFailures,
+		KeyDestroyed: after.KeyDestroyed - before.KeyDestroyed,
+	}
+	if got != want {
+		t.Fatalf("OpStats moved by %+v, want %+v", got, want)
+	}
+
+	if len(failures) != 1 {
+		t.Fatalf("handler called %d times, want 1", len(failures))
+	}
+	f := failures[0]
+	if f.KeyID != "key-7" || f.CiphertextLen != len(plaintext)+TagSize || f.Variant != XChaCha20 {
+		t.Fatalf("handler got %+v", f)
+	}
+}
+
+func TestKeyDestroyedCounter(t *testing.T) {
+	aead := testAEAD(t, XChaCha20)
+	nonce := make([]byte, aead.NonceSize())
+	aead.Close()
+
+	before := OpStats().KeyDestroyed
+	if _, err := aead.SealAndWipe(nil, nonce, nil, nil); err != ErrKeyDestroyed {
+		t.Fatalf("got %v, want ErrKeyDestroyed", err)
+	}
+	if got := OpStats().KeyDestroyed - before; got != 1 {
+		t.Fatalf("KeyDestroyed moved by %d, want 1", got)
+	}
+}
+
+// TestCountersAllocs checks that keeping the counters never allocates
+// when no Metrics or handler is registered.
+func TestCountersAllocs(t *testing.T) {
+	k := testAEAD(t, XChaCha20).(*chacha20poly1305)
+	allocs := testing.AllocsPerRun(100, func() {
+		k.countSeal(64)
+		k.countOpen(64+TagSize, nil, true)
+		k.countOpen(64+TagSize, nil, false)
+	})
+	if allocs != 0 {
+		t.Fatalf("counters allocate %v times", allocs)
+	}
+}
+
+// BenchmarkCounters measures what the operation counters add to every
+// Seal and Open when no Metrics or handler is registered.
+func BenchmarkCounters(b *testing.B) {
+	k := testAEAD(b, XChaCha20).(*chacha20poly1305)
+	b.Run("seal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			k.countSeal(64)
+		}
+	})
+	b.Run("open", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			k.countOpen(64+TagSize, nil, true)
+		}
+	})
+}
+
+// BenchmarkSealMetrics compares Seal with and without a Metrics.
+func BenchmarkSealMetrics(b *testing.B) {
+	for _, m := range []Metrics{nil, &countingMetrics{}} {
+		name := "none"
+		if m != nil {
+			name = "counting"
+		}
+		b.Run(name, func(b *testing.B) {
+			aead := testAEAD(b, XChaCha20, WithMetrics(m))
+			nonce := make([]byte, aead.NonceSize())
+			dst := make([]byte, 0, 64+TagSize)
+			msg := bytes.Repeat([]byte{1}, 64)
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				aead.Seal(dst[:0], nonce, msg, nil)
+			}
+		})
+	}
+}
@@ -0,0 +1,430 @@
+package chacha20poly1305guard
+
+import (
+	"bufio"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrAlreadyMigrated is recorded by MigrateDir for files that are
+	// already envelopes sealed with the current key of the keyring.
+	ErrAlreadyMigrated = errors.New("already sealed with the current key")
+
+	// ErrInJournal is recorded by MigrateDir for files that its journal
+	// lists as migrated.
+	ErrInJournal = errors.New("listed in the migration journal")
+)
+
+// DefaultMigrateMaxSize is the largest file MigrateDir migrates unless
+// MigrateOptions says otherwise. Each file in flight holds its plaintext
+// in locked memory.
+const DefaultMigrateMaxSize = 16 << 20
+
+// migrateTempPrefix starts the names of the files MigrateDir writes
+// before renaming them into place.
+const migrateTempPrefix = ".c20pguard-migrate-"
+
+// MigrateBlob opens blob, the output of oldAEAD.Seal under oldNonce, and
+// reseals it with newAEAD as an envelope under a random nonce, so
+// newAEAD must be an XChaCha20Poly1305 AEAD. aad must be the data blob
+// was sealed with and is used again for the envelope. The plaintext only
+// exists in locked memory, and only while it is resealed.
+func MigrateBlob(oldAEAD, newAEAD cipher.AEAD, oldNonce, blob, aad []byte) ([]byte, error) {
+	return migrate(oldAEAD, newAEAD, oldNonce, blob, aad, aad, nil)
+}
+
+// migrate opens ciphertext with data and reseals it as an envelope with
+// aad and keyID.
+func migrate(oldAEAD, newAEAD cipher.AEAD, nonce, ciphertext, data, aad, keyID []byte) ([]byte, error) {
+	if newAEAD.NonceSize() < XNonceSize {
+		return nil, ErrNonceSourceRequired
+	}
+	if len(nonce) != oldAEAD.NonceSize() {
+		return nil, &NonceError{Want: oldAEAD.NonceSize(), Got: len(nonce)}
+	}
+	newNonce := make([]byte, newAEAD.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, newNonce); err != nil {
+		return nil, err
+	}
+
+	var env []byte
+	err := openLocked(oldAEAD, nonce, ciphertext, data, func(plaintext []byte) error {
+		var err error
+		env, err = SealEnvelope(newAEAD, newNonce, plaintext, aad, keyID)
+		return err
+	})
+	return env, err
+}
+
+// openLocked opens ciphertext and passes the plaintext to fn. AEADs of
+// this package decrypt into locked memory; for others the plaintext is
+// wiped once fn returns.
+func openLocked(aead cipher.AEAD, nonce, ciphertext, data []byte, fn func(plaintext []byte) error) error {
+	if k, ok := aead.(*chacha20poly1305); ok {
+		return k.OpenWith(nonce, ciphertext, data, fn)
+	}
+	plaintext, err := aead.Open(nil, nonce, ciphertext, data)
+	if err != nil {
+		return err
+	}
+	defer wipe(plaintext)
+	return fn(plaintext)
+}
+
+// MigrateOptions configures MigrateDir.
+type MigrateOptions struct {
+	// DryRun opens every file that would be migrated, so that failures
+	// are reported, but writes nothing, not even the journal.
+	DryRun bool
+
+	// Concurrency is the number of files migrated at once. Zero means
+	// one.
+	Concurrency int
+
+	// MaxSize is the largest file migrated. Zero selects
+	// DefaultMigrateMaxSize.
+	MaxSize int64
+
+	// Journal, if set, is the path of a file recording the files that
+	// have been migrated, one per line. Files listed in it are skipped,
+	// so an interrupted migration resumes where it stopped.
+	Journal string
+
+	// Algorithm is the algorithm of the new envelopes. Zero selects
+	// AlgorithmXChaCha20Poly1305, which is the only built-in algorithm
+	// whose nonces can be random.
+	Algorithm Algorithm
+
+	// AAD returns the associated data of the file at path, relative to
+	// the directory. It is used to open the file and for its new
+	// envelope. Nil means no associated data.
+	AAD func(path string) []byte
+
+	// Legacy, if set, is called for files that are not envelopes. It
+	// returns the AEAD and nonce the file was sealed with and the
+	// ciphertext within blob. If it is nil, such files fail.
+	Legacy func(path string, blob []byte) (aead cipher.AEAD, nonce, ciphertext []byte, err error)
+}
+
+// MigrateSummary reports the outcome of MigrateDir. Paths are relative
+// to the directory.
+type MigrateSummary struct {
+	Migrated []string
+	Skipped  map[string]error
+	Failed   map[string]error
+}
+
+// MigrateDir reseals every regular file under dir with the current key
+// of keyring, as an envelope whose key ID is the key fingerprint.
+// Envelopes are opened with the keyring and other files with
+// opts.Legacy. Files already sealed with the current key are skipped
+// with ErrAlreadyMigrated.
+//
+// Each file is replaced atomically, by writing its new content to a
+// temporary file in the same directory and renaming it over the old
+// one, keeping its mode and modification time. Plaintext is only held
+// in locked memory and never written anywhere.
+//
+// MigrateDir stops starting new files once ctx is done and then returns
+// the summary so far together with ctx.Err(). Errors of individual
+// files, including entries of dir that cannot be read, are recorded in
+// the summary rather than returned; only an unreadable dir itself stops
+// MigrateDir.
+func MigrateDir(ctx context.Context, dir string, keyring *Keyring, opts MigrateOptions) (*MigrateSummary, error) {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = DefaultMigrateMaxSize
+	}
+	if opts.Algorithm == 0 {
+		opts.Algorithm = AlgorithmXChaCha20Poly1305
+	}
+
+	keyring.mu.RLock()
+	fp := keyring.current
+	keyring.mu.RUnlock()
+	newAEAD, err := keyring.aead(fp, opts.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	j, err := openJournal(opts.Journal, opts.DryRun)
+	if err != nil {
+		return nil, err
+	}
+	defer j.close()
+
+	m := &migration{
+		dir:     dir,
+		keyring: keyring,
+		fp:      fp,
+		newAEAD: newAEAD,
+		opts:    &opts,
+		journal: j,
+		summary: &MigrateSummary{Skipped: make(map[string]error), Failed: make(map[string]error)},
+	}
+
+	paths := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rel := range paths {
+				m.file(rel)
+			}
+		}()
+	}
+
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rel, relErr := filepath.Rel(dir, path)
+		if relErr != nil {
+			return relErr
+		}
+		if err != nil {
+			// Only an unreadable dir stops the migration; other
+			// entries fail on their own.
+			if path == dir {
+				return err
+			}
+			m.fail(rel, err)
+			return nil
+		}
+		if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), migrateTempPrefix) {
+			return nil
+		}
+		if j.path != "" {
+			if abs, _ := filepath.Abs(path); abs == j.path {
+				return nil
+			}
+		}
+		if j.done[rel] {
+			m.skip(rel, ErrInJournal)
+			return nil
+		}
+
+		select {
+		case paths <- rel:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(paths)
+	wg.Wait()
+
+	return m.summary, err
+}
+
+// migration is the state of a MigrateDir call shared by its workers.
+type migration struct {
+	dir     string
+	keyring *Keyring
+	fp      string
+	newAEAD cipher.AEAD
+	opts    *MigrateOptions
+	journal *journal
+
+	mu      sync.Mutex
+	summary *MigrateSummary
+}
+
+// skip records that the file at rel was skipped because of err.
+func (m *migration) skip(rel string, err error) {
+	m.mu.Lock()
+	m.summary.Skipped[rel] = err
+	m.mu.Unlock()
+}
+
+// fail records that the file at rel failed with err.
+func (m *migration) fail(rel string, err error) {
+	m.mu.Lock()
+	m.summary.Failed[rel] = err
+	m.mu.Unlock()
+}
+
+// file migrates the file at rel and records the outcome.
+func (m *migration) file(rel string) {
+	err := m.migrateFile(rel)
+	if errors.Is(err, ErrAlreadyMigrated) {
+		m.skip(rel, err)
+		return
+	}
+
+	if err != nil {
+		m.fail(rel, err)
+		return
+	}
+	m.mu.Lock()
+	m.summary.Migrated = append(m.summary.Migrated, rel)
+	m.mu.Unlock()
+}
+
+func (m *migration) migrateFile(rel string) error {
+	path := filepath.Join(m.dir, rel)
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Size() > m.opts.MaxSize {
+		return fmt.Errorf("%w: file is %d bytes, more than %d", ErrTooLarge, info.Size(), m.opts.MaxSize)
+	}
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var aad []byte
+	if m.opts.AAD != nil {
+		aad = m.opts.AAD(rel)
+	}
+
+	var env []byte
+	if sniffFormat(blob) == FormatEnvelope {
+		msg, err := DecodeEnvelope(blob)
+		if err != nil {
+			return err
+		}
+		if string(msg.KeyID) == m.fp && msg.Algorithm == m.opts.Algorithm {
+			return ErrAlreadyMigrated
+		}
+		old, err := m.keyring.aead(string(msg.KeyID), msg.Algorithm)
+		if err != nil {
+			return err
+		}
+		data, err := messageAD(old, msg, aad)
+		if err != nil {
+			return err
+		}
+		env, err = migrate(old, m.newAEAD, msg.Nonce, msg.Ciphertext, data, aad, []byte(m.fp))
+		if err != nil {
+			return err
+		}
+	} else {
+		if m.opts.Legacy == nil {
+			return ErrUnknownFormat
+		}
+		old, nonce, ciphertext, err := m.opts.Legacy(rel, blob)
+		if err != nil {
+			return err
+		}
+		env, err = migrate(old, m.newAEAD, nonce, ciphertext, aad, aad, []byte(m.fp))
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.opts.DryRun {
+		return nil
+	}
+	if err := replaceFile(path, env, info); err != nil {
+		return err
+	}
+	return m.journal.add(rel)
+}
+
+// replaceFile atomically replaces the file at path, described by info,
+// with content, keeping its mode and modification time.
+func replaceFile(path string, content []byte, info os.FileInfo) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), migrateTempPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := os.Chtimes(tmp.Name(), info.ModTime(), info.ModTime()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// journal records the files MigrateDir has migrated.
+type journal struct {
+	path string
+	done map[string]bool
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+// openJournal reads the journal at path, if any, and opens it for
+// appending unless dryRun is set. An empty path gives a journal that
+// records nothing.
+func openJournal(path string, dryRun bool) (*journal, error) {
+	j := &journal{done: make(map[string]bool)}
+	if path == "" {
+		return j, nil
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	j.path = abs
+
+	if f, err := os.Open(path); err == nil {
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			j.done[s.Text()] = true
+		}
+		f.Close()
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if !dryRun {
+		if j.f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+			return nil, err
+		}
+	}
+	return j, nil
+}
+
+// add records that rel has been migrated.
+func (j *journal) add(rel string) error {
+	if j.f == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.f.WriteString(rel + "\n"); err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+func (j *journal) close() {
+	if j.f != nil {
+		j.f.Close()
+	}
+}
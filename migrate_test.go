@@ -0,0 +1,307 @@
+package chacha20poly1305guard
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestMigrateBlob(t *testing.T) {
+	old, newAEAD := testAEAD(t, ChaCha20), testAEAD(t, XChaCha20)
+	nonce := make([]byte, NonceSize)
+	blob := old.Seal(nil, nonce, []byte("plaintext"), []byte("data"))
+
+	env, err := MigrateBlob(old, newAEAD, nonce, blob, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, err := OpenEnvelope(newAEAD, env, []byte("data")); err != nil || string(p) != "plaintext" {
+		t.Fatalf("open migrated blob: %q, %v", p, err)
+	}
+	if _, err := MigrateBlob(old, newAEAD, nonce, blob, []byte("other data")); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("other data: got %v, want ErrAuthFailed", err)
+	}
+	if _, err := MigrateBlob(old, old, nonce, blob, []byte("data")); !errors.Is(err, ErrNonceSourceRequired) {
+		t.Fatalf("new AEAD with short nonces: got %v, want ErrNonceSourceRequired", err)
+	}
+}
+
+// migrateTree is a directory for MigrateDir holding envelopes sealed
+// with an old key of keyring and legacy blobs sealed with legacy, each
+// of them with its path as associated data.
+type migrateTree struct {
+	dir     string
+	keyring *Keyring
+	legacy  cipher.AEAD
+	files   map[string]string
+	modTime time.Time
+}
+
+var migrateFiles = map[string]string{
+	"a.env":        "envelope a",
+	"b.legacy":     "legacy b",
+	"c.env":        "envelope c",
+	"sub/d.legacy": "legacy d",
+	"sub/e.env":    "envelope e",
+}
+
+func newMigrateTree(t *testing.T) *migrateTree {
+	tree := &migrateTree{
+		dir:     t.TempDir(),
+		keyring: new(Keyring),
+		legacy:  testAEAD(t, ChaCha20),
+		files:   migrateFiles,
+		modTime: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	t.Cleanup(func() { tree.keyring.Close() })
+	if _, err := tree.keyring.Add(lockedBytes(t, bytes.Repeat([]byte{1}, KeySize))); err != nil {
+		t.Fatal(err)
+	}
+
+	i := byte(0)
+	for rel, plaintext := range tree.files {
+		var blob []byte
+		if filepath.Ext(rel) == ".env" {
+			nonce := bytes.Repeat([]byte{i}, XNonceSize)
+			env, err := tree.keyring.SealEnvelope(AlgorithmXChaCha20Poly1305, nonce, []byte(plaintext), []byte(rel))
+			if err != nil {
+				t.Fatal(err)
+			}
+			blob = env
+		} else {
+			nonce := bytes.Repeat([]byte{i}, NonceSize)
+			blob = tree.legacy.Seal(nonce, nonce, []byte(plaintext), []byte(rel))
+		}
+		i++
+
+		path := filepath.Join(tree.dir, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, blob, 0640); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, tree.modTime, tree.modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Rotate to the key the files are migrated to.
+	if _, err := tree.keyring.Add(lockedBytes(t, bytes.Repeat([]byte{2}, KeySize))); err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+// options returns MigrateOptions for the tree.
+func (tree *migrateTree) options() MigrateOptions {
+	return MigrateOptions{
+		AAD: func(rel string) []byte { return []byte(rel) },
+		Legacy: func(rel string, blob []byte) (cipher.AEAD, []byte, []byte, error) {
+			if len(blob) < NonceSize {
+				return nil, nil, nil, ErrUnknownFormat
+			}
+			return tree.legacy, blob[:NonceSize], blob[NonceSize:], nil
+		},
+	}
+}
+
+// snapshot returns the content of every file under the tree.
+func (tree *migrateTree) snapshot(t *testing.T) map[string]string {
+	files := make(map[string]string)
+	err := filepath.Walk(tree.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		b, err := ioutil.ReadFile(path)
+		rel, _ := filepath.Rel(tree.dir, path)
+		files[rel] = string(b)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// checkMigrated checks that the file at rel is an envelope sealed with
+// the current key, with the plaintext, mode and modification time it
+// started with.
+func (tree *migrateTree) checkMigrated(t *testing.T, rel string) {
+	t.Helper()
+	path := filepath.Join(tree.dir, rel)
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := DecodeEnvelope(blob)
+	if err != nil || string(msg.KeyID) != tree.keyring.current {
+		t.Fatalf("%s: sealed under %q, %v, want the current key %q", rel, msg.KeyID, err, tree.keyring.current)
+	}
+	if p, err := tree.keyring.OpenEnvelope(blob, []byte(rel)); err != nil || string(p) != tree.files[rel] {
+		t.Fatalf("%s: opened to %q, %v", rel, p, err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 || !info.ModTime().Equal(tree.modTime) {
+		t.Fatalf("%s: mode %v and mtime %v, want %v and %v", rel, info.Mode().Perm(), info.ModTime(), os.FileMode(0640), tree.modTime)
+	}
+}
+
+func sortedKeys(m map[string]error) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestMigrateDirDryRun(t *testing.T) {
+	tree := newMigrateTree(t)
+	before := tree.snapshot(t)
+	opts := tree.options()
+	opts.DryRun = true
+	opts.Journal = filepath.Join(tree.dir, "journal")
+
+	summary, err := MigrateDir(context.Background(), tree.dir, tree.keyring, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.Migrated) != len(tree.files) || len(summary.Failed) != 0 {
+		t.Fatalf("dry run: migrated %v, failed %v", summary.Migrated, summary.Failed)
+	}
+	after := tree.snapshot(t)
+	if len(after) != len(before) {
+		t.Fatalf("dry run left %d files, want %d; the journal must not be written", len(after), len(before))
+	}
+	for rel, b := range before {
+		if after[rel] != b {
+			t.Fatalf("dry run changed %s", rel)
+		}
+	}
+}
+
+func TestMigrateDirResume(t *testing.T) {
+	tree := newMigrateTree(t)
+	journal := filepath.Join(t.TempDir(), "journal")
+
+	// Interrupt the migration while the second file is migrated. With a
+	// single worker, no file is started after that.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opts := tree.options()
+	opts.Journal = journal
+	aad, calls := opts.AAD, 0
+	opts.AAD = func(rel string) []byte {
+		if calls++; calls == 2 {
+			cancel()
+		}
+		return aad(rel)
+	}
+	summary, err := MigrateDir(ctx, tree.dir, tree.keyring, opts)
+	if err != context.Canceled {
+		t.Fatalf("interrupted: got %v, want context.Canceled", err)
+	}
+	if len(summary.Migrated) != 2 || len(summary.Failed) != 0 {
+		t.Fatalf("interrupted: migrated %v, failed %v", summary.Migrated, summary.Failed)
+	}
+	first := summary.Migrated
+	for _, rel := range first {
+		tree.checkMigrated(t, rel)
+	}
+	b, err := ioutil.ReadFile(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := first[0] + "\n" + first[1] + "\n"; string(b) != want {
+		t.Fatalf("journal is %q, want %q", b, want)
+	}
+
+	// Resuming skips the files in the journal and migrates the others.
+	opts = tree.options()
+	opts.Journal = journal
+	opts.Concurrency = 3
+	summary, err = MigrateDir(context.Background(), tree.dir, tree.keyring, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.Migrated) != len(tree.files)-2 || len(summary.Failed) != 0 {
+		t.Fatalf("resumed: migrated %v, failed %v", summary.Migrated, summary.Failed)
+	}
+	if len(summary.Skipped) != 2 || summary.Skipped[first[0]] != ErrInJournal || summary.Skipped[first[1]] != ErrInJournal {
+		t.Fatalf("resumed: skipped %v, want %v", summary.Skipped, first)
+	}
+	for rel := range tree.files {
+		tree.checkMigrated(t, rel)
+	}
+	if names := tree.snapshot(t); len(names) != len(tree.files) {
+		t.Fatalf("%d files left behind, want %d", len(names), len(tree.files))
+	}
+
+	// Without the journal, migrated files are recognised as such.
+	summary, err = MigrateDir(context.Background(), tree.dir, tree.keyring, tree.options())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.Migrated) != 0 || len(summary.Skipped) != len(tree.files) {
+		t.Fatalf("again: migrated %v, skipped %v", summary.Migrated, summary.Skipped)
+	}
+	for rel, err := range summary.Skipped {
+		if err != ErrAlreadyMigrated {
+			t.Fatalf("again: %s skipped with %v, want ErrAlreadyMigrated", rel, err)
+		}
+	}
+}
+
+func TestMigrateDirFailures(t *testing.T) {
+	tree := newMigrateTree(t)
+	if err := ioutil.WriteFile(filepath.Join(tree.dir, "f.legacy"), []byte("short"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tree.dir, "g.legacy"), make([]byte, 64), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	// Remove c.env while a.env is migrated, once the walk has listed the
+	// directory: with a single worker the walk only reaches c.env after
+	// a.env is done, and must record it rather than stop.
+	opts := tree.options()
+	aad := opts.AAD
+	opts.AAD = func(rel string) []byte {
+		if rel == "a.env" {
+			os.Remove(filepath.Join(tree.dir, "c.env"))
+		}
+		return aad(rel)
+	}
+	summary, err := MigrateDir(context.Background(), tree.dir, tree.keyring, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed := sortedKeys(summary.Failed); len(failed) != 3 || failed[0] != "c.env" || failed[1] != "f.legacy" || failed[2] != "g.legacy" {
+		t.Fatalf("failed %v", summary.Failed)
+	}
+	if !os.IsNotExist(summary.Failed["c.env"]) {
+		t.Fatalf("c.env failed with %v, want a missing file", summary.Failed["c.env"])
+	}
+	if !errors.Is(summary.Failed["f.legacy"], ErrUnknownFormat) || !errors.Is(summary.Failed["g.legacy"], ErrAuthFailed) {
+		t.Fatalf("failed %v", summary.Failed)
+	}
+	if len(summary.Migrated) != len(tree.files)-1 {
+		t.Fatalf("migrated %v", summary.Migrated)
+	}
+
+	// An unreadable directory stops the migration.
+	if _, err := MigrateDir(context.Background(), filepath.Join(tree.dir, "missing"), tree.keyring, opts); !os.IsNotExist(err) {
+		t.Fatalf("missing directory: got %v", err)
+	}
+}
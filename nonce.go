@@ -0,0 +1,95 @@
+package chacha20poly1305guard
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrNonceExhausted is returned once a nonce generator has handed out
+// every nonce it can. The key must be replaced before sealing again.
+var ErrNonceExhausted = errors.New("nonce space exhausted")
+
+// DefaultNonceBlockSize is the number of nonces a ShardedNonce reserves
+// at a time when no block size is given.
+const DefaultNonceBlockSize = 1024
+
+// maxNonceCounter caps the counter of a ShardedNonce.
+const maxNonceCounter = 1 << 63
+
+// ShardedNonce generates unique counter nonces for many goroutines
+// sealing under one key. Instead of an atomic increment per message,
+// which becomes a point of contention at high rates, callers reserve
+// blocks of counter values with one atomic add and then hand them out
+// without synchronisation. Values in a reserved block that are never
+// used are skipped, so nonces are unique but not contiguous.
+//
+// Each nonce holds the counter as a little endian uint64 in its last 8
+// bytes, with the bytes before it zero. A ShardedNonce is safe for
+// concurrent use.
+type ShardedNonce struct {
+	size      int
+	blockSize uint64
+	next      uint64 // start of the next unreserved block
+	blocks    sync.Pool
+}
+
+// nonceBlock is a reserved range [next, end) of counter values.
+type nonceBlock struct {
+	next, end uint64
+}
+
+// NewShardedNonce returns a ShardedNonce producing nonces of nonceSize
+// bytes, which must be at least 8, reserving blockSize values at a time.
+// A blockSize of zero selects DefaultNonceBlockSize.
+func NewShardedNonce(nonceSize int, blockSize uint64) (*ShardedNonce, error) {
+	if nonceSize < 8 {
+		return nil, ErrInvalidNonce
+	}
+	if blockSize == 0 {
+		blockSize = DefaultNonceBlockSize
+	}
+	return &ShardedNonce{size: nonceSize, blockSize: blockSize}, nil
+}
+
+// NonceSize returns the size of the nonces returned by Next.
+func (s *ShardedNonce) NonceSize() int {
+	return s.size
+}
+
+// Next returns a nonce that no other call to Next on s has returned, or
+// ErrNonceExhausted.
+func (s *ShardedNonce) Next() ([]byte, error) {
+	b, _ := s.blocks.Get().(*nonceBlock)
+	if b == nil || b.next == b.end {
+		start, err := s.reserve()
+		if err != nil {
+			return nil, err
+		}
+		b = &nonceBlock{next: start, end: start + s.blockSize}
+	}
+
+	nonce := make([]byte, s.size)
+	binary.LittleEndian.PutUint64(nonce[s.size-8:], b.next)
+	b.next++
+	s.blocks.Put(b)
+
+	return nonce, nil
+}
+
+// reserve returns the start of a newly reserved block of counter values.
+// The counter only moves when the whole block fits below
+// maxNonceCounter, so it can never wrap around, however large the block
+// or however often Next is called once the nonces are exhausted.
+func (s *ShardedNonce) reserve() (uint64, error) {
+	for {
+		start := atomic.LoadUint64(&s.next)
+		if s.blockSize > maxNonceCounter || start > maxNonceCounter-s.blockSize {
+			return 0, ErrNonceExhausted
+		}
+		if atomic.CompareAndSwapUint64(&s.next, start, start+s.blockSize) {
+			return start, nil
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package chacha20poly1305guard
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestShardedNonceUnique(t *testing.T) {
+	const goroutines, perGoroutine = 16, 2000
+
+	s, err := NewShardedNonce(XNonceSize, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := make([][]string, goroutines)
+	var wg sync.WaitGroup
+	for g := range results {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < perGoroutine; i++ {
+				nonce, err := s.Next()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if len(nonce) != XNonceSize {
+					t.Errorf("nonce of %d bytes", len(nonce))
+					return
+				}
+				results[g] = append(results[g], string(nonce))
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool, goroutines*perGoroutine)
+	for _, nonces := range results {
+		for _, n := range nonces {
+			if seen[n] {
+				t.Fatalf("nonce %x returned twice", n)
+			}
+			seen[n] = true
+		}
+	}
+}
+
+func TestShardedNonceErrors(t *testing.T) {
+	if _, err := NewShardedNonce(7, 0); !errors.Is(err, ErrInvalidNonce) {
+		t.Fatalf("NewShardedNonce(7): got %v, want ErrInvalidNonce", err)
+	}
+
+	s, err := NewShardedNonce(NonceSize, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.next = maxNonceCounter - 1
+	if _, err := s.Next(); err != ErrNonceExhausted {
+		t.Fatalf("Next past the limit: got %v, want ErrNonceExhausted", err)
+	}
+}
+
+func TestShardedNonceNoWrap(t *testing.T) {
+	// With blocks of a quarter of the counter range, two blocks fit and
+	// every later call must fail without moving the counter, which would
+	// otherwise wrap around after a few more calls and reuse nonces.
+	s, err := NewShardedNonce(NonceSize, maxNonceCounter/2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		s.blocks = sync.Pool{}
+		if _, err := s.Next(); err != nil {
+			t.Fatalf("block %d: %v", i, err)
+		}
+	}
+	for i := 0; i < 8; i++ {
+		s.blocks = sync.Pool{}
+		if n, err := s.Next(); err != ErrNonceExhausted {
+			t.Fatalf("call %d past the limit: got %x, %v, want ErrNonceExhausted", i, n, err)
+		}
+	}
+	if s.next != maxNonceCounter {
+		t.Fatalf("counter moved past the limit to %#x", s.next)
+	}
+
+	// A block larger than the whole range is never reserved.
+	s, err = NewShardedNonce(NonceSize, math.MaxUint64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Next(); err != ErrNonceExhausted || s.next != 0 {
+		t.Fatalf("oversized block: got %v, counter %#x", err, s.next)
+	}
+}
+
+// TestShardedNonceExhausted runs the counter up to its end with nonces
+// of both sizes: the counter always occupies the last 8 bytes, so both
+// stop at the same point.
+func TestShardedNonceExhausted(t *testing.T) {
+	for _, size := range []int{NonceSize, XNonceSize} {
+		s, err := NewShardedNonce(size, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.next = maxNonceCounter - 2
+		for _, want := range []uint64{maxNonceCounter - 2, maxNonceCounter - 1} {
+			n, err := s.Next()
+			if err != nil {
+				t.Fatalf("%d byte nonces: counter %#x: %v", size, want, err)
+			}
+			if len(n) != size || binary.LittleEndian.Uint64(n[size-8:]) != want || !bytes.Equal(n[:size-8], make([]byte, size-8)) {
+				t.Fatalf("%d byte nonces: got %x, want counter %#x", size, n, want)
+			}
+		}
+		if n, err := s.Next(); err != ErrNonceExhausted {
+			t.Fatalf("%d byte nonces: got %x, %v past the end, want ErrNonceExhausted", size, n, err)
+		}
+	}
+}
+
+func TestShardedNonceAllocs(t *testing.T) {
+	s, err := NewShardedNonce(XNonceSize, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Next()
+
+	// The nonce itself; blocks are recycled through the pool.
+	if allocs := testing.AllocsPerRun(1000, func() { s.Next() }); allocs > 1 {
+		t.Fatalf("Next allocates %v times, want 1", allocs)
+	}
+}
+
+// BenchmarkShardedNonce and BenchmarkAtomicNonce compare ShardedNonce
+// with a single atomic counter under contention from every CPU. Run
+// them with -race as well, where the cost of shared atomics shows most.
+func BenchmarkShardedNonce(b *testing.B) {
+	s, err := NewShardedNonce(XNonceSize, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := s.Next(); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkAtomicNonce(b *testing.B) {
+	var counter uint64
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			atomicNonce(&counter)
+		}
+	})
+}
+
+// atomicNonce is the naive counter nonce. It is not inlined so that the
+// nonce is allocated on the heap, as the one returned by Next is.
+//
+//go:noinline
+func atomicNonce(counter *uint64) []byte {
+	nonce := make([]byte, XNonceSize)
+	binary.LittleEndian.PutUint64(nonce[XNonceSize-8:], atomic.AddUint64(counter, 1))
+	return nonce
+}
@@ -0,0 +1,6 @@
+//go:build !race
+// +build !race
+
+package chacha20poly1305guard
+
+const raceEnabled = false
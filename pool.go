@@ -0,0 +1,148 @@
+package chacha20poly1305guard
+
+import (
+	"os"
+	"sync"
+
+	"github.com/awnumar/memguard"
+)
+
+// minPoolBucket is the smallest buffer size handed out by a GuardedPool.
+// Every LockedBuffer costs at least one locked page anyway.
+const minPoolBucket = 64
+
+// DefaultPoolRetained is the amount of locked memory, in bytes, kept
+// by the pool used for internal scratch buffers.
+const DefaultPoolRetained = 256 << 10
+
+// scratchPool backs the scratch buffers used by Seal and Open.
+var scratchPool = NewGuardedPool(DefaultPoolRetained)
+
+// GuardedPool reuses LockedBuffers so that hot paths do not pay for an
+// mmap, mlock, munlock and munmap on every call.
+//
+// Buffers are handed out in power of two sizes and are wiped when they
+// are returned. At most maxRetained bytes of locked memory, counted in
+// whole pages, are kept for reuse; anything beyond that is destroyed on
+// Put. Every buffer obtained from Get must be given back with Put, even
+// if it was destroyed in the meantime. A GuardedPool is safe for
+// concurrent use.
+type GuardedPool struct {
+	mu          sync.Mutex
+	free        map[int][]*memguard.LockedBuffer
+	out         map[*memguard.LockedBuffer]struct{} // handed out by Get
+	retained    int
+	maxRetained int
+}
+
+// NewGuardedPool returns a GuardedPool that retains at most maxRetained
+// bytes of locked memory.
+func NewGuardedPool(maxRetained int) *GuardedPool {
+	return &GuardedPool{
+		free:        make(map[int][]*memguard.LockedBuffer),
+		out:         make(map[*memguard.LockedBuffer]struct{}),
+		maxRetained: maxRetained,
+	}
+}
+
+// Get returns a mutable, zeroed LockedBuffer of at least size bytes.
+// Its Size may be larger than requested. When no buffer is available for
+// reuse a new one is allocated.
+func (p *GuardedPool) Get(size int) (*memguard.LockedBuffer, error) {
+	if size < 1 {
+		return nil, memguard.ErrInvalidLength
+	}
+	bucket := poolBucket(size)
+
+	p.mu.Lock()
+	if free := p.free[bucket]; len(free) > 0 {
+		b := free[len(free)-1]
+		p.free[bucket] = free[:len(free)-1]
+		p.retained -= lockedSize(bucket)
+		p.out[b] = struct{}{}
+		p.mu.Unlock()
+		return b, nil
+	}
+	p.mu.Unlock()
+
+	b, err := scratchUsage.track(newMutable(bucket))
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	p.out[b] = struct{}{}
+	p.mu.Unlock()
+	return b, nil
+}
+
+// Put wipes b and keeps it for reuse, or destroys it if the pool is full
+// or b is no longer a mutable buffer of its bucket size. A buffer that
+// was not obtained from Get is destroyed and never kept. Putting a
+// destroyed buffer is a no-op. b must not be used after Put.
+func (p *GuardedPool) Put(b *memguard.LockedBuffer) {
+	if b == nil {
+		return
+	}
+
+	p.mu.Lock()
+	_, ours := p.out[b]
+	delete(p.out, b)
+	p.mu.Unlock()
+
+	if b.IsDestroyed() {
+		return
+	}
+	if !ours {
+		// Not tracked by this pool; whoever allocated it accounts for it.
+		b.Destroy()
+		return
+	}
+
+	size := b.Size()
+	if !b.IsMutable() || size != poolBucket(size) {
+		scratchUsage.destroy(b)
+		return
+	}
+	b.Wipe()
+
+	p.mu.Lock()
+	if p.retained+lockedSize(size) > p.maxRetained {
+		p.mu.Unlock()
+		scratchUsage.destroy(b)
+		return
+	}
+	p.free[size] = append(p.free[size], b)
+	p.retained += lockedSize(size)
+	p.mu.Unlock()
+}
+
+// Purge destroys every buffer held by the pool.
+func (p *GuardedPool) Purge() {
+	p.mu.Lock()
+	free := p.free
+	p.free = make(map[int][]*memguard.LockedBuffer)
+	p.retained = 0
+	p.mu.Unlock()
+
+	for _, bufs := range free {
+		for _, b := range bufs {
+			scratchUsage.destroy(b)
+		}
+	}
+}
+
+// poolBucket rounds size up to the bucket it is served from.
+func poolBucket(size int) int {
+	bucket := minPoolBucket
+	for bucket < size {
+		bucket <<= 1
+	}
+	return bucket
+}
+
+// lockedSize is the amount of memory memguard locks for a buffer of n
+// bytes: the data and its 32 byte canary, rounded up to whole pages.
+func lockedSize(n int) int {
+	page := os.Getpagesize()
+	return (n + 32 + page - 1) / page * page
+}
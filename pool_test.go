@@ -0,0 +1,157 @@
+package chacha20poly1305guard
+
+import (
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/awnumar/memguard"
+)
+
+// waitScratch runs the garbage collector until the scratch buffer count
+// is want, so that finalizers of dropped buffers have run.
+func waitScratch(t *testing.T, want int64) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if Stats().Scratch.Buffers == want {
+			return
+		}
+		runtime.GC()
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("scratch buffers = %d, want %d", Stats().Scratch.Buffers, want)
+}
+
+func TestGuardedPoolReuse(t *testing.T) {
+	p := NewGuardedPool(DefaultPoolRetained)
+	defer p.Purge()
+
+	b, err := p.Get(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Size() != poolBucket(10) {
+		t.Fatalf("Size = %d, want %d", b.Size(), poolBucket(10))
+	}
+	copy(b.Buffer(), "secret")
+	p.Put(b)
+
+	b2, err := p.Get(poolBucket(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b2 != b {
+		t.Fatal("buffer was not reused")
+	}
+	for _, c := range b2.Buffer() {
+		if c != 0 {
+			t.Fatal("reused buffer was not wiped")
+		}
+	}
+	p.Put(b2)
+}
+
+func TestGuardedPoolPutAfterDestroy(t *testing.T) {
+	before := Stats().Scratch.Buffers
+	p := NewGuardedPool(DefaultPoolRetained)
+
+	b, err := p.Get(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Destroy()
+	p.Put(b)
+	p.Put(b)
+
+	if len(p.out) != 0 || len(p.free[b.Size()]) != 0 || p.retained != 0 {
+		t.Fatal("pool kept a destroyed buffer")
+	}
+	b2, err := p.Get(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b2 == b || b2.IsDestroyed() {
+		t.Fatal("Get returned the destroyed buffer")
+	}
+	p.Put(b2)
+	p.Purge()
+
+	// The destroyed buffer is released from the counters by its
+	// finalizer, everything else by Purge.
+	waitScratch(t, before)
+}
+
+func TestGuardedPoolForeignBuffer(t *testing.T) {
+	before := Stats().Scratch
+	p := NewGuardedPool(DefaultPoolRetained)
+	defer p.Purge()
+
+	b, err := memguard.NewMutable(poolBucket(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Put(b)
+
+	if !b.IsDestroyed() {
+		t.Fatal("foreign buffer was not destroyed")
+	}
+	if p.retained != 0 {
+		t.Fatal("foreign buffer was retained")
+	}
+	if got := Stats().Scratch; got.Buffers != before.Buffers || got.Bytes != before.Bytes {
+		t.Fatalf("scratch usage changed from %+v to %+v", before, got)
+	}
+}
+
+func TestGuardedPoolRetainedLimit(t *testing.T) {
+	before := Stats().Scratch.Buffers
+	p := NewGuardedPool(lockedSize(64))
+
+	a, _ := p.Get(64)
+	b, _ := p.Get(64)
+	p.Put(a)
+	p.Put(b)
+
+	if p.retained != lockedSize(64) || len(p.free[64]) != 1 {
+		t.Fatalf("retained %d bytes in %d buffers, want one buffer", p.retained, len(p.free[64]))
+	}
+	if !b.IsDestroyed() {
+		t.Fatal("buffer over the limit was not destroyed")
+	}
+	if got := Stats().Scratch.Buffers; got != before+1 {
+		t.Fatalf("scratch buffers = %d, want %d", got, before+1)
+	}
+	p.Purge()
+	if got := Stats().Scratch.Buffers; got != before {
+		t.Fatalf("scratch buffers after Purge = %d, want %d", got, before)
+	}
+}
+
+// BenchmarkGuardedPool compares a Get and Put from a GuardedPool with
+// allocating and destroying a LockedBuffer directly, which costs an mmap,
+// mlock, munlock and munmap each time.
+func BenchmarkGuardedPool(b *testing.B) {
+	for _, size := range []int{64, 4096} {
+		b.Run("pool/"+strconv.Itoa(size), func(b *testing.B) {
+			p := NewGuardedPool(DefaultPoolRetained)
+			defer p.Purge()
+			for i := 0; i < b.N; i++ {
+				buf, err := p.Get(size)
+				if err != nil {
+					b.Fatal(err)
+				}
+				p.Put(buf)
+			}
+		})
+		b.Run("direct/"+strconv.Itoa(size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				buf, err := memguard.NewMutable(size)
+				if err != nil {
+					b.Fatal(err)
+				}
+				buf.Destroy()
+			}
+		})
+	}
+}
@@ -0,0 +1,8 @@
+//go:build race
+// +build race
+
+package chacha20poly1305guard
+
+// raceEnabled is set when the race detector is on. It makes sync.Pool
+// drop items at random, so allocation counts are not meaningful.
+const raceEnabled = true
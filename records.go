@@ -0,0 +1,190 @@
+package chacha20poly1305guard
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/awnumar/memguard"
+)
+
+var (
+	// ErrInvalidRecord is returned by OpenRecord and OpenRecords for a
+	// record that is malformed, or that does not belong with the others.
+	ErrInvalidRecord = errors.New("invalid record")
+
+	// ErrMissingRecord is returned by OpenRecords when a record of the
+	// set is missing.
+	ErrMissingRecord = errors.New("missing record")
+)
+
+// recordHeaderSize is the size of the header in front of the envelope of
+// each record: a 16 byte set ID, and the index and count as uint32 LE.
+const recordHeaderSize = 16 + 4 + 4
+
+// SealRecords splits plaintext into pieces of recordSize bytes, the last
+// one possibly shorter, and seals each into an independent record with
+// XChaCha20Poly1305 and a random nonce. Records can be stored, sent and
+// opened separately and in any order with OpenRecord, or put back
+// together with OpenRecords.
+//
+// Each record starts with a random ID shared by the whole set, its index
+// and the number of records, followed by an envelope. That header is
+// authenticated, so a record cannot be moved to another position or
+// mixed into another set, and OpenRecords notices a missing record. An
+// empty plaintext gives a single empty record.
+func SealRecords(key *memguard.LockedBuffer, plaintext []byte, recordSize int) ([][]byte, error) {
+	if recordSize < 1 {
+		return nil, fmt.Errorf("invalid record size %d", recordSize)
+	}
+	count := (len(plaintext) + recordSize - 1) / recordSize
+	if count == 0 {
+		count = 1
+	}
+	if count > math.MaxUint32 {
+		return nil, ErrTooLarge
+	}
+
+	aead, err := NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	defer aead.(AEAD).Close()
+
+	var setID [16]byte
+	if _, err := io.ReadFull(rand.Reader, setID[:]); err != nil {
+		return nil, err
+	}
+
+	records := make([][]byte, count)
+	nonce := make([]byte, XNonceSize)
+	for i := range records {
+		start := i * recordSize
+		end := start + recordSize
+		if end > len(plaintext) {
+			end = len(plaintext)
+		}
+
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return nil, err
+		}
+		h := recordHeader(setID, i, count)
+		env, err := SealEnvelope(aead, nonce, plaintext[start:end], h, nil)
+		if err != nil {
+			return nil, err
+		}
+		records[i] = append(h, env...)
+	}
+	return records, nil
+}
+
+// OpenRecord opens a single record written by SealRecords and returns
+// its index in the set and its plaintext.
+func OpenRecord(key *memguard.LockedBuffer, record []byte) (index int, plaintext []byte, err error) {
+	aead, err := NewX(key)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer aead.(AEAD).Close()
+
+	_, index, _, plaintext, err = openRecord(aead, record)
+	return index, plaintext, err
+}
+
+// OpenRecords opens a set of records written by SealRecords, given in
+// any order, and returns the original plaintext. Records from different
+// sets, duplicates and gaps are rejected, with ErrInvalidRecord or
+// ErrMissingRecord, and nothing is returned unless every record opens.
+func OpenRecords(key *memguard.LockedBuffer, records [][]byte) ([]byte, error) {
+	if len(records) == 0 {
+		return nil, ErrMissingRecord
+	}
+
+	aead, err := NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	defer aead.(AEAD).Close()
+
+	var setID [16]byte
+	var pieces [][]byte
+	defer func() {
+		for _, p := range pieces {
+			wipe(p)
+		}
+	}()
+
+	for i, r := range records {
+		id, index, count, p, err := openRecord(aead, r)
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %w", i, err)
+		}
+		if i == 0 {
+			// The count is authenticated, but chosen by whoever sealed
+			// the set: only allocate for the records actually given.
+			switch {
+			case count > len(records):
+				wipe(p)
+				return nil, fmt.Errorf("%w: %d of %d records", ErrMissingRecord, len(records), count)
+			case count < len(records):
+				wipe(p)
+				return nil, fmt.Errorf("%w: %d records for a set of %d", ErrInvalidRecord, len(records), count)
+			}
+			setID = id
+			pieces = make([][]byte, count)
+		}
+		if id != setID || count != len(pieces) || pieces[index] != nil {
+			wipe(p)
+			return nil, fmt.Errorf("record %d: %w", i, ErrInvalidRecord)
+		}
+		if p == nil {
+			p = []byte{}
+		}
+		pieces[index] = p
+	}
+
+	size := 0
+	for i, p := range pieces {
+		if p == nil {
+			return nil, fmt.Errorf("%w: index %d of %d", ErrMissingRecord, i, len(pieces))
+		}
+		size += len(p)
+	}
+
+	out := make([]byte, 0, size)
+	for _, p := range pieces {
+		out = append(out, p...)
+	}
+	return out, nil
+}
+
+func recordHeader(setID [16]byte, index, count int) []byte {
+	h := make([]byte, recordHeaderSize)
+	copy(h, setID[:])
+	binary.LittleEndian.PutUint32(h[16:], uint32(index))
+	binary.LittleEndian.PutUint32(h[20:], uint32(count))
+	return h
+}
+
+func openRecord(aead cipher.AEAD, record []byte) (setID [16]byte, index, count int, plaintext []byte, err error) {
+	if len(record) < recordHeaderSize {
+		return setID, 0, 0, nil, ErrInvalidRecord
+	}
+	h := record[:recordHeaderSize]
+	copy(setID[:], h)
+	index = int(binary.LittleEndian.Uint32(h[16:]))
+	count = int(binary.LittleEndian.Uint32(h[20:]))
+	if count == 0 || index >= count {
+		return setID, 0, 0, nil, ErrInvalidRecord
+	}
+
+	plaintext, err = OpenEnvelope(aead, record[recordHeaderSize:], h)
+	if err != nil {
+		return setID, 0, 0, nil, err
+	}
+	return setID, index, count, plaintext, nil
+}
@@ -0,0 +1,95 @@
+package chacha20poly1305guard
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"math"
+	"testing"
+)
+
+func TestRecords(t *testing.T) {
+	key := testKey(t)
+	plaintext := []byte("the quick brown fox jumps over the lazy dog")
+
+	records, err := SealRecords(key, plaintext, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 5 {
+		t.Fatalf("got %d records, want 5", len(records))
+	}
+
+	shuffled := [][]byte{records[3], records[0], records[4], records[2], records[1]}
+	if got, err := OpenRecords(key, shuffled); err != nil || string(got) != string(plaintext) {
+		t.Fatalf("OpenRecords = %q, %v", got, err)
+	}
+	if index, got, err := OpenRecord(key, records[4]); err != nil || index != 4 || string(got) != "dog" {
+		t.Fatalf("OpenRecord = %d, %q, %v", index, got, err)
+	}
+
+	empty, err := SealRecords(key, nil, 10)
+	if err != nil || len(empty) != 1 {
+		t.Fatalf("SealRecords of nothing = %d records, %v", len(empty), err)
+	}
+	if got, err := OpenRecords(key, empty); err != nil || len(got) != 0 {
+		t.Fatalf("OpenRecords of nothing = %q, %v", got, err)
+	}
+}
+
+func TestRecordsRejected(t *testing.T) {
+	key := testKey(t)
+	plaintext := []byte("the quick brown fox jumps over the lazy dog")
+	records, _ := SealRecords(key, plaintext, 10)
+	other, _ := SealRecords(key, plaintext, 10)
+
+	moved := append([]byte(nil), records[1]...)
+	moved[16] = 2
+	if _, _, err := OpenRecord(key, moved); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("record moved to another index: got %v, want ErrAuthFailed", err)
+	}
+
+	tests := []struct {
+		name    string
+		records [][]byte
+		want    error
+	}{
+		{"none", nil, ErrMissingRecord},
+		{"missing", records[:4], ErrMissingRecord},
+		{"extra", append(records[:5:5], other[0]), ErrInvalidRecord},
+		{"duplicate", [][]byte{records[0], records[1], records[1], records[3], records[4]}, ErrInvalidRecord},
+		{"mixed sets", [][]byte{records[0], other[1], records[2], records[3], records[4]}, ErrInvalidRecord},
+	}
+	for _, tt := range tests {
+		if _, err := OpenRecords(key, tt.records); !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+// TestRecordsForgedCount checks that OpenRecords does not allocate for
+// the count of a record before comparing it with the records given. The
+// holder of the key can seal a record claiming a set of 2^32-1.
+func TestRecordsForgedCount(t *testing.T) {
+	key := testKey(t)
+	aead, err := NewX(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aead.(AEAD).Close()
+
+	var setID [16]byte
+	nonce := make([]byte, XNonceSize)
+	io.ReadFull(rand.Reader, setID[:])
+	h := recordHeader(setID, 0, math.MaxUint32)
+	env, err := SealEnvelope(aead, nonce, []byte("x"), h, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := append(h, env...)
+
+	// Allocating for the count would take 96 GiB.
+	if _, err := OpenRecords(key, [][]byte{forged}); !errors.Is(err, ErrMissingRecord) {
+		t.Fatalf("got %v, want ErrMissingRecord", err)
+	}
+}
@@ -0,0 +1,83 @@
+package chacha20poly1305guard
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/alexzava/chacha20guard"
+	"github.com/awnumar/memguard"
+)
+
+// fingerprintNonce is the XChaCha20 nonce whose keystream identifies a
+// key. It is derived from a fixed label so that it never coincides with
+// a nonce used to seal messages in practice.
+var fingerprintNonce = func() []byte {
+	sum := sha256.Sum256([]byte("chacha20poly1305guard key fingerprint v1"))
+	return sum[:XNonceSize]
+}()
+
+// fingerprint returns a short, non-secret identifier of the key: 8 bytes
+// of its keystream under fingerprintNonce, skipping the first block
+// which would be a Poly1305 key. Going through the keystream means the
+// key never has to leave locked memory, which a hash or HMAC over the
+// key bytes could not guarantee.
+func fingerprint(ek keyAccess) (string, error) {
+	c, err := ek.stream(chacha20guard.NewX, fingerprintNonce)
+	if err != nil {
+		return "", err
+	}
+
+	block := make([]byte, 64+8)
+	c.XORKeyStream(block, block)
+
+	return hex.EncodeToString(block[64:]), nil
+}
+
+// fingerprintVersion prefixes the output of KeyFingerprint, so that the
+// derivation can change without old and new fingerprints colliding.
+const fingerprintVersion = "v1:"
+
+// KeyFingerprint returns a stable, non-secret identifier of key, such as
+// "v1:3f9ac0d27be41a85", for telling keys apart in rotation and multi-key
+// setups. It is the same fingerprint String shows, behind a version
+// prefix. Short as it is, it fits in the key ID of an envelope, which
+// lets the opener pick the right key.
+//
+// The fingerprint is 64 bits of keystream, so it reveals nothing about
+// the key, and the key never leaves locked memory to compute it.
+func KeyFingerprint(key *memguard.LockedBuffer) (string, error) {
+	if len(key.Buffer()) != KeySize {
+		return "", &SizeError{Field: "key", Want: KeySize, Got: len(key.Buffer()), Err: ErrInvalidKey}
+	}
+	fp, err := fingerprint(lockedKey{key})
+	if err != nil {
+		return "", err
+	}
+	return fingerprintVersion + fp, nil
+}
+
+// String describes the AEAD without revealing the key.
+func (k *chacha20poly1305) String() string {
+	fp, err := fingerprint(k.ek)
+	if err != nil {
+		fp = "unavailable"
+	}
+	return fmt.Sprintf("chacha20poly1305guard.AEAD{nonce: %d bytes, key: [REDACTED], fingerprint: %s}", k.NonceSize(), fp)
+}
+
+// GoString is the same as String, so %#v does not dump the fields.
+func (k *chacha20poly1305) GoString() string {
+	return k.String()
+}
+
+// Format prints String for every verb, so that no formatting directive
+// reaches the fields holding the key.
+func (k *chacha20poly1305) Format(f fmt.State, verb rune) {
+	fmt.Fprint(f, k.String())
+}
+
+// Format keeps the key bytes out of any formatted output.
+func (unlockedKey) Format(f fmt.State, verb rune) {
+	fmt.Fprint(f, "[REDACTED]")
+}
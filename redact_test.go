@@ -0,0 +1,117 @@
+package chacha20poly1305guard
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/chacha20"
+)
+
+// TestRedacted formats every AEAD this package hands out, and its key
+// holders, with every common verb and as JSON, and looks for the key in
+// the output in any of the forms it could take.
+func TestRedacted(t *testing.T) {
+	raw := []byte("\xc0\xff\xeeredacted-test-key-0123456789\xfe")
+	key := lockedBytes(t, raw)
+
+	locked, err := NewX(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlocked, err := NewUnlockedForTesting(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider, err := NewWithProvider(NewLockedBufferProvider(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forms := []string{
+		string(raw),
+		hex.EncodeToString(raw),
+		strings.ToUpper(hex.EncodeToString(raw)),
+		fmt.Sprint([]byte(raw)),
+		fmt.Sprintf("%#v", []byte(raw)),
+		fmt.Sprintf("%q", raw)[1:20],
+	}
+	values := map[string]interface{}{
+		"locked":       locked,
+		"unlocked":     unlocked,
+		"provider":     provider,
+		"unlocked key": unlocked.(*chacha20poly1305).ek,
+	}
+	for name, v := range values {
+		var out []string
+		for _, verb := range []string{"%v", "%+v", "%#v", "%s", "%x", "%q"} {
+			out = append(out, fmt.Sprintf(verb, v))
+		}
+		j, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("%s: json.Marshal: %v", name, err)
+		}
+		out = append(out, string(j))
+
+		for _, o := range out {
+			for _, f := range forms {
+				if strings.Contains(o, f) || bytes.Contains([]byte(o), raw[:8]) {
+					t.Fatalf("%s: formatted output %q contains the key", name, o)
+				}
+			}
+		}
+		if !strings.Contains(fmt.Sprint(v), "REDACTED") {
+			t.Errorf("%s: %q is not marked as redacted", name, fmt.Sprint(v))
+		}
+	}
+}
+
+func TestKeyFingerprint(t *testing.T) {
+	key := testKey(t)
+	fp, err := KeyFingerprint(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fp) != len("v1:")+16 || !strings.HasPrefix(fp, "v1:") {
+		t.Fatalf("fingerprint %q is not v1: and 16 hex digits", fp)
+	}
+	if _, err := hex.DecodeString(fp[3:]); err != nil {
+		t.Fatalf("fingerprint %q: %v", fp, err)
+	}
+
+	// It is 8 bytes of the XChaCha20 keystream past the first block.
+	c, err := chacha20.NewUnauthenticatedCipher(key.Buffer(), fingerprintNonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := make([]byte, 64+8)
+	c.XORKeyStream(ks, ks)
+	if want := "v1:" + hex.EncodeToString(ks[64:]); fp != want {
+		t.Fatalf("fingerprint %s, want %s", fp, want)
+	}
+
+	// Stable, and the same for another buffer holding the same key.
+	if again, err := KeyFingerprint(lockedBytes(t, key.Buffer())); err != nil || again != fp {
+		t.Fatalf("same key: %q, %v, want %q", again, err, fp)
+	}
+	other, err := KeyFingerprint(lockedBytes(t, bytes.Repeat([]byte{1}, KeySize)))
+	if err != nil || other == fp {
+		t.Fatalf("different keys share the fingerprint %q: %v", fp, err)
+	}
+	if strings.Contains(fp, hex.EncodeToString(key.Buffer()[:8])) {
+		t.Fatal("fingerprint contains the key")
+	}
+
+	// String shows the same fingerprint.
+	if s := fmt.Sprint(testAEAD(t, ChaCha20)); !strings.Contains(s, fp[3:]) {
+		t.Fatalf("String %q does not show the fingerprint %s", s, fp)
+	}
+
+	if _, err := KeyFingerprint(lockedBytes(t, make([]byte, KeySize-1))); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("short key: got %v, want ErrInvalidKey", err)
+	}
+}
@@ -0,0 +1,242 @@
+package chacha20poly1305guard
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/rpc"
+	"sync"
+)
+
+// ErrInvalidFrame is returned by the RPC codecs for a frame that is
+// truncated or malformed.
+var ErrInvalidFrame = errors.New("invalid frame")
+
+// MaxRPCMessageSize is the largest frame the RPC codecs read or write.
+const MaxRPCMessageSize = 16 << 20
+
+// rpcServerBit marks the nonces of messages sent by the server, so the
+// two directions never share a nonce under the same key.
+const rpcServerBit = 1 << 63
+
+// NewRPCClientCodec returns an rpc.ClientCodec that seals the calls it
+// sends over conn with aead, for use with rpc.NewClientWithCodec. The
+// other end must use NewRPCServerCodec with the same key.
+//
+// Each message travels as a uint32 LE length followed by the sequence
+// number and method name in clear, and the sealed gob encoding of the
+// error string and body. The sequence number and method are the
+// associated data, so a response cannot be passed off as the one of
+// another call. Nonces are counters, one per direction, that are never
+// sent: each side expects the next value, so dropped, replayed and
+// reordered messages fail to open. A connection must therefore not
+// outlive its key, nor a key be shared by two connections.
+func NewRPCClientCodec(conn io.ReadWriteCloser, aead cipher.AEAD) (rpc.ClientCodec, error) {
+	c, err := newRPCConn(conn, aead, 0, rpcServerBit)
+	if err != nil {
+		return nil, err
+	}
+	return &rpcClientCodec{c}, nil
+}
+
+// NewRPCServerCodec returns the rpc.ServerCodec matching
+// NewRPCClientCodec, for use with rpc.ServeCodec.
+func NewRPCServerCodec(conn io.ReadWriteCloser, aead cipher.AEAD) (rpc.ServerCodec, error) {
+	c, err := newRPCConn(conn, aead, rpcServerBit, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &rpcServerCodec{c}, nil
+}
+
+type rpcClientCodec struct{ *rpcConn }
+
+func (c *rpcClientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	return c.writeFrame(r.Seq, r.ServiceMethod, "", body)
+}
+
+func (c *rpcClientCodec) ReadResponseHeader(r *rpc.Response) error {
+	seq, method, errStr, err := c.readFrame()
+	if err != nil {
+		return err
+	}
+	r.Seq, r.ServiceMethod, r.Error = seq, method, errStr
+	return nil
+}
+
+func (c *rpcClientCodec) ReadResponseBody(body interface{}) error {
+	return c.readBody(body)
+}
+
+type rpcServerCodec struct{ *rpcConn }
+
+func (c *rpcServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	seq, method, _, err := c.readFrame()
+	if err != nil {
+		return err
+	}
+	r.Seq, r.ServiceMethod = seq, method
+	return nil
+}
+
+func (c *rpcServerCodec) ReadRequestBody(body interface{}) error {
+	return c.readBody(body)
+}
+
+func (c *rpcServerCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	return c.writeFrame(r.Seq, r.ServiceMethod, r.Error, body)
+}
+
+// rpcConn is the half shared by both codecs. Writes may come from many
+// goroutines and are serialized by mu; net/rpc reads from one goroutine
+// only.
+type rpcConn struct {
+	conn io.ReadWriteCloser
+	aead cipher.AEAD
+
+	mu   sync.Mutex
+	send uint64
+
+	recv uint64
+	body []byte // plaintext body of the frame last read
+}
+
+func newRPCConn(conn io.ReadWriteCloser, aead cipher.AEAD, send, recv uint64) (*rpcConn, error) {
+	if aead.NonceSize() < 8 {
+		return nil, ErrInvalidNonce
+	}
+	return &rpcConn{conn: conn, aead: aead, send: send, recv: recv}, nil
+}
+
+func (c *rpcConn) nonce(counter uint64) []byte {
+	nonce := make([]byte, c.aead.NonceSize())
+	binary.LittleEndian.PutUint64(nonce[len(nonce)-8:], counter)
+	return nonce
+}
+
+// rpcHeader returns the clear part of a frame: the sequence number as
+// uint64 LE and the method name, preceded by its length as uint16 LE.
+func rpcHeader(seq uint64, method string) ([]byte, error) {
+	if len(method) > math.MaxUint16 {
+		return nil, fmt.Errorf("%w: method name of %d bytes", ErrTooLarge, len(method))
+	}
+	h := make([]byte, 10, 10+len(method))
+	binary.LittleEndian.PutUint64(h, seq)
+	binary.LittleEndian.PutUint16(h[8:], uint16(len(method)))
+	return append(h, method...), nil
+}
+
+func (c *rpcConn) writeFrame(seq uint64, method, errStr string, body interface{}) error {
+	header, err := rpcHeader(seq, method)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	var n [4]byte
+	binary.LittleEndian.PutUint32(n[:], uint32(len(errStr)))
+	buf.Write(n[:])
+	buf.WriteString(errStr)
+	if err := gob.NewEncoder(&buf).Encode(body); err != nil {
+		return err
+	}
+	plaintext := buf.Bytes()
+	defer wipe(plaintext)
+
+	size := len(header) + len(plaintext) + c.aead.Overhead()
+	if size > MaxRPCMessageSize {
+		return fmt.Errorf("%w: message of %d bytes", ErrTooLarge, size)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.send&^rpcServerBit == rpcServerBit-1 {
+		return ErrNonceExhausted
+	}
+	nonce := c.nonce(c.send)
+	c.send++
+
+	frame := make([]byte, 4, 4+size)
+	binary.LittleEndian.PutUint32(frame, uint32(size))
+	frame = append(frame, header...)
+	frame = c.aead.Seal(frame, nonce, plaintext, header)
+	_, err = c.conn.Write(frame)
+	return err
+}
+
+func (c *rpcConn) readFrame() (seq uint64, method, errStr string, err error) {
+	c.discardBody()
+
+	var n [4]byte
+	if _, err := io.ReadFull(c.conn, n[:]); err != nil {
+		return 0, "", "", err
+	}
+	size := binary.LittleEndian.Uint32(n[:])
+	if size > MaxRPCMessageSize {
+		return 0, "", "", fmt.Errorf("%w: message of %d bytes", ErrTooLarge, size)
+	}
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(c.conn, frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, "", "", err
+	}
+
+	if len(frame) < 10 {
+		return 0, "", "", ErrInvalidFrame
+	}
+	hlen := 10 + int(binary.LittleEndian.Uint16(frame[8:]))
+	if len(frame) < hlen {
+		return 0, "", "", ErrInvalidFrame
+	}
+	header := frame[:hlen]
+
+	if c.recv&^rpcServerBit == rpcServerBit-1 {
+		return 0, "", "", ErrNonceExhausted
+	}
+	plaintext, err := c.aead.Open(nil, c.nonce(c.recv), frame[hlen:], header)
+	if err != nil {
+		return 0, "", "", err
+	}
+	c.recv++
+
+	if len(plaintext) < 4 {
+		wipe(plaintext)
+		return 0, "", "", ErrInvalidFrame
+	}
+	elen := binary.LittleEndian.Uint32(plaintext)
+	if uint64(elen) > uint64(len(plaintext)-4) {
+		wipe(plaintext)
+		return 0, "", "", ErrInvalidFrame
+	}
+	errStr = string(plaintext[4 : 4+elen])
+	c.body = plaintext[4+elen:]
+
+	return binary.LittleEndian.Uint64(header), string(header[10:]), errStr, nil
+}
+
+// readBody decodes the body of the frame last read into body, or drops
+// it when body is nil.
+func (c *rpcConn) readBody(body interface{}) error {
+	defer c.discardBody()
+	if body == nil {
+		return nil
+	}
+	return gob.NewDecoder(bytes.NewReader(c.body)).Decode(body)
+}
+
+func (c *rpcConn) discardBody() {
+	wipe(c.body)
+	c.body = nil
+}
+
+func (c *rpcConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,136 @@
+package chacha20poly1305guard
+
+import (
+	"crypto/cipher"
+	"errors"
+	"net"
+	"net/rpc"
+	"sync"
+	"testing"
+)
+
+type Arith struct{}
+
+type ArithArgs struct{ A, B int }
+
+func (Arith) Add(args ArithArgs, sum *int) error {
+	*sum = args.A + args.B
+	return nil
+}
+
+func (Arith) Fail(args ArithArgs, sum *int) error {
+	return errors.New("arith: failure")
+}
+
+// rpcClient serves Arith over an in-memory connection with the server
+// codec under serverAEAD, and returns a client using clientAEAD whose
+// writes go through wrap, if not nil.
+func rpcClient(t *testing.T, clientAEAD, serverAEAD cipher.AEAD, wrap func(net.Conn) net.Conn) *rpc.Client {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+
+	srv := rpc.NewServer()
+	if err := srv.Register(Arith{}); err != nil {
+		t.Fatal(err)
+	}
+	sc, err := NewRPCServerCodec(serverConn, serverAEAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeCodec(sc)
+
+	var conn net.Conn = clientConn
+	if wrap != nil {
+		conn = wrap(clientConn)
+	}
+	cc, err := NewRPCClientCodec(conn, clientAEAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := rpc.NewClientWithCodec(cc)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestRPC(t *testing.T) {
+	aead := testAEAD(t, XChaCha20)
+	client := rpcClient(t, aead, aead, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var sum int
+			if err := client.Call("Arith.Add", ArithArgs{i, 1}, &sum); err != nil || sum != i+1 {
+				t.Errorf("Add(%d, 1) = %d, %v", i, sum, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var sum int
+	if err := client.Call("Arith.Fail", ArithArgs{}, &sum); err == nil || err.Error() != "arith: failure" {
+		t.Fatalf("Fail: got %v", err)
+	}
+	if err := client.Call("Arith.Missing", ArithArgs{}, &sum); err == nil {
+		t.Fatal("call to a missing method succeeded")
+	}
+	// The connection survives errors returned by the server.
+	if err := client.Call("Arith.Add", ArithArgs{2, 3}, &sum); err != nil || sum != 5 {
+		t.Fatalf("Add(2, 3) = %d, %v", sum, err)
+	}
+}
+
+// flipConn flips a bit of the byte at offset at of the stream written
+// through it.
+type flipConn struct {
+	net.Conn
+	written, at int
+}
+
+func (c *flipConn) Write(p []byte) (int, error) {
+	q := append([]byte(nil), p...)
+	if i := c.at - c.written; i >= 0 && i < len(q) {
+		q[i] ^= 1
+	}
+	c.written += len(q)
+	return c.Conn.Write(q)
+}
+
+func TestRPCTampered(t *testing.T) {
+	// A call to Arith.Add is a 4 byte length, a 19 byte header with
+	// the sequence number and method name, and the sealed body.
+	for _, at := range []struct {
+		name   string
+		offset int
+	}{
+		{"sequence number", 5},
+		{"method name", 16},
+		{"body", 30},
+		{"tag", 60},
+	} {
+		aead := testAEAD(t, XChaCha20)
+		client := rpcClient(t, aead, aead, func(c net.Conn) net.Conn {
+			return &flipConn{Conn: c, at: at.offset}
+		})
+
+		var sum int
+		if err := client.Call("Arith.Add", ArithArgs{1, 2}, &sum); err == nil {
+			t.Fatalf("tampered %s: call succeeded", at.name)
+		}
+	}
+}
+
+func TestRPCWrongKey(t *testing.T) {
+	other, err := NewXUnlockedForTesting(make([]byte, KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := rpcClient(t, other, testAEAD(t, XChaCha20), nil)
+
+	var sum int
+	if err := client.Call("Arith.Add", ArithArgs{1, 2}, &sum); err == nil {
+		t.Fatal("call under the wrong key succeeded")
+	}
+}
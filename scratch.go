@@ -0,0 +1,22 @@
+package chacha20poly1305guard
+
+// scratch returns an n byte buffer for derived secrets, such as the
+// Poly1305 one-time key, together with a function that wipes and frees
+// it. The buffer is taken from scratchPool unless the AEAD was created
+// with NewUnlockedForTesting, or locked memory is unavailable under
+// DegradeWithWarning, in which case it is ordinary memory that is still
+// wiped on release.
+func (k *chacha20poly1305) scratch(n int) ([]byte, func(), error) {
+	if !k.unlocked {
+		b, err := scratchPool.Get(n)
+		if err == nil {
+			return b.Buffer()[:n], func() { scratchPool.Put(b) }, nil
+		}
+		if !degrade(err) {
+			return nil, nil, err
+		}
+	}
+
+	b := make([]byte, n)
+	return b, func() { wipe(b) }, nil
+}
@@ -0,0 +1,110 @@
+package chacha20poly1305guard
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrSecretBoxDestroyed is returned by SecretBox.Reveal once the box has
+// been destroyed, or for a zero SecretBox.
+var ErrSecretBoxDestroyed = errors.New("secret box destroyed")
+
+// secretBoxAAD is the associated data of every SecretBox.
+const secretBoxAAD = "chacha20poly1305guard secret box"
+
+// secretBoxKey is the key shared by every SecretBox of the process,
+// created on first use and never destroyed.
+var secretBoxKey struct {
+	once sync.Once
+	aead *chacha20poly1305
+	err  error
+}
+
+// SecretBox holds a secret encrypted in memory, for long-lived structs
+// that keep a password or token around. The secret is sealed under a
+// random key of the process, held in locked memory, and only decrypted,
+// into locked memory, for the duration of a Reveal callback.
+//
+// The key is created by the first NewSecretBox and lives as long as the
+// process: nothing in this package destroys it, not even once every box
+// is destroyed, short of memguard.DestroyAll or memguard.SafeExit. It
+// counts as one key in Stats from then on.
+//
+// A SecretBox may be copied freely: copies share the sealed value, so
+// destroying one destroys them all. It marshals to JSON as a redacted
+// placeholder and prints as one, so it cannot leak through accidental
+// serialization or logging. It is safe for concurrent use.
+type SecretBox struct {
+	s *secretBoxState
+}
+
+type secretBoxState struct {
+	mu     sync.RWMutex
+	sealed []byte // nonce || ciphertext, nil once destroyed
+}
+
+// NewSecretBox seals plaintext into a new SecretBox and wipes plaintext,
+// even on failure. It fails only if the key of the process cannot be
+// created, or randomness cannot be read; a failure to create the key is
+// returned by every later call.
+func NewSecretBox(plaintext []byte) (SecretBox, error) {
+	defer wipe(plaintext)
+
+	secretBoxKey.once.Do(func() {
+		secretBoxKey.aead, secretBoxKey.err = newEphemeralAEAD()
+	})
+	if secretBoxKey.err != nil {
+		return SecretBox{}, secretBoxKey.err
+	}
+
+	sealed, err := sealSecret(secretBoxKey.aead, []byte(secretBoxAAD), plaintext)
+	if err != nil {
+		return SecretBox{}, err
+	}
+	return SecretBox{&secretBoxState{sealed: sealed}}, nil
+}
+
+// Reveal decrypts the secret into locked memory and calls fn with it.
+// The slice is only valid during the call and is destroyed when fn
+// returns, so fn must not retain it. It returns ErrSecretBoxDestroyed
+// after Destroy, or the error from fn.
+func (b SecretBox) Reveal(fn func(plaintext []byte) error) error {
+	if b.s == nil {
+		return ErrSecretBoxDestroyed
+	}
+	b.s.mu.RLock()
+	defer b.s.mu.RUnlock()
+
+	if b.s.sealed == nil {
+		return ErrSecretBoxDestroyed
+	}
+	return openSecret(secretBoxKey.aead, []byte(secretBoxAAD), b.s.sealed, fn)
+}
+
+// Destroy wipes the sealed secret of b and of every copy of it. Calling
+// it twice is harmless.
+func (b SecretBox) Destroy() {
+	if b.s == nil {
+		return
+	}
+	b.s.mu.Lock()
+	defer b.s.mu.Unlock()
+
+	wipe(b.s.sealed)
+	b.s.sealed = nil
+}
+
+// MarshalJSON returns a redacted placeholder.
+func (b SecretBox) MarshalJSON() ([]byte, error) {
+	return []byte(`"[REDACTED]"`), nil
+}
+
+// String returns a redacted placeholder.
+func (b SecretBox) String() string {
+	return "[REDACTED]"
+}
+
+// GoString is the same as String.
+func (b SecretBox) GoString() string {
+	return b.String()
+}
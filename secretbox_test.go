@@ -0,0 +1,113 @@
+package chacha20poly1305guard
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// revealed returns the secret held by b.
+func revealed(b SecretBox) (string, error) {
+	var s string
+	err := b.Reveal(func(p []byte) error {
+		s = string(p)
+		return nil
+	})
+	return s, err
+}
+
+func TestSecretBox(t *testing.T) {
+	plaintext := []byte("hunter2")
+	b, err := NewSecretBox(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "\x00\x00\x00\x00\x00\x00\x00" {
+		t.Fatalf("plaintext not wiped: %q", plaintext)
+	}
+	if s, err := revealed(b); err != nil || s != "hunter2" {
+		t.Fatalf("Reveal: %q, %v", s, err)
+	}
+	if strings.Contains(string(b.s.sealed), "hunter2") {
+		t.Fatal("secret stored in the clear")
+	}
+
+	// Errors from fn are returned as they are.
+	errFn := errors.New("fn failed")
+	if err := b.Reveal(func([]byte) error { return errFn }); err != errFn {
+		t.Fatalf("Reveal: got %v, want the error of fn", err)
+	}
+
+	// Copies share the secret, and destroying any of them destroys all.
+	c := b
+	if s, err := revealed(c); err != nil || s != "hunter2" {
+		t.Fatalf("Reveal of a copy: %q, %v", s, err)
+	}
+	c.Destroy()
+	for name, box := range map[string]SecretBox{"original": b, "copy": c} {
+		if _, err := revealed(box); err != ErrSecretBoxDestroyed {
+			t.Fatalf("%s after Destroy: got %v, want ErrSecretBoxDestroyed", name, err)
+		}
+	}
+	b.Destroy()
+
+	// Other boxes are unaffected.
+	other, err := NewSecretBox([]byte("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Destroy()
+	if s, err := revealed(other); err != nil || s != "other" {
+		t.Fatalf("Reveal of another box: %q, %v", s, err)
+	}
+}
+
+func TestSecretBoxZero(t *testing.T) {
+	var b SecretBox
+	if _, err := revealed(b); err != ErrSecretBoxDestroyed {
+		t.Fatalf("Reveal of a zero SecretBox: got %v, want ErrSecretBoxDestroyed", err)
+	}
+	b.Destroy()
+	if b.String() != "[REDACTED]" {
+		t.Fatalf("zero SecretBox prints as %q", b.String())
+	}
+	if j, err := json.Marshal(b); err != nil || string(j) != `"[REDACTED]"` {
+		t.Fatalf("zero SecretBox marshals to %s, %v", j, err)
+	}
+}
+
+func TestSecretBoxRedacted(t *testing.T) {
+	b, err := NewSecretBox([]byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Destroy()
+
+	type config struct {
+		User     string
+		Password SecretBox
+		Token    *SecretBox
+	}
+	cfg := config{User: "alice", Password: b, Token: &b}
+
+	for _, verb := range []string{"%v", "%+v", "%#v", "%s", "%q", "%x"} {
+		for _, v := range []interface{}{b, &b, cfg, &cfg} {
+			if out := fmt.Sprintf(verb, v); strings.Contains(out, "hunter2") || strings.Contains(out, fmt.Sprintf("%x", "hunter2")) {
+				t.Errorf("%s of %T prints the secret: %s", verb, v, out)
+			}
+		}
+	}
+	if out := fmt.Sprint(cfg); !strings.Contains(out, "[REDACTED]") {
+		t.Errorf("struct prints as %s, want a redacted placeholder", out)
+	}
+
+	j, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(j) != `{"User":"alice","Password":"[REDACTED]","Token":"[REDACTED]"}` {
+		t.Fatalf("JSON: %s", j)
+	}
+}
@@ -0,0 +1,259 @@
+package chacha20poly1305guard
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrSecretNotFound is returned by SecretStore.Get for a name that has
+// no secret.
+var ErrSecretNotFound = errors.New("secret not found")
+
+// secretStoreAAD prefixes the name of a secret in its associated data.
+const secretStoreAAD = "chacha20poly1305guard secret\x00"
+
+// SecretStoreOption configures NewSecretStore.
+type SecretStoreOption func(*secretStoreConfig)
+
+type secretStoreConfig struct {
+	rekeyEvery time.Duration
+}
+
+// WithRekeyInterval makes the store call Rekey every d in the
+// background. A failed rekey keeps the current key and is retried at the
+// next interval.
+func WithRekeyInterval(d time.Duration) SecretStoreOption {
+	return func(c *secretStoreConfig) {
+		c.rekeyEvery = d
+	}
+}
+
+// SecretStore keeps a small set of named secrets, such as API tokens and
+// database passwords, in memory for the lifetime of a process. Each
+// value is sealed as soon as it is stored, under a random key created
+// for the store and held in a locked, immutable buffer, and is only
+// decrypted, into locked memory, for the duration of a Get callback.
+// The name of each secret is authenticated with it, so values cannot be
+// swapped between names.
+//
+// memguard v0.15 has no Enclave, which would keep the key itself
+// encrypted; the key is protected like the keys of every other AEAD of
+// this package.
+//
+// A SecretStore is safe for concurrent use. DestroyAll must be called
+// once it is no longer needed, to release the key and stop rekeying.
+type SecretStore struct {
+	mu        sync.RWMutex
+	aead      *chacha20poly1305
+	secrets   map[string][]byte // nonce || ciphertext
+	destroyed bool
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// NewSecretStore returns an empty SecretStore with a new random key.
+func NewSecretStore(opts ...SecretStoreOption) (*SecretStore, error) {
+	var cfg secretStoreConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	aead, err := newEphemeralAEAD()
+	if err != nil {
+		return nil, err
+	}
+	s := &SecretStore{aead: aead, secrets: make(map[string][]byte)}
+
+	if cfg.rekeyEvery > 0 {
+		s.stop = make(chan struct{})
+		s.done = make(chan struct{})
+		go s.rekeyLoop(cfg.rekeyEvery)
+	}
+	return s, nil
+}
+
+// newEphemeralAEAD returns an XChaCha20Poly1305 AEAD owning a new
+// random key.
+func newEphemeralAEAD() (*chacha20poly1305, error) {
+	key, err := keyUsage.track(newMutable(KeySize))
+	if err != nil {
+		return nil, err
+	}
+	if err := key.FillRandomBytes(); err != nil {
+		keyUsage.destroy(key)
+		return nil, err
+	}
+	if err := key.MakeImmutable(); err != nil {
+		keyUsage.destroy(key)
+		return nil, err
+	}
+
+	k, err := newAEAD(key, XChaCha20, nil)
+	if err != nil {
+		keyUsage.destroy(key)
+		return nil, err
+	}
+	k.owned = key
+	return k, nil
+}
+
+// Put seals value under name, replacing any previous secret of that
+// name, and wipes value, even on failure.
+func (s *SecretStore) Put(name string, value []byte) error {
+	defer wipe(value)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.destroyed {
+		return ErrKeyDestroyed
+	}
+	sealed, err := sealSecret(s.aead, []byte(secretStoreAAD+name), value)
+	if err != nil {
+		return err
+	}
+	if old, ok := s.secrets[name]; ok {
+		wipe(old)
+	}
+	s.secrets[name] = sealed
+	return nil
+}
+
+// Get decrypts the secret name into locked memory and calls fn with it.
+// The slice is only valid during the call and is destroyed when fn
+// returns: fn must not retain it, and must not call other methods of
+// the store. It returns ErrSecretNotFound for an unknown name, or the
+// error from fn.
+func (s *SecretStore) Get(name string, fn func(value []byte) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.destroyed {
+		return ErrKeyDestroyed
+	}
+	sealed, ok := s.secrets[name]
+	if !ok {
+		return ErrSecretNotFound
+	}
+	return openSecret(s.aead, []byte(secretStoreAAD+name), sealed, fn)
+}
+
+// Names returns the names of the secrets in the store, sorted.
+func (s *SecretStore) Names() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := make([]string, 0, len(s.secrets))
+	for name := range s.secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Delete removes the secret name, if any.
+func (s *SecretStore) Delete(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sealed, ok := s.secrets[name]; ok {
+		wipe(sealed)
+		delete(s.secrets, name)
+	}
+}
+
+// Rekey seals every secret again under a new random key and destroys the
+// old one. On failure the store is left as it was.
+func (s *SecretStore) Rekey() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.destroyed {
+		return ErrKeyDestroyed
+	}
+
+	aead, err := newEphemeralAEAD()
+	if err != nil {
+		return err
+	}
+	secrets := make(map[string][]byte, len(s.secrets))
+	for name, sealed := range s.secrets {
+		ad := []byte(secretStoreAAD + name)
+		err := openSecret(s.aead, ad, sealed, func(value []byte) error {
+			resealed, err := sealSecret(aead, ad, value)
+			secrets[name] = resealed
+			return err
+		})
+		if err != nil {
+			aead.Close()
+			return err
+		}
+	}
+
+	for _, sealed := range s.secrets {
+		wipe(sealed)
+	}
+	s.aead.Close()
+	s.aead, s.secrets = aead, secrets
+	return nil
+}
+
+// DestroyAll stops rekeying, wipes every secret and destroys the key.
+// The store cannot be used afterwards; its methods return
+// ErrKeyDestroyed.
+func (s *SecretStore) DestroyAll() {
+	if s.stop != nil {
+		s.stopOnce.Do(func() { close(s.stop) })
+		<-s.done
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.destroyed {
+		return
+	}
+	for name, sealed := range s.secrets {
+		wipe(sealed)
+		delete(s.secrets, name)
+	}
+	s.aead.Close()
+	s.destroyed = true
+}
+
+func (s *SecretStore) rekeyLoop(every time.Duration) {
+	defer close(s.done)
+
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.Rekey()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// sealSecret seals value under a random nonce and returns the nonce
+// followed by the ciphertext.
+func sealSecret(aead *chacha20poly1305, ad, value []byte) ([]byte, error) {
+	nonce := make([]byte, XNonceSize, XNonceSize+len(value)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.seal(nonce, nonce, value, ad)
+}
+
+// openSecret opens the output of sealSecret into locked memory for fn.
+func openSecret(aead *chacha20poly1305, ad, sealed []byte, fn func([]byte) error) error {
+	nonce, ciphertext := sealed[:XNonceSize], sealed[XNonceSize:]
+	return aead.OpenWith(nonce, ciphertext, ad, fn)
+}
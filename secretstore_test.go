@@ -0,0 +1,203 @@
+package chacha20poly1305guard
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// getSecret returns the secret name of s.
+func getSecret(s *SecretStore, name string) (string, error) {
+	var v string
+	err := s.Get(name, func(value []byte) error {
+		v = string(value)
+		return nil
+	})
+	return v, err
+}
+
+func TestSecretStore(t *testing.T) {
+	s, err := NewSecretStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.DestroyAll()
+
+	value := []byte("hunter2")
+	if err := s.Put("db", value); err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "\x00\x00\x00\x00\x00\x00\x00" {
+		t.Fatalf("Put did not wipe its input: %q", value)
+	}
+	if err := s.Put("api", []byte("token")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := getSecret(s, "db"); err != nil || v != "hunter2" {
+		t.Fatalf("Get: %q, %v", v, err)
+	}
+	if _, err := getSecret(s, "missing"); err != ErrSecretNotFound {
+		t.Fatalf("unknown name: got %v, want ErrSecretNotFound", err)
+	}
+	errFn := errors.New("fn failed")
+	if err := s.Get("db", func([]byte) error { return errFn }); err != errFn {
+		t.Fatalf("Get: got %v, want the error of fn", err)
+	}
+	if names := s.Names(); !reflect.DeepEqual(names, []string{"api", "db"}) {
+		t.Fatalf("Names() = %q", names)
+	}
+
+	// Put replaces a secret, Delete removes it.
+	if err := s.Put("db", []byte("correct horse")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := getSecret(s, "db"); err != nil || v != "correct horse" {
+		t.Fatalf("Get after replacing: %q, %v", v, err)
+	}
+	s.Delete("db")
+	s.Delete("missing")
+	if _, err := getSecret(s, "db"); err != ErrSecretNotFound {
+		t.Fatalf("deleted: got %v, want ErrSecretNotFound", err)
+	}
+	if names := s.Names(); !reflect.DeepEqual(names, []string{"api"}) {
+		t.Fatalf("Names() = %q after Delete", names)
+	}
+}
+
+// TestSecretStoreNameBinding swaps the sealed values of two names, which
+// must then fail to open.
+func TestSecretStoreNameBinding(t *testing.T) {
+	s, err := NewSecretStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.DestroyAll()
+	s.Put("a", []byte("value a"))
+	s.Put("b", []byte("value b"))
+
+	s.secrets["a"], s.secrets["b"] = s.secrets["b"], s.secrets["a"]
+	for _, name := range []string{"a", "b"} {
+		if _, err := getSecret(s, name); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("%s after swapping: got %v, want ErrAuthFailed", name, err)
+		}
+	}
+}
+
+func TestSecretStoreRekey(t *testing.T) {
+	s, err := NewSecretStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.DestroyAll()
+	for i := 0; i < 3; i++ {
+		s.Put(fmt.Sprint("secret ", i), []byte(fmt.Sprint("value ", i)))
+	}
+
+	old, sealed := s.aead, string(s.secrets["secret 0"])
+	if err := s.Rekey(); err != nil {
+		t.Fatal(err)
+	}
+	if s.aead == old || !old.owned.IsDestroyed() {
+		t.Fatal("Rekey kept the old key")
+	}
+	if string(s.secrets["secret 0"]) == sealed {
+		t.Fatal("Rekey did not seal the secrets again")
+	}
+	for i := 0; i < 3; i++ {
+		if v, err := getSecret(s, fmt.Sprint("secret ", i)); err != nil || v != fmt.Sprint("value ", i) {
+			t.Fatalf("secret %d after Rekey: %q, %v", i, v, err)
+		}
+	}
+}
+
+func TestSecretStoreDestroyAll(t *testing.T) {
+	before := settledStats().Keys
+	s, err := NewSecretStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put("db", []byte("hunter2"))
+	sealed := s.secrets["db"]
+
+	s.DestroyAll()
+	s.DestroyAll()
+	if _, err := getSecret(s, "db"); err != ErrKeyDestroyed {
+		t.Fatalf("Get: got %v, want ErrKeyDestroyed", err)
+	}
+	if err := s.Put("db", []byte("x")); err != ErrKeyDestroyed {
+		t.Fatalf("Put: got %v, want ErrKeyDestroyed", err)
+	}
+	if err := s.Rekey(); err != ErrKeyDestroyed {
+		t.Fatalf("Rekey: got %v, want ErrKeyDestroyed", err)
+	}
+	if len(s.Names()) != 0 {
+		t.Fatalf("Names() = %q after DestroyAll", s.Names())
+	}
+	for _, b := range sealed {
+		if b != 0 {
+			t.Fatal("DestroyAll did not wipe the sealed secrets")
+		}
+	}
+	if after := Stats().Keys; after.Buffers != before.Buffers {
+		t.Fatalf("%d key buffers after DestroyAll, want %d", after.Buffers, before.Buffers)
+	}
+}
+
+// TestSecretStoreConcurrent uses a store from several goroutines while
+// it rekeys in the background, then destroys it. Run it with -race.
+func TestSecretStoreConcurrent(t *testing.T) {
+	s, err := NewSecretStore(WithRekeyInterval(time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("shared", []byte("shared value")); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			name := fmt.Sprint("secret ", g)
+			for i := 0; i < 100; i++ {
+				want := fmt.Sprint("value ", g, " ", i)
+				if err := s.Put(name, []byte(want)); err != nil {
+					errs <- err
+					return
+				}
+				if v, err := getSecret(s, name); err != nil || v != want {
+					errs <- fmt.Errorf("%s: %q, %v", name, v, err)
+					return
+				}
+				if v, err := getSecret(s, "shared"); err != nil || v != "shared value" {
+					errs <- fmt.Errorf("shared: %q, %v", v, err)
+					return
+				}
+				s.Names()
+				if i%10 == 0 {
+					time.Sleep(time.Millisecond)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	s.DestroyAll()
+	select {
+	case <-s.done:
+	default:
+		t.Fatal("DestroyAll returned before the rekey goroutine stopped")
+	}
+	if _, err := getSecret(s, "shared"); err != ErrKeyDestroyed {
+		t.Fatalf("Get after DestroyAll: got %v, want ErrKeyDestroyed", err)
+	}
+}
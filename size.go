@@ -0,0 +1,139 @@
+package chacha20poly1305guard
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrInconsistentLength is returned by PlaintextSize for a length that
+// no plaintext could have been sealed to.
+var ErrInconsistentLength = errors.New("length inconsistent with format")
+
+// SizeOptions describes the parameters of a format that its sizes
+// depend on. Fields that a format does not use are ignored.
+type SizeOptions struct {
+	// Variant is the construction of FormatLegacy and FormatEnvelope,
+	// which determines the length of the nonce in envelopes.
+	Variant Variant
+
+	// KeyIDLen is the length of the key ID of FormatEnvelope, at most
+	// 255. Envelopes with an encryption context are not covered.
+	KeyIDLen int
+
+	// ChunkSize is the chunk size of FormatStream, as passed to
+	// WithChunkSize. Zero selects DefaultChunkSize.
+	ChunkSize int
+
+	// Compact selects the compact header of FormatStream, as
+	// WithCompactHeader does.
+	Compact bool
+}
+
+// CiphertextSize returns the length of the output of format f for a
+// plaintext of plaintextLen bytes: the output of Seal for FormatLegacy,
+// of SealEnvelope for FormatEnvelope and of EncryptStream for
+// FormatStream. Other formats fail with ErrUnknownFormat.
+func CiphertextSize(f Format, plaintextLen int64, opts SizeOptions) (int64, error) {
+	if plaintextLen < 0 {
+		return 0, ErrInconsistentLength
+	}
+	overhead, err := formatOverhead(f, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	if f != FormatStream {
+		return overhead + plaintextLen, nil
+	}
+
+	chunkSize := int64(streamChunkSize(opts))
+	chunks := (plaintextLen + chunkSize - 1) / chunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return overhead + plaintextLen + chunks*TagSize, nil
+}
+
+// PlaintextSize is the inverse of CiphertextSize: it returns the length
+// of the plaintext in an output of format f that is ciphertextLen bytes
+// long. A length that format f never produces fails with
+// ErrInconsistentLength, without anything having to be decrypted.
+func PlaintextSize(f Format, ciphertextLen int64, opts SizeOptions) (int64, error) {
+	overhead, err := formatOverhead(f, opts)
+	if err != nil {
+		return 0, err
+	}
+	if f == FormatStream {
+		return streamPlaintextSize(ciphertextLen-overhead, opts)
+	}
+
+	if ciphertextLen < overhead {
+		return 0, fmt.Errorf("%w: %d bytes is too short for %v", ErrInconsistentLength, ciphertextLen, f)
+	}
+	return ciphertextLen - overhead, nil
+}
+
+// streamPlaintextSize returns the length of the plaintext of the chunks
+// of a stream, which are n bytes long in total. Every chunk but the last
+// is full, and the last one is only empty if it is the only one.
+func streamPlaintextSize(n int64, opts SizeOptions) (int64, error) {
+	chunkSize := int64(streamChunkSize(opts))
+	sealed := int64(sealedChunkSize(int(chunkSize)))
+
+	full, last := n/sealed, n%sealed
+	switch {
+	case n < TagSize:
+	case last == 0:
+		return full * chunkSize, nil
+	case last > TagSize || (last == TagSize && full == 0):
+		return full*chunkSize + last - TagSize, nil
+	}
+	return 0, fmt.Errorf("%w: %d bytes is not a whole number of chunks", ErrInconsistentLength, n)
+}
+
+// formatOverhead returns what format f adds to a sealed plaintext once,
+// excluding the tags of streams, which depend on the plaintext length.
+func formatOverhead(f Format, opts SizeOptions) (int64, error) {
+	switch f {
+	case FormatLegacy:
+		if _, _, err := opts.Variant.params(); err != nil {
+			return 0, err
+		}
+		return TagSize, nil
+
+	case FormatEnvelope:
+		nonceSize, _, err := opts.Variant.params()
+		if err != nil {
+			return 0, err
+		}
+		if opts.KeyIDLen < 0 || opts.KeyIDLen > 255 {
+			return 0, ErrInvalidEnvelope
+		}
+		return int64(envelopeHeaderSize + opts.KeyIDLen + nonceSize + TagSize), nil
+
+	case FormatStream:
+		if err := checkChunkSize(streamChunkSize(opts)); err != nil {
+			return 0, err
+		}
+		if opts.Compact {
+			return compactStreamHeaderSize, nil
+		}
+		return streamHeaderSize, nil
+	}
+	return 0, fmt.Errorf("%w: sizes of %v", ErrUnknownFormat, f)
+}
+
+// streamChunkSize returns the chunk size of opts, with zero meaning
+// DefaultChunkSize as in WithChunkSize.
+func streamChunkSize(opts SizeOptions) int {
+	if opts.ChunkSize == 0 {
+		return DefaultChunkSize
+	}
+	return opts.ChunkSize
+}
+
+// sealedChunkSize returns the length of a full chunk of a stream once
+// sealed.
+func sealedChunkSize(chunkSize int) int {
+	return chunkSize + TagSize
+}
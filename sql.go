@@ -0,0 +1,218 @@
+package chacha20poly1305guard
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ErrNoColumnCipher is returned by EncryptedBytes and EncryptedString
+// when neither the value nor the package has a ColumnCipher.
+var ErrNoColumnCipher = errors.New("no column cipher configured")
+
+// ErrUnknownKeyID is returned when a value was sealed under a key ID
+// that is not known.
+var ErrUnknownKeyID = errors.New("unknown key ID")
+
+// ColumnCipher holds the AEADs used to seal database values. New values
+// are sealed with the primary AEAD and record its key ID in their
+// envelope; values sealed under older keys still open as long as those
+// keys have been added, which allows keys to be rotated without
+// rewriting every row at once. The AEADs must be XChaCha20Poly1305,
+// since every value gets a random nonce. A ColumnCipher is safe for
+// concurrent use.
+type ColumnCipher struct {
+	mu        sync.RWMutex
+	primaryID string
+	aeads     map[string]cipher.AEAD
+}
+
+// NewColumnCipher returns a ColumnCipher sealing with primary under the
+// key ID id.
+func NewColumnCipher(id string, primary cipher.AEAD) (*ColumnCipher, error) {
+	c := &ColumnCipher{aeads: make(map[string]cipher.AEAD)}
+	if err := c.SetPrimary(id, primary); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// AddKey makes values sealed under id openable with aead.
+func (c *ColumnCipher) AddKey(id string, aead cipher.AEAD) error {
+	if aead.NonceSize() != XNonceSize {
+		return ErrNonceSourceRequired
+	}
+	if len(id) > 255 {
+		return ErrInvalidEnvelope
+	}
+
+	c.mu.Lock()
+	c.aeads[id] = aead
+	c.mu.Unlock()
+	return nil
+}
+
+// SetPrimary adds aead under id and seals new values with it.
+func (c *ColumnCipher) SetPrimary(id string, aead cipher.AEAD) error {
+	if err := c.AddKey(id, aead); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.primaryID = id
+	c.mu.Unlock()
+	return nil
+}
+
+// seal returns an envelope of plaintext bound to column.
+func (c *ColumnCipher) seal(column string, plaintext []byte) ([]byte, error) {
+	c.mu.RLock()
+	id := c.primaryID
+	aead := c.aeads[id]
+	c.mu.RUnlock()
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return SealEnvelope(aead, nonce, plaintext, []byte(column), []byte(id))
+}
+
+// open opens an envelope written by seal for the same column.
+func (c *ColumnCipher) open(column string, envelope []byte) ([]byte, error) {
+	m, err := DecodeEnvelope(envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.RLock()
+	aead, ok := c.aeads[string(m.KeyID)]
+	c.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKeyID, m.KeyID)
+	}
+
+	return OpenSealedMessage(aead, m, []byte(column))
+}
+
+var (
+	defaultColumnCipherMu sync.RWMutex
+	defaultColumnCipher   *ColumnCipher
+)
+
+// SetDefaultColumnCipher sets the ColumnCipher used by EncryptedBytes and
+// EncryptedString values that do not name their own.
+func SetDefaultColumnCipher(c *ColumnCipher) {
+	defaultColumnCipherMu.Lock()
+	defaultColumnCipher = c
+	defaultColumnCipherMu.Unlock()
+}
+
+func columnCipher(c *ColumnCipher) (*ColumnCipher, error) {
+	if c != nil {
+		return c, nil
+	}
+
+	defaultColumnCipherMu.RLock()
+	c = defaultColumnCipher
+	defaultColumnCipherMu.RUnlock()
+	if c == nil {
+		return nil, ErrNoColumnCipher
+	}
+	return c, nil
+}
+
+// envelopeFromSQL returns the envelope stored in a database value, or
+// nil for NULL.
+func envelopeFromSQL(src interface{}) ([]byte, error) {
+	switch v := src.(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	}
+	return nil, fmt.Errorf("chacha20poly1305guard: cannot scan %T into an encrypted value", src)
+}
+
+// EncryptedBytes is a nullable []byte stored encrypted in a database.
+// Column, typically "table.column", is authenticated with the value so
+// that it cannot be copied into another column undetected; it must be
+// set before both writing and scanning.
+type EncryptedBytes struct {
+	Bytes  []byte
+	Valid  bool // Valid is false for NULL.
+	Column string
+
+	// Cipher seals and opens the value. If nil, the package default set
+	// with SetDefaultColumnCipher is used.
+	Cipher *ColumnCipher
+}
+
+// Value implements driver.Valuer.
+func (e EncryptedBytes) Value() (driver.Value, error) {
+	if !e.Valid {
+		return nil, nil
+	}
+	c, err := columnCipher(e.Cipher)
+	if err != nil {
+		return nil, err
+	}
+	return c.seal(e.Column, e.Bytes)
+}
+
+// Scan implements sql.Scanner.
+func (e *EncryptedBytes) Scan(src interface{}) error {
+	env, err := envelopeFromSQL(src)
+	if err != nil {
+		return err
+	}
+	if env == nil {
+		e.Bytes, e.Valid = nil, false
+		return nil
+	}
+
+	c, err := columnCipher(e.Cipher)
+	if err != nil {
+		return err
+	}
+	p, err := c.open(e.Column, env)
+	if err != nil {
+		return err
+	}
+
+	e.Bytes, e.Valid = p, true
+	return nil
+}
+
+// EncryptedString is the string counterpart of EncryptedBytes.
+type EncryptedString struct {
+	String string
+	Valid  bool // Valid is false for NULL.
+	Column string
+	Cipher *ColumnCipher
+}
+
+// Value implements driver.Valuer. The copy of the string made for
+// sealing is wiped afterwards; the string itself cannot be.
+func (e EncryptedString) Value() (driver.Value, error) {
+	p := []byte(e.String)
+	defer wipe(p)
+	return EncryptedBytes{p, e.Valid, e.Column, e.Cipher}.Value()
+}
+
+// Scan implements sql.Scanner.
+func (e *EncryptedString) Scan(src interface{}) error {
+	b := EncryptedBytes{Column: e.Column, Cipher: e.Cipher}
+	if err := b.Scan(src); err != nil {
+		return err
+	}
+	e.String, e.Valid = string(b.Bytes), b.Valid
+	wipe(b.Bytes)
+	return nil
+}
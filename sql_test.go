@@ -0,0 +1,221 @@
+package chacha20poly1305guard
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+)
+
+// memDriver is a database/sql driver keeping one table of id and value
+// in memory. It understands two statements: "insert", taking an id and
+// a value, and "select", taking an id.
+type memDriver struct {
+	mu   sync.Mutex
+	rows map[string]driver.Value
+}
+
+func (d *memDriver) Open(string) (driver.Conn, error) { return memConn{d}, nil }
+
+type memConn struct{ d *memDriver }
+
+func (c memConn) Prepare(query string) (driver.Stmt, error) { return memStmt{c.d, query}, nil }
+func (memConn) Close() error                                { return nil }
+func (memConn) Begin() (driver.Tx, error)                   { return nil, errors.New("memDriver: no transactions") }
+
+type memStmt struct {
+	d     *memDriver
+	query string
+}
+
+func (memStmt) Close() error  { return nil }
+func (memStmt) NumInput() int { return -1 }
+
+func (s memStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if s.query != "insert" || len(args) != 2 {
+		return nil, errors.New("memDriver: bad insert")
+	}
+	s.d.mu.Lock()
+	s.d.rows[args[0].(string)] = args[1]
+	s.d.mu.Unlock()
+	return driver.RowsAffected(1), nil
+}
+
+func (s memStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if s.query != "select" || len(args) != 1 {
+		return nil, errors.New("memDriver: bad select")
+	}
+	s.d.mu.Lock()
+	v, ok := s.d.rows[args[0].(string)]
+	s.d.mu.Unlock()
+	return &memRows{v: v, done: !ok}, nil
+}
+
+type memRows struct {
+	v    driver.Value
+	done bool
+}
+
+func (*memRows) Columns() []string { return []string{"value"} }
+func (*memRows) Close() error      { return nil }
+
+func (r *memRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = r.v
+	return nil
+}
+
+var memDB = &memDriver{rows: make(map[string]driver.Value)}
+
+func init() {
+	sql.Register("chacha20poly1305guard-mem", memDB)
+}
+
+// openMemDB returns a database backed by memDB.
+func openMemDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("chacha20poly1305guard-mem", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func storeValue(t *testing.T, db *sql.DB, id string, v interface{}) {
+	t.Helper()
+	if _, err := db.Exec("insert", id, v); err != nil {
+		t.Fatalf("insert %s: %v", id, err)
+	}
+}
+
+func loadValue(db *sql.DB, id string, dest interface{}) error {
+	return db.QueryRow("select", id).Scan(dest)
+}
+
+func TestEncryptedColumns(t *testing.T) {
+	db := openMemDB(t)
+	c, err := NewColumnCipher("k1", testAEAD(t, XChaCha20))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storeValue(t, db, "email", EncryptedString{String: "alice@example.com", Valid: true, Column: "users.email", Cipher: c})
+	storeValue(t, db, "token", EncryptedBytes{Bytes: []byte{1, 2, 3}, Valid: true, Column: "users.token", Cipher: c})
+	storeValue(t, db, "null", EncryptedString{Column: "users.email", Cipher: c})
+	storeValue(t, db, "empty", EncryptedString{Valid: true, Column: "users.email", Cipher: c})
+
+	memDB.mu.Lock()
+	stored, _ := memDB.rows["email"].([]byte)
+	null := memDB.rows["null"]
+	memDB.mu.Unlock()
+	if stored == nil || bytes.Contains(stored, []byte("alice")) {
+		t.Fatalf("stored value %q is not an envelope hiding the plaintext", stored)
+	}
+	if null != nil {
+		t.Fatalf("NULL stored as %v", null)
+	}
+
+	s := EncryptedString{Column: "users.email", Cipher: c}
+	if err := loadValue(db, "email", &s); err != nil || !s.Valid || s.String != "alice@example.com" {
+		t.Fatalf("email: %+v, %v", s, err)
+	}
+	b := EncryptedBytes{Column: "users.token", Cipher: c}
+	if err := loadValue(db, "token", &b); err != nil || !b.Valid || !bytes.Equal(b.Bytes, []byte{1, 2, 3}) {
+		t.Fatalf("token: %+v, %v", b, err)
+	}
+	s = EncryptedString{String: "stale", Valid: true, Column: "users.email", Cipher: c}
+	if err := loadValue(db, "null", &s); err != nil || s.Valid || s.String != "" {
+		t.Fatalf("NULL: %+v, %v", s, err)
+	}
+	if err := loadValue(db, "empty", &s); err != nil || !s.Valid || s.String != "" {
+		t.Fatalf("empty: %+v, %v", s, err)
+	}
+
+	// A value copied into another column does not open there.
+	s = EncryptedString{Column: "users.name", Cipher: c}
+	if err := loadValue(db, "email", &s); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("value read from another column: got %v, want ErrAuthFailed", err)
+	}
+}
+
+func TestEncryptedColumnsRotation(t *testing.T) {
+	db := openMemDB(t)
+	c, err := NewColumnCipher("k1", testAEAD(t, XChaCha20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeValue(t, db, "old", EncryptedString{String: "old row", Valid: true, Column: "t.c", Cipher: c})
+
+	newKey, err := NewXUnlockedForTesting(bytes.Repeat([]byte{7}, KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetPrimary("k2", newKey); err != nil {
+		t.Fatal(err)
+	}
+	storeValue(t, db, "new", EncryptedString{String: "new row", Valid: true, Column: "t.c", Cipher: c})
+
+	memDB.mu.Lock()
+	m, err := DecodeEnvelope(memDB.rows["new"].([]byte))
+	memDB.mu.Unlock()
+	if err != nil || string(m.KeyID) != "k2" {
+		t.Fatalf("new row sealed under key %q, %v", m.KeyID, err)
+	}
+	for id, want := range map[string]string{"old": "old row", "new": "new row"} {
+		s := EncryptedString{Column: "t.c", Cipher: c}
+		if err := loadValue(db, id, &s); err != nil || s.String != want {
+			t.Fatalf("%s: %q, %v", id, s.String, err)
+		}
+	}
+
+	onlyNew, err := NewColumnCipher("k2", newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := EncryptedString{Column: "t.c", Cipher: onlyNew}
+	if err := loadValue(db, "old", &s); !errors.Is(err, ErrUnknownKeyID) {
+		t.Fatalf("row under a retired key: got %v, want ErrUnknownKeyID", err)
+	}
+
+	if _, err := NewColumnCipher("k3", testAEAD(t, ChaCha20)); !errors.Is(err, ErrNonceSourceRequired) {
+		t.Fatalf("ChaCha20 column cipher: got %v, want ErrNonceSourceRequired", err)
+	}
+}
+
+func TestEncryptedColumnsDefaultCipher(t *testing.T) {
+	SetDefaultColumnCipher(nil)
+	if _, err := (EncryptedBytes{Valid: true}).Value(); !errors.Is(err, ErrNoColumnCipher) {
+		t.Fatalf("no cipher: got %v, want ErrNoColumnCipher", err)
+	}
+	// NULL needs no cipher.
+	if v, err := (EncryptedBytes{}).Value(); v != nil || err != nil {
+		t.Fatalf("NULL without a cipher: %v, %v", v, err)
+	}
+
+	c, err := NewColumnCipher("k1", testAEAD(t, XChaCha20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetDefaultColumnCipher(c)
+	defer SetDefaultColumnCipher(nil)
+
+	v, err := EncryptedBytes{Bytes: []byte("value"), Valid: true, Column: "t.c"}.Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b EncryptedBytes
+	b.Column = "t.c"
+	if err := b.Scan(v); err != nil || string(b.Bytes) != "value" {
+		t.Fatalf("Scan with the default cipher: %q, %v", b.Bytes, err)
+	}
+	if err := b.Scan(42); err == nil {
+		t.Fatal("scanned an integer")
+	}
+}
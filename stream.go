@@ -0,0 +1,368 @@
+package chacha20poly1305guard
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/awnumar/memguard"
+)
+
+var (
+	// ErrInvalidHeader is returned by DecryptStream when the stream does
+	// not start with a header it understands.
+	ErrInvalidHeader = errors.New("invalid stream header")
+
+	// ErrInvalidChunkSize is returned for a chunk size outside
+	// [MinChunkSize, MaxChunkSize] or not a multiple of ChunkAlignment.
+	ErrInvalidChunkSize = errors.New("invalid chunk size")
+)
+
+const (
+	// DefaultChunkSize is the amount of plaintext sealed in each chunk of
+	// a stream unless WithChunkSize says otherwise.
+	DefaultChunkSize = 64 << 10
+
+	// ChunkAlignment is the ChaCha20 block size. Chunk sizes must be a
+	// multiple of it so that no keystream block is split between chunks.
+	ChunkAlignment = 64
+
+	// MinChunkSize is the smallest chunk size. Below it the 16 byte tag
+	// of every chunk becomes a large part of the stream.
+	MinChunkSize = ChunkAlignment
+
+	// MaxChunkSize is the largest chunk size. Both ends of a stream hold
+	// a chunk in memory, and it bounds what a corrupt header can make
+	// DecryptStream allocate. It is far below the per-message limit of
+	// ChaCha20.
+	MaxChunkSize = 16 << 20
+)
+
+// StreamOption configures EncryptStream.
+type StreamOption func(*streamConfig)
+
+type streamConfig struct {
+	chunkSize int
+	compact   bool
+
+	// firstCounter is the counter of the first chunk. It is always zero
+	// outside of tests, which use it to reach the end of the counter.
+	firstCounter uint64
+}
+
+// WithChunkSize sets the amount of plaintext sealed in each chunk. Zero
+// selects DefaultChunkSize; other values must be a multiple of
+// ChunkAlignment between MinChunkSize and MaxChunkSize.
+func WithChunkSize(n int) StreamOption {
+	return func(c *streamConfig) {
+		c.chunkSize = n
+	}
+}
+
+// WithCompactHeader selects the compact stream format, whose header is
+// only a marker byte and the stream ID, 17 bytes instead of 22, for
+// applications that encrypt many small streams. Compact streams are not
+// self-describing: they do not record their chunk size, so DecryptStream
+// must be given this option and the same WithChunkSize as EncryptStream.
+// A compact stream passed to DecryptStream without this option, or the
+// other way around, fails with ErrInvalidHeader.
+func WithCompactHeader() StreamOption {
+	return func(c *streamConfig) {
+		c.compact = true
+	}
+}
+
+// newStreamConfig applies opts. The chunk size is left for the caller to
+// check, since DecryptStream ignores it unless the stream is compact.
+func newStreamConfig(opts []StreamOption) *streamConfig {
+	var cfg streamConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.chunkSize == 0 {
+		cfg.chunkSize = DefaultChunkSize
+	}
+	return &cfg
+}
+
+// checkChunkSize returns ErrInvalidChunkSize unless n is a valid, non
+// zero chunk size.
+func checkChunkSize(n int) error {
+	if n < MinChunkSize || n > MaxChunkSize || n%ChunkAlignment != 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidChunkSize, n)
+	}
+	return nil
+}
+
+const (
+	streamVersion    = 1
+	streamHeaderSize = 1 + 1 + 4 + 16
+
+	// compactStreamMarker is the first byte of a compact stream. It is
+	// not a valid version, so neither reader mistakes the other format
+	// for its own.
+	compactStreamMarker     = 0x80 | streamVersion
+	compactStreamHeaderSize = 1 + 16
+)
+
+// A stream starts with a header made of a version byte, the Algorithm ID
+// of XChaCha20Poly1305 as one byte, the chunk size as a little endian
+// uint32 and a random 16 byte stream ID. It is followed by chunks of
+// chunk size bytes of plaintext, each sealed with XChaCha20Poly1305
+// under the nonce stream ID || chunk counter, as SealXSplit does. Every
+// chunk but the last is full; the last one may be empty. The associated
+// data of a chunk is the header followed by one byte which is 1 for the
+// last chunk and 0 otherwise, so a stream cut at a chunk boundary, or
+// chunks moved between streams, fail to open.
+//
+// A compact stream starts with compactStreamMarker and the stream ID.
+// The chunk size, which it does not record, is added to the associated
+// data after the header, so that a reader with the wrong chunk size
+// fails to authenticate the stream.
+
+// streamAD returns the associated data of the chunks of a stream with
+// the given header, with room for the last chunk flag at the end.
+func streamAD(header []byte, cfg *streamConfig) []byte {
+	ad := append([]byte(nil), header...)
+	if cfg.compact {
+		var n [4]byte
+		binary.LittleEndian.PutUint32(n[:], uint32(cfg.chunkSize))
+		ad = append(ad, n[:]...)
+	}
+	return append(ad, 0)
+}
+
+// newStreamAEAD returns the XChaCha20Poly1305 AEAD that seals the chunks
+// of a stream.
+func newStreamAEAD(key *memguard.LockedBuffer) (AEAD, error) {
+	k, err := NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	return k.(AEAD), nil
+}
+
+// EncryptStream encrypts everything read from in to out with key, until
+// in returns io.EOF. Memory use is bounded by one chunk of plaintext and
+// one of ciphertext, whatever the size of the stream, and the plaintext
+// is only held in locked memory. Errors from in and out are returned as
+// they are; whatever was written to out by then is not a valid stream.
+func EncryptStream(key *memguard.LockedBuffer, in io.Reader, out io.Writer, opts ...StreamOption) error {
+	cfg := newStreamConfig(opts)
+	if err := checkChunkSize(cfg.chunkSize); err != nil {
+		return err
+	}
+	chunkSize := cfg.chunkSize
+
+	k, err := newStreamAEAD(key)
+	if err != nil {
+		return err
+	}
+	defer k.Close()
+
+	var streamID [16]byte
+	if _, err := io.ReadFull(rand.Reader, streamID[:]); err != nil {
+		return err
+	}
+	var header []byte
+	if cfg.compact {
+		header = append([]byte{compactStreamMarker}, streamID[:]...)
+	} else {
+		header = make([]byte, streamHeaderSize)
+		header[0] = streamVersion
+		header[1] = byte(AlgorithmXChaCha20Poly1305)
+		binary.LittleEndian.PutUint32(header[2:], uint32(chunkSize))
+		copy(header[6:], streamID[:])
+	}
+
+	if _, err := out.Write(header); err != nil {
+		return err
+	}
+
+	// The plaintext buffer holds one byte more than a chunk, which tells
+	// whether the chunk in front of it is the last one.
+	plain, err := streamUsage.track(newMutable(chunkSize + 1))
+	if err != nil {
+		return err
+	}
+	defer streamUsage.destroy(plain)
+	buf := plain.Buffer()
+
+	ad := streamAD(header, cfg)
+	sealed := make([]byte, sealedChunkSize(chunkSize))
+	nonce := splitNonce(streamID, 0)
+
+	have := 0
+	for counter := cfg.firstCounter; ; counter++ {
+		n, err := io.ReadFull(in, buf[have:])
+		have += n
+		setSplitCounter(nonce, counter)
+
+		last := false
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			last = true
+		default:
+			return err
+		}
+
+		size := chunkSize
+		if last {
+			size = have
+			ad[len(ad)-1] = 1
+		} else if counter == math.MaxUint64 {
+			// The next chunk would reuse the nonce of the first.
+			return ErrNonceExhausted
+		}
+
+		n, err = k.SealTo(sealed, nonce, buf[:size], ad)
+		if err != nil {
+			return err
+		}
+		if _, err := out.Write(sealed[:n]); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+
+		buf[0] = buf[chunkSize]
+		have = 1
+	}
+}
+
+// DecryptStream decrypts a stream written by EncryptStream from in to
+// out. Only authenticated chunks are written to out, but a stream that
+// fails part way through leaves the chunks before the failure in out,
+// so the output must be discarded whenever an error is returned. A
+// stream that was cut short fails with ErrAuthFailed. Compact streams
+// need the options described at WithCompactHeader; otherwise opts are
+// ignored, WithChunkSize included, and are not checked.
+//
+// Chunks are decrypted straight into locked memory, as Open does with
+// WithLockedScratch, so streams need no such option. The chunk buffers,
+// one locked for plaintext and one for ciphertext, are allocated once
+// per stream and reused for every chunk, so a long
+// stream costs no more memory than a short one and only a constant
+// number of allocations per chunk, for the keystream.
+func DecryptStream(key *memguard.LockedBuffer, in io.Reader, out io.Writer, opts ...StreamOption) error {
+	cfg := newStreamConfig(opts)
+	if cfg.compact {
+		if err := checkChunkSize(cfg.chunkSize); err != nil {
+			return err
+		}
+	} else {
+		// The chunk size comes from the header; WithChunkSize is
+		// ignored, even if it is invalid.
+		cfg.chunkSize = 0
+	}
+
+	k, err := newStreamAEAD(key)
+	if err != nil {
+		return err
+	}
+	defer k.Close()
+
+	header, streamID, err := readStreamHeader(in, cfg)
+	if err != nil {
+		return err
+	}
+	chunkSize := cfg.chunkSize
+
+	plain, err := streamUsage.track(newMutable(chunkSize))
+	if err != nil {
+		return err
+	}
+	defer streamUsage.destroy(plain)
+
+	ad := streamAD(header, cfg)
+	sealedSize := sealedChunkSize(chunkSize)
+	buf := make([]byte, sealedSize+1)
+	nonce := splitNonce(streamID, 0)
+
+	have := 0
+	for counter := cfg.firstCounter; ; counter++ {
+		n, err := io.ReadFull(in, buf[have:])
+		have += n
+		setSplitCounter(nonce, counter)
+
+		last := false
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			last = true
+		default:
+			return err
+		}
+
+		size := sealedSize
+		if last {
+			size = have
+			ad[len(ad)-1] = 1
+		} else if counter == math.MaxUint64 {
+			return ErrNonceExhausted
+		}
+
+		n, err = k.OpenTo(plain.Buffer(), nonce, buf[:size], ad)
+		if err != nil {
+			return fmt.Errorf("chunk %d: %w", counter, err)
+		}
+		if _, err := out.Write(plain.Buffer()[:n]); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+
+		buf[0] = buf[sealedSize]
+		have = 1
+	}
+}
+
+// readStreamHeader reads the header of a stream in the format selected
+// by cfg and returns it together with the stream ID. For streams that
+// are not compact it sets cfg.chunkSize from the header.
+func readStreamHeader(in io.Reader, cfg *streamConfig) (header []byte, streamID [16]byte, err error) {
+	size := streamHeaderSize
+	if cfg.compact {
+		size = compactStreamHeaderSize
+	}
+	header = make([]byte, size)
+	if _, err := io.ReadFull(in, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, streamID, ErrInvalidHeader
+		}
+		return nil, streamID, err
+	}
+
+	switch {
+	case cfg.compact && header[0] == compactStreamMarker:
+		copy(streamID[:], header[1:])
+		return header, streamID, nil
+	case cfg.compact:
+		return nil, streamID, fmt.Errorf("%w: not a compact stream", ErrInvalidHeader)
+	case header[0] == compactStreamMarker:
+		return nil, streamID, fmt.Errorf("%w: compact stream, which needs WithCompactHeader", ErrInvalidHeader)
+	}
+
+	if header[0] != streamVersion {
+		return nil, streamID, ErrInvalidHeader
+	}
+	info, err := LookupAlgorithm(Algorithm(header[1]))
+	if err != nil {
+		return nil, streamID, fmt.Errorf("%w: %v", ErrInvalidHeader, err)
+	}
+	if info.ID != AlgorithmXChaCha20Poly1305 {
+		return nil, streamID, fmt.Errorf("%w: streams of %s are not supported", ErrInvalidHeader, info.Name)
+	}
+	cfg.chunkSize = int(binary.LittleEndian.Uint32(header[2:]))
+	if checkChunkSize(cfg.chunkSize) != nil {
+		return nil, streamID, ErrInvalidHeader
+	}
+	copy(streamID[:], header[6:])
+	return header, streamID, nil
+}
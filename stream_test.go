@@ -0,0 +1,426 @@
+package chacha20poly1305guard
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"runtime"
+	"testing"
+	"testing/iotest"
+)
+
+// streamSizes are plaintext sizes around the chunk boundaries of a
+// stream with chunks of n bytes.
+func streamSizes(n int) []int {
+	return []int{0, 1, n - 1, n, n + 1, 3 * n, 3*n + 7}
+}
+
+// encryptStream returns the stream EncryptStream writes for plaintext.
+func encryptStream(tb testing.TB, plaintext []byte, opts ...StreamOption) []byte {
+	tb.Helper()
+	var out bytes.Buffer
+	if err := EncryptStream(testKey(tb), bytes.NewReader(plaintext), &out, opts...); err != nil {
+		tb.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+// decryptStream returns what DecryptStream writes for stream, and its
+// error.
+func decryptStream(tb testing.TB, stream []byte, opts ...StreamOption) ([]byte, error) {
+	tb.Helper()
+	var out bytes.Buffer
+	err := DecryptStream(testKey(tb), bytes.NewReader(stream), &out, opts...)
+	return out.Bytes(), err
+}
+
+// streamLen returns the length of the stream of n bytes of plaintext in
+// chunks of chunkSize: every chunk but the last is full, and a plaintext
+// which is an exact multiple of the chunk size ends in a full last chunk.
+func streamLen(headerSize, chunkSize, n int) int {
+	chunks := (n + chunkSize - 1) / chunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return headerSize + n + chunks*TagSize
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	for _, n := range streamSizes(DefaultChunkSize) {
+		plaintext := bytes.Repeat([]byte{0x5a}, n)
+		stream := encryptStream(t, plaintext)
+		if want := streamLen(streamHeaderSize, DefaultChunkSize, n); len(stream) != want {
+			t.Fatalf("%d bytes: stream is %d bytes long, want %d", n, len(stream), want)
+		}
+		got, err := decryptStream(t, stream)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", n, err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Fatalf("%d bytes: round trip changed the plaintext", n)
+		}
+	}
+}
+
+func TestStreamPipe(t *testing.T) {
+	plaintext := bytes.Repeat([]byte("pipe"), DefaultChunkSize)
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(EncryptStream(testKey(t), bytes.NewReader(plaintext), pw))
+	}()
+
+	var out bytes.Buffer
+	if err := DecryptStream(testKey(t), pr, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), plaintext) {
+		t.Fatal("round trip through a pipe changed the plaintext")
+	}
+}
+
+// TestStreamOneByteReader reads both the plaintext and the stream one
+// byte at a time, so that no read lines up with a chunk.
+func TestStreamOneByteReader(t *testing.T) {
+	plaintext := bytes.Repeat([]byte{1, 2, 3}, DefaultChunkSize/2)
+	var stream bytes.Buffer
+	if err := EncryptStream(testKey(t), iotest.OneByteReader(bytes.NewReader(plaintext)), &stream); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := DecryptStream(testKey(t), iotest.OneByteReader(&stream), &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), plaintext) {
+		t.Fatal("round trip changed the plaintext")
+	}
+}
+
+// errWriter fails every write.
+type errWriter struct{ err error }
+
+func (w errWriter) Write([]byte) (int, error) { return 0, w.err }
+
+func TestStreamIOErrors(t *testing.T) {
+	ioErr := errors.New("i/o failed")
+	plaintext := make([]byte, 3*DefaultChunkSize)
+	stream := encryptStream(t, plaintext)
+
+	// A reader which fails after two chunks.
+	failing := io.MultiReader(bytes.NewReader(plaintext[:2*DefaultChunkSize]), iotest.ErrReader(ioErr))
+	if err := EncryptStream(testKey(t), failing, io.Discard); err != ioErr {
+		t.Fatalf("EncryptStream with a failing reader: got %v, want the read error", err)
+	}
+	failing = io.MultiReader(bytes.NewReader(stream[:len(stream)/2]), iotest.ErrReader(ioErr))
+	if err := DecryptStream(testKey(t), failing, io.Discard); err != ioErr {
+		t.Fatalf("DecryptStream with a failing reader: got %v, want the read error", err)
+	}
+
+	if err := EncryptStream(testKey(t), bytes.NewReader(plaintext), errWriter{ioErr}); err != ioErr {
+		t.Fatalf("EncryptStream with a failing writer: got %v, want the write error", err)
+	}
+	if err := DecryptStream(testKey(t), bytes.NewReader(stream), errWriter{ioErr}); err != ioErr {
+		t.Fatalf("DecryptStream with a failing writer: got %v, want the write error", err)
+	}
+}
+
+func TestStreamTampered(t *testing.T) {
+	const chunk = DefaultChunkSize + TagSize
+	stream := encryptStream(t, make([]byte, 3*DefaultChunkSize))
+	header, chunks := stream[:streamHeaderSize], stream[streamHeaderSize:]
+
+	swapped := append(append([]byte(nil), header...), chunks[chunk:2*chunk]...)
+	swapped = append(swapped, chunks[:chunk]...)
+	swapped = append(swapped, chunks[2*chunk:]...)
+
+	other := encryptStream(t, make([]byte, 3*DefaultChunkSize))
+
+	for _, tc := range []struct {
+		name   string
+		stream []byte
+	}{
+		{"empty", nil},
+		{"truncated header", stream[:streamHeaderSize-1]},
+		{"header only", header},
+		{"truncated at a chunk boundary", stream[:streamHeaderSize+2*chunk]},
+		{"truncated inside a chunk", stream[:len(stream)-1]},
+		{"reordered chunks", swapped},
+		{"chunk from another stream", append(append([]byte(nil), other[:len(other)-chunk]...), stream[len(stream)-chunk:]...)},
+		{"trailing data", append(append([]byte(nil), stream...), 0)},
+	} {
+		if _, err := decryptStream(t, tc.stream); err == nil {
+			t.Fatalf("%s: stream opened", tc.name)
+		}
+	}
+
+	for _, off := range []int{0, 1, 2, 5, 6, streamHeaderSize - 1, streamHeaderSize, len(stream) - 1} {
+		tampered := append([]byte(nil), stream...)
+		tampered[off] ^= 0x80
+		if _, err := decryptStream(t, tampered); err == nil {
+			t.Fatalf("bit flip at offset %d: stream opened", off)
+		}
+	}
+}
+
+// sealStream builds a stream in the format of EncryptStream, with the
+// last chunk flag of every chunk given by last.
+func sealStream(tb testing.TB, chunks [][]byte, last []bool) []byte {
+	tb.Helper()
+	k, err := newStreamAEAD(testKey(tb))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer k.Close()
+
+	var streamID [16]byte
+	copy(streamID[:], "stream ID bytes!")
+	header := make([]byte, streamHeaderSize)
+	header[0] = streamVersion
+	header[1] = byte(AlgorithmXChaCha20Poly1305)
+	binary.LittleEndian.PutUint32(header[2:], DefaultChunkSize)
+	copy(header[6:], streamID[:])
+
+	stream := append([]byte(nil), header...)
+	for i, c := range chunks {
+		ad := append(append([]byte(nil), header...), 0)
+		if last[i] {
+			ad[len(ad)-1] = 1
+		}
+		stream = k.SealXSplit(stream, streamID, uint64(i), c, ad)
+	}
+	return stream
+}
+
+func TestStreamLastChunkFlag(t *testing.T) {
+	full := make([]byte, DefaultChunkSize)
+	chunks := [][]byte{full, full, []byte("end")}
+
+	if _, err := decryptStream(t, sealStream(t, chunks, []bool{false, false, true})); err != nil {
+		t.Fatalf("stream sealed like EncryptStream does: %v", err)
+	}
+	for _, last := range [][]bool{
+		{false, false, false},
+		{false, true, true},
+		{true, false, true},
+	} {
+		if _, err := decryptStream(t, sealStream(t, chunks, last)); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("last chunk flags %v: got %v, want ErrAuthFailed", last, err)
+		}
+	}
+}
+
+func TestChunkSize(t *testing.T) {
+	for _, tc := range []struct {
+		n     int
+		valid bool
+	}{
+		{MinChunkSize, true},
+		{4 * ChunkAlignment, true},
+		{DefaultChunkSize, true},
+		{MaxChunkSize, true},
+		{0, false},
+		{-ChunkAlignment, false},
+		{1, false},
+		{MinChunkSize - ChunkAlignment/2, false},
+		{MinChunkSize + 1, false},
+		{3*ChunkAlignment - 1, false},
+		{MaxChunkSize + ChunkAlignment, false},
+		{MaxChunkSize + 1, false},
+	} {
+		if err := checkChunkSize(tc.n); (err == nil) != tc.valid || err != nil && !errors.Is(err, ErrInvalidChunkSize) {
+			t.Fatalf("checkChunkSize(%d) = %v, valid %v", tc.n, err, tc.valid)
+		}
+		if tc.n == 0 || tc.n == MaxChunkSize {
+			// Covered below, and too slow to round trip.
+			continue
+		}
+
+		var out bytes.Buffer
+		err := EncryptStream(testKey(t), bytes.NewReader(make([]byte, 1000)), &out, WithChunkSize(tc.n))
+		if !tc.valid {
+			if !errors.Is(err, ErrInvalidChunkSize) || out.Len() != 0 {
+				t.Fatalf("chunk size %d: got %v and %d bytes written, want ErrInvalidChunkSize and nothing", tc.n, err, out.Len())
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("chunk size %d: %v", tc.n, err)
+		}
+		if want := streamLen(streamHeaderSize, tc.n, 1000); out.Len() != want {
+			t.Fatalf("chunk size %d: stream is %d bytes long, want %d", tc.n, out.Len(), want)
+		}
+		if got, err := decryptStream(t, out.Bytes()); err != nil || len(got) != 1000 {
+			t.Fatalf("chunk size %d: %d bytes, %v", tc.n, len(got), err)
+		}
+	}
+
+	// Zero selects DefaultChunkSize.
+	stream := encryptStream(t, nil, WithChunkSize(0))
+	if got := binary.LittleEndian.Uint32(stream[2:]); got != DefaultChunkSize {
+		t.Fatalf("WithChunkSize(0) writes a chunk size of %d, want %d", got, DefaultChunkSize)
+	}
+}
+
+func TestStreamHeaderChunkSize(t *testing.T) {
+	stream := encryptStream(t, []byte("plaintext"), WithChunkSize(MinChunkSize))
+	for _, n := range []uint32{0, 1, MinChunkSize - 1, MinChunkSize + 1, MaxChunkSize + ChunkAlignment, 1<<32 - 1} {
+		tampered := append([]byte(nil), stream...)
+		binary.LittleEndian.PutUint32(tampered[2:], n)
+		if _, err := decryptStream(t, tampered); !errors.Is(err, ErrInvalidHeader) {
+			t.Fatalf("chunk size %d in the header: got %v, want ErrInvalidHeader", n, err)
+		}
+	}
+
+	// The header, not WithChunkSize, gives the chunk size of a stream
+	// that is not compact, so an invalid option does not matter.
+	if got, err := decryptStream(t, stream, WithChunkSize(-1)); err != nil || string(got) != "plaintext" {
+		t.Fatalf("with an ignored WithChunkSize: %q, %v", got, err)
+	}
+}
+
+func TestStreamCompact(t *testing.T) {
+	compact := []StreamOption{WithCompactHeader(), WithChunkSize(MinChunkSize)}
+	for _, n := range streamSizes(MinChunkSize) {
+		plaintext := bytes.Repeat([]byte{0xc3}, n)
+		stream := encryptStream(t, plaintext, compact...)
+		if want := streamLen(compactStreamHeaderSize, MinChunkSize, n); len(stream) != want {
+			t.Fatalf("%d bytes: compact stream is %d bytes long, want %d", n, len(stream), want)
+		}
+		got, err := decryptStream(t, stream, compact...)
+		if err != nil || !bytes.Equal(got, plaintext) {
+			t.Fatalf("%d bytes: round trip gave %d bytes, %v", n, len(got), err)
+		}
+	}
+
+	stream := encryptStream(t, []byte("plaintext"), compact...)
+	if _, err := decryptStream(t, stream); !errors.Is(err, ErrInvalidHeader) {
+		t.Fatalf("compact stream read without WithCompactHeader: got %v, want ErrInvalidHeader", err)
+	}
+	if _, err := decryptStream(t, encryptStream(t, []byte("plaintext")), WithCompactHeader()); !errors.Is(err, ErrInvalidHeader) {
+		t.Fatalf("standard stream read with WithCompactHeader: got %v, want ErrInvalidHeader", err)
+	}
+	if _, err := decryptStream(t, stream, WithCompactHeader(), WithChunkSize(2*MinChunkSize)); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("compact stream read with the wrong chunk size: got %v, want ErrAuthFailed", err)
+	}
+	if _, err := decryptStream(t, stream, WithCompactHeader(), WithChunkSize(MinChunkSize+1)); !errors.Is(err, ErrInvalidChunkSize) {
+		t.Fatalf("compact stream read with an invalid chunk size: got %v, want ErrInvalidChunkSize", err)
+	}
+}
+
+// TestStreamCounterExhausted starts a stream two chunks before the end
+// of the chunk counter: two chunks fit, a third would reuse the nonce of
+// the first chunk and must fail instead.
+func TestStreamCounterExhausted(t *testing.T) {
+	nearEnd := func(c *streamConfig) { c.firstCounter = math.MaxUint64 - 1 }
+	opts := []StreamOption{WithChunkSize(MinChunkSize), nearEnd}
+
+	for _, n := range []int{MinChunkSize + 1, 2 * MinChunkSize} {
+		plaintext := bytes.Repeat([]byte{0x3c}, n)
+		stream := encryptStream(t, plaintext, opts...)
+		if got, err := decryptStream(t, stream, nearEnd); err != nil || !bytes.Equal(got, plaintext) {
+			t.Fatalf("%d bytes: round trip gave %d bytes, %v", n, len(got), err)
+		}
+		// The counter is part of the nonce.
+		if _, err := decryptStream(t, stream); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("%d bytes read from counter zero: got %v, want ErrAuthFailed", n, err)
+		}
+	}
+
+	var out bytes.Buffer
+	in := bytes.NewReader(make([]byte, 2*MinChunkSize+1))
+	if err := EncryptStream(testKey(t), in, &out, opts...); err != ErrNonceExhausted {
+		t.Fatalf("third chunk: got %v, want ErrNonceExhausted", err)
+	}
+	if want := streamHeaderSize + sealedChunkSize(MinChunkSize); out.Len() != want {
+		t.Fatalf("wrote %d bytes before failing, want the header and one chunk, %d", out.Len(), want)
+	}
+}
+
+// TestStreamStats checks that the chunk buffers of a stream are released
+// when it ends, whether it succeeds or fails.
+func TestStreamStats(t *testing.T) {
+	before := settledStats().Streams
+	stream := encryptStream(t, make([]byte, 2*DefaultChunkSize+1))
+	if _, err := decryptStream(t, stream); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decryptStream(t, stream[:len(stream)-1]); err == nil {
+		t.Fatal("truncated stream opened")
+	}
+	failing := io.MultiReader(bytes.NewReader(make([]byte, DefaultChunkSize+1)), iotest.ErrReader(errors.New("read failed")))
+	if err := EncryptStream(testKey(t), failing, io.Discard); err == nil {
+		t.Fatal("EncryptStream ignored a read error")
+	}
+
+	after := Stats().Streams
+	if after.Buffers != before.Buffers || after.Bytes != before.Bytes {
+		t.Fatalf("stream buffers: %+v after, %+v before", after, before)
+	}
+	if after.PeakBuffers < 1 {
+		t.Fatalf("peak stream buffers = %d, want at least 1", after.PeakBuffers)
+	}
+}
+
+// TestDecryptStreamAllocs checks that DecryptStream reuses its chunk
+// buffers: what it allocates per chunk does not grow with the chunk.
+func TestDecryptStreamAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocation counts are not meaningful under the race detector")
+	}
+	const chunks = 64
+	stream := encryptStream(t, make([]byte, chunks*DefaultChunkSize))
+	key := testKey(t)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	if err := DecryptStream(key, bytes.NewReader(stream), io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	runtime.ReadMemStats(&after)
+
+	perChunk := (after.TotalAlloc - before.TotalAlloc) / chunks
+	if perChunk > DefaultChunkSize/16 {
+		t.Fatalf("DecryptStream allocates %d bytes per chunk of %d", perChunk, DefaultChunkSize)
+	}
+	if allocs := (after.Mallocs - before.Mallocs) / chunks; allocs > 8 {
+		t.Fatalf("DecryptStream allocates %d times per chunk", allocs)
+	}
+}
+
+// BenchmarkDecryptStream decrypts a 100 MB stream and reports the
+// allocations per chunk, which must stay constant as the stream grows.
+func BenchmarkDecryptStream(b *testing.B) {
+	const size = 100 << 20
+	var stream bytes.Buffer
+	if err := EncryptStream(testKey(b), io.LimitReader(zeroReader{}, size), &stream); err != nil {
+		b.Fatal(err)
+	}
+	key := testKey(b)
+	chunks := float64(size / DefaultChunkSize)
+
+	b.SetBytes(size)
+	b.ReportAllocs()
+	b.ResetTimer()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for i := 0; i < b.N; i++ {
+		if err := DecryptStream(key, bytes.NewReader(stream.Bytes()), io.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.Mallocs-before.Mallocs)/float64(b.N)/chunks, "allocs/chunk")
+}
+
+// zeroReader reads an endless stream of zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
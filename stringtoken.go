@@ -0,0 +1,138 @@
+package chacha20poly1305guard
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	// ErrInvalidToken is returned by DecryptString when its input is not
+	// a well formed token.
+	ErrInvalidToken = errors.New("invalid token")
+
+	// ErrTooLarge is returned when an input exceeds a size limit.
+	ErrTooLarge = errors.New("input too large")
+
+	// ErrNonceSourceRequired is returned by EncryptString for an AEAD
+	// whose nonces are too short to be picked at random.
+	ErrNonceSourceRequired = errors.New("a nonce source is required for this AEAD")
+)
+
+// MaxStringSize is the largest plaintext EncryptString accepts.
+const MaxStringSize = 1 << 20
+
+// tokenVersion is the first byte of every token written by
+// EncryptString.
+const tokenVersion = 1
+
+// StringOption configures EncryptString.
+type StringOption func(*stringConfig)
+
+type stringConfig struct {
+	nonce func() ([]byte, error)
+}
+
+// WithNonceSource makes EncryptString take nonces from fn instead of
+// generating random ones. It is required for ChaCha20Poly1305, whose 8
+// byte nonces are too short to be safely chosen at random; fn should
+// return a counter or similar that never repeats under one key.
+func WithNonceSource(fn func() ([]byte, error)) StringOption {
+	return func(c *stringConfig) {
+		c.nonce = fn
+	}
+}
+
+// EncryptString seals plaintext and returns it as a single unpadded
+// base64url token holding a version byte, the nonce and the ciphertext.
+// The version byte is authenticated along with aad. By default the nonce
+// is random, which is only allowed for XChaCha20Poly1305; other AEADs
+// fail with ErrNonceSourceRequired unless WithNonceSource is given.
+// Plaintexts longer than MaxStringSize fail with ErrTooLarge.
+func EncryptString(aead cipher.AEAD, plaintext string, aad []byte, opts ...StringOption) (string, error) {
+	if len(plaintext) > MaxStringSize {
+		return "", ErrTooLarge
+	}
+
+	var cfg stringConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	p := []byte(plaintext)
+	defer wipe(p)
+
+	return encryptToken(aead, p, aad, &cfg)
+}
+
+func encryptToken(aead cipher.AEAD, p, aad []byte, cfg *stringConfig) (string, error) {
+	if len(p) > MaxStringSize {
+		return "", ErrTooLarge
+	}
+
+	var nonce []byte
+	if cfg.nonce != nil {
+		var err error
+		if nonce, err = cfg.nonce(); err != nil {
+			return "", err
+		}
+	} else {
+		if aead.NonceSize() < XNonceSize {
+			return "", ErrNonceSourceRequired
+		}
+		nonce = make([]byte, aead.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return "", err
+		}
+	}
+	if len(nonce) != aead.NonceSize() {
+		return "", &NonceError{Want: aead.NonceSize(), Got: len(nonce)}
+	}
+
+	out := make([]byte, 0, 1+len(nonce)+len(p)+aead.Overhead())
+	out = append(out, tokenVersion)
+	out = append(out, nonce...)
+	out = aead.Seal(out, nonce, p, tokenAAD(aad))
+
+	return base64.RawURLEncoding.EncodeToString(out), nil
+}
+
+// DecryptString opens a token written by EncryptString. Malformed tokens
+// fail with ErrInvalidToken, tokens of another version with
+// ErrUnsupportedVersion and forged or damaged ones with ErrAuthFailed.
+func DecryptString(aead cipher.AEAD, token string, aad []byte) (string, error) {
+	p, err := decryptToken(aead, token, aad)
+	if err != nil {
+		return "", err
+	}
+	defer wipe(p)
+
+	return string(p), nil
+}
+
+func decryptToken(aead cipher.AEAD, token string, aad []byte) ([]byte, error) {
+	if base64.RawURLEncoding.DecodedLen(len(token)) > 1+aead.NonceSize()+MaxStringSize+aead.Overhead() {
+		return nil, ErrTooLarge
+	}
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if len(b) < 1+aead.NonceSize()+aead.Overhead() {
+		return nil, ErrInvalidToken
+	}
+	if b[0] != tokenVersion {
+		return nil, ErrUnsupportedVersion
+	}
+
+	nonce, ciphertext := b[1:1+aead.NonceSize()], b[1+aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, tokenAAD(aad))
+}
+
+// tokenAAD binds the token version to the caller's associated data.
+func tokenAAD(aad []byte) []byte {
+	return append([]byte{tokenVersion}, aad...)
+}
@@ -0,0 +1,113 @@
+package chacha20poly1305guard
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestEncryptString(t *testing.T) {
+	aead := testAEAD(t, XChaCha20)
+	token, err := EncryptString(aead, "secret value", []byte("users.email"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.ContainsAny(token, "+/=") {
+		t.Fatalf("%q is not unpadded base64url", token)
+	}
+	if got, err := DecryptString(aead, token, []byte("users.email")); err != nil || got != "secret value" {
+		t.Fatalf("DecryptString = %q, %v", got, err)
+	}
+	if again, _ := EncryptString(aead, "secret value", []byte("users.email")); again == token {
+		t.Fatal("two tokens share a nonce")
+	}
+	if got, err := DecryptString(aead, mustEncryptString(t, aead, ""), nil); err != nil || got != "" {
+		t.Fatalf("empty string: %q, %v", got, err)
+	}
+}
+
+func mustEncryptString(tb testing.TB, aead AEAD, s string) string {
+	tb.Helper()
+	token, err := EncryptString(aead, s, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return token
+}
+
+func TestDecryptStringErrors(t *testing.T) {
+	aead := testAEAD(t, XChaCha20)
+	token := mustEncryptString(t, aead, "secret value")
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	flipped := append([]byte(nil), raw...)
+	flipped[len(flipped)-1] ^= 1
+	version := append([]byte{tokenVersion + 1}, raw[1:]...)
+
+	for _, tc := range []struct {
+		name  string
+		token string
+		aad   []byte
+		want  error
+	}{
+		{"not base64", token[:10] + "*" + token[11:], nil, ErrInvalidToken},
+		{"padded", token + "=", nil, ErrInvalidToken},
+		{"too short", encode(raw[:1+XNonceSize+TagSize-1]), nil, ErrInvalidToken},
+		{"empty", "", nil, ErrInvalidToken},
+		{"other version", encode(version), nil, ErrUnsupportedVersion},
+		{"tampered", encode(flipped), nil, ErrAuthFailed},
+		{"other associated data", token, []byte("other"), ErrAuthFailed},
+		{"too large", strings.Repeat("A", base64.RawURLEncoding.EncodedLen(2*MaxStringSize)), nil, ErrTooLarge},
+	} {
+		_, err := DecryptString(aead, tc.token, tc.aad)
+		if !errors.Is(err, tc.want) {
+			t.Fatalf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+		// The three kinds of failure are told apart.
+		for _, other := range []error{ErrInvalidToken, ErrUnsupportedVersion, ErrAuthFailed} {
+			if other != tc.want && errors.Is(err, other) {
+				t.Fatalf("%s: %v also matches %v", tc.name, err, other)
+			}
+		}
+	}
+
+	if _, err := EncryptString(aead, strings.Repeat("x", MaxStringSize+1), nil); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("oversized plaintext: got %v, want ErrTooLarge", err)
+	}
+}
+
+func TestEncryptStringNonceSource(t *testing.T) {
+	aead := testAEAD(t, ChaCha20)
+	if _, err := EncryptString(aead, "value", nil); !errors.Is(err, ErrNonceSourceRequired) {
+		t.Fatalf("ChaCha20 with random nonces: got %v, want ErrNonceSourceRequired", err)
+	}
+
+	var counter uint64
+	next := func() ([]byte, error) {
+		counter++
+		nonce := make([]byte, NonceSize)
+		binary.LittleEndian.PutUint64(nonce, counter)
+		return nonce, nil
+	}
+	token, err := EncryptString(aead, "value", nil, WithNonceSource(next))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := DecryptString(aead, token, nil); err != nil || got != "value" {
+		t.Fatalf("DecryptString = %q, %v", got, err)
+	}
+
+	short := func() ([]byte, error) { return make([]byte, NonceSize-1), nil }
+	if _, err := EncryptString(aead, "value", nil, WithNonceSource(short)); !errors.Is(err, ErrInvalidNonce) {
+		t.Fatalf("short nonce from the source: got %v, want ErrInvalidNonce", err)
+	}
+	failed := errors.New("no nonce")
+	if _, err := EncryptString(aead, "value", nil, WithNonceSource(func() ([]byte, error) { return nil, failed })); err != failed {
+		t.Fatalf("failing source: got %v, want its error", err)
+	}
+}
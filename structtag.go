@@ -0,0 +1,200 @@
+package chacha20poly1305guard
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+var (
+	// ErrNotStructPointer is returned by EncryptStruct and DecryptStruct
+	// when they are not given a non-nil pointer to a struct.
+	ErrNotStructPointer = errors.New("value is not a pointer to a struct")
+
+	// ErrUnexportedField is returned for a field tagged guard:"encrypt"
+	// that is not exported and so cannot be set.
+	ErrUnexportedField = errors.New("tagged field is unexported")
+
+	// ErrUnsupportedFieldType is returned for a field tagged
+	// guard:"encrypt" that is neither a string nor a []byte.
+	ErrUnsupportedFieldType = errors.New("tagged field is not a string or []byte")
+
+	// ErrNotEncrypted is returned by DecryptStruct for a tagged field that
+	// does not hold a value written by EncryptStruct.
+	ErrNotEncrypted = errors.New("tagged field is not encrypted")
+)
+
+// encryptedStringPrefix marks string fields encrypted by EncryptStruct.
+// The rest of the string is the envelope in unpadded base64url.
+const encryptedStringPrefix = "c2pg:"
+
+// EncryptStruct encrypts, in place, every field of the struct v points to
+// that is tagged `guard:"encrypt"`. Tagged fields must be exported
+// strings or []byte; untagged structs, pointers to structs, slices and
+// arrays are searched for tagged fields too.
+//
+// Each field is replaced by an envelope sealed under a random nonce, so
+// aead must be XChaCha20Poly1305. A string field holds "c2pg:" followed
+// by the envelope in base64url, a []byte field the envelope itself, so
+// the struct still round-trips through encoding/json. The path of the
+// field, such as "DB.Replicas[1].Password", is authenticated with it:
+// a value moved to another field, or a slice element moved to another
+// index, no longer decrypts. Fields that are already encrypted are left
+// alone, so calling EncryptStruct twice is harmless.
+func EncryptStruct(aead cipher.AEAD, v interface{}) error {
+	if aead.NonceSize() != XNonceSize {
+		return ErrNonceSourceRequired
+	}
+
+	return walkTagged(v, func(path string, f reflect.Value) error {
+		ad := []byte(path)
+
+		switch f.Kind() {
+		case reflect.String:
+			if _, ok := decodeEncryptedString(f.String()); ok {
+				return nil
+			}
+			p := []byte(f.String())
+			defer wipe(p)
+			env, err := sealField(aead, p, ad)
+			if err != nil {
+				return err
+			}
+			f.SetString(encryptedStringPrefix + base64.RawURLEncoding.EncodeToString(env))
+
+		default:
+			if _, err := DecodeEnvelope(f.Bytes()); err == nil {
+				return nil
+			}
+			env, err := sealField(aead, f.Bytes(), ad)
+			if err != nil {
+				return err
+			}
+			f.SetBytes(env)
+		}
+		return nil
+	})
+}
+
+// DecryptStruct reverses EncryptStruct in place. Every tagged field must
+// hold a value written by EncryptStruct for the same path; a plaintext
+// value fails with ErrNotEncrypted rather than being accepted as is.
+func DecryptStruct(aead cipher.AEAD, v interface{}) error {
+	return walkTagged(v, func(path string, f reflect.Value) error {
+		ad := []byte(path)
+
+		switch f.Kind() {
+		case reflect.String:
+			env, ok := decodeEncryptedString(f.String())
+			if !ok {
+				return fmt.Errorf("%w: %s", ErrNotEncrypted, path)
+			}
+			p, err := OpenEnvelope(aead, env, ad)
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			f.SetString(string(p))
+			wipe(p)
+
+		default:
+			if _, err := DecodeEnvelope(f.Bytes()); err != nil {
+				return fmt.Errorf("%w: %s", ErrNotEncrypted, path)
+			}
+			p, err := OpenEnvelope(aead, f.Bytes(), ad)
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			f.SetBytes(p)
+		}
+		return nil
+	})
+}
+
+func sealField(aead cipher.AEAD, plaintext, ad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return SealEnvelope(aead, nonce, plaintext, ad, nil)
+}
+
+// decodeEncryptedString returns the envelope held by a string field
+// encrypted by EncryptStruct.
+func decodeEncryptedString(s string) ([]byte, bool) {
+	if !strings.HasPrefix(s, encryptedStringPrefix) {
+		return nil, false
+	}
+	env, err := base64.RawURLEncoding.DecodeString(s[len(encryptedStringPrefix):])
+	if err != nil {
+		return nil, false
+	}
+	if _, err := DecodeEnvelope(env); err != nil {
+		return nil, false
+	}
+	return env, true
+}
+
+// walkTagged calls fn for every field tagged guard:"encrypt" in the
+// struct v points to.
+func walkTagged(v interface{}, fn func(path string, f reflect.Value) error) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return ErrNotStructPointer
+	}
+	return walkValue(rv.Elem(), "", fn)
+}
+
+func walkValue(v reflect.Value, path string, fn func(path string, f reflect.Value) error) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return walkValue(v.Elem(), path, fn)
+		}
+
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return nil
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := walkValue(v.Index(i), fmt.Sprintf("%s[%d]", path, i), fn); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			p := sf.Name
+			if path != "" {
+				p = path + "." + sf.Name
+			}
+
+			if sf.Tag.Get("guard") != "encrypt" {
+				if sf.PkgPath == "" {
+					if err := walkValue(v.Field(i), p, fn); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+
+			if sf.PkgPath != "" {
+				return fmt.Errorf("%w: %s", ErrUnexportedField, p)
+			}
+			f := v.Field(i)
+			if f.Kind() != reflect.String && !(f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.Uint8) {
+				return fmt.Errorf("%w: %s", ErrUnsupportedFieldType, p)
+			}
+			if err := fn(p, f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package chacha20poly1305guard
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+type taggedReplica struct {
+	Host     string
+	Password string `guard:"encrypt"`
+}
+
+type taggedConfig struct {
+	Name     string
+	Password string `guard:"encrypt"`
+	Token    []byte `guard:"encrypt"`
+	DB       struct {
+		Primary  *taggedReplica
+		Replicas []taggedReplica
+	}
+}
+
+func newTaggedConfig() *taggedConfig {
+	c := &taggedConfig{Name: "app", Password: "hunter2", Token: []byte{1, 2, 3}}
+	c.DB.Primary = &taggedReplica{Host: "db0", Password: "p0"}
+	c.DB.Replicas = []taggedReplica{{Host: "db1", Password: "p1"}, {Host: "db2", Password: "p2"}}
+	return c
+}
+
+func TestEncryptStruct(t *testing.T) {
+	aead := testAEAD(t, XChaCha20)
+	c := newTaggedConfig()
+	if err := EncryptStruct(aead, c); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Name != "app" || c.DB.Primary.Host != "db0" || c.DB.Replicas[1].Host != "db2" {
+		t.Fatalf("untagged fields changed: %+v", c)
+	}
+	for _, s := range []string{c.Password, c.DB.Primary.Password, c.DB.Replicas[0].Password, c.DB.Replicas[1].Password} {
+		if !strings.HasPrefix(s, encryptedStringPrefix) {
+			t.Fatalf("tagged field not encrypted: %q", s)
+		}
+	}
+	if _, err := DecodeEnvelope(c.Token); err != nil {
+		t.Fatalf("[]byte field does not hold an envelope: %v", err)
+	}
+
+	// Encrypting twice leaves the fields as they are.
+	password, token := c.Password, string(c.Token)
+	if err := EncryptStruct(aead, c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Password != password || string(c.Token) != token {
+		t.Fatal("second EncryptStruct encrypted the fields again")
+	}
+
+	// The encrypted struct survives encoding/json.
+	j, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d taggedConfig
+	if err := json.Unmarshal(j, &d); err != nil {
+		t.Fatal(err)
+	}
+	if err := DecryptStruct(aead, &d); err != nil {
+		t.Fatal(err)
+	}
+	want := newTaggedConfig()
+	if d.Password != want.Password || string(d.Token) != string(want.Token) ||
+		d.DB.Primary.Password != want.DB.Primary.Password ||
+		d.DB.Replicas[0].Password != want.DB.Replicas[0].Password ||
+		d.DB.Replicas[1].Password != want.DB.Replicas[1].Password {
+		t.Fatalf("round trip: got %+v", d)
+	}
+}
+
+func TestEncryptStructPathBinding(t *testing.T) {
+	aead := testAEAD(t, XChaCha20)
+
+	// A slice element moved to another index does not decrypt.
+	c := newTaggedConfig()
+	if err := EncryptStruct(aead, c); err != nil {
+		t.Fatal(err)
+	}
+	c.DB.Replicas[0], c.DB.Replicas[1] = c.DB.Replicas[1], c.DB.Replicas[0]
+	if err := DecryptStruct(aead, c); !errors.Is(err, ErrAuthFailed) || !strings.Contains(err.Error(), "DB.Replicas[0].Password") {
+		t.Fatalf("swapped replicas: got %v, want ErrAuthFailed naming the path", err)
+	}
+
+	// Nor does a value moved to another field.
+	c = newTaggedConfig()
+	if err := EncryptStruct(aead, c); err != nil {
+		t.Fatal(err)
+	}
+	c.DB.Primary.Password = c.Password
+	if err := DecryptStruct(aead, c); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("moved field: got %v, want ErrAuthFailed", err)
+	}
+
+	// A plaintext value is not accepted as is.
+	c = newTaggedConfig()
+	if err := DecryptStruct(aead, c); !errors.Is(err, ErrNotEncrypted) {
+		t.Fatalf("plaintext struct: got %v, want ErrNotEncrypted", err)
+	}
+}
+
+func TestEncryptStructRejected(t *testing.T) {
+	aead := testAEAD(t, XChaCha20)
+
+	type unexported struct {
+		secret string `guard:"encrypt"`
+	}
+	type unsupported struct {
+		PIN int `guard:"encrypt"`
+	}
+	type nested struct {
+		Inner []unsupported
+	}
+
+	for _, tc := range []struct {
+		name string
+		v    interface{}
+		want error
+	}{
+		{"struct value", taggedConfig{}, ErrNotStructPointer},
+		{"nil pointer", (*taggedConfig)(nil), ErrNotStructPointer},
+		{"pointer to string", new(string), ErrNotStructPointer},
+		{"unexported field", &unexported{secret: "s"}, ErrUnexportedField},
+		{"int field", &unsupported{PIN: 1234}, ErrUnsupportedFieldType},
+		{"nested int field", &nested{Inner: []unsupported{{PIN: 1}}}, ErrUnsupportedFieldType},
+	} {
+		if err := EncryptStruct(aead, tc.v); !errors.Is(err, tc.want) {
+			t.Errorf("EncryptStruct %s: got %v, want %v", tc.name, err, tc.want)
+		}
+		if err := DecryptStruct(aead, tc.v); !errors.Is(err, tc.want) {
+			t.Errorf("DecryptStruct %s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+
+	if err := EncryptStruct(testAEAD(t, ChaCha20), newTaggedConfig()); !errors.Is(err, ErrNonceSourceRequired) {
+		t.Fatalf("ChaCha20: got %v, want ErrNonceSourceRequired", err)
+	}
+}
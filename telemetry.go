@@ -0,0 +1,36 @@
+package chacha20poly1305guard
+
+import (
+	"crypto/cipher"
+
+	"github.com/awnumar/memguard"
+)
+
+// TelemetryTagSize is the length of the tag used by NewTelemetry.
+const TelemetryTagSize = 8
+
+// NewTelemetry returns an XChaCha20Poly1305 AEAD whose tag is truncated
+// to TelemetryTagSize bytes, for small, high volume messages such as UDP
+// telemetry where a 16 byte tag is a large share of every packet. The
+// 192 bit nonce means nonces can be chosen at random.
+//
+// Security caveat: a truncated tag gives much weaker authentication. Each
+// forgery attempt succeeds with probability of about 2^-64 instead of
+// about 2^-128 (somewhat more for long messages), so an attacker who can
+// submit n forged packets succeeds with probability of about n*2^-64.
+// That is acceptable for non-critical, short lived data that is cheap
+// to drop, and nothing else: do not use it for data whose integrity
+// matters, for stored data, or anywhere an attacker can try forgeries
+// without limit. Confidentiality is the same as with NewX.
+//
+// The ciphertexts are not compatible with any other AEAD in this
+// package, and the AEAD cannot be used with envelopes.
+func NewTelemetry(key *memguard.LockedBuffer, opts ...Option) (cipher.AEAD, error) {
+	k, err := newAEAD(key, XChaCha20, opts)
+	if err != nil {
+		return nil, err
+	}
+	k.tagSize = TelemetryTagSize
+
+	return k, nil
+}
@@ -0,0 +1,71 @@
+package chacha20poly1305guard
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestTelemetry(t *testing.T) {
+	aead, err := NewTelemetry(testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aead.(AEAD).Close()
+	if aead.NonceSize() != XNonceSize || aead.Overhead() != TelemetryTagSize {
+		t.Fatalf("nonce size %d and overhead %d", aead.NonceSize(), aead.Overhead())
+	}
+
+	nonce := bytes.Repeat([]byte{1}, XNonceSize)
+	plaintext := []byte("cpu=0.93 mem=0.41")
+	sealed := aead.Seal(nil, nonce, plaintext, []byte("host-1"))
+	if len(sealed) != len(plaintext)+TelemetryTagSize {
+		t.Fatalf("sealed %d bytes, want %d", len(sealed), len(plaintext)+TelemetryTagSize)
+	}
+	// The encryption is that of NewX; only the tag is shorter.
+	full := testAEAD(t, XChaCha20).Seal(nil, nonce, plaintext, []byte("host-1"))
+	if !bytes.Equal(sealed[:len(plaintext)], full[:len(plaintext)]) {
+		t.Fatal("ciphertext differs from NewX")
+	}
+
+	if got, err := aead.Open(nil, nonce, sealed, []byte("host-1")); err != nil || !bytes.Equal(got, plaintext) {
+		t.Fatalf("open: %q, %v", got, err)
+	}
+	for i := range sealed {
+		forged := append([]byte(nil), sealed...)
+		forged[i] ^= 0x80
+		if _, err := aead.Open(nil, nonce, forged, []byte("host-1")); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("byte %d flipped: got %v, want ErrAuthFailed", i, err)
+		}
+	}
+	if _, err := aead.Open(nil, nonce, sealed, []byte("host-2")); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("other data: got %v, want ErrAuthFailed", err)
+	}
+	if _, err := aead.Open(nil, nonce, sealed[:TelemetryTagSize-1], nil); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("shorter than a tag: got %v, want ErrAuthFailed", err)
+	}
+	// Nor does it open a ciphertext with a full length tag.
+	if _, err := aead.Open(nil, nonce, full, []byte("host-1")); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("NewX ciphertext: got %v, want ErrAuthFailed", err)
+	}
+}
+
+func TestTelemetryNoEnvelopes(t *testing.T) {
+	aead, err := NewTelemetry(testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aead.(AEAD).Close()
+	nonce := make([]byte, XNonceSize)
+
+	if _, err := SealEnvelope(aead, nonce, []byte("plaintext"), nil, nil); !errors.Is(err, ErrUnknownAlgorithm) {
+		t.Fatalf("SealEnvelope: got %v, want ErrUnknownAlgorithm", err)
+	}
+	env, err := SealEnvelope(testAEAD(t, XChaCha20), nonce, []byte("plaintext"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenEnvelope(aead, env, nil); !errors.Is(err, ErrUnknownAlgorithm) {
+		t.Fatalf("OpenEnvelope: got %v, want ErrUnknownAlgorithm", err)
+	}
+}
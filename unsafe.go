@@ -0,0 +1,117 @@
+package chacha20poly1305guard
+
+import (
+	"crypto/cipher"
+
+	"github.com/awnumar/memguard"
+	"golang.org/x/crypto/poly1305"
+)
+
+// UnsafeLowLevel exposes the two halves of the construction separately:
+// the Poly1305 one-time key, taken from the first 64 byte block of the
+// keystream, and the keystream from the second block on, which encrypts
+// the message. A batch pipeline can derive the material for many
+// messages in one pass and seal them later with SealWithSubkey.
+//
+// WARNING: nothing here can check that the one-time key and stream
+// belong together, come from a nonce that was never used before, or are
+// used only once. Sealing two messages with the same material reveals
+// their XOR and lets anyone forge messages under that nonce. Mismatched
+// material produces ciphertexts that nobody can open. Use Seal and Open
+// unless profiling shows the key derivation is the bottleneck and you
+// control exactly how the material is derived and consumed.
+//
+// The zero value is ready to use:
+//
+//	var ll chacha20poly1305guard.UnsafeLowLevel
+//	macKey, stream, err := ll.Derive(aead, nonce)
+//	...
+//	ciphertext, err := ll.SealWithSubkey(nil, macKey, stream, plaintext, data)
+//	macKey.Destroy()
+type UnsafeLowLevel struct{}
+
+// Derive returns the one-time Poly1305 key, in a new LockedBuffer the
+// caller must destroy, and the keystream positioned past the first block
+// that aead, which must come from this package, would use to seal a
+// message under nonce. Sealing with them gives the same result as
+// aead.Seal with that nonce.
+func (UnsafeLowLevel) Derive(aead cipher.AEAD, nonce []byte) (macKey *memguard.LockedBuffer, stream cipher.Stream, err error) {
+	k, ok := aead.(*chacha20poly1305)
+	if !ok || k.tagSize != poly1305.TagSize {
+		return nil, nil, ErrUnknownAlgorithm
+	}
+	if err := k.checkNonce(nonce); err != nil {
+		return nil, nil, err
+	}
+
+	c, err := k.stream(k.fullNonce(nonce))
+	if err != nil {
+		return nil, nil, err
+	}
+	key, release, err := k.macKey(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+
+	macKey, err = newMutable(len(key))
+	if err != nil {
+		return nil, nil, err
+	}
+	copy(macKey.Buffer(), key[:])
+
+	return macKey, c, nil
+}
+
+// SealWithSubkey encrypts plaintext with stream, which must be positioned
+// past the block the one-time key macKey was taken from, authenticates
+// the result and data with macKey, and appends ciphertext and tag to dst.
+// See the warning on UnsafeLowLevel.
+func (UnsafeLowLevel) SealWithSubkey(dst []byte, macKey *memguard.LockedBuffer, stream cipher.Stream, plaintext, data []byte) ([]byte, error) {
+	key, err := oneTimeKey(macKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ret, out := sliceForAppend(dst, len(plaintext)+poly1305.TagSize)
+	ciphertext, digest := out[:len(plaintext)], out[len(plaintext):]
+	stream.XORKeyStream(ciphertext, plaintext)
+
+	var t [poly1305.TagSize]byte
+	computeTag(&t, key, ciphertext, data)
+	copy(digest, t[:])
+
+	return ret, nil
+}
+
+// OpenWithSubkey reverses SealWithSubkey. The tag is checked before
+// anything is decrypted; if it does not match, the result is an error
+// matching ErrAuthFailed and stream is left untouched.
+func (UnsafeLowLevel) OpenWithSubkey(dst []byte, macKey *memguard.LockedBuffer, stream cipher.Stream, ciphertext, data []byte) ([]byte, error) {
+	if len(ciphertext) < poly1305.TagSize {
+		return nil, &AuthError{Err: &SizeError{Field: "ciphertext", Want: poly1305.TagSize, Got: len(ciphertext), Err: ErrCiphertextTooShort}}
+	}
+	digest := ciphertext[len(ciphertext)-poly1305.TagSize:]
+	ciphertext = ciphertext[:len(ciphertext)-poly1305.TagSize]
+
+	if err := VerifyWithKey(macKey, ciphertext, data, digest); err != nil {
+		return nil, err
+	}
+
+	ret, out := sliceForAppend(dst, len(ciphertext))
+	defer wipeOnPanic(out)
+	stream.XORKeyStream(out, ciphertext)
+
+	return ret, nil
+}
+
+// oneTimeKey returns the contents of a Poly1305 key held in b.
+func oneTimeKey(b *memguard.LockedBuffer) (*[32]byte, error) {
+	if b.IsDestroyed() {
+		return nil, memguard.ErrDestroyed
+	}
+	if b.Size() != 32 {
+		return nil, &SizeError{Field: "key", Want: 32, Got: b.Size(), Err: ErrInvalidKey}
+	}
+	return (*[32]byte)(b.Buffer()), nil
+}
@@ -0,0 +1,100 @@
+package chacha20poly1305guard
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"errors"
+	"testing"
+)
+
+// countingStream counts the calls to XORKeyStream of the stream it
+// wraps.
+type countingStream struct {
+	cipher.Stream
+	calls int
+}
+
+func (s *countingStream) XORKeyStream(dst, src []byte) {
+	s.calls++
+	s.Stream.XORKeyStream(dst, src)
+}
+
+func TestUnsafeLowLevel(t *testing.T) {
+	var ll UnsafeLowLevel
+	for _, v := range variants {
+		aead := testAEAD(t, v)
+		nonce := bytes.Repeat([]byte{7}, aead.NonceSize())
+		plaintext, data := bytes.Repeat([]byte("plaintext"), 20), []byte("data")
+
+		macKey, stream, err := ll.Derive(aead, nonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sealed, err := ll.SealWithSubkey([]byte("prefix"), macKey, stream, plaintext, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := aead.Seal([]byte("prefix"), nonce, plaintext, data)
+		if !bytes.Equal(sealed, want) {
+			t.Fatalf("%v: SealWithSubkey differs from Seal", v)
+		}
+		if !bytes.Equal(sealed[len("prefix"):], referenceSeal(t, nonce, plaintext, data)) {
+			t.Fatalf("%v: SealWithSubkey differs from the reference", v)
+		}
+		macKey.Destroy()
+		sealed = sealed[len("prefix"):]
+
+		// A forged tag fails before the stream is used, so the same
+		// stream still opens the genuine message afterwards.
+		macKey, stream, err = ll.Derive(aead, nonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counting := &countingStream{Stream: stream}
+		forged := append([]byte(nil), sealed...)
+		forged[len(forged)-1] ^= 1
+		if out, err := ll.OpenWithSubkey(nil, macKey, counting, forged, data); !errors.Is(err, ErrAuthFailed) || out != nil {
+			t.Fatalf("%v: forged tag: got %q, %v, want ErrAuthFailed", v, out, err)
+		}
+		if _, err := ll.OpenWithSubkey(nil, macKey, counting, sealed, []byte("other data")); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("%v: other data: got %v, want ErrAuthFailed", v, err)
+		}
+		if _, err := ll.OpenWithSubkey(nil, macKey, counting, sealed[:TagSize-1], data); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("%v: shorter than a tag: got %v, want ErrAuthFailed", v, err)
+		}
+		if counting.calls != 0 {
+			t.Fatalf("%v: the stream was used %d times by failed opens", v, counting.calls)
+		}
+		if p, err := ll.OpenWithSubkey(nil, macKey, counting, sealed, data); err != nil || !bytes.Equal(p, plaintext) {
+			t.Fatalf("%v: open after failures: %q, %v", v, p, err)
+		}
+
+		// A destroyed key is refused.
+		macKey.Destroy()
+		if _, err := ll.SealWithSubkey(nil, macKey, stream, plaintext, data); err == nil {
+			t.Fatalf("%v: SealWithSubkey accepted a destroyed key", v)
+		}
+	}
+}
+
+func TestUnsafeLowLevelDeriveErrors(t *testing.T) {
+	var ll UnsafeLowLevel
+	aead := testAEAD(t, ChaCha20)
+	if _, _, err := ll.Derive(aead, make([]byte, NonceSize+1)); !errors.Is(err, ErrInvalidNonce) {
+		t.Fatalf("wrong nonce size: got %v, want ErrInvalidNonce", err)
+	}
+
+	telemetry, err := NewTelemetry(testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer telemetry.(AEAD).Close()
+	for name, other := range map[string]cipher.AEAD{
+		"short tag": telemetry,
+		"wrapped":   struct{ cipher.AEAD }{aead},
+	} {
+		if _, _, err := ll.Derive(other, make([]byte, other.NonceSize())); !errors.Is(err, ErrUnknownAlgorithm) {
+			t.Fatalf("%s: got %v, want ErrUnknownAlgorithm", name, err)
+		}
+	}
+}
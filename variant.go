@@ -0,0 +1,106 @@
+package chacha20poly1305guard
+
+import (
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/alexzava/chacha20guard"
+	"github.com/awnumar/memguard"
+)
+
+// ErrUnknownVariant is returned when a Variant is not one of the
+// constants defined by this package.
+var ErrUnknownVariant = errors.New("unknown variant")
+
+// Variant selects the construction used by an AEAD.
+type Variant int
+
+const (
+	// ChaCha20 is ChaCha20Poly1305 with a 64 bit nonce.
+	ChaCha20 Variant = iota
+
+	// XChaCha20 is XChaCha20Poly1305 with a 192 bit nonce.
+	XChaCha20
+)
+
+// params returns the nonce size and stream constructor of v.
+func (v Variant) params() (int, streamFunc, error) {
+	switch v {
+	case ChaCha20:
+		return NonceSize, chacha20guard.New, nil
+	case XChaCha20:
+		return XNonceSize, chacha20guard.NewX, nil
+	}
+	return 0, nil, ErrUnknownVariant
+}
+
+// String returns the name of the construction, as accepted by
+// ParseVariant.
+func (v Variant) String() string {
+	switch v {
+	case ChaCha20:
+		return "ChaCha20Poly1305"
+	case XChaCha20:
+		return "XChaCha20Poly1305"
+	}
+	return fmt.Sprintf("Variant(%d)", int(v))
+}
+
+// ParseVariant returns the Variant named s, ignoring case. It accepts the
+// names returned by String and fails with ErrUnknownVariant otherwise.
+func ParseVariant(s string) (Variant, error) {
+	for _, v := range []Variant{ChaCha20, XChaCha20} {
+		if strings.EqualFold(s, v.String()) {
+			return v, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %q", ErrUnknownVariant, s)
+}
+
+// NonceSizeFor returns the nonce size of v, or 0 if v is unknown.
+func NonceSizeFor(v Variant) int {
+	n, _, _ := v.params()
+	return n
+}
+
+// NewAEAD returns an AEAD of the given variant, which makes it easy to
+// pick the construction from configuration. The key must be 256 bits
+// long.
+func NewAEAD(key *memguard.LockedBuffer, variant Variant, opts ...Option) (cipher.AEAD, error) {
+	k, err := newAEAD(key, variant, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// NewFromArray copies key into a new immutable LockedBuffer and returns
+// an AEAD of the given variant using it. The buffer belongs to the AEAD
+// and is destroyed by Close, or by memguard once the AEAD is no longer
+// referenced.
+//
+// The local copy of key is wiped, but since arrays are passed by value
+// the caller's array and any copies the compiler made on the way are
+// not. Wipe the original as soon as this returns.
+func NewFromArray(key [32]byte, variant Variant, opts ...Option) (cipher.AEAD, error) {
+	if _, _, err := variant.params(); err != nil {
+		return nil, err
+	}
+
+	b, err := keyUsage.track(newImmutableFromBytes(key[:]))
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := newAEAD(b, variant, opts)
+	if err != nil {
+		keyUsage.destroy(b)
+		return nil, err
+	}
+	k.owned = b
+
+	return k, nil
+}
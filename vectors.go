@@ -0,0 +1,99 @@
+package chacha20poly1305guard
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+
+	"github.com/awnumar/memguard"
+)
+
+// TestVector is one entry written by GenerateTestVectors. Binary fields
+// are hex encoded; Ciphertext excludes the tag.
+type TestVector struct {
+	Variant    string `json:"variant"`
+	Key        string `json:"key"`
+	Nonce      string `json:"nonce"`
+	AAD        string `json:"aad"`
+	Plaintext  string `json:"plaintext"`
+	Ciphertext string `json:"ciphertext"`
+	Tag        string `json:"tag"`
+}
+
+// testVectorCases are the plaintext and associated data lengths of the
+// test vectors: empty inputs, lengths around the 64 byte ChaCha20 block
+// and a message spanning many blocks.
+var testVectorCases = []struct{ plaintext, aad int }{
+	{0, 0},
+	{0, 12},
+	{1, 0},
+	{63, 12},
+	{64, 12},
+	{65, 0},
+	{129, 37},
+	{16<<10 + 3, 255},
+}
+
+// GenerateTestVectors writes a JSON array of TestVectors for both
+// variants, for other implementations to check their compatibility
+// with this package. The inputs are fixed, so the output is always the
+// same. The keys are public test keys and are never used for anything
+// else.
+func GenerateTestVectors(w io.Writer) error {
+	var vectors []TestVector
+	for _, v := range []Variant{ChaCha20, XChaCha20} {
+		nonceSize, _, _ := v.params()
+		for i, c := range testVectorCases {
+			key := testVectorBytes(KeySize, byte(i))
+			nonce := testVectorBytes(nonceSize, byte(0x40+i))
+			aad := testVectorBytes(c.aad, byte(0x80+i))
+			plaintext := testVectorBytes(c.plaintext, byte(0xc0+i))
+
+			out, err := sealTestVector(key, v, nonce, plaintext, aad)
+			if err != nil {
+				return err
+			}
+			n := len(out) - TagSize
+
+			vectors = append(vectors, TestVector{
+				Variant:    v.String(),
+				Key:        hex.EncodeToString(key),
+				Nonce:      hex.EncodeToString(nonce),
+				AAD:        hex.EncodeToString(aad),
+				Plaintext:  hex.EncodeToString(plaintext),
+				Ciphertext: hex.EncodeToString(out[:n]),
+				Tag:        hex.EncodeToString(out[n:]),
+			})
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(vectors)
+}
+
+// sealTestVector seals plaintext the way users of the package do, with
+// a LockedBuffer key through NewAEAD, so that the vectors describe what
+// New and NewX produce.
+func sealTestVector(key []byte, v Variant, nonce, plaintext, aad []byte) ([]byte, error) {
+	buf, err := memguard.NewImmutableFromBytes(append([]byte(nil), key...))
+	if err != nil {
+		return nil, err
+	}
+	defer buf.Destroy()
+	aead, err := NewAEAD(buf, v)
+	if err != nil {
+		return nil, err
+	}
+	defer aead.(AEAD).Close()
+	return aead.Seal(nil, nonce, plaintext, aad), nil
+}
+
+// testVectorBytes returns n bytes counting up from seed.
+func testVectorBytes(n int, seed byte) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = seed + byte(i)
+	}
+	return b
+}
@@ -0,0 +1,70 @@
+package chacha20poly1305guard
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+)
+
+// TestGenerateTestVectors opens every published vector with New or NewX,
+// so that the vectors are known to match what users of the package get.
+func TestGenerateTestVectors(t *testing.T) {
+	var out bytes.Buffer
+	if err := GenerateTestVectors(&out); err != nil {
+		t.Fatal(err)
+	}
+	var vectors []TestVector
+	if err := json.Unmarshal(out.Bytes(), &vectors); err != nil {
+		t.Fatal(err)
+	}
+	if len(vectors) != 2*len(testVectorCases) {
+		t.Fatalf("%d vectors, want %d", len(vectors), 2*len(testVectorCases))
+	}
+
+	unhex := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	for i, tv := range vectors {
+		v, err := ParseVariant(tv.Variant)
+		if err != nil {
+			t.Fatal(err)
+		}
+		constructor := New
+		if v == XChaCha20 {
+			constructor = NewX
+		}
+		aead, err := constructor(lockedBytes(t, unhex(tv.Key)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer aead.(AEAD).Close()
+
+		nonce, aad, plaintext := unhex(tv.Nonce), unhex(tv.AAD), unhex(tv.Plaintext)
+		sealed := append(unhex(tv.Ciphertext), unhex(tv.Tag)...)
+		got, err := aead.Open(nil, nonce, sealed, aad)
+		if err != nil || !bytes.Equal(got, plaintext) {
+			t.Fatalf("vector %d (%s, %d bytes): open gave %x, %v", i, tv.Variant, len(plaintext), got, err)
+		}
+		if !bytes.Equal(aead.Seal(nil, nonce, plaintext, aad), sealed) {
+			t.Fatalf("vector %d (%s, %d bytes): Seal differs from the vector", i, tv.Variant, len(plaintext))
+		}
+		sealed[len(sealed)-1] ^= 1
+		if _, err := aead.Open(nil, nonce, sealed, aad); err == nil {
+			t.Fatalf("vector %d: opened with a modified tag", i)
+		}
+	}
+
+	// The output is the same every time.
+	var again bytes.Buffer
+	if err := GenerateTestVectors(&again); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), again.Bytes()) {
+		t.Fatal("GenerateTestVectors output changed between calls")
+	}
+}
@@ -0,0 +1,111 @@
+package chacha20poly1305guard
+
+import (
+	"crypto/cipher"
+	"sync/atomic"
+
+	"github.com/awnumar/memguard"
+)
+
+// wrappedAEAD is an AEAD of another package whose key is kept in a
+// LockedBuffer. See WrapAEAD.
+type wrappedAEAD struct {
+	key  *memguard.LockedBuffer
+	ctor func(key []byte) (cipher.AEAD, error)
+
+	nonceSize int
+	overhead  int
+	closed    int32
+}
+
+// WrapAEAD gives an AEAD of another package, such as AES-GCM, the key
+// handling of this one. The key stays in key and ctor is called for
+// every operation, with a copy of the key in locked scratch memory that
+// is wiped as soon as the operation returns, so ctor may keep a
+// reference to the slice. Close makes further operations fail with
+// ErrKeyDestroyed, as does destroying key; Close does not destroy key,
+// which belongs to the caller.
+//
+// This only protects the key as far as ctor allows. Most constructions,
+// including crypto/aes and x/crypto/chacha20poly1305, copy the key or
+// expand it into a key schedule in ordinary memory, which is never
+// wiped and lingers until it is garbage collected and overwritten.
+// Rebuilding the AEAD for every operation keeps those copies short
+// lived, at the cost of running ctor every time.
+//
+// ctor is called once by WrapAEAD to learn the nonce size and overhead,
+// which must not depend on the key.
+func WrapAEAD(key *memguard.LockedBuffer, ctor func(key []byte) (cipher.AEAD, error)) (cipher.AEAD, error) {
+	w := &wrappedAEAD{key: key, ctor: ctor}
+	err := w.with(func(aead cipher.AEAD) error {
+		w.nonceSize = aead.NonceSize()
+		w.overhead = aead.Overhead()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// with constructs the AEAD from a locked copy of the key and calls fn
+// with it, wiping the copy afterwards.
+func (w *wrappedAEAD) with(fn func(aead cipher.AEAD) error) error {
+	if atomic.LoadInt32(&w.closed) != 0 || w.key.IsDestroyed() {
+		return ErrKeyDestroyed
+	}
+
+	n := len(w.key.Buffer())
+	b, err := scratchPool.Get(n)
+	if err != nil {
+		return err
+	}
+	defer scratchPool.Put(b)
+	key := b.Buffer()[:n]
+	copy(key, w.key.Buffer())
+
+	aead, err := w.ctor(key)
+	if err != nil {
+		return err
+	}
+	return fn(aead)
+}
+
+func (w *wrappedAEAD) NonceSize() int {
+	return w.nonceSize
+}
+
+func (w *wrappedAEAD) Overhead() int {
+	return w.overhead
+}
+
+// Seal panics with ErrKeyDestroyed once the AEAD is closed, and with the
+// error of the constructor if it fails.
+func (w *wrappedAEAD) Seal(dst, nonce, plaintext, data []byte) []byte {
+	var out []byte
+	err := w.with(func(aead cipher.AEAD) error {
+		out = aead.Seal(dst, nonce, plaintext, data)
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	return out
+}
+
+func (w *wrappedAEAD) Open(dst, nonce, ciphertext, data []byte) ([]byte, error) {
+	var out []byte
+	err := w.with(func(aead cipher.AEAD) error {
+		var err error
+		out, err = aead.Open(dst, nonce, ciphertext, data)
+		return err
+	})
+	return out, err
+}
+
+// Close makes further operations fail with ErrKeyDestroyed. It does not
+// destroy the key.
+func (w *wrappedAEAD) Close() error {
+	atomic.StoreInt32(&w.closed, 1)
+	return nil
+}
@@ -0,0 +1,94 @@
+package chacha20poly1305guard
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"testing"
+
+	chachapoly "golang.org/x/crypto/chacha20poly1305"
+)
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func TestWrapAEAD(t *testing.T) {
+	for name, ctor := range map[string]func([]byte) (cipher.AEAD, error){
+		"AES-GCM":           newGCM,
+		"ChaCha20Poly1305":  chachapoly.New,
+		"XChaCha20Poly1305": chachapoly.NewX,
+	} {
+		key := testKey(t)
+		w, err := WrapAEAD(key, ctor)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		plain, err := ctor(key.Buffer())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.NonceSize() != plain.NonceSize() || w.Overhead() != plain.Overhead() {
+			t.Fatalf("%s: nonce size %d and overhead %d, want %d and %d", name, w.NonceSize(), w.Overhead(), plain.NonceSize(), plain.Overhead())
+		}
+
+		nonce := bytes.Repeat([]byte{3}, w.NonceSize())
+		ct := w.Seal([]byte("prefix"), nonce, []byte("plaintext"), []byte("data"))
+		want := plain.Seal([]byte("prefix"), nonce, []byte("plaintext"), []byte("data"))
+		if !bytes.Equal(ct, want) {
+			t.Fatalf("%s: wrapped output differs from the unwrapped AEAD", name)
+		}
+		if p, err := w.Open(nil, nonce, ct[len("prefix"):], []byte("data")); err != nil || string(p) != "plaintext" {
+			t.Fatalf("%s: open: %q, %v", name, p, err)
+		}
+		if _, err := w.Open(nil, nonce, ct[len("prefix"):], []byte("other")); err == nil {
+			t.Fatalf("%s: opened with other data", name)
+		}
+
+		// Close stops the AEAD but leaves the key alone.
+		if err := w.(interface{ Close() error }).Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := panicErr(func() { w.Seal(nil, nonce, nil, nil) }); err != ErrKeyDestroyed {
+			t.Fatalf("%s: Seal after Close panicked with %v, want ErrKeyDestroyed", name, err)
+		}
+		if _, err := w.Open(nil, nonce, ct[len("prefix"):], []byte("data")); err != ErrKeyDestroyed {
+			t.Fatalf("%s: Open after Close: got %v, want ErrKeyDestroyed", name, err)
+		}
+		if key.IsDestroyed() {
+			t.Fatalf("%s: Close destroyed the key", name)
+		}
+	}
+}
+
+func TestWrapAEADDestroyedKey(t *testing.T) {
+	key := lockedBytes(t, make([]byte, KeySize))
+	w, err := WrapAEAD(key, chachapoly.New)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, w.NonceSize())
+	ct := w.Seal(nil, nonce, []byte("plaintext"), nil)
+
+	key.Destroy()
+	if err := panicErr(func() { w.Seal(nil, nonce, nil, nil) }); err != ErrKeyDestroyed {
+		t.Fatalf("Seal with a destroyed key panicked with %v, want ErrKeyDestroyed", err)
+	}
+	if _, err := w.Open(nil, nonce, ct, nil); err != ErrKeyDestroyed {
+		t.Fatalf("Open with a destroyed key: got %v, want ErrKeyDestroyed", err)
+	}
+	if _, err := WrapAEAD(key, chachapoly.New); err != ErrKeyDestroyed {
+		t.Fatalf("WrapAEAD of a destroyed key: got %v, want ErrKeyDestroyed", err)
+	}
+
+	// Errors of the constructor are returned as is.
+	short := lockedBytes(t, make([]byte, 7))
+	if _, err := WrapAEAD(short, chachapoly.New); err == nil || errors.Is(err, ErrKeyDestroyed) {
+		t.Fatalf("WrapAEAD with a 7-byte key: got %v", err)
+	}
+}